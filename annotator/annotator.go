@@ -13,67 +13,226 @@
 package annotator
 
 import (
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/tflow2/annotator/bird"
+	"github.com/google/tflow2/annotator/cymru"
+	"github.com/google/tflow2/annotator/enrich"
+	"github.com/google/tflow2/annotator/ttl"
 	"github.com/google/tflow2/netflow"
 	"github.com/google/tflow2/stats"
 )
 
+// Bits of netflow.Flow.Enrichments recording which annotations were applied
+const (
+	// EnrichedPrefixes is set if BIRD knew routes for source and destination
+	EnrichedPrefixes = 1 << iota
+
+	// EnrichedASNs is set if source and destination ASN were found via BIRD or DNS
+	EnrichedASNs
+
+	// EnrichedAttributes is set if the enrichment service knew source and destination
+	EnrichedAttributes
+
+	// EnrichedComplete is set if all configured annotations were applied
+	EnrichedComplete = 1 << 31
+)
+
 // Annotator represents an flow annotator
 type Annotator struct {
-	inputs        []chan *netflow.Flow
-	output        chan *netflow.Flow
-	aggregation   int64
-	numWorkers    int
-	bgpAugment    bool
-	birdAnnotator *bird.Annotator
-	debug int
+	inputs      []chan *netflow.Flow
+	outputs     []chan *netflow.Flow
+	aggregation int64
+	numWorkers  int
+
+	// plugins are the annotation steps flows pass through, in order
+	plugins []Plugin
+
+	// expected holds the Enrichments bits of all configured built in annotations
+	expected uint32
+
+	// workers tracks running workers, done is closed once all of them returned and outputs are closed
+	workers sync.WaitGroup
+	done    chan struct{}
+}
+
+// Config configures an `Annotator`. Zero values disable the respective built in
+// annotation unless noted otherwise.
+type Config struct {
+	// Inputs are the channels flows are received on
+	Inputs []chan *netflow.Flow
+
+	// Outputs are the channels annotated flows are sent to, each gets all flows
+	Outputs []chan *netflow.Flow
+
+	// NumWorkers is the number of annotation workers per input
+	NumWorkers int
+
+	// Aggregation is the length of the periods flow timestamps are rounded down to, in seconds
+	Aggregation int64
+
+	// BGPAugment is set if flows are annotated via the BIRD instances listening on
+	// BirdSock and BirdSock6. The results of up to BirdCacheSize addresses are
+	// cached for BirdCacheTTL.
+	BGPAugment    bool
+	BirdSock      string
+	BirdSock6     string
+	BirdCacheSize int
+	BirdCacheTTL  time.Duration
+
+	// CymruFallback is set if ASNs BIRD has no route for are looked up via DNS
+	CymruFallback bool
+
+	// EnrichURL is the HTTP service flows are enriched via, caching the results of
+	// up to EnrichCacheSize addresses and giving up on queries after EnrichTimeout
+	EnrichURL       string
+	EnrichCacheSize int
+	EnrichTimeout   time.Duration
+
+	// TTLAnomalies is set if flows with unusual TTLs for their source are flagged
+	TTLAnomalies bool
+
+	// Plugins are applied after the built in annotations, in order
+	Plugins []Plugin
 }
 
-// New creates a new `Annotator` instance
-func New(inputs []chan *netflow.Flow, output chan *netflow.Flow, numWorkers int, aggregation int64, bgpAugment bool, birdSock string, birdSock6 string, debug int) *Annotator {
+// New creates a new `Annotator` instance configured by `cfg` and starts it. BIRD
+// annotations come first, as TTL anomalies are checked per source prefix, followed
+// by enrichment and `cfg.Plugins`.
+func New(cfg Config) *Annotator {
 	a := &Annotator{
-		inputs:      inputs,
-		output:      output,
-		aggregation: aggregation,
-		numWorkers:  numWorkers,
-		bgpAugment:  bgpAugment,
-		debug:	debug,
+		inputs:      cfg.Inputs,
+		outputs:     cfg.Outputs,
+		aggregation: cfg.Aggregation,
+		numWorkers:  cfg.NumWorkers,
+		done:        make(chan struct{}),
 	}
-	if bgpAugment {
-		a.birdAnnotator = bird.NewAnnotator(birdSock, birdSock6, debug)
+	if cfg.BGPAugment {
+		p := &bgpPlugin{bird: bird.NewAnnotator(cfg.BirdSock, cfg.BirdSock6, cfg.BirdCacheSize, cfg.BirdCacheTTL)}
+		if cfg.CymruFallback {
+			p.cymru = cymru.NewAnnotator()
+		}
+		a.plugins = append(a.plugins, p)
+		a.expected |= EnrichedPrefixes | EnrichedASNs
+	}
+
+	// Sources are described by prefix and ASN, so TTLs are checked after BIRD
+	if cfg.TTLAnomalies {
+		a.plugins = append(a.plugins, ttlPlugin{ttl.NewAnnotator()})
 	}
+	if cfg.EnrichURL != "" {
+		a.plugins = append(a.plugins, enrichPlugin{enrich.NewAnnotator(cfg.EnrichURL, cfg.EnrichCacheSize, cfg.EnrichTimeout)})
+		a.expected |= EnrichedAttributes
+	}
+	a.plugins = append(a.plugins, cfg.Plugins...)
 	a.Init()
 	return a
 }
 
+// SetDebug raises the debug level of all plugins supporting it above the shared
+// one to `l`. It takes effect immediately, also for flows being processed.
+func (a *Annotator) SetDebug(l int) {
+	for _, p := range a.plugins {
+		if d, ok := p.(debugSetter); ok {
+			d.SetDebug(l)
+		}
+	}
+}
+
 // Init get's the annotation layer started, receives flows, annotates them, and carries them
-// further to the database module
+// further to the database module and other sinks. Flows of all inputs are merged
+// into one queue served by a shared pool of workers, so a busy input can use the
+// workers an idle one doesn't need. Workers return once all inputs are closed and
+// drained. The outputs are closed then as well.
 func (a *Annotator) Init() {
-	for _, ch := range a.inputs {
-		for i := 0; i < a.numWorkers; i++ {
-			go func(ch chan *netflow.Flow) {
-				for {
-					// Read flow from netflow/IPFIX module
-					fl := <-ch
-
-					// Align timestamp on `aggrTime` raster
-					fl.Timestamp = fl.Timestamp - (fl.Timestamp % a.aggregation)
-
-					// Update global statstics
-					atomic.AddUint64(&stats.GlobalStats.FlowBytes, fl.Size)
-					atomic.AddUint64(&stats.GlobalStats.FlowPackets, uint64(fl.Packets))
-
-					// Annotate flows with ASN and Prefix information from local BIRD (bird.nic.cz) instance
-					if a.bgpAugment {
-						a.birdAnnotator.Augment(fl)
-					}
-
-					// Send flow over to database module
-					a.output <- fl
+	work := make(chan *netflow.Flow, a.numWorkers)
+
+	var forwarders sync.WaitGroup
+	for i, ch := range a.inputs {
+		forwarders.Add(1)
+		go func(rs *stats.InputStats, ch chan *netflow.Flow) {
+			defer forwarders.Done()
+			a.forward(rs, ch, work)
+		}(stats.AnnotatorInput(i), ch)
+	}
+	go func() {
+		forwarders.Wait()
+		close(work)
+	}()
+
+	latency := stats.Latency("annotator")
+	for i := 0; i < a.numWorkers*len(a.inputs); i++ {
+		a.workers.Add(1)
+		go func() {
+			defer a.workers.Done()
+
+			for fl := range work {
+				// Align timestamp on `aggrTime` raster
+				fl.Timestamp = fl.Timestamp - (fl.Timestamp % a.aggregation)
+
+				// Update global statstics
+				atomic.AddUint64(&stats.GlobalStats.FlowBytes, fl.Size)
+				atomic.AddUint64(&stats.GlobalStats.FlowPackets, uint64(fl.Packets))
+
+				a.annotate(fl)
+				latency.Observe(fl.Received)
+
+				// Send flow over to database module and other sinks
+				for _, out := range a.outputs {
+					out <- fl
 				}
-			}(ch)
+			}
+		}()
+	}
+
+	go func() {
+		a.workers.Wait()
+		for _, out := range a.outputs {
+			close(out)
 		}
+		close(a.done)
+	}()
+}
+
+// forward passes the flows of input `ch` on to the shared queue `work`. Each input
+// has at most one flow waiting for the queue at a time, so inputs are served in
+// turn when workers are busy and each busy input gets its share of the workers.
+// The time spent waiting is recorded in `rs` to show which inputs are held back.
+func (a *Annotator) forward(rs *stats.InputStats, ch chan *netflow.Flow, work chan *netflow.Flow) {
+	for fl := range ch {
+		atomic.AddUint64(&rs.Flows, 1)
+		atomic.StoreUint64(&rs.QueueDepth, uint64(len(ch)))
+
+		select {
+		case work <- fl:
+			continue
+		default:
+		}
+
+		start := time.Now()
+		work <- fl
+		atomic.AddUint64(&rs.BlockedNanos, uint64(time.Since(start)))
 	}
+	atomic.StoreUint64(&rs.QueueDepth, 0)
+}
+
+// annotate passes `fl` through all plugins and records if all built in annotations succeeded
+func (a *Annotator) annotate(fl *netflow.Flow) {
+	for _, p := range a.plugins {
+		p.Annotate(fl)
+	}
+
+	atomic.AddUint64(&stats.GlobalStats.AnnotatedFlows, 1)
+	if fl.Enrichments&a.expected == a.expected {
+		fl.Enrichments |= EnrichedComplete
+		atomic.AddUint64(&stats.GlobalStats.AnnotatedComplete, 1)
+	}
+}
+
+// Wait blocks until all inputs have been closed, all flows received on them
+// have been passed on and the outputs have been closed
+func (a *Annotator) Wait() {
+	<-a.done
 }
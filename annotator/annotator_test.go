@@ -12,16 +12,22 @@
 package annotator
 
 import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
 )
 
 func TestTimestampAggr(t *testing.T) {
 	ca := make(chan *netflow.Flow)
 	cb := make(chan *netflow.Flow)
 	var aggr int64 = 60
-	go Init(ca, cb, aggr, false, 1)
+	New(Config{Inputs: []chan *netflow.Flow{ca}, Outputs: []chan *netflow.Flow{cb}, NumWorkers: 1, Aggregation: aggr})
 
 	testData := []struct {
 		ts   int64
@@ -49,3 +55,122 @@ func TestTimestampAggr(t *testing.T) {
 		}
 	}
 }
+
+func TestDrain(t *testing.T) {
+	ca := make(chan *netflow.Flow, 10)
+	cb := make(chan *netflow.Flow, 10)
+	cc := make(chan *netflow.Flow, 10)
+	a := New(Config{Inputs: []chan *netflow.Flow{ca, cb}, Outputs: []chan *netflow.Flow{cc}, NumWorkers: 2, Aggregation: 60})
+
+	for i := 0; i < 5; i++ {
+		ca <- &netflow.Flow{}
+		cb <- &netflow.Flow{}
+	}
+	close(ca)
+	close(cb)
+	a.Wait()
+
+	n := 0
+	for range cc {
+		n++
+	}
+	if n != 10 {
+		t.Errorf("Expected 10 flows after drain, got %d", n)
+	}
+}
+
+func TestFanIn(t *testing.T) {
+	hot := make(chan *netflow.Flow, 100)
+	idle := make(chan *netflow.Flow)
+	out := make(chan *netflow.Flow, 100)
+	before := atomic.LoadUint64(&stats.AnnotatorInput(0).Flows)
+	a := New(Config{Inputs: []chan *netflow.Flow{hot, idle}, Outputs: []chan *netflow.Flow{out}, NumWorkers: 1, Aggregation: 60})
+
+	for i := 0; i < 100; i++ {
+		hot <- &netflow.Flow{}
+	}
+	close(hot)
+	close(idle)
+	a.Wait()
+
+	if len(out) != 100 {
+		t.Errorf("Expected 100 flows, got %d", len(out))
+	}
+	if n := atomic.LoadUint64(&stats.AnnotatorInput(0).Flows) - before; n != 100 {
+		t.Errorf("Expected 100 flows counted for the hot input, got %d", n)
+	}
+}
+
+func TestEnrichments(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"10.0.0.1": {"site": "ams"}}`))
+	}))
+	defer srv.Close()
+
+	ca := make(chan *netflow.Flow)
+	cb := make(chan *netflow.Flow)
+	New(Config{Inputs: []chan *netflow.Flow{ca}, Outputs: []chan *netflow.Flow{cb}, NumWorkers: 1, Aggregation: 60, EnrichURL: srv.URL, EnrichCacheSize: 10, EnrichTimeout: time.Second})
+
+	send := func() *netflow.Flow {
+		ca <- &netflow.Flow{SrcAddr: net.IP{10, 0, 0, 1}, DstAddr: net.IP{10, 0, 0, 2}}
+		return <-cb
+	}
+
+	// Attributes are looked up in the background, so the first flow passes unannotated
+	if fl := send(); fl.Enrichments != 0 {
+		t.Errorf("Expected no enrichments, got %#x", fl.Enrichments)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fl := send()
+		if fl.Enrichments == EnrichedAttributes|EnrichedComplete {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected attribute enrichment, got %#x", fl.Enrichments)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// tagPlugin appends its tag to the application name of flows, recording the order plugins are applied in
+type tagPlugin struct {
+	tag string
+}
+
+func (p tagPlugin) Annotate(fl *netflow.Flow) {
+	fl.ApplicationName += p.tag
+}
+
+func TestPlugins(t *testing.T) {
+	ca := make(chan *netflow.Flow)
+	cb := make(chan *netflow.Flow)
+	plugins := []Plugin{tagPlugin{tag: "a"}, tagPlugin{tag: "b"}}
+	New(Config{Inputs: []chan *netflow.Flow{ca}, Outputs: []chan *netflow.Flow{cb}, NumWorkers: 1, Aggregation: 60, Plugins: plugins})
+
+	ca <- &netflow.Flow{}
+	if fl := <-cb; fl.ApplicationName != "ab" || fl.Enrichments != EnrichedComplete {
+		t.Errorf("Expected plugins applied in order and complete enrichment, got %q (%#x)", fl.ApplicationName, fl.Enrichments)
+	}
+}
+
+// debugPlugin records the debug level passed on to it
+type debugPlugin struct {
+	level int
+}
+
+func (p *debugPlugin) Annotate(fl *netflow.Flow) {}
+
+func (p *debugPlugin) SetDebug(l int) {
+	p.level = l
+}
+
+func TestSetDebug(t *testing.T) {
+	p := &debugPlugin{}
+	a := New(Config{Inputs: []chan *netflow.Flow{make(chan *netflow.Flow)}, Outputs: []chan *netflow.Flow{make(chan *netflow.Flow)}, NumWorkers: 1, Aggregation: 60, Plugins: []Plugin{tagPlugin{tag: "a"}, p}})
+	a.SetDebug(2)
+	if p.level != 2 {
+		t.Errorf("Expected debug level 2 passed on to plugin, got %d", p.level)
+	}
+}
@@ -20,8 +20,11 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/lru"
 	"github.com/google/tflow2/netflow"
 	"github.com/google/tflow2/stats"
 )
@@ -37,15 +40,31 @@ type QueryResult struct {
 
 	// NhAs is the ASN of the subject IPs associated Next Hop
 	NHAS uint32
+
+	// ASPathLength is the number of AS hops to the subject IP
+	ASPathLength uint32
 }
 
-// QueryCache represents a set of QueryResults that have been cached
+// QueryCache represents a set of QueryResults that have been cached. It is size
+// bounded and expires results, so route changes are eventually picked up. Results
+// are keyed by address rather than by prefix: A cached prefix could hide more
+// specific routes of addresses not looked up yet.
 type QueryCache struct {
-	cache map[string]QueryResult
-	lock  sync.RWMutex
+	cache *lru.Cache
 }
 
-// birdCon represents a connection to a BIRD instance
+// Timeouts and backoff of BIRD connections. Variables so tests can shorten them.
+var (
+	// queryTimeout is the time a query may take before the connection is taken as broken
+	queryTimeout = 5 * time.Second
+
+	// reconnectBackoff is the time waited after the first failed connection attempt.
+	// It doubles with each further failed attempt, up to maxReconnectBackoff.
+	reconnectBackoff    = time.Second
+	maxReconnectBackoff = time.Minute
+)
+
+// birdCon represents a connection to a BIRD instance. `con` is nil while not connected.
 type birdCon struct {
 	sock  string
 	con   net.Conn
@@ -67,17 +86,17 @@ type Annotator struct {
 	// connectio to BIRD6
 	bird6 *birdCon
 	
-	// debug level
-	debug int
+	// debug is the debug level of this annotator
+	debug debug.Local
 }
 
-// NewAnnotator creates a new BIRD annotator and get's service started
-func NewAnnotator(sock string, sock6 string, debug int) *Annotator {
+// NewAnnotator creates a new BIRD annotator and get's service started. Results of
+// up to `cacheSize` addresses are cached for `cacheTTL` (forever if 0).
+func NewAnnotator(sock string, sock6 string, cacheSize int, cacheTTL time.Duration) *Annotator {
 	a := &Annotator{
-		cache:  newQueryCache(),
+		cache:  newQueryCache(cacheSize, cacheTTL),
 		queryC: make(chan string),
 		resC:   make(chan *QueryResult),
-		debug:  debug,
 	}
 
 	var wg sync.WaitGroup
@@ -100,94 +119,122 @@ func NewAnnotator(sock string, sock6 string, debug int) *Annotator {
 	return a
 }
 
+// SetDebug raises the debug level of this annotator above the shared one to
+// `l`. It takes effect immediately, also for flows being processed.
+func (a *Annotator) SetDebug(l int) {
+	a.debug.Set(l)
+}
+
 // getConn gets the net.Conn property of the BIRD connection
 func (c *birdCon) getConn() *net.Conn {
 	return &c.con
 }
 
-// newQueryCache creates and initializes a new `QueryCache`
-func newQueryCache() *QueryCache {
-	return &QueryCache{cache: make(map[string]QueryResult)}
+// newQueryCache creates and initializes a new `QueryCache` holding up to `size`
+// results for `ttl` each
+func newQueryCache(size int, ttl time.Duration) *QueryCache {
+	return &QueryCache{cache: lru.New(size, ttl)}
 }
 
-// reconnector receives a signal via channel that triggers a connection attempt to BIRD
+// reconnector receives a signal via channel that triggers connection attempts to
+// BIRD. Failed attempts are retried with exponential backoff until connected.
 func (c *birdCon) reconnector() {
 	for {
 		// wait for signal of a closed connection
 		<-c.recon
 
-		// try to connect up to 5 times
-		for i := 0; i < 5; i++ {
-			tmpCon, err := net.Dial("unix", c.sock)
-			if err != nil {
-				glog.Warningf("Unable to connect to BIRD on %s: %v", c.sock, err)
-				continue
+		backoff := reconnectBackoff
+		for !c.connect() {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxReconnectBackoff {
+				backoff = maxReconnectBackoff
 			}
+		}
+		glog.Infof("Connected to BIRD on %s", c.sock)
+	}
+}
 
-			// Read welcome message we are not interested in
-			buf := make([]byte, 1024)
-			nbytes, err := tmpCon.Read(buf[:])
-			if err != nil || nbytes == 0 {
-				if err == nil {
-					tmpCon.Close()
-				}
-				glog.Warning("Reading from BIRD failed: %v", err)
-				continue
-			}
+// connect dials BIRD and reads its welcome message. It returns true if connected.
+func (c *birdCon) connect() bool {
+	tmpCon, err := net.Dial("unix", c.sock)
+	if err != nil {
+		glog.Warningf("Unable to connect to BIRD on %s: %v", c.sock, err)
+		return false
+	}
 
-			c.lock.Lock()
-			c.con = tmpCon
-			c.lock.Unlock()
-			break
-		}
+	// Read welcome message we are not interested in
+	buf := make([]byte, 1024)
+	tmpCon.SetReadDeadline(time.Now().Add(queryTimeout))
+	nbytes, err := tmpCon.Read(buf[:])
+	if err != nil || nbytes == 0 {
+		tmpCon.Close()
+		glog.Warningf("Reading from BIRD failed: %v", err)
+		return false
+	}
+
+	c.lock.Lock()
+	c.con = tmpCon
+	c.lock.Unlock()
+	return true
+}
+
+// reconnect closes the broken connection and signals the reconnector, unless
+// it was signaled already. Queries are skipped until it reconnected.
+func (c *birdCon) reconnect() {
+	c.lock.Lock()
+	if c.con != nil {
+		c.con.Close()
+		c.con = nil
+	}
+	c.lock.Unlock()
+
+	select {
+	case c.recon <- true:
+	default:
 	}
 }
 
+// conn returns the current connection, nil if not connected
+func (c *birdCon) conn() net.Conn {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.con
+}
+
 // Get tries to receive an entry from QueryCache `qc`
 func (qc *QueryCache) Get(addr []byte) *QueryResult {
-	qc.lock.RLock()
-	defer qc.lock.RUnlock()
-
-	res, ok := qc.cache[net.IP(addr).String()]
+	res, ok := qc.cache.Get(net.IP(addr).String())
 	if !ok {
 		atomic.AddUint64(&stats.GlobalStats.BirdCacheMiss, 1)
 		return nil
 	}
 	atomic.AddUint64(&stats.GlobalStats.BirdCacheHits, 1)
-	return &res
+	r := res.(QueryResult)
+	return &r
 }
 
 // Set sets data for `addr` in QueryCache `qc` to `qres`
 func (qc *QueryCache) Set(addr []byte, qres *QueryResult) {
-	qc.lock.Lock()
-	defer qc.lock.Unlock()
-	qc.cache[net.IP(addr).String()] = *qres
+	qc.cache.Set(net.IP(addr).String(), *qres)
 }
 
 // newBirdCon creates a birdCon to socket `s`
 func newBirdCon(s string) *birdCon {
 	b := &birdCon{
 		sock:  s,
-		recon: make(chan bool),
+		recon: make(chan bool, 1),
 	}
 	go b.reconnector()
 	b.recon <- true
 	return b
 }
 
-// Augment function provides the main interface to the external world to consume service of this module
+// Augment function provides the main interface to the external world to consume service of this module.
+// Flows pass un-augmented while BIRD is unreachable.
 func (a *Annotator) Augment(fl *netflow.Flow) {
-	srcRes := a.cache.Get(fl.SrcAddr)
-	if srcRes == nil {
-		srcRes = a.query(net.IP(fl.Router), fl.SrcAddr)
-		a.cache.Set(fl.SrcAddr, srcRes)
-	}
-
-	dstRes := a.cache.Get(fl.DstAddr)
-	if dstRes == nil {
-		dstRes = a.query(net.IP(fl.Router), fl.DstAddr)
-		a.cache.Set(fl.DstAddr, dstRes)
-	}
+	srcRes := a.lookup(net.IP(fl.Router), fl.SrcAddr)
+	dstRes := a.lookup(net.IP(fl.Router), fl.DstAddr)
 
 	fl.SrcPfx = &netflow.Pfx{}
 	fl.SrcPfx.IP = srcRes.Pfx.IP
@@ -200,15 +247,72 @@ func (a *Annotator) Augment(fl *netflow.Flow) {
 	fl.SrcAs = srcRes.AS
 	fl.DstAs = dstRes.AS
 	fl.NextHopAs = dstRes.NHAS
+	fl.AsPathLength = dstRes.ASPathLength
+}
+
+// lookup returns the cached result for `addr` or queries BIRD for it. Results
+// of failed queries are empty and not cached, so they are retried once BIRD is back.
+func (a *Annotator) lookup(rtr net.IP, addr net.IP) *QueryResult {
+	if res := a.cache.Get(addr); res != nil {
+		return res
+	}
+	res := a.query(rtr, addr)
+	if res == nil {
+		return &QueryResult{}
+	}
+	a.cache.Set(addr, res)
+	return res
+}
+
+// asPathLength returns the number of AS hops of BIRD formatted AS path `path`,
+// e.g. "25291 3320 3320 20940 { 16625 }". Prepended ASNs are counted once, as
+// sets ({ }) count as one hop and confederation segments (( ) and [ ]) as none.
+func asPathLength(path string) uint32 {
+	var length uint32
+	inSet := false
+	inConfed := false
+	last := ""
+	for _, tok := range strings.Fields(path) {
+		switch tok {
+		case "{":
+			inSet = true
+			length++
+			continue
+		case "}":
+			inSet = false
+			last = ""
+			continue
+		case "(", "[":
+			inConfed = true
+			continue
+		case ")", "]":
+			inConfed = false
+			continue
+		}
+		if inSet || inConfed || tok == last {
+			continue
+		}
+		length++
+		last = tok
+	}
+	return length
 }
 
-// query forms a query, sends it to the processing engine, reads the result and returns it
+// query forms a query, sends it to the processing engine, reads the result and
+// returns it. It returns nil if BIRD is not connected or the query failed.
 func (a *Annotator) query(rtr net.IP, addr net.IP) *QueryResult {
-	query := fmt.Sprintf("show route all for %s protocol nf_%s\n", addr.String(), strings.Replace(rtr.String(), ".", "_", -1))
+	query := fmt.Sprintf("show route all for %s protocol %s\n", addr.String(), protocolName(rtr))
 	a.queryC <- query
 	return <-a.resC
 }
 
+// protocolName returns the name of the BIRD protocol of router `rtr`, e.g.
+// nf_185_66_194_0 or nf_2001_db8__1. Colons of IPv6 addresses are not allowed
+// in protocol names and would make the query look like one for an IPv6 route.
+func protocolName(rtr net.IP) string {
+	return "nf_" + strings.NewReplacer(".", "_", ":", "_").Replace(rtr.String())
+}
+
 // gateway starts the main service routine
 func (a *Annotator) gateway() {
 	query := ""
@@ -228,31 +332,32 @@ func (a *Annotator) gateway() {
 			bird = a.bird6
 		}
 
-		// Skip annotation if we're not connected to bird yet
-		bird.lock.RLock()
-		if bird.con == nil {
-			glog.Warningf("skipped annotating flow: BIRD is not connected yet")
-			bird.lock.RUnlock()
-			a.resC <- &res
+		// Skip annotation if we're not connected to bird (yet)
+		con := bird.conn()
+		if con == nil {
+			if a.debug.Level() > 0 {
+				glog.Warningf("skipped annotating flow: BIRD is not connected")
+			}
+			a.resC <- nil
 			continue
 		}
 
-		// Send query to BIRD
-		_, err := bird.con.Write(data)
+		// Send query to BIRD and read its reply. Errors (including EOF of a
+		// restarted BIRD) drop the connection, which is re-dialed in the background.
+		con.SetDeadline(time.Now().Add(queryTimeout))
+		_, err := con.Write(data)
 		if err != nil {
-			bird.lock.RUnlock()
 			glog.Errorf("Unable to write to BIRD: %v", err)
-			bird.recon <- true
+			bird.reconnect()
+			a.resC <- nil
 			continue
 		}
-		bird.lock.RUnlock()
 
-		// Read reply from BIRD
-		n, err := bird.con.Read(buf[:])
+		n, err := con.Read(buf[:])
 		if err != nil {
-			bird.lock.RUnlock()
 			glog.Errorf("unable to read from BIRD: %v", err)
-			bird.recon <- true
+			bird.reconnect()
+			a.resC <- nil
 			continue
 		}
 
@@ -276,16 +381,18 @@ func (a *Annotator) gateway() {
 				pfx = parts[1]
 
 				_, tmpNet, err := net.ParseCIDR(pfx)
-				res.Pfx = *tmpNet
 				if err != nil {
 					glog.Warningf("unable to parse CIDR from BIRD: %v (query '%v')", err, query)
 					continue
 				}
+				res.Pfx = *tmpNet
 				continue
 			}
 
 			// Find line that contains the AS Path
 			if strings.Contains(line, "BGP.as_path: ") {
+				res.ASPathLength = asPathLength(strings.SplitN(line, "BGP.as_path: ", 2)[1])
+
 				// Remove curly braces from BIRD AS path (ignores aggregators), e.g. BGP.as_path: 25291 3320 20940 { 16625 }
 				line = strings.Replace(line, "{ ", "", -1)
 				line = strings.Replace(line, " }", "", -1)
@@ -312,7 +419,7 @@ func (a *Annotator) gateway() {
 				break
 			}
 		}
-		if res.AS == 0 && a.debug > 2{
+		if res.AS == 0 && a.debug.Level() > 2{
 			glog.Warningf("unable to find AS path for '%v'", query)
 		}
 		a.resC <- &res
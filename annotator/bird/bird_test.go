@@ -0,0 +1,119 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bird
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/tflow2/netflow"
+)
+
+// routeReply is BIRDs reply to a query for a route learned via AS path 65002 65001
+const routeReply = "1007-10.0.0.0/8          via 192.0.2.1 on eth0 [nf_192_0_2_1 12:00:00] * (100) [AS65001i]\n" +
+	" \tType: BGP unicast univ\n" +
+	"1012-\tBGP.origin: IGP\n" +
+	" \tBGP.as_path: 65002 65001\n" +
+	"0000 \n"
+
+// fakeBird serves BIRD sessions on `l`. The first session is closed after
+// answering `answered` queries, as if BIRD was restarted.
+func fakeBird(l net.Listener, answered int) {
+	for session := 0; ; session++ {
+		con, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(con net.Conn, first bool) {
+			defer con.Close()
+			con.Write([]byte("0001 BIRD 1.6.3 ready.\n"))
+			buf := make([]byte, 1024)
+			for n := 0; !first || n < answered; n++ {
+				if _, err := con.Read(buf); err != nil {
+					return
+				}
+				con.Write([]byte(routeReply))
+			}
+		}(con, session == 0)
+	}
+}
+
+// waitConnected waits for `c` to be connected to BIRD
+func waitConnected(t *testing.T, c *birdCon) {
+	for deadline := time.Now().Add(5 * time.Second); c.conn() == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Not connected to BIRD on %s", c.sock)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	reconnectBackoff = 10 * time.Millisecond
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "bird.ctl")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeBird(l, 2)
+
+	a := NewAnnotator(sock, filepath.Join(dir, "bird6.ctl"), 100, 0)
+	waitConnected(t, a.bird4)
+
+	augment := func(src net.IP, dst net.IP) *netflow.Flow {
+		fl := &netflow.Flow{Router: net.IP{192, 0, 2, 1}, SrcAddr: src, DstAddr: dst}
+		a.Augment(fl)
+		return fl
+	}
+
+	fl := augment(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2})
+	if fl.SrcAs != 65001 || fl.DstAs != 65001 || fl.NextHopAs != 65002 || fl.AsPathLength != 2 {
+		t.Errorf("Expected AS 65001 -> 65001 via 65002 (2 hops), got %d -> %d via %d (%d hops)", fl.SrcAs, fl.DstAs, fl.NextHopAs, fl.AsPathLength)
+	}
+
+	// BIRD closed the session, so flows pass un-augmented rather than blocking
+	fl = augment(net.IP{10, 0, 0, 3}, net.IP{10, 0, 0, 4})
+	if fl.SrcAs != 0 {
+		t.Errorf("Expected un-augmented flow while disconnected, got AS %d", fl.SrcAs)
+	}
+
+	// Failed queries aren't cached, so the addresses are annotated once reconnected
+	waitConnected(t, a.bird4)
+	fl = augment(net.IP{10, 0, 0, 3}, net.IP{10, 0, 0, 4})
+	if fl.SrcAs != 65001 || fl.DstAs != 65001 {
+		t.Errorf("Expected AS 65001 -> 65001 after reconnect, got %d -> %d", fl.SrcAs, fl.DstAs)
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	c := newQueryCache(1, 0)
+	c.Set(net.IP{10, 0, 0, 1}, &QueryResult{AS: 65001})
+	if res := c.Get(net.IP{10, 0, 0, 1}); res == nil || res.AS != 65001 {
+		t.Errorf("Expected cached AS 65001, got %v", res)
+	}
+
+	// The cache holds one result only
+	c.Set(net.IP{10, 0, 0, 2}, &QueryResult{AS: 65002})
+	if res := c.Get(net.IP{10, 0, 0, 1}); res != nil {
+		t.Errorf("Expected result of 10.0.0.1 to be evicted, got %v", res)
+	}
+
+	c = newQueryCache(10, time.Millisecond)
+	c.Set(net.IP{10, 0, 0, 1}, &QueryResult{AS: 65001})
+	time.Sleep(5 * time.Millisecond)
+	if res := c.Get(net.IP{10, 0, 0, 1}); res != nil {
+		t.Errorf("Expected result of 10.0.0.1 to be expired, got %v", res)
+	}
+}
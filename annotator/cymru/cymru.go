@@ -0,0 +1,197 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cymru looks up origin ASNs using Team Cymru's DNS based IP to ASN
+// mapping service. It is used as a fallback for addresses BIRD has no route for.
+package cymru
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/lru"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+const (
+	// zone4 and zone6 are the DNS zones queried for IPv4 and IPv6 addresses
+	zone4 = "origin.asn.cymru.com"
+	zone6 = "origin6.asn.cymru.com"
+
+	// cacheSize is the number of addresses to cache results for
+	cacheSize = 100000
+
+	// cacheTTL is the time results (including misses) are cached for
+	cacheTTL = 6 * time.Hour
+
+	// queryTimeout is the maximum time a single DNS query may take
+	queryTimeout = time.Second
+
+	// breakerThreshold is the number of consecutive failed queries that opens the circuit breaker
+	breakerThreshold = 5
+
+	// breakerTimeout is the time no queries are sent once the circuit breaker is open
+	breakerTimeout = time.Minute
+)
+
+// Annotator represents an annotator looking up ASNs via DNS
+type Annotator struct {
+	// cache holds the ASNs of addresses already looked up. 0 if the service doesn't know the address.
+	cache *lru.Cache
+
+	// lookupTXT performs the actual DNS query
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	// failures is the number of consecutive failed queries, openUntil the time the circuit breaker stays open
+	failures  int
+	openUntil time.Time
+	lock      sync.Mutex
+
+	// debug is the debug level of this annotator
+	debug debug.Local
+}
+
+// NewAnnotator creates a new DNS based ASN annotator
+func NewAnnotator() *Annotator {
+	return &Annotator{
+		cache:     lru.New(cacheSize, cacheTTL),
+		lookupTXT: net.DefaultResolver.LookupTXT,
+	}
+}
+
+// SetDebug raises the debug level of this annotator above the shared one to
+// `l`. It takes effect immediately, also for flows being processed.
+func (a *Annotator) SetDebug(l int) {
+	a.debug.Set(l)
+}
+
+// Augment sets source and destination ASN of `fl` if they are not set yet
+func (a *Annotator) Augment(fl *netflow.Flow) {
+	if fl.SrcAs == 0 {
+		fl.SrcAs = a.lookup(fl.SrcAddr)
+	}
+	if fl.DstAs == 0 {
+		fl.DstAs = a.lookup(fl.DstAddr)
+	}
+}
+
+// lookup returns the origin ASN of `addr`, 0 if unknown
+func (a *Annotator) lookup(addr net.IP) uint32 {
+	key := addr.String()
+	if asn, ok := a.cache.Get(key); ok {
+		atomic.AddUint64(&stats.GlobalStats.CymruCacheHits, 1)
+		return asn.(uint32)
+	}
+	atomic.AddUint64(&stats.GlobalStats.CymruCacheMiss, 1)
+
+	if !a.allow() {
+		return 0
+	}
+
+	asn, err := a.query(addr)
+	a.done(err)
+	if err != nil {
+		atomic.AddUint64(&stats.GlobalStats.CymruErrors, 1)
+		if a.debug.Level() > 0 {
+			glog.Warningf("Cymru lookup for %s failed: %v", key, err)
+		}
+		return 0
+	}
+
+	a.cache.Set(key, asn)
+	return asn
+}
+
+// allow returns false while the circuit breaker is open
+func (a *Annotator) allow() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return !time.Now().Before(a.openUntil)
+}
+
+// done updates the circuit breaker with the result of a query
+func (a *Annotator) done(err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err == nil {
+		a.failures = 0
+		return
+	}
+
+	a.failures++
+	if a.failures >= breakerThreshold {
+		glog.Errorf("%d consecutive Cymru lookup failures, pausing lookups for %v", a.failures, breakerTimeout)
+		a.openUntil = time.Now().Add(breakerTimeout)
+		a.failures = 0
+	}
+}
+
+// query asks the service for the origin ASN of `addr`
+func (a *Annotator) query(addr net.IP) (uint32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	txts, err := a.lookupTXT(ctx, queryName(addr))
+	if err != nil {
+		// Addresses unknown to the service yield NXDOMAIN which is a valid answer
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	for _, txt := range txts {
+		if asn, err := parseTXT(txt); err == nil {
+			return asn, nil
+		}
+	}
+	return 0, nil
+}
+
+// queryName builds the name to query for `addr`, e.g. 1.2.0.192.origin.asn.cymru.com for 192.0.2.1
+func queryName(addr net.IP) string {
+	if ip := addr.To4(); ip != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", ip[3], ip[2], ip[1], ip[0], zone4)
+	}
+
+	ip := addr.To16()
+	nibbles := make([]string, 0, 33)
+	for i := len(ip) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, strconv.FormatUint(uint64(ip[i]&0x0f), 16), strconv.FormatUint(uint64(ip[i]>>4), 16))
+	}
+	nibbles = append(nibbles, zone6)
+	return strings.Join(nibbles, ".")
+}
+
+// parseTXT parses a TXT record like "23028 | 216.90.108.0/24 | US | arin | 1998-09-25".
+// If the prefix is originated by multiple ASNs the first one is returned.
+func parseTXT(txt string) (uint32, error) {
+	parts := strings.Split(txt, "|")
+	asns := strings.Fields(parts[0])
+	if len(asns) == 0 {
+		return 0, fmt.Errorf("no ASN in %q", txt)
+	}
+
+	asn, err := strconv.ParseUint(asns[0], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse ASN in %q: %v", txt, err)
+	}
+	return uint32(asn), nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cymru
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/tflow2/netflow"
+)
+
+func TestQueryName(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{addr: "192.0.2.1", expected: "1.2.0.192.origin.asn.cymru.com"},
+		{addr: "2001:db8::1", expected: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.origin6.asn.cymru.com"},
+	}
+
+	for _, test := range tests {
+		if name := queryName(net.ParseIP(test.addr)); name != test.expected {
+			t.Errorf("%s: Expected %s, got %s", test.addr, test.expected, name)
+		}
+	}
+}
+
+func TestAugment(t *testing.T) {
+	queries := 0
+	a := NewAnnotator()
+	a.lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		queries++
+		switch name {
+		case "1.2.0.192.origin.asn.cymru.com":
+			return []string{"64496 64497 | 192.0.2.0/24 | ZZ | test | 2017-01-01"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	fl := &netflow.Flow{
+		SrcAddr: net.IP{192, 0, 2, 1},
+		DstAddr: net.IP{198, 51, 100, 1},
+	}
+	a.Augment(fl)
+	a.Augment(fl)
+
+	if fl.SrcAs != 64496 {
+		t.Errorf("Expected source AS 64496, got %d", fl.SrcAs)
+	}
+	if fl.DstAs != 0 {
+		t.Errorf("Expected destination AS 0, got %d", fl.DstAs)
+	}
+
+	// Second flow must be served from the cache, including the miss
+	if queries != 2 {
+		t.Errorf("Expected 2 queries, got %d", queries)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	queries := 0
+	a := NewAnnotator()
+	a.lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		queries++
+		return nil, errors.New("timeout")
+	}
+
+	for i := 0; i < 2*breakerThreshold; i++ {
+		a.Augment(&netflow.Flow{SrcAs: 1, DstAddr: net.IP{192, 0, 2, byte(i)}})
+	}
+	if queries != breakerThreshold {
+		t.Errorf("Expected %d queries before circuit breaker opens, got %d", breakerThreshold, queries)
+	}
+}
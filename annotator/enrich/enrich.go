@@ -0,0 +1,241 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package enrich annotates flows with attributes retrieved from an external HTTP
+// service, e.g. threat intelligence or an asset inventory.
+//
+// The service is queried with a POST request carrying a JSON list of addresses:
+//   ["192.0.2.1", "2001:db8::1"]
+// and is expected to answer with a JSON object mapping addresses to attributes:
+//   {"192.0.2.1": {"owner": "web-frontend", "risk": "low"}}
+// Addresses missing in the reply are cached as having no attributes.
+package enrich
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/lru"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+const (
+	// batchSize is the maximum number of addresses sent to the service in one request
+	batchSize = 100
+
+	// batchInterval is the maximum time an address waits to be sent to the service
+	batchInterval = 100 * time.Millisecond
+
+	// queueSize is the number of addresses waiting to be looked up. Lookups
+	// are dropped if the queue is full.
+	queueSize = 10000
+
+	// breakerThreshold is the number of consecutive failed requests that opens the circuit breaker
+	breakerThreshold = 5
+
+	// breakerTimeout is the time no requests are sent once the circuit breaker is open
+	breakerTimeout = 30 * time.Second
+)
+
+// Annotator represents an annotator querying an external HTTP service
+type Annotator struct {
+	endpoint string
+	client   *http.Client
+
+	// cache holds the attributes of addresses already looked up
+	cache *lru.Cache
+
+	// queue carries addresses that are to be looked up
+	queue chan string
+
+	// pending keeps addresses that are queued or in flight to avoid duplicate lookups
+	pending     map[string]struct{}
+	pendingLock sync.Mutex
+
+	// failures is the number of consecutive failed requests
+	failures int
+
+	// openUntil is the time until the circuit breaker stays open
+	openUntil time.Time
+
+	// debug is the debug level of this annotator
+	debug debug.Local
+}
+
+// NewAnnotator creates a new HTTP enrichment annotator and gets service started
+func NewAnnotator(endpoint string, cacheSize int, timeout time.Duration) *Annotator {
+	a := &Annotator{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: timeout},
+		cache:    lru.New(cacheSize, 0),
+		queue:    make(chan string, queueSize),
+		pending:  make(map[string]struct{}),
+	}
+	go a.batcher()
+	return a
+}
+
+// SetDebug raises the debug level of this annotator above the shared one to
+// `l`. It takes effect immediately, also for flows being processed.
+func (a *Annotator) SetDebug(l int) {
+	a.debug.Set(l)
+}
+
+// Augment adds the cached attributes of the flows source and destination address
+// to the flows labels. It never blocks: Addresses not in the cache are queued for
+// lookup and the flow is passed on unannotated. It returns true if the attributes
+// of both addresses were known. Addresses missing in the flow are not looked up.
+func (a *Annotator) Augment(fl *netflow.Flow) bool {
+	src, dst := true, true
+	if len(fl.SrcAddr) > 0 {
+		src = a.label(fl, "src.", fl.SrcAddr)
+	}
+	if len(fl.DstAddr) > 0 {
+		dst = a.label(fl, "dst.", fl.DstAddr)
+	}
+	return src && dst
+}
+
+// label adds the attributes of `addr` to the labels of `fl` prefixing each key
+// with `prefix`. It returns false if the attributes of `addr` are not known yet.
+func (a *Annotator) label(fl *netflow.Flow, prefix string, addr []byte) bool {
+	key := net.IP(addr).String()
+	attrs, ok := a.cache.Get(key)
+	if !ok {
+		atomic.AddUint64(&stats.GlobalStats.EnrichCacheMiss, 1)
+		a.lookup(key)
+		return false
+	}
+	atomic.AddUint64(&stats.GlobalStats.EnrichCacheHits, 1)
+
+	for k, v := range attrs.(map[string]string) {
+		if fl.Labels == nil {
+			fl.Labels = make(map[string]string)
+		}
+		fl.Labels[prefix+k] = v
+	}
+	return true
+}
+
+// lookup queues `addr` for lookup unless it is already pending
+func (a *Annotator) lookup(addr string) {
+	a.pendingLock.Lock()
+	defer a.pendingLock.Unlock()
+	if _, ok := a.pending[addr]; ok {
+		return
+	}
+
+	select {
+	case a.queue <- addr:
+		a.pending[addr] = struct{}{}
+	default:
+		atomic.AddUint64(&stats.GlobalStats.EnrichDropped, 1)
+	}
+}
+
+// batcher collects queued addresses and sends them to the service in batches
+func (a *Annotator) batcher() {
+	batch := make([]string, 0, batchSize)
+	ticker := time.NewTicker(batchInterval)
+	for {
+		select {
+		case addr := <-a.queue:
+			batch = append(batch, addr)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		a.process(batch)
+		batch = batch[:0]
+	}
+}
+
+// process queries the service for `batch` and fills the cache with the result
+func (a *Annotator) process(batch []string) {
+	defer a.done(batch)
+
+	if time.Now().Before(a.openUntil) {
+		if a.debug.Level() > 0 {
+			glog.Warningf("circuit breaker open, dropping %d lookups", len(batch))
+		}
+		atomic.AddUint64(&stats.GlobalStats.EnrichDropped, uint64(len(batch)))
+		return
+	}
+
+	res, err := a.query(batch)
+	if err != nil {
+		atomic.AddUint64(&stats.GlobalStats.EnrichErrors, 1)
+		a.failures++
+		glog.Errorf("enrichment query failed: %v", err)
+		if a.failures >= breakerThreshold {
+			glog.Errorf("%d consecutive enrichment failures, pausing queries for %v", a.failures, breakerTimeout)
+			a.openUntil = time.Now().Add(breakerTimeout)
+			a.failures = 0
+		}
+		return
+	}
+	a.failures = 0
+
+	for _, addr := range batch {
+		attrs, ok := res[addr]
+		if !ok {
+			attrs = map[string]string{}
+		}
+		a.cache.Set(addr, attrs)
+	}
+}
+
+// done removes the addresses of `batch` from the list of pending lookups
+func (a *Annotator) done(batch []string) {
+	a.pendingLock.Lock()
+	defer a.pendingLock.Unlock()
+	for _, addr := range batch {
+		delete(a.pending, addr)
+	}
+}
+
+// query sends a single request to the service
+func (a *Annotator) query(batch []string) (map[string]map[string]string, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client.Post(a.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	res := make(map[string]map[string]string)
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("unable to decode response: %v", err)
+	}
+	return res, nil
+}
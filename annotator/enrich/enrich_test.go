@@ -0,0 +1,180 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package enrich
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/tflow2/lru"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+// service is a test enrichment service recording the size of each batch queried
+type service struct {
+	lock    sync.Mutex
+	batches []int
+	status  int
+}
+
+func (s *service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var addrs []string
+	if err := json.NewDecoder(r.Body).Decode(&addrs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	s.batches = append(s.batches, len(addrs))
+	status := s.status
+	s.lock.Unlock()
+	if status != 0 {
+		http.Error(w, "unavailable", status)
+		return
+	}
+
+	res := make(map[string]map[string]string)
+	for _, addr := range addrs {
+		if addr == "192.0.2.1" {
+			res[addr] = map[string]string{"owner": "web-frontend"}
+		}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// sizes returns the sizes of the batches queried so far
+func (s *service) sizes() []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]int{}, s.batches...)
+}
+
+// newTestAnnotator creates an annotator querying `endpoint` without starting its batcher
+func newTestAnnotator(endpoint string, queueSize int) *Annotator {
+	return &Annotator{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: time.Second},
+		cache:    lru.New(1000, 0),
+		queue:    make(chan string, queueSize),
+		pending:  make(map[string]struct{}),
+	}
+}
+
+func TestAugment(t *testing.T) {
+	srv := httptest.NewServer(&service{})
+	defer srv.Close()
+	a := NewAnnotator(srv.URL, 100, time.Second)
+
+	// Flows are passed on unannotated until the attributes were looked up
+	fl := &netflow.Flow{SrcAddr: net.IP{192, 0, 2, 1}, DstAddr: net.IP{198, 51, 100, 1}}
+	if a.Augment(fl) || len(fl.Labels) != 0 {
+		t.Fatalf("Expected flow unannotated on cache miss, got %v", fl.Labels)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		fl = &netflow.Flow{SrcAddr: net.IP{192, 0, 2, 1}, DstAddr: net.IP{198, 51, 100, 1}}
+		if a.Augment(fl) {
+			break
+		}
+	}
+	if len(fl.Labels) != 1 || fl.Labels["src.owner"] != "web-frontend" {
+		t.Errorf("Expected src.owner web-frontend once looked up, got %v", fl.Labels)
+	}
+}
+
+func TestAugmentEmptyAddress(t *testing.T) {
+	a := newTestAnnotator("", 10)
+	fl := &netflow.Flow{DstAddr: net.IP{198, 51, 100, 1}}
+	a.Augment(fl)
+	if len(a.queue) != 1 {
+		t.Fatalf("Expected only the destination queued, got %d lookups", len(a.queue))
+	}
+	if addr := <-a.queue; addr != "198.51.100.1" {
+		t.Errorf("Expected 198.51.100.1 queued, got %q", addr)
+	}
+	if !a.Augment(&netflow.Flow{}) || len(a.queue) != 0 {
+		t.Errorf("Expected flows without addresses to be complete without lookups, got %d lookups", len(a.queue))
+	}
+}
+
+func TestBatching(t *testing.T) {
+	s := &service{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// Addresses are queued before the batcher starts, so batches are full
+	a := newTestAnnotator(srv.URL, queueSize)
+	for i := 0; i < 2*batchSize+50; i++ {
+		a.lookup(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	go a.batcher()
+
+	var sizes []int
+	for deadline := time.Now().Add(5 * time.Second); len(sizes) < 3 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		sizes = s.sizes()
+	}
+	if len(sizes) != 3 || sizes[0] != batchSize || sizes[1] != batchSize || sizes[2] != 50 {
+		t.Errorf("Expected batches of %d, %d and 50 addresses, got %v", batchSize, batchSize, sizes)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	s := &service{status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	a := newTestAnnotator(srv.URL, 10)
+	failed := atomic.LoadUint64(&stats.GlobalStats.EnrichErrors)
+	for i := 0; i < breakerThreshold; i++ {
+		if time.Now().Before(a.openUntil) {
+			t.Fatalf("Expected circuit breaker closed after %d failures", i)
+		}
+		a.process([]string{"192.0.2.1"})
+	}
+	if got := atomic.LoadUint64(&stats.GlobalStats.EnrichErrors) - failed; got != breakerThreshold {
+		t.Errorf("Expected %d errors, got %d", breakerThreshold, got)
+	}
+	if !time.Now().Before(a.openUntil) {
+		t.Fatalf("Expected circuit breaker open after %d failures", breakerThreshold)
+	}
+
+	// Lookups are dropped without querying the service while the breaker is open
+	dropped := atomic.LoadUint64(&stats.GlobalStats.EnrichDropped)
+	a.process([]string{"192.0.2.1", "192.0.2.2"})
+	if n := len(s.sizes()); n != breakerThreshold {
+		t.Errorf("Expected %d queries, got %d", breakerThreshold, n)
+	}
+	if got := atomic.LoadUint64(&stats.GlobalStats.EnrichDropped) - dropped; got != 2 {
+		t.Errorf("Expected 2 lookups dropped, got %d", got)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	a := newTestAnnotator("", 1)
+	dropped := atomic.LoadUint64(&stats.GlobalStats.EnrichDropped)
+	a.lookup("192.0.2.1")
+	a.lookup("192.0.2.1")
+	a.lookup("192.0.2.2")
+	if got := atomic.LoadUint64(&stats.GlobalStats.EnrichDropped) - dropped; got != 1 {
+		t.Errorf("Expected 1 lookup dropped, got %d", got)
+	}
+	if _, ok := a.pending["192.0.2.2"]; ok {
+		t.Errorf("Expected dropped lookup not to be pending")
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package geoip annotates flows with the countries of their source and
+// destination addresses from a MaxMind GeoIP2/GeoLite2 country or city database,
+// and with their ASNs from a GeoLite2 ASN database
+package geoip
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+// reloadInterval is the interval the database file is checked for changes at
+const reloadInterval = time.Minute
+
+// Annotator represents an annotator looking up countries in a GeoIP database
+type Annotator struct {
+	path string
+
+	// db holds the *database currently used. It is replaced as a whole on reload.
+	db atomic.Value
+
+	// modTime and size of the database file loaded last
+	modTime time.Time
+	size    int64
+
+	// debug is the debug level of this annotator
+	debug debug.Local
+}
+
+// NewAnnotator creates a new GeoIP annotator using the MaxMind DB file at
+// `path`. The file is reloaded when it changes.
+func NewAnnotator(path string) (*Annotator, error) {
+	a := &Annotator{
+		path: path,
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	go a.watch()
+	return a, nil
+}
+
+// SetDebug raises the debug level of this annotator above the shared one to
+// `l`. It takes effect immediately, also for flows being processed.
+func (a *Annotator) SetDebug(l int) {
+	a.debug.Set(l)
+}
+
+// load reads and parses the database file, replacing the database used for lookups
+func (a *Annotator) load() error {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	db, err := openDatabase(raw)
+	if err != nil {
+		return err
+	}
+
+	a.db.Store(db)
+	a.modTime = fi.ModTime()
+	a.size = fi.Size()
+	return nil
+}
+
+// watch reloads the database whenever its file changed. A database failing to
+// load is logged and the previous one is kept.
+func (a *Annotator) watch() {
+	for range time.Tick(reloadInterval) {
+		a.reloadIfChanged()
+	}
+}
+
+// reloadIfChanged reloads the database if its file changed since it was loaded last
+func (a *Annotator) reloadIfChanged() {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		glog.Warningf("Unable to stat GeoIP database: %v", err)
+		return
+	}
+	if fi.ModTime().Equal(a.modTime) && fi.Size() == a.size {
+		return
+	}
+
+	if err := a.load(); err != nil {
+		atomic.AddUint64(&stats.GlobalStats.GeoIPErrors, 1)
+		glog.Errorf("Unable to reload GeoIP database %s, keeping previous one: %v", a.path, err)
+		return
+	}
+	glog.Infof("Reloaded GeoIP database %s", a.path)
+}
+
+// Annotate sets the source and destination country of `fl` if the database knows
+// them, and the source and destination ASN unless they are set already (e.g. via
+// BGP). Annotators of a country and an ASN database can thus be applied in turn.
+func (a *Annotator) Annotate(fl *netflow.Flow) {
+	db := a.db.Load().(*database)
+	a.annotate(db, fl.SrcAddr, &fl.SrcCountry, &fl.SrcAs)
+	a.annotate(db, fl.DstAddr, &fl.DstCountry, &fl.DstAs)
+}
+
+// annotate sets `country` and, unless it is set, `asn` to those of `addr` if
+// known. Addresses that aren't routable on the internet are not looked up.
+func (a *Annotator) annotate(db *database, addr net.IP, country *string, asn *uint32) {
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return
+	}
+
+	c, as, err := db.lookup(addr)
+	if err != nil {
+		atomic.AddUint64(&stats.GlobalStats.GeoIPErrors, 1)
+		if a.debug.Level() > 0 {
+			glog.Warningf("GeoIP lookup of %s failed: %v", addr, err)
+		}
+		return
+	}
+	if c != "" {
+		*country = c
+	}
+	if *asn == 0 {
+		*asn = as
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package geoip
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/tflow2/netflow"
+)
+
+// mmdbString encodes `s` as MaxMind DB string
+func mmdbString(s string) []byte {
+	return append([]byte{typeString<<5 | byte(len(s))}, s...)
+}
+
+// mmdbMap encodes a map of `n` pairs, followed by the encoded pairs `kv`
+func mmdbMap(n int, kv ...[]byte) []byte {
+	b := []byte{typeMap<<5 | byte(n)}
+	for _, v := range kv {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// mmdbUint encodes `v` as MaxMind DB uint32
+func mmdbUint(v uint32) []byte {
+	return []byte{typeUint32<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+// buildDatabase creates an IPv4 MaxMind DB with 24 bit records mapping the /24
+// networks in `networks` to the data section records at the given offsets of `data`
+func buildDatabase(networks map[string]int, data []byte) []byte {
+	// Nodes hold the child node index, -1 if empty, or -2-offset for data records
+	nodes := [][2]int{{-1, -1}}
+	for network, off := range networks {
+		ip := net.ParseIP(network).To4()
+		node := 0
+		for i := 0; i < 24; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == 23 {
+				nodes[node][bit] = -2 - off
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var db []byte
+	count := len(nodes)
+	for _, n := range nodes {
+		for _, rec := range n {
+			v := rec
+			if rec == -1 {
+				v = count
+			} else if rec < -1 {
+				v = count + dataSectionSeparator + (-2 - rec)
+			}
+			db = append(db, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	db = append(db, make([]byte, dataSectionSeparator)...)
+	db = append(db, data...)
+	db = append(db, metadataMarker...)
+	return append(db, mmdbMap(3,
+		mmdbString("node_count"), mmdbUint(uint32(count)),
+		mmdbString("record_size"), mmdbUint(24),
+		mmdbString("ip_version"), mmdbUint(4),
+	)...)
+}
+
+// testDatabase creates a database with 81.2.69.0/24 in `country` and 1.1.1.0/24
+// registered in AU. The latter refers to the iso_code key of the first via a pointer.
+func testDatabase(country string) []byte {
+	gb := mmdbMap(1, mmdbString("country"), mmdbMap(1, mmdbString("iso_code"), mmdbString(country)))
+	keyOffset := 1 + len(mmdbString("country")) + 1
+	au := mmdbMap(1, mmdbString("registered_country"), mmdbMap(1, []byte{typePointer << 5, byte(keyOffset)}, mmdbString("AU")))
+
+	data := append(gb, au...)
+	return buildDatabase(map[string]int{"81.2.69.0": 0, "1.1.1.0": len(gb)}, data)
+}
+
+func TestAnnotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := ioutil.WriteFile(path, testDatabase("GB"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAnnotator(path)
+	if err != nil {
+		t.Fatalf("Unable to load database: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		addr    net.IP
+		country string
+	}{
+		{name: "Country", addr: net.IP{81, 2, 69, 160}, country: "GB"},
+		{name: "Registered country", addr: net.IP{1, 1, 1, 1}, country: "AU"},
+		{name: "Unknown", addr: net.IP{192, 0, 2, 1}},
+		{name: "Private", addr: net.IP{10, 0, 0, 1}},
+		{name: "IPv6 address in IPv4 database", addr: net.ParseIP("2001:db8::1")},
+	}
+	for _, test := range tests {
+		fl := &netflow.Flow{SrcAddr: test.addr, DstAddr: net.IP{81, 2, 69, 1}}
+		a.Annotate(fl)
+		if fl.SrcCountry != test.country || fl.DstCountry != "GB" {
+			t.Errorf("%s: Expected %q -> GB, got %q -> %q", test.name, test.country, fl.SrcCountry, fl.DstCountry)
+		}
+	}
+
+	// Broken files are not loaded, changed ones are
+	later := time.Now().Add(time.Hour)
+	reload := func(raw []byte, country string) {
+		if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+		later = later.Add(time.Hour)
+		os.Chtimes(path, later, later)
+		a.reloadIfChanged()
+
+		fl := &netflow.Flow{SrcAddr: net.IP{81, 2, 69, 160}}
+		if a.Annotate(fl); fl.SrcCountry != country {
+			t.Errorf("Expected %q after reload, got %q", country, fl.SrcCountry)
+		}
+	}
+	reload([]byte("not a database"), "GB")
+	reload(testDatabase("IE"), "IE")
+}
+
+func TestAnnotateASN(t *testing.T) {
+	dir := t.TempDir()
+	asn := buildDatabase(map[string]int{"81.2.69.0": 0}, mmdbMap(1, mmdbString("autonomous_system_number"), mmdbUint(64500)))
+	var annotators []*Annotator
+	for name, raw := range map[string][]byte{"country.mmdb": testDatabase("GB"), "asn.mmdb": asn} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+		a, err := NewAnnotator(path)
+		if err != nil {
+			t.Fatalf("Unable to load database %s: %v", name, err)
+		}
+		annotators = append(annotators, a)
+	}
+
+	// Countries and ASNs of both databases are kept whatever the order, ASNs set via BGP are kept
+	fl := &netflow.Flow{SrcAddr: net.IP{81, 2, 69, 160}, DstAddr: net.IP{81, 2, 69, 1}, DstAs: 65001}
+	for _, a := range annotators {
+		a.Annotate(fl)
+	}
+	if fl.SrcCountry != "GB" || fl.DstCountry != "GB" || fl.SrcAs != 64500 || fl.DstAs != 65001 {
+		t.Errorf("Expected GB (AS64500) -> GB (AS65001), got %q (AS%d) -> %q (AS%d)", fl.SrcCountry, fl.SrcAs, fl.DstCountry, fl.DstAs)
+	}
+}
+
+func TestOpenDatabaseInvalid(t *testing.T) {
+	metadata := func(nodes uint32, recordSize uint32) []byte {
+		return append(append([]byte{}, metadataMarker...), mmdbMap(3,
+			mmdbString("node_count"), mmdbUint(nodes),
+			mmdbString("record_size"), mmdbUint(recordSize),
+			mmdbString("ip_version"), mmdbUint(4),
+		)...)
+	}
+	raw := testDatabase("GB")
+
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{name: "No metadata", raw: raw[:len(raw)-60]},
+		{name: "Tree exceeding file", raw: metadata(1000, 24)},
+		{name: "Unsupported record size", raw: metadata(0, 20)},
+		{name: "Truncated metadata", raw: metadata(0, 24)[:30]},
+	}
+	for _, test := range tests {
+		if _, err := openDatabase(test.raw); err == nil {
+			t.Errorf("%s: Expected error", test.name)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package geoip
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// metadataMarker precedes the metadata at the end of MaxMind DB files
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Data section types of the MaxMind DB format
+const (
+	typeExtended = 0
+	typePointer  = 1
+	typeString   = 2
+	typeDouble   = 3
+	typeBytes    = 4
+	typeUint16   = 5
+	typeUint32   = 6
+	typeMap      = 7
+	typeInt32    = 8
+	typeUint64   = 9
+	typeUint128  = 10
+	typeArray    = 11
+	typeBool     = 14
+	typeFloat    = 15
+)
+
+// dataSectionSeparator is the number of zero bytes between search tree and data section
+const dataSectionSeparator = 16
+
+// database is a MaxMind DB (.mmdb) file, see
+// https://maxmind.github.io/MaxMind-DB/. It is read only, so lookups are
+// safe for concurrent use.
+type database struct {
+	tree       []byte
+	data       decoder
+	nodeCount  uint32
+	recordSize uint32
+	ipVersion  uint64
+
+	// ipv4Start is the node IPv4 addresses are looked up from in IPv6 trees
+	ipv4Start uint32
+}
+
+// openDatabase parses the MaxMind DB in `raw`
+func openDatabase(raw []byte) (*database, error) {
+	i := bytes.LastIndex(raw, metadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("metadata not found, not a MaxMind DB file")
+	}
+	meta := decoder(raw[i+len(metadataMarker):])
+
+	db := &database{}
+	var nodeCount, recordSize uint64
+	for key, v := range map[string]*uint64{"node_count": &nodeCount, "record_size": &recordSize, "ip_version": &db.ipVersion} {
+		off, err := meta.lookup(0, key)
+		if err != nil {
+			return nil, fmt.Errorf("metadata: %v", err)
+		}
+		if off < 0 {
+			return nil, fmt.Errorf("metadata: %s missing", key)
+		}
+		if *v, err = meta.uint(off); err != nil {
+			return nil, fmt.Errorf("metadata %s: %v", key, err)
+		}
+	}
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", recordSize)
+	}
+	db.nodeCount = uint32(nodeCount)
+	db.recordSize = uint32(recordSize)
+
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+dataSectionSeparator > uint64(i) {
+		return nil, fmt.Errorf("search tree of %d nodes exceeds file", nodeCount)
+	}
+	db.tree = raw[:treeSize]
+	db.data = decoder(raw[treeSize+dataSectionSeparator : i])
+
+	// IPv4 addresses are found as IPv4-mapped ::/96 in IPv6 trees
+	if db.ipVersion == 6 {
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (`bit` 0) or right (`bit` 1) record of node `node`
+func (db *database) record(node uint32, bit uint) uint32 {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		if bit == 0 {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		b = b[bit*4:]
+		return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	}
+}
+
+// find returns the data section offset of the record of `ip`, -1 if `ip` is not in the database
+func (db *database) find(ip net.IP) (int, error) {
+	node := uint32(0)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return -1, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(ip[i/8]>>(7-uint(i%8)))&1)
+	}
+	if node <= db.nodeCount {
+		return -1, nil
+	}
+
+	off := int(node-db.nodeCount) - dataSectionSeparator
+	if off >= len(db.data) {
+		return -1, fmt.Errorf("record of %s points beyond data section", ip)
+	}
+	return off, nil
+}
+
+// lookup returns the ISO code of the country of `ip`, falling back to the
+// country it is registered in, and the number of the AS announcing it (as found in
+// GeoLite2-ASN databases). It returns "" and 0 for those unknown.
+func (db *database) lookup(ip net.IP) (string, uint32, error) {
+	off, err := db.find(ip)
+	if err != nil || off < 0 {
+		return "", 0, err
+	}
+
+	var asn uint64
+	v, err := db.data.lookup(off, "autonomous_system_number")
+	if err != nil {
+		return "", 0, err
+	}
+	if v >= 0 {
+		if asn, err = db.data.uint(v); err != nil {
+			return "", 0, err
+		}
+	}
+
+	for _, path := range [][]string{{"country", "iso_code"}, {"registered_country", "iso_code"}} {
+		v, err := db.data.lookup(off, path...)
+		if err != nil {
+			return "", 0, err
+		}
+		if v >= 0 {
+			country, err := db.data.string(v)
+			return country, uint32(asn), err
+		}
+	}
+	return "", uint32(asn), nil
+}
+
+// decoder decodes values of a MaxMind DB data section. Offsets are relative to its start.
+type decoder []byte
+
+// control decodes the type and size of the value at `off`, resolving pointers.
+// It returns the offset of the payload and the offset following the value at `off`
+// (which differs from the payload for pointers).
+func (d decoder) control(off int) (typ int, size int, payload int, next int, err error) {
+	typ, size, payload, err = d.rawControl(off)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if typ != typePointer {
+		return typ, size, payload, -1, nil
+	}
+
+	// A pointer's size is the offset pointed to, which never is another pointer
+	next = payload
+	typ, size, payload, err = d.rawControl(size)
+	if err == nil && typ == typePointer {
+		err = fmt.Errorf("pointer to pointer at %d", off)
+	}
+	return typ, size, payload, next, err
+}
+
+// rawControl decodes the type and size of the value at `off` without resolving pointers.
+// For pointers the size returned is the offset pointed to.
+func (d decoder) rawControl(off int) (typ int, size int, payload int, err error) {
+	b, err := d.bytes(off, 1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	off++
+	typ = int(b[0] >> 5)
+	size = int(b[0] & 0x1f)
+
+	if typ == typePointer {
+		n := size>>3 + 1
+		p, err := d.bytes(off, n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		target := 0
+		if n < 4 {
+			target = size & 0x7
+		}
+		for _, c := range p {
+			target = target<<8 | int(c)
+		}
+		target += []int{0, 2048, 526336, 0}[n-1]
+		return typePointer, target, off + n, nil
+	}
+
+	if typ == typeExtended {
+		e, err := d.bytes(off, 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		typ = 7 + int(e[0])
+		off++
+	}
+
+	if size >= 29 {
+		n := size - 28
+		s, err := d.bytes(off, n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		size = 0
+		for _, c := range s {
+			size = size<<8 | int(c)
+		}
+		size += []int{29, 285, 65821}[n-1]
+		off += n
+	}
+	return typ, size, off, nil
+}
+
+// bytes returns the `n` bytes at `off`
+func (d decoder) bytes(off int, n int) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > len(d) {
+		return nil, fmt.Errorf("value at %d exceeds data section", off)
+	}
+	return d[off : off+n], nil
+}
+
+// skip returns the offset following the value at `off`
+func (d decoder) skip(off int) (int, error) {
+	typ, size, payload, next, err := d.control(off)
+	if err != nil {
+		return 0, err
+	}
+	end := payload
+	switch typ {
+	case typeMap, typeArray:
+		n := size
+		if typ == typeMap {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			if end, err = d.skip(end); err != nil {
+				return 0, err
+			}
+		}
+	case typeBool:
+	default:
+		end += size
+	}
+	if next >= 0 {
+		return next, nil
+	}
+	return end, nil
+}
+
+// lookup follows the map keys `path` from the value at `off`. It returns the
+// offset of the value found, -1 if a key doesn't exist.
+func (d decoder) lookup(off int, path ...string) (int, error) {
+	for _, key := range path {
+		typ, size, payload, _, err := d.control(off)
+		if err != nil {
+			return 0, err
+		}
+		if typ != typeMap {
+			return -1, nil
+		}
+
+		found := -1
+		pos := payload
+		for i := 0; i < size && found < 0; i++ {
+			k, err := d.string(pos)
+			if err != nil {
+				return 0, err
+			}
+			if pos, err = d.skip(pos); err != nil {
+				return 0, err
+			}
+			if k == key {
+				found = pos
+			} else if pos, err = d.skip(pos); err != nil {
+				return 0, err
+			}
+		}
+		if found < 0 {
+			return -1, nil
+		}
+		off = found
+	}
+	return off, nil
+}
+
+// string decodes the string at `off`
+func (d decoder) string(off int) (string, error) {
+	typ, size, payload, _, err := d.control(off)
+	if err != nil {
+		return "", err
+	}
+	if typ != typeString {
+		return "", fmt.Errorf("value at %d is of type %d, not a string", off, typ)
+	}
+	b, err := d.bytes(payload, size)
+	return string(b), err
+}
+
+// uint decodes the unsigned integer at `off`
+func (d decoder) uint(off int) (uint64, error) {
+	typ, size, payload, _, err := d.control(off)
+	if err != nil {
+		return 0, err
+	}
+	if typ != typeUint16 && typ != typeUint32 && typ != typeUint64 || size > 8 {
+		return 0, fmt.Errorf("value at %d is of type %d, not an unsigned integer", off, typ)
+	}
+	b, err := d.bytes(payload, size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
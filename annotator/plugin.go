@@ -0,0 +1,92 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package annotator
+
+import (
+	"sync/atomic"
+
+	"github.com/google/tflow2/annotator/bird"
+	"github.com/google/tflow2/annotator/cymru"
+	"github.com/google/tflow2/annotator/enrich"
+	"github.com/google/tflow2/annotator/ttl"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+// Plugin is an annotation step. Each flow is passed through all plugins in the
+// order they were registered, by all workers concurrently. Plugins implementing
+// `SetDebug(l int)` get debug level changes of the annotator passed on.
+type Plugin interface {
+	// Annotate adds annotations to `fl`
+	Annotate(fl *netflow.Flow)
+}
+
+// debugSetter is implemented by plugins whose debug level can be raised at runtime
+type debugSetter interface {
+	SetDebug(l int)
+}
+
+// bgpPlugin annotates flows with prefix and ASN information from local BIRD
+// (bird.nic.cz) instances. ASNs BIRD has no route for are looked up via DNS
+// unless `cymru` is nil.
+type bgpPlugin struct {
+	bird  *bird.Annotator
+	cymru *cymru.Annotator
+}
+
+// Annotate implements Plugin
+func (p *bgpPlugin) Annotate(fl *netflow.Flow) {
+	p.bird.Augment(fl)
+	if len(fl.SrcPfx.GetMask()) > 0 && len(fl.DstPfx.GetMask()) > 0 {
+		fl.Enrichments |= EnrichedPrefixes
+		atomic.AddUint64(&stats.GlobalStats.AnnotatedPrefixes, 1)
+	}
+
+	if p.cymru != nil {
+		p.cymru.Augment(fl)
+	}
+	if fl.SrcAs != 0 && fl.DstAs != 0 {
+		fl.Enrichments |= EnrichedASNs
+		atomic.AddUint64(&stats.GlobalStats.AnnotatedASNs, 1)
+	}
+}
+
+// SetDebug raises the debug level of the BIRD and DNS annotators to `l`
+func (p *bgpPlugin) SetDebug(l int) {
+	p.bird.SetDebug(l)
+	if p.cymru != nil {
+		p.cymru.SetDebug(l)
+	}
+}
+
+// ttlPlugin flags flows with unusual TTLs for their source
+type ttlPlugin struct {
+	*ttl.Annotator
+}
+
+// Annotate implements Plugin
+func (p ttlPlugin) Annotate(fl *netflow.Flow) {
+	p.Augment(fl)
+}
+
+// enrichPlugin annotates flows with attributes from an external HTTP service
+type enrichPlugin struct {
+	*enrich.Annotator
+}
+
+// Annotate implements Plugin
+func (p enrichPlugin) Annotate(fl *netflow.Flow) {
+	if p.Augment(fl) {
+		fl.Enrichments |= EnrichedAttributes
+		atomic.AddUint64(&stats.GlobalStats.AnnotatedAttributes, 1)
+	}
+}
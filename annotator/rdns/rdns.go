@@ -0,0 +1,154 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rdns annotates flows with the host names of their source and
+// destination addresses, looked up via reverse DNS (PTR records)
+package rdns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/lru"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+const (
+	// queueSize is the number of addresses waiting to be looked up. Addresses
+	// of flows arriving while the queue is full are looked up for later flows.
+	queueSize = 1000
+
+	// numWorkers is the number of lookups running concurrently
+	numWorkers = 8
+
+	// queryTimeout is the maximum time a single PTR lookup may take
+	queryTimeout = 2 * time.Second
+)
+
+// Annotator represents an annotator looking up host names via reverse DNS
+type Annotator struct {
+	// cache holds the names of addresses already looked up, "" if the address
+	// has no PTR record or the lookup failed. Names are looked up again once expired.
+	cache *lru.Cache
+
+	// lookupAddr performs the actual DNS query
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+
+	// queue holds the addresses to look up, pending their cache keys
+	queue   chan net.IP
+	pending map[string]bool
+	lock    sync.Mutex
+
+	// debug is the debug level of this annotator
+	debug debug.Local
+}
+
+// NewAnnotator creates a new reverse DNS annotator caching the names of up to
+// `cacheSize` addresses for `cacheTTL`
+func NewAnnotator(cacheSize int, cacheTTL time.Duration) *Annotator {
+	a := &Annotator{
+		cache:      lru.New(cacheSize, cacheTTL),
+		lookupAddr: net.DefaultResolver.LookupAddr,
+		queue:      make(chan net.IP, queueSize),
+		pending:    make(map[string]bool),
+	}
+	for i := 0; i < numWorkers; i++ {
+		go a.worker()
+	}
+	return a
+}
+
+// SetDebug raises the debug level of this annotator above the shared one to
+// `l`. It takes effect immediately, also for flows being processed.
+func (a *Annotator) SetDebug(l int) {
+	a.debug.Set(l)
+}
+
+// Annotate sets the host names of source and destination address of `fl`.
+// Names not cached yet are looked up in the background, so flows are never held
+// up by slow resolvers. They are left empty until the lookup finished.
+func (a *Annotator) Annotate(fl *netflow.Flow) {
+	if fl.SrcHost == "" && len(fl.SrcAddr) > 0 {
+		fl.SrcHost = a.name(fl.SrcAddr)
+	}
+	if fl.DstHost == "" && len(fl.DstAddr) > 0 {
+		fl.DstHost = a.name(fl.DstAddr)
+	}
+}
+
+// name returns the cached name of `addr`, queueing a lookup if it isn't cached
+func (a *Annotator) name(addr net.IP) string {
+	key := addr.String()
+	if name, ok := a.cache.Get(key); ok {
+		atomic.AddUint64(&stats.GlobalStats.RDNSCacheHits, 1)
+		return name.(string)
+	}
+	atomic.AddUint64(&stats.GlobalStats.RDNSCacheMiss, 1)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.pending[key] {
+		return ""
+	}
+	select {
+	case a.queue <- addr:
+		a.pending[key] = true
+	default:
+	}
+	return ""
+}
+
+// worker looks up the addresses queued
+func (a *Annotator) worker() {
+	for addr := range a.queue {
+		key := addr.String()
+		name, err := a.query(key)
+		if err != nil {
+			// Failed lookups are cached like addresses without PTR record, so
+			// broken resolvers aren't asked for every flow
+			atomic.AddUint64(&stats.GlobalStats.RDNSErrors, 1)
+			if a.debug.Level() > 0 {
+				glog.Warningf("Reverse DNS lookup of %s failed: %v", key, err)
+			}
+		}
+		a.cache.Set(key, name)
+
+		a.lock.Lock()
+		delete(a.pending, key)
+		a.lock.Unlock()
+	}
+}
+
+// query returns the first PTR name of `addr` without trailing dot, "" if it has none
+func (a *Annotator) query(addr string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	names, err := a.lookupAddr(ctx, addr)
+	if err != nil {
+		// Addresses without PTR record yield NXDOMAIN which is a valid answer
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	return strings.TrimSuffix(names[0], "."), nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/tflow2/netflow"
+)
+
+func TestAnnotate(t *testing.T) {
+	var queries int32
+	a := NewAnnotator(100, time.Hour)
+	a.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		atomic.AddInt32(&queries, 1)
+		switch addr {
+		case "192.0.2.1":
+			return []string{"host.example.com.", "alias.example.com."}, nil
+		case "2001:db8::1":
+			return nil, errors.New("timeout")
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	annotate := func(src net.IP, dst net.IP) *netflow.Flow {
+		fl := &netflow.Flow{SrcAddr: src, DstAddr: dst}
+		a.Annotate(fl)
+		return fl
+	}
+
+	// Names are looked up in the background, so the first flows are left unnamed
+	if fl := annotate(net.IP{192, 0, 2, 1}, net.IP{198, 51, 100, 1}); fl.SrcHost != "" || fl.DstHost != "" {
+		t.Errorf("Expected no names before lookup, got %q and %q", fl.SrcHost, fl.DstHost)
+	}
+	fl := annotate(net.IP{192, 0, 2, 1}, net.IP{198, 51, 100, 1})
+	for deadline := time.Now().Add(5 * time.Second); fl.SrcHost == "" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		fl = annotate(net.IP{192, 0, 2, 1}, net.IP{198, 51, 100, 1})
+	}
+	if fl.SrcHost != "host.example.com" || fl.DstHost != "" {
+		t.Errorf("Expected host.example.com -> \"\", got %q -> %q", fl.SrcHost, fl.DstHost)
+	}
+
+	// Failed lookups are cached too
+	annotate(net.ParseIP("2001:db8::1"), net.IP{198, 51, 100, 1})
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, ok := a.cache.Get("2001:db8::1"); ok {
+			break
+		}
+	}
+	for i := 0; i < 10; i++ {
+		annotate(net.ParseIP("2001:db8::1"), net.IP{198, 51, 100, 1})
+	}
+	if q := atomic.LoadInt32(&queries); q != 3 {
+		t.Errorf("Expected 3 queries, got %d", q)
+	}
+
+	// Names already set are kept
+	fl = &netflow.Flow{SrcAddr: net.IP{192, 0, 2, 1}, SrcHost: "other.example.com"}
+	if a.Annotate(fl); fl.SrcHost != "other.example.com" {
+		t.Errorf("Expected other.example.com to be kept, got %q", fl.SrcHost)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	a := NewAnnotator(100, time.Hour)
+	a.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		return nil, errors.New("timeout")
+	}
+	if name, err := a.query("192.0.2.1"); err == nil || name != "" {
+		t.Errorf("Expected error, got %q (%v)", name, err)
+	}
+
+	a.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	if name, err := a.query("192.0.2.1"); err != nil || name != "" {
+		t.Errorf("Expected no name and no error for NXDOMAIN, got %q (%v)", name, err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snmp
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// BER tags of the SNMPv2c messages used
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+	tagGetRequest  = 0xa0
+	tagResponse    = 0xa2
+)
+
+// version2c is the version number of SNMPv2c messages
+const version2c = 1
+
+// varBind is a variable of a PDU. Value is nil unless the agent returned a string,
+// e.g. if it returned noSuchInstance for an interface it doesn't have.
+type varBind struct {
+	oid   []uint32
+	value []byte
+}
+
+// tlv encodes `content` with `tag` and its length
+func tlv(tag byte, content ...[]byte) []byte {
+	c := bytes.Join(content, nil)
+	b := []byte{tag}
+	switch n := len(c); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, c...)
+}
+
+// encodeInteger encodes `v` as INTEGER
+func encodeInteger(v int32) []byte {
+	b := []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	// Leading bytes not needed to keep the sign are dropped
+	for len(b) > 1 && (b[0] == 0 && b[1]&0x80 == 0 || b[0] == 0xff && b[1]&0x80 != 0) {
+		b = b[1:]
+	}
+	return tlv(tagInteger, b)
+}
+
+// encodeOID encodes `oid` as OBJECT IDENTIFIER. It needs at least 2 components.
+func encodeOID(oid []uint32) []byte {
+	b := []byte{byte(oid[0]*40 + oid[1])}
+	for _, c := range oid[2:] {
+		var enc []byte
+		for enc = []byte{byte(c & 0x7f)}; c >= 0x80; {
+			c >>= 7
+			enc = append([]byte{byte(c&0x7f) | 0x80}, enc...)
+		}
+		b = append(b, enc...)
+	}
+	return tlv(tagOID, b)
+}
+
+// encodeGetRequest encodes a SNMPv2c GetRequest for the variables `oids`
+func encodeGetRequest(community string, requestID int32, oids ...[]uint32) []byte {
+	var vars [][]byte
+	for _, oid := range oids {
+		vars = append(vars, tlv(tagSequence, encodeOID(oid), tlv(tagNull)))
+	}
+	pdu := tlv(tagGetRequest, encodeInteger(requestID), encodeInteger(0), encodeInteger(0), tlv(tagSequence, vars...))
+	return tlv(tagSequence, encodeInteger(version2c), tlv(tagOctetString, []byte(community)), pdu)
+}
+
+// decodeTLV decodes the value at the start of `b`. It returns its tag, its
+// content and the bytes following it.
+func decodeTLV(b []byte) (tag byte, content []byte, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated value of %d bytes", len(b))
+	}
+	tag = b[0]
+	n := int(b[1])
+	b = b[2:]
+	if n&0x80 != 0 {
+		l := n & 0x7f
+		if l == 0 || l > 2 || len(b) < l {
+			return 0, nil, nil, fmt.Errorf("unsupported length of %d bytes", l)
+		}
+		n = 0
+		for _, c := range b[:l] {
+			n = n<<8 | int(c)
+		}
+		b = b[l:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, fmt.Errorf("value of %d bytes exceeds message", n)
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// decodeExpected decodes the value at the start of `b`, which must be of type `tag`
+func decodeExpected(b []byte, tag byte) (content []byte, rest []byte, err error) {
+	t, content, rest, err := decodeTLV(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t != tag {
+		return nil, nil, fmt.Errorf("got type 0x%02x, expected 0x%02x", t, tag)
+	}
+	return content, rest, nil
+}
+
+// decodeInteger decodes the INTEGER at the start of `b`
+func decodeInteger(b []byte) (int64, []byte, error) {
+	c, rest, err := decodeExpected(b, tagInteger)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(c) == 0 || len(c) > 8 {
+		return 0, nil, fmt.Errorf("integer of %d bytes", len(c))
+	}
+	v := int64(int8(c[0]))
+	for _, d := range c[1:] {
+		v = v<<8 | int64(d)
+	}
+	return v, rest, nil
+}
+
+// decodeOID decodes the content of an OBJECT IDENTIFIER
+func decodeOID(c []byte) ([]uint32, error) {
+	if len(c) == 0 {
+		return nil, fmt.Errorf("empty object identifier")
+	}
+	oid := []uint32{uint32(c[0]) / 40, uint32(c[0]) % 40}
+	var v uint32
+	for i, d := range c[1:] {
+		v = v<<7 | uint32(d&0x7f)
+		if d&0x80 == 0 {
+			oid = append(oid, v)
+			v = 0
+		} else if i == len(c)-2 {
+			return nil, fmt.Errorf("truncated object identifier")
+		}
+	}
+	return oid, nil
+}
+
+// decodeResponse decodes a SNMPv2c Response. It returns the request ID and the
+// variables, or an error if the agent reported one.
+func decodeResponse(b []byte) (int32, []varBind, error) {
+	msg, _, err := decodeExpected(b, tagSequence)
+	if err != nil {
+		return 0, nil, err
+	}
+	version, msg, err := decodeInteger(msg)
+	if err != nil {
+		return 0, nil, fmt.Errorf("version: %v", err)
+	}
+	if version != version2c {
+		return 0, nil, fmt.Errorf("version %d, expected SNMPv2c", version)
+	}
+	if _, msg, err = decodeExpected(msg, tagOctetString); err != nil {
+		return 0, nil, fmt.Errorf("community: %v", err)
+	}
+	pdu, _, err := decodeExpected(msg, tagResponse)
+	if err != nil {
+		return 0, nil, fmt.Errorf("PDU: %v", err)
+	}
+
+	var fields [3]int64
+	for i := range fields {
+		if fields[i], pdu, err = decodeInteger(pdu); err != nil {
+			return 0, nil, fmt.Errorf("PDU header: %v", err)
+		}
+	}
+	if fields[1] != 0 {
+		return 0, nil, fmt.Errorf("agent returned error %d for variable %d", fields[1], fields[2])
+	}
+
+	list, _, err := decodeExpected(pdu, tagSequence)
+	if err != nil {
+		return 0, nil, fmt.Errorf("variables: %v", err)
+	}
+	var vars []varBind
+	for len(list) > 0 {
+		var vb []byte
+		if vb, list, err = decodeExpected(list, tagSequence); err != nil {
+			return 0, nil, fmt.Errorf("variable: %v", err)
+		}
+		c, vb, err := decodeExpected(vb, tagOID)
+		if err != nil {
+			return 0, nil, fmt.Errorf("variable name: %v", err)
+		}
+		oid, err := decodeOID(c)
+		if err != nil {
+			return 0, nil, err
+		}
+		tag, value, _, err := decodeTLV(vb)
+		if err != nil {
+			return 0, nil, fmt.Errorf("value of %v: %v", oid, err)
+		}
+		v := varBind{oid: oid}
+		if tag == tagOctetString {
+			v.value = value
+		}
+		vars = append(vars, v)
+	}
+	return int32(fields[0]), vars, nil
+}
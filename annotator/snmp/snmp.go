@@ -0,0 +1,203 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package snmp annotates flows with the names of their input and output
+// interfaces, looked up via SNMPv2c from the ifXTable of the exporting router
+package snmp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/lru"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+const (
+	// cacheSize is the number of interfaces to cache names for
+	cacheSize = 100000
+
+	// queueSize is the number of interfaces waiting to be looked up. Interfaces
+	// of flows arriving while the queue is full are looked up for later flows.
+	queueSize = 1000
+
+	// numWorkers is the number of lookups running concurrently
+	numWorkers = 4
+
+	// queryTimeout is the time a router has to answer a query
+	queryTimeout = 2 * time.Second
+)
+
+var (
+	// ifName and ifDescr are the OIDs of the ifXTable and ifTable columns
+	// holding interface names. The ifIndex is appended.
+	ifName  = []uint32{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 1}
+	ifDescr = []uint32{1, 3, 6, 1, 2, 1, 2, 2, 1, 2}
+)
+
+// Annotator represents an annotator looking up interface names via SNMP
+type Annotator struct {
+	community string
+
+	// port is the UDP port routers are queried on
+	port int
+
+	// cache holds the names of interfaces already looked up, "" if the router
+	// didn't tell. Names are looked up again once expired.
+	cache *lru.Cache
+
+	// queue holds the interfaces to look up, pending their cache keys
+	queue   chan iface
+	pending map[string]bool
+	lock    sync.Mutex
+
+	// debug is the debug level of this annotator
+	debug debug.Local
+}
+
+// iface identifies an interface of a router
+type iface struct {
+	router  net.IP
+	ifIndex uint32
+}
+
+// key returns the cache key of `i`
+func (i iface) key() string {
+	return i.router.String() + "/" + strconv.FormatUint(uint64(i.ifIndex), 10)
+}
+
+// NewAnnotator creates a new SNMP annotator querying routers with `community`.
+// Names are looked up again after `refresh`, so renamed interfaces are picked up.
+func NewAnnotator(community string, refresh time.Duration) *Annotator {
+	a := &Annotator{
+		community: community,
+		port:      161,
+		cache:     lru.New(cacheSize, refresh),
+		queue:     make(chan iface, queueSize),
+		pending:   make(map[string]bool),
+	}
+	for i := 0; i < numWorkers; i++ {
+		go a.worker()
+	}
+	return a
+}
+
+// SetDebug raises the debug level of this annotator above the shared one to
+// `l`. It takes effect immediately, also for flows being processed.
+func (a *Annotator) SetDebug(l int) {
+	a.debug.Set(l)
+}
+
+// Annotate sets the names of the input and output interface of `fl` unless the
+// exporter announced them. Names not cached yet are looked up in the background,
+// so flows are never held up by routers slow to answer. They are left empty
+// until the router answered.
+func (a *Annotator) Annotate(fl *netflow.Flow) {
+	rtr := net.IP(fl.Router)
+	if fl.IntInName == "" && fl.IntIn != 0 {
+		fl.IntInName = a.name(iface{rtr, fl.IntIn})
+	}
+	if fl.IntOutName == "" && fl.IntOut != 0 {
+		fl.IntOutName = a.name(iface{rtr, fl.IntOut})
+	}
+}
+
+// name returns the cached name of `i`, queueing a lookup if it isn't cached
+func (a *Annotator) name(i iface) string {
+	key := i.key()
+	if name, ok := a.cache.Get(key); ok {
+		return name.(string)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.pending[key] {
+		return ""
+	}
+	select {
+	case a.queue <- i:
+		a.pending[key] = true
+	default:
+	}
+	return ""
+}
+
+// worker looks up the interfaces queued
+func (a *Annotator) worker() {
+	for i := range a.queue {
+		key := i.key()
+		name, err := a.query(i)
+		atomic.AddUint64(&stats.GlobalStats.SNMPQueries, 1)
+		if err != nil {
+			// Unreachable routers are asked again once the refresh interval passed
+			atomic.AddUint64(&stats.GlobalStats.SNMPErrors, 1)
+			if a.debug.Level() > 0 {
+				glog.Warningf("SNMP lookup of interface %s failed: %v", key, err)
+			}
+		}
+		a.cache.Set(key, name)
+
+		a.lock.Lock()
+		delete(a.pending, key)
+		a.lock.Unlock()
+	}
+}
+
+// query asks the router of `i` for its name, falling back to its description
+func (a *Annotator) query(i iface) (string, error) {
+	con, err := net.DialTimeout("udp", net.JoinHostPort(i.router.String(), strconv.Itoa(a.port)), queryTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer con.Close()
+	con.SetDeadline(time.Now().Add(queryTimeout))
+
+	name := append(append([]uint32{}, ifName...), i.ifIndex)
+	descr := append(append([]uint32{}, ifDescr...), i.ifIndex)
+	requestID := rand.Int31()
+	if _, err := con.Write(encodeGetRequest(a.community, requestID, name, descr)); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := con.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		id, vars, err := decodeResponse(buf[:n])
+		if err != nil {
+			return "", err
+		}
+		// Late answers to previous queries are skipped
+		if id != requestID {
+			continue
+		}
+
+		values := make(map[string]string)
+		for _, v := range vars {
+			values[fmt.Sprint(v.oid)] = string(bytes.TrimRight(v.value, "\x00"))
+		}
+		if n := values[fmt.Sprint(name)]; n != "" {
+			return n, nil
+		}
+		return values[fmt.Sprint(descr)], nil
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snmp
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/tflow2/netflow"
+)
+
+// fakeAgent answers GetRequests with `community` on `con`. Variables are
+// answered from `values`, unknown ones with noSuchInstance.
+func fakeAgent(con net.PacketConn, community string, values map[string]string) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := con.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		// Message: version, community and PDU of request ID, error status, error index and variables
+		msg, _, _ := decodeExpected(buf[:n], tagSequence)
+		_, msg, _ = decodeInteger(msg)
+		c, msg, _ := decodeExpected(msg, tagOctetString)
+		if string(c) != community {
+			continue
+		}
+		pdu, _, _ := decodeExpected(msg, tagGetRequest)
+		id, pdu, _ := decodeInteger(pdu)
+		_, pdu, _ = decodeInteger(pdu)
+		_, pdu, _ = decodeInteger(pdu)
+		list, _, _ := decodeExpected(pdu, tagSequence)
+
+		var vars [][]byte
+		for len(list) > 0 {
+			var vb []byte
+			vb, list, _ = decodeExpected(list, tagSequence)
+			raw, _, _ := decodeExpected(vb, tagOID)
+			oid, _ := decodeOID(raw)
+			value := tlv(0x81)
+			if v, ok := values[fmt.Sprint(oid)]; ok {
+				value = tlv(tagOctetString, []byte(v))
+			}
+			vars = append(vars, tlv(tagSequence, encodeOID(oid), value))
+		}
+		resp := tlv(tagResponse, encodeInteger(int32(id)), encodeInteger(0), encodeInteger(0), tlv(tagSequence, vars...))
+		con.WriteTo(tlv(tagSequence, encodeInteger(version2c), tlv(tagOctetString, c), resp), addr)
+	}
+}
+
+func TestOID(t *testing.T) {
+	oid := []uint32{1, 3, 6, 1, 2, 1, 31, 1, 1, 1, 1, 1073741824}
+	c, _, err := decodeExpected(encodeOID(oid), tagOID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decodeOID(c); err != nil || !reflect.DeepEqual(got, oid) {
+		t.Errorf("Expected %v, got %v (%v)", oid, got, err)
+	}
+	if _, err := decodeOID(c[:len(c)-1]); err == nil {
+		t.Errorf("Expected error decoding truncated OID")
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	con, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	go fakeAgent(con, "secret", map[string]string{
+		fmt.Sprint(append(ifName, 1)):  "xe-0/0/0",
+		fmt.Sprint(append(ifDescr, 1)): "Uplink",
+		fmt.Sprint(append(ifDescr, 2)): "Ethernet2",
+	})
+
+	a := NewAnnotator("secret", time.Hour)
+	a.port = con.LocalAddr().(*net.UDPAddr).Port
+	annotate := func(intIn uint32, intOut uint32) *netflow.Flow {
+		fl := &netflow.Flow{Router: net.IP{127, 0, 0, 1}, IntIn: intIn, IntOut: intOut}
+		a.Annotate(fl)
+		return fl
+	}
+
+	// Names are looked up in the background, so the first flows are left unnamed
+	if fl := annotate(1, 2); fl.IntInName != "" || fl.IntOutName != "" {
+		t.Errorf("Expected no names before lookup, got %q and %q", fl.IntInName, fl.IntOutName)
+	}
+	fl := annotate(1, 2)
+	for deadline := time.Now().Add(5 * time.Second); fl.IntOutName == "" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		fl = annotate(1, 2)
+	}
+	if fl.IntInName != "xe-0/0/0" || fl.IntOutName != "Ethernet2" {
+		t.Errorf("Expected ifName xe-0/0/0 and ifDescr Ethernet2, got %q and %q", fl.IntInName, fl.IntOutName)
+	}
+
+	// Names announced by the exporter are kept
+	fl = &netflow.Flow{Router: net.IP{127, 0, 0, 1}, IntIn: 1, IntInName: "et-0/0/1"}
+	if a.Annotate(fl); fl.IntInName != "et-0/0/1" {
+		t.Errorf("Expected announced name et-0/0/1, got %q", fl.IntInName)
+	}
+
+	// Routers rejecting the community leave names empty
+	a.community = "public"
+	name, err := a.query(iface{net.IP{127, 0, 0, 1}, 3})
+	if err == nil || name != "" {
+		t.Errorf("Expected timeout querying with wrong community, got %q (%v)", name, err)
+	}
+}
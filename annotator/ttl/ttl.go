@@ -0,0 +1,160 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ttl flags flows whose TTL deviates from the TTL typically seen for
+// their source. As the number of hops between a source and the exporter rarely
+// changes, a deviation hints at a route change or at spoofed source addresses.
+package ttl
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/lru"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+const (
+	// cacheSize is the number of sources to keep a model for
+	cacheSize = 100000
+
+	// alpha is the weight of a new observation in the moving averages
+	alpha = 0.05
+
+	// minSamples is the number of observations needed before flows are flagged
+	minSamples = 20
+
+	// threshold is the deviation from the mean, in multiples of the mean
+	// absolute deviation, above which a flow is flagged
+	threshold = 4
+
+	// minDeviation is the deviation (in hops) that is always tolerated
+	minDeviation = 2
+
+	// decayInterval is the time after which an idle model loses half of its samples
+	decayInterval = 10 * time.Minute
+)
+
+// model tracks the TTL of flows of a single source
+type model struct {
+	mean     float64
+	dev      float64
+	samples  int
+	lastSeen time.Time
+}
+
+// observe checks `ttl` against the model and updates the model with it. It
+// returns true if `ttl` deviates significantly from the TTLs seen before.
+func (m *model) observe(ttl float64, now time.Time) bool {
+	// Halve the weight of old observations for each decay interval the model was idle
+	if m.samples > 0 {
+		m.samples >>= uint(now.Sub(m.lastSeen) / decayInterval)
+	}
+	m.lastSeen = now
+
+	if m.samples == 0 {
+		m.mean = ttl
+		m.dev = 0
+		m.samples = 1
+		return false
+	}
+
+	diff := math.Abs(ttl - m.mean)
+	anomaly := m.samples >= minSamples && diff > math.Max(minDeviation, threshold*m.dev)
+
+	m.mean += alpha * (ttl - m.mean)
+	m.dev += alpha * (diff - m.dev)
+	if m.samples < minSamples {
+		m.samples++
+	}
+	return anomaly
+}
+
+// Annotator represents an annotator flagging TTL anomalies
+type Annotator struct {
+	// models holds a model for each source, keyed by router and source
+	models *lru.Cache
+	lock   sync.Mutex
+
+	// debug is the debug level of this annotator
+	debug debug.Local
+}
+
+// NewAnnotator creates a new TTL anomaly annotator
+func NewAnnotator() *Annotator {
+	return &Annotator{
+		models: lru.New(cacheSize, 0),
+	}
+}
+
+// SetDebug raises the debug level of this annotator above the shared one to
+// `l`. It takes effect immediately, also for flows being processed.
+func (a *Annotator) SetDebug(l int) {
+	a.debug.Set(l)
+}
+
+// Augment sets the TtlAnomaly flag of `fl` if its maximum TTL deviates from the
+// TTL typically seen for its source. Flows without TTL are ignored.
+func (a *Annotator) Augment(fl *netflow.Flow) {
+	if fl.MaxTtl == 0 {
+		return
+	}
+
+	key := sourceKey(fl)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var m *model
+	if v, ok := a.models.Get(key); ok {
+		m = v.(*model)
+	} else {
+		m = &model{}
+		a.models.Set(key, m)
+	}
+
+	if m.observe(float64(fl.MaxTtl), time.Now()) {
+		fl.TtlAnomaly = true
+		atomic.AddUint64(&stats.GlobalStats.TTLAnomalies, 1)
+		if a.debug.Level() > 1 {
+			glog.Infof("TTL anomaly for %s: %d, typically %.1f", key, fl.MaxTtl, m.mean)
+		}
+	}
+}
+
+// sourceKey identifies the source of `fl` as seen by its router. Sources are
+// described by their prefix if known, their ASN otherwise. If neither is known
+// the sources /24 (IPv4) or /48 (IPv6) is used.
+func sourceKey(fl *netflow.Flow) string {
+	rtr := net.IP(fl.Router).String()
+	if len(fl.SrcPfx.GetMask()) > 0 {
+		pfx := net.IPNet{IP: fl.SrcPfx.IP, Mask: fl.SrcPfx.Mask}
+		return fmt.Sprintf("%s/%s", rtr, pfx.String())
+	}
+	if fl.SrcAs != 0 {
+		return fmt.Sprintf("%s/AS%d", rtr, fl.SrcAs)
+	}
+
+	addr := net.IP(fl.SrcAddr)
+	mask := net.CIDRMask(48, 128)
+	if addr.To4() != nil {
+		addr = addr.To4()
+		mask = net.CIDRMask(24, 32)
+	}
+	pfx := net.IPNet{IP: addr.Mask(mask), Mask: mask}
+	return fmt.Sprintf("%s/%s", rtr, pfx.String())
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ttl
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/tflow2/netflow"
+)
+
+func TestObserve(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	m := &model{}
+
+	// Anomalies are only flagged once enough samples were seen
+	for i := 0; i < minSamples; i++ {
+		if m.observe(float64(58+(i%2)*60), now) {
+			t.Errorf("Expected no anomaly while learning")
+		}
+	}
+	for i := 0; i < 100; i++ {
+		m.observe(float64(58+i%2), now)
+	}
+
+	if m.observe(59, now) {
+		t.Errorf("Expected no anomaly for typical TTL")
+	}
+	if !m.observe(120, now) {
+		t.Errorf("Expected anomaly for TTL 120 with typical TTL %.1f", m.mean)
+	}
+
+	// After being idle for long the model relearns before flagging again
+	if m.observe(120, now.Add(time.Duration(8)*decayInterval)) {
+		t.Errorf("Expected no anomaly after decay")
+	}
+}
+
+func TestSourceKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		flow     *netflow.Flow
+		expected string
+	}{
+		{
+			name: "Prefix",
+			flow: &netflow.Flow{
+				Router: net.IP{192, 0, 2, 1},
+				SrcAs:  64496,
+				SrcPfx: &netflow.Pfx{IP: net.IP{198, 51, 100, 0}, Mask: net.CIDRMask(22, 32)},
+			},
+			expected: "192.0.2.1/198.51.100.0/22",
+		},
+		{
+			name:     "ASN",
+			flow:     &netflow.Flow{Router: net.IP{192, 0, 2, 1}, SrcAs: 64496},
+			expected: "192.0.2.1/AS64496",
+		},
+		{
+			name:     "IPv4 address",
+			flow:     &netflow.Flow{Router: net.IP{192, 0, 2, 1}, SrcAddr: net.IP{198, 51, 100, 17}},
+			expected: "192.0.2.1/198.51.100.0/24",
+		},
+		{
+			name:     "IPv6 address",
+			flow:     &netflow.Flow{Router: net.IP{192, 0, 2, 1}, SrcAddr: net.ParseIP("2001:db8:1:2::1")},
+			expected: "192.0.2.1/2001:db8:1::/48",
+		},
+	}
+
+	for _, test := range tests {
+		if key := sourceKey(test.flow); key != test.expected {
+			t.Errorf("%s: Expected %s, got %s", test.name, test.expected, key)
+		}
+	}
+}
+
+func TestAugment(t *testing.T) {
+	a := NewAnnotator()
+	flow := func(ttl uint32) *netflow.Flow {
+		fl := &netflow.Flow{Router: net.IP{192, 0, 2, 1}, SrcAddr: net.IP{198, 51, 100, 1}, MaxTtl: ttl}
+		a.Augment(fl)
+		return fl
+	}
+
+	for i := 0; i < 2*minSamples; i++ {
+		flow(60)
+	}
+	if fl := flow(60); fl.TtlAnomaly {
+		t.Errorf("Expected no anomaly for typical TTL")
+	}
+	if fl := flow(250); !fl.TtlAnomaly {
+		t.Errorf("Expected anomaly for TTL 250")
+	}
+	if fl := flow(0); fl.TtlAnomaly {
+		t.Errorf("Expected flows without TTL to be ignored")
+	}
+}
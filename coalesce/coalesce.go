@@ -0,0 +1,191 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package coalesce merges flows of the same tuple within an aggregation bucket
+// before they are passed on to the database and other sinks
+package coalesce
+
+import (
+	"container/list"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+// endOfFlow is the IPFIX flowEndReason of flows the exporter saw ending, e.g. by a TCP FIN
+const endOfFlow = 3
+
+// Buffer coalesces flows keyed by tuple and time bucket. It holds up to a fixed
+// number of entries, flushing the least recently updated ones early if more are needed.
+type Buffer struct {
+	capacity    int
+	aggregation int64
+	outputs     []chan *netflow.Flow
+
+	// ll holds the entries, most recently updated first
+	ll    *list.List
+	items map[string]*list.Element
+
+	// Input is the channel used to receive flows from the annotator layer
+	Input chan *netflow.Flow
+
+	// now returns the current unix time
+	now func() int64
+}
+
+// entry is a coalesced flow kept in the list
+type entry struct {
+	key string
+	fl  *netflow.Flow
+}
+
+// New creates a new `Buffer` holding up to `capacity` coalesced flows. Flows are
+// sent to each of `outputs` once their bucket of `aggregation` seconds is over.
+// When `Input` is closed all flows are flushed and `outputs` are closed.
+func New(capacity int, aggregation int64, outputs []chan *netflow.Flow) *Buffer {
+	b := &Buffer{
+		capacity:    capacity,
+		aggregation: aggregation,
+		outputs:     outputs,
+		ll:          list.New(),
+		items:       make(map[string]*list.Element),
+		Input:       make(chan *netflow.Flow, 1024),
+		now:         func() int64 { return time.Now().Unix() },
+	}
+	go b.worker()
+	return b
+}
+
+// worker coalesces flows received on `Input` and flushes expired buckets every second
+func (b *Buffer) worker() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case fl, ok := <-b.Input:
+			if !ok {
+				b.flush(func(*netflow.Flow) bool { return true })
+				for _, out := range b.outputs {
+					close(out)
+				}
+				return
+			}
+			b.add(fl)
+		case <-ticker.C:
+			now := b.now()
+			b.flush(func(fl *netflow.Flow) bool { return fl.Timestamp+b.aggregation <= now })
+		}
+	}
+}
+
+// add merges `fl` into the entry of its tuple and bucket, evicting the least
+// recently updated entry if the buffer is full. Entries are flushed right away
+// once a record reports the end of the flow, as no continuation is coming.
+func (b *Buffer) add(fl *netflow.Flow) {
+	key := flowKey(fl)
+	if el, ok := b.items[key]; ok {
+		e := el.Value.(*entry)
+		merge(e.fl, fl)
+		atomic.AddUint64(&stats.GlobalStats.CoalescedFlows, 1)
+		if fl.EndReason == endOfFlow {
+			e.fl.EndReason = fl.EndReason
+			b.emit(el)
+			atomic.AddUint64(&stats.GlobalStats.CoalesceEnded, 1)
+			return
+		}
+		b.ll.MoveToFront(el)
+		return
+	}
+
+	if fl.EndReason == endOfFlow {
+		for _, out := range b.outputs {
+			out <- fl
+		}
+		atomic.AddUint64(&stats.GlobalStats.CoalesceEnded, 1)
+		return
+	}
+
+	b.items[key] = b.ll.PushFront(&entry{key: key, fl: fl})
+	if b.ll.Len() > b.capacity {
+		b.emit(b.ll.Back())
+		atomic.AddUint64(&stats.GlobalStats.CoalesceEvictions, 1)
+	}
+}
+
+// merge adds the counters of `fl` to `dst`, extending its duration and TTL range
+// to cover both. Start, end and TTLs of 0 are unknown and thus ignored.
+func merge(dst *netflow.Flow, fl *netflow.Flow) {
+	if uint64(dst.Packets)+uint64(fl.Packets) > math.MaxUint32 {
+		dst.Packets = math.MaxUint32
+	} else {
+		dst.Packets += fl.Packets
+	}
+	dst.Size += fl.Size
+	dst.DroppedPackets += fl.DroppedPackets
+	dst.DroppedBytes += fl.DroppedBytes
+	dst.TcpFlags |= fl.TcpFlags
+	dst.TtlAnomaly = dst.TtlAnomaly || fl.TtlAnomaly
+
+	if fl.Start != 0 && (dst.Start == 0 || fl.Start < dst.Start) {
+		dst.Start = fl.Start
+	}
+	if fl.End > dst.End {
+		dst.End = fl.End
+	}
+	if fl.MinTtl != 0 && (dst.MinTtl == 0 || fl.MinTtl < dst.MinTtl) {
+		dst.MinTtl = fl.MinTtl
+	}
+	if fl.MaxTtl > dst.MaxTtl {
+		dst.MaxTtl = fl.MaxTtl
+	}
+}
+
+// flush emits all entries `expired` returns true for
+func (b *Buffer) flush(expired func(*netflow.Flow) bool) {
+	for el := b.ll.Back(); el != nil; {
+		prev := el.Prev()
+		if expired(el.Value.(*entry).fl) {
+			b.emit(el)
+		}
+		el = prev
+	}
+}
+
+// emit removes `el` from the buffer and sends its flow to all outputs
+func (b *Buffer) emit(el *list.Element) {
+	e := el.Value.(*entry)
+	b.ll.Remove(el)
+	delete(b.items, e.key)
+	for _, out := range b.outputs {
+		out <- e.fl
+	}
+}
+
+// flowKey builds the key identifying the tuple and bucket of `fl`
+func flowKey(fl *netflow.Flow) string {
+	key := make([]byte, 0, 80)
+	key = appendBytes(key, fl.Router)
+	key = appendBytes(key, fl.SrcAddr)
+	key = appendBytes(key, fl.DstAddr)
+	key = appendBytes(key, fl.NextHop)
+	for _, v := range []uint32{fl.Protocol, fl.SrcPort, fl.DstPort, fl.IntIn, fl.IntOut, uint32(fl.Timestamp >> 32), uint32(fl.Timestamp)} {
+		key = append(key, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return string(key)
+}
+
+// appendBytes appends `v` prefixed with its length to keep keys unambiguous
+func appendBytes(b []byte, v []byte) []byte {
+	return append(append(b, byte(len(v))), v...)
+}
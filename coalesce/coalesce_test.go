@@ -0,0 +1,165 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coalesce
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/google/tflow2/netflow"
+)
+
+func newTestBuffer(capacity int) (*Buffer, chan *netflow.Flow) {
+	out := make(chan *netflow.Flow, 10)
+	return &Buffer{
+		capacity:    capacity,
+		aggregation: 60,
+		outputs:     []chan *netflow.Flow{out},
+		ll:          list.New(),
+		items:       make(map[string]*list.Element),
+	}, out
+}
+
+func testFlow(src byte, ts int64) *netflow.Flow {
+	return &netflow.Flow{
+		SrcAddr:   net.IP{10, 0, 0, src},
+		DstAddr:   net.IP{10, 0, 1, 1},
+		Timestamp: ts,
+		Packets:   1,
+		Size:      100,
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	b, out := newTestBuffer(10)
+	b.add(testFlow(1, 60))
+	b.add(testFlow(1, 60))
+	b.add(testFlow(1, 120))
+	b.add(testFlow(2, 60))
+
+	if b.ll.Len() != 3 {
+		t.Fatalf("Expected 3 entries, got %d", b.ll.Len())
+	}
+
+	b.flush(func(fl *netflow.Flow) bool { return fl.Timestamp+b.aggregation <= 120 })
+	if len(out) != 2 {
+		t.Fatalf("Expected 2 flushed flows, got %d", len(out))
+	}
+	fl := <-out
+	if fl.Packets != 2 || fl.Size != 200 {
+		t.Errorf("Expected 2 packets and 200 bytes, got %d and %d", fl.Packets, fl.Size)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	b, out := newTestBuffer(10)
+	first := testFlow(1, 60)
+	first.Start, first.End = 61000, 62000
+	first.TcpFlags = 0x02
+	first.MinTtl, first.MaxTtl = 60, 62
+	first.DroppedPackets, first.DroppedBytes = 1, 40
+	second := testFlow(1, 60)
+	second.Start, second.End = 60500, 61500
+	second.TcpFlags = 0x10
+	second.MinTtl, second.MaxTtl = 58, 61
+	second.DroppedPackets, second.DroppedBytes = 2, 80
+	second.Packets = math.MaxUint32
+	unknown := testFlow(1, 60)
+	b.add(first)
+	b.add(second)
+	b.add(unknown)
+	b.flush(func(*netflow.Flow) bool { return true })
+
+	fl := <-out
+	if fl.Start != 60500 || fl.End != 62000 {
+		t.Errorf("Expected flow from 60500 to 62000, got %d to %d", fl.Start, fl.End)
+	}
+	if fl.TcpFlags != 0x12 {
+		t.Errorf("Expected TCP flags 0x12, got %#x", fl.TcpFlags)
+	}
+	if fl.MinTtl != 58 || fl.MaxTtl != 62 {
+		t.Errorf("Expected TTLs 58 - 62, got %d - %d", fl.MinTtl, fl.MaxTtl)
+	}
+	if fl.DroppedPackets != 3 || fl.DroppedBytes != 120 {
+		t.Errorf("Expected 3 dropped packets of 120 bytes, got %d of %d", fl.DroppedPackets, fl.DroppedBytes)
+	}
+	if fl.Packets != math.MaxUint32 || fl.Size != 300 {
+		t.Errorf("Expected packets capped at %d and 300 bytes, got %d and %d", uint32(math.MaxUint32), fl.Packets, fl.Size)
+	}
+}
+
+func TestEndOfFlow(t *testing.T) {
+	b, out := newTestBuffer(10)
+	b.add(testFlow(1, 60))
+	ended := testFlow(1, 60)
+	ended.EndReason = endOfFlow
+	b.add(ended)
+
+	if b.ll.Len() != 0 {
+		t.Errorf("Expected ended flow to be flushed, %d entries left", b.ll.Len())
+	}
+	if len(out) != 1 {
+		t.Fatalf("Expected 1 flushed flow, got %d", len(out))
+	}
+	if fl := <-out; fl.Packets != 2 || fl.EndReason != endOfFlow {
+		t.Errorf("Expected 2 packets with end of flow, got %d packets with end reason %d", fl.Packets, fl.EndReason)
+	}
+
+	// Short flows ending in a single record are not buffered at all
+	short := testFlow(2, 60)
+	short.EndReason = endOfFlow
+	b.add(short)
+	if b.ll.Len() != 0 || len(out) != 1 {
+		t.Errorf("Expected single record flow to be passed on, got %d entries and %d flows", b.ll.Len(), len(out))
+	}
+
+	// Flows ended by the active timeout keep accumulating
+	active := testFlow(3, 60)
+	active.EndReason = 2
+	b.add(active)
+	if b.ll.Len() != 1 {
+		t.Errorf("Expected active timeout flow to be kept, got %d entries", b.ll.Len())
+	}
+}
+
+func TestEviction(t *testing.T) {
+	b, out := newTestBuffer(2)
+	b.add(testFlow(1, 60))
+	b.add(testFlow(2, 60))
+	b.add(testFlow(1, 60))
+	b.add(testFlow(3, 60))
+
+	if len(out) != 1 {
+		t.Fatalf("Expected 1 evicted flow, got %d", len(out))
+	}
+	if fl := <-out; !net.IP(fl.SrcAddr).Equal(net.IP{10, 0, 0, 2}) {
+		t.Errorf("Expected least recently updated flow of 10.0.0.2 to be evicted, got %s", net.IP(fl.SrcAddr))
+	}
+}
+
+func TestDrain(t *testing.T) {
+	out := make(chan *netflow.Flow, 10)
+	b := New(10, 60, []chan *netflow.Flow{out})
+	b.Input <- testFlow(1, 60)
+	b.Input <- testFlow(1, 60)
+	close(b.Input)
+
+	n := 0
+	for range out {
+		n++
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 coalesced flow after drain, got %d", n)
+	}
+}
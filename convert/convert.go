@@ -99,6 +99,20 @@ func Int64Byte(data int64) (ret []byte) {
 	return buf.Bytes()
 }
 
+// MAC converts a 6 byte value kept in reverse byte order (see Reverse) into a MAC
+// address. Unlike Reverse it copies the value, leaving `data` untouched. It
+// returns nil if `data` is not 6 bytes long.
+func MAC(data []byte) net.HardwareAddr {
+	if len(data) != 6 {
+		return nil
+	}
+	mac := make(net.HardwareAddr, 6)
+	for i := range mac {
+		mac[i] = data[5-i]
+	}
+	return mac
+}
+
 // Reverse reverses byte slice without allocating new memory
 func Reverse(data []byte) []byte {
 	n := len(data)
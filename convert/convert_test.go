@@ -113,6 +113,38 @@ func TestUint64b(t *testing.T) {
 	}
 }
 
+func TestUint64(t *testing.T) {
+	// Input is in reversed (little endian) byte order, as kept for IPFIX field values
+	tests := []struct {
+		input  []byte
+		wanted uint64
+	}{
+		{
+			input:  []byte{0x2a},
+			wanted: 42,
+		},
+		{
+			input:  []byte{0xdc, 0x05},
+			wanted: 1500,
+		},
+		{
+			input:  []byte{0, 0, 0, 0x80},
+			wanted: 2147483648,
+		},
+		{
+			input:  []byte{0, 0xf2, 0x05, 0x2a, 0x01, 0, 0, 0},
+			wanted: 5000000000,
+		},
+	}
+
+	for _, test := range tests {
+		res := Uint64(test.input)
+		if res != test.wanted {
+			t.Errorf("Expected: %d, got: %d", test.wanted, res)
+		}
+	}
+}
+
 func TestUintX(t *testing.T) {
 	tests := []struct {
 		input  []byte
@@ -159,6 +191,33 @@ func TestReverse(t *testing.T) {
 	}
 }
 
+func TestMAC(t *testing.T) {
+	tests := []struct {
+		input  []byte
+		wanted []byte
+	}{
+		{
+			input:  []byte{0x01, 0x00, 0x10, 0x5e, 0x00, 0x02},
+			wanted: []byte{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01},
+		},
+		{
+			input:  []byte{0x01, 0x02, 0x03},
+			wanted: nil,
+		},
+	}
+
+	for _, test := range tests {
+		input := append([]byte{}, test.input...)
+		res := MAC(input)
+		if !sliceEq(res, test.wanted) {
+			t.Errorf("Expected: %d, got: %d", test.wanted, res)
+		}
+		if !sliceEq(input, test.input) {
+			t.Errorf("Expected input %d to be left untouched, got: %d", test.input, input)
+		}
+	}
+}
+
 func sliceEq(a []byte, b []byte) bool {
 	if a == nil && b == nil {
 		return true
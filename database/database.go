@@ -14,6 +14,7 @@ package database
 
 import (
 	"compress/gzip"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
@@ -25,46 +26,56 @@ import (
 	"github.com/golang/glog"
 	"github.com/golang/protobuf/proto"
 	"github.com/google/tflow2/avltree"
+	"github.com/google/tflow2/debug"
 	"github.com/google/tflow2/netflow"
 	"github.com/google/tflow2/nfserver"
+	"github.com/google/tflow2/stats"
 )
 
 // TimeGroup groups all indices to flows of a particular router at a particular
 // time into one object
 type TimeGroup struct {
-	Any       map[int]*avltree.Tree // Workaround: Why a map? Because: cannot assign to flows[fl.Timestamp][rtr].Any
-	SrcAddr   map[string]*avltree.Tree
-	DstAddr   map[string]*avltree.Tree
-	Protocol  map[uint32]*avltree.Tree
-	IntIn     map[uint32]*avltree.Tree
-	IntOut    map[uint32]*avltree.Tree
-	NextHop   map[string]*avltree.Tree
-	SrcAs     map[uint32]*avltree.Tree
-	DstAs     map[uint32]*avltree.Tree
-	NextHopAs map[uint32]*avltree.Tree
-	SrcPfx    map[string]*avltree.Tree
-	DstPfx    map[string]*avltree.Tree
-	SrcPort   map[uint32]*avltree.Tree
-	DstPort   map[uint32]*avltree.Tree
-	Locks     *LockGroup
+	Any        map[int]*avltree.Tree // Workaround: Why a map? Because: cannot assign to flows[fl.Timestamp][rtr].Any
+	SrcAddr    map[string]*avltree.Tree
+	DstAddr    map[string]*avltree.Tree
+	Protocol   map[uint32]*avltree.Tree
+	IntIn      map[uint32]*avltree.Tree
+	IntOut     map[uint32]*avltree.Tree
+	IntInName  map[string]*avltree.Tree
+	IntOutName map[string]*avltree.Tree
+	ConnID     map[string]*avltree.Tree
+	NextHop    map[string]*avltree.Tree
+	BgpNextHop map[string]*avltree.Tree
+	SrcAs      map[uint32]*avltree.Tree
+	DstAs      map[uint32]*avltree.Tree
+	NextHopAs  map[uint32]*avltree.Tree
+	SrcPfx     map[string]*avltree.Tree
+	DstPfx     map[string]*avltree.Tree
+	SrcPort    map[uint32]*avltree.Tree
+	DstPort    map[uint32]*avltree.Tree
+	Locks      *LockGroup
 }
 
 // LockGroup is a group of locks suitable to lock any particular member of TimeGroup
 type LockGroup struct {
-	Any       sync.RWMutex
-	SrcAddr   sync.RWMutex
-	DstAddr   sync.RWMutex
-	Protocol  sync.RWMutex
-	IntIn     sync.RWMutex
-	IntOut    sync.RWMutex
-	NextHop   sync.RWMutex
-	SrcAs     sync.RWMutex
-	DstAs     sync.RWMutex
-	NextHopAs sync.RWMutex
-	SrcPfx    sync.RWMutex
-	DstPfx    sync.RWMutex
-	SrcPort   sync.RWMutex
-	DstPort   sync.RWMutex
+	Any        sync.RWMutex
+	SrcAddr    sync.RWMutex
+	DstAddr    sync.RWMutex
+	Protocol   sync.RWMutex
+	IntIn      sync.RWMutex
+	IntOut     sync.RWMutex
+	IntInName  sync.RWMutex
+	IntOutName sync.RWMutex
+	ConnID     sync.RWMutex
+	NextHop    sync.RWMutex
+	BgpNextHop sync.RWMutex
+	SrcAs      sync.RWMutex
+	DstAs      sync.RWMutex
+	NextHopAs  sync.RWMutex
+	SrcPfx     sync.RWMutex
+	DstPfx     sync.RWMutex
+	SrcPort    sync.RWMutex
+	DstPort    sync.RWMutex
 }
 
 // FlowsByTimeRtr holds all keys (and thus is the only way) to our flows
@@ -80,31 +91,41 @@ type FlowDatabase struct {
 	compLevel   int
 	samplerate  int
 	storage     string
-	debug       int
 	anonymize   bool
 	Input       chan *netflow.Flow
+
+	// maxFlows is the maximum number of flows kept in memory (unlimited if 0).
+	// numFlows, counts (flows per timestamp) and evicted (the newest timestamp
+	// evicted so far) are protected by `lock`.
+	maxFlows int64
+	numFlows int64
+	counts   map[int64]int64
+	evicted  int64
 }
 
-// New creates a new FlowDatabase and returns a pointer to it
-func New(aggregation int64, maxAge int64, numAddWorker int, samplerate int, debug int, compLevel int, storage string, anonymize bool) *FlowDatabase {
+// New creates a new FlowDatabase and returns a pointer to it. Flows are kept for `maxAge`
+// seconds. If `maxFlows` is not 0 at most `maxFlows` flows are kept, evicting the oldest first.
+func New(aggregation int64, maxAge int64, maxFlows int64, numAddWorker int, samplerate int, compLevel int, storage string, anonymize bool) *FlowDatabase {
 	flowDB := &FlowDatabase{
 		maxAge:      maxAge,
+		maxFlows:    maxFlows,
+		counts:      make(map[int64]int64),
 		aggregation: aggregation,
 		compLevel:   compLevel,
 		samplerate:  samplerate,
 		Input:       make(chan *netflow.Flow),
 		lastDump:    time.Now().Unix(),
 		storage:     storage,
-		debug:       debug,
 		flows:       make(FlowsByTimeRtr),
 		anonymize:   anonymize,
 	}
 
+	latency := stats.Latency("database")
 	for i := 0; i < numAddWorker; i++ {
 		go func() {
-			for {
-				fl := <-flowDB.Input
+			for fl := range flowDB.Input {
 				flowDB.Add(fl)
+				latency.Observe(fl.Received)
 			}
 		}()
 
@@ -141,6 +162,16 @@ func (fdb *FlowDatabase) Add(fl *netflow.Flow) {
 	dstPfx := fl.DstPfx.String()
 
 	fdb.lock.Lock()
+	// Late flows of an evicted timestamp would recreate it and overwrite its dump
+	if fl.Timestamp <= fdb.evicted {
+		fdb.lock.Unlock()
+		atomic.AddUint64(&stats.GlobalStats.DBEvictedFlows, 1)
+		if debug.Level() > 1 {
+			glog.Warningf("dropped flow of %d: already evicted", fl.Timestamp)
+		}
+		return
+	}
+
 	// Check if timestamp entry exists already. If not, create it.
 	if _, ok := fdb.flows[fl.Timestamp]; !ok {
 		fdb.flows[fl.Timestamp] = make(map[string]TimeGroup)
@@ -149,29 +180,39 @@ func (fdb *FlowDatabase) Add(fl *netflow.Flow) {
 	// Check if router entry exists already. If not, create it.
 	if _, ok := fdb.flows[fl.Timestamp][rtr]; !ok {
 		fdb.flows[fl.Timestamp][rtr] = TimeGroup{
-			Any:       make(map[int]*avltree.Tree),
-			SrcAddr:   make(map[string]*avltree.Tree),
-			DstAddr:   make(map[string]*avltree.Tree),
-			Protocol:  make(map[uint32]*avltree.Tree),
-			IntIn:     make(map[uint32]*avltree.Tree),
-			IntOut:    make(map[uint32]*avltree.Tree),
-			NextHop:   make(map[string]*avltree.Tree),
-			SrcAs:     make(map[uint32]*avltree.Tree),
-			DstAs:     make(map[uint32]*avltree.Tree),
-			NextHopAs: make(map[uint32]*avltree.Tree),
-			SrcPfx:    make(map[string]*avltree.Tree),
-			DstPfx:    make(map[string]*avltree.Tree),
-			SrcPort:   make(map[uint32]*avltree.Tree),
-			DstPort:   make(map[uint32]*avltree.Tree),
-			Locks:     &LockGroup{},
+			Any:        make(map[int]*avltree.Tree),
+			SrcAddr:    make(map[string]*avltree.Tree),
+			DstAddr:    make(map[string]*avltree.Tree),
+			Protocol:   make(map[uint32]*avltree.Tree),
+			IntIn:      make(map[uint32]*avltree.Tree),
+			IntOut:     make(map[uint32]*avltree.Tree),
+			IntInName:  make(map[string]*avltree.Tree),
+			IntOutName: make(map[string]*avltree.Tree),
+			ConnID:     make(map[string]*avltree.Tree),
+			NextHop:    make(map[string]*avltree.Tree),
+			BgpNextHop: make(map[string]*avltree.Tree),
+			SrcAs:      make(map[uint32]*avltree.Tree),
+			DstAs:      make(map[uint32]*avltree.Tree),
+			NextHopAs:  make(map[uint32]*avltree.Tree),
+			SrcPfx:     make(map[string]*avltree.Tree),
+			DstPfx:     make(map[string]*avltree.Tree),
+			SrcPort:    make(map[uint32]*avltree.Tree),
+			DstPort:    make(map[uint32]*avltree.Tree),
+			Locks:      &LockGroup{},
 		}
 	}
+	fdb.counts[fl.Timestamp]++
+	fdb.numFlows++
+	if fdb.maxFlows > 0 && fdb.numFlows > fdb.maxFlows {
+		fdb.evict()
+	}
+	fdb.updateStats()
 	fdb.lock.Unlock()
 
 	fdb.lock.RLock()
 	defer fdb.lock.RUnlock()
-	if _, ok := fdb.flows[fl.Timestamp]; !ok {
-		glog.Warningf("stopped adding data for %d: already deleted", fl.Timestamp)
+	if _, ok := fdb.flows[fl.Timestamp][rtr]; !ok {
+		glog.Warningf("stopped adding data for %d of %s: already deleted", fl.Timestamp, rtr)
 		return
 	}
 
@@ -220,6 +261,36 @@ func (fdb *FlowDatabase) Add(fl *netflow.Flow) {
 	fdb.flows[fl.Timestamp][rtr].IntOut[fl.IntOut].Insert(fl, fl, ptrIsSmaller)
 	locks.IntOut.Unlock()
 
+	// Interface names are only known for exporters announcing them
+	if fl.IntInName != "" {
+		locks.IntInName.Lock()
+		if fdb.flows[fl.Timestamp][rtr].IntInName[fl.IntInName] == nil {
+			fdb.flows[fl.Timestamp][rtr].IntInName[fl.IntInName] = avltree.New()
+		}
+		fdb.flows[fl.Timestamp][rtr].IntInName[fl.IntInName].Insert(fl, fl, ptrIsSmaller)
+		locks.IntInName.Unlock()
+	}
+
+	if fl.IntOutName != "" {
+		locks.IntOutName.Lock()
+		if fdb.flows[fl.Timestamp][rtr].IntOutName[fl.IntOutName] == nil {
+			fdb.flows[fl.Timestamp][rtr].IntOutName[fl.IntOutName] = avltree.New()
+		}
+		fdb.flows[fl.Timestamp][rtr].IntOutName[fl.IntOutName].Insert(fl, fl, ptrIsSmaller)
+		locks.IntOutName.Unlock()
+	}
+
+	// Connection IDs are only sent by some DPI exporters
+	if len(fl.ConnectionId) > 0 {
+		connID := hex.EncodeToString(fl.ConnectionId)
+		locks.ConnID.Lock()
+		if fdb.flows[fl.Timestamp][rtr].ConnID[connID] == nil {
+			fdb.flows[fl.Timestamp][rtr].ConnID[connID] = avltree.New()
+		}
+		fdb.flows[fl.Timestamp][rtr].ConnID[connID].Insert(fl, fl, ptrIsSmaller)
+		locks.ConnID.Unlock()
+	}
+
 	locks.NextHop.Lock()
 	if fdb.flows[fl.Timestamp][rtr].NextHop[nextHopAddr] == nil {
 		fdb.flows[fl.Timestamp][rtr].NextHop[nextHopAddr] = avltree.New()
@@ -227,6 +298,16 @@ func (fdb *FlowDatabase) Add(fl *netflow.Flow) {
 	fdb.flows[fl.Timestamp][rtr].NextHop[nextHopAddr].Insert(fl, fl, ptrIsSmaller)
 	locks.NextHop.Unlock()
 
+	if len(fl.BgpNextHop) > 0 {
+		bgpNextHopAddr := net.IP(fl.BgpNextHop).String()
+		locks.BgpNextHop.Lock()
+		if fdb.flows[fl.Timestamp][rtr].BgpNextHop[bgpNextHopAddr] == nil {
+			fdb.flows[fl.Timestamp][rtr].BgpNextHop[bgpNextHopAddr] = avltree.New()
+		}
+		fdb.flows[fl.Timestamp][rtr].BgpNextHop[bgpNextHopAddr].Insert(fl, fl, ptrIsSmaller)
+		locks.BgpNextHop.Unlock()
+	}
+
 	locks.SrcAs.Lock()
 	if fdb.flows[fl.Timestamp][rtr].SrcAs[fl.SrcAs] == nil {
 		fdb.flows[fl.Timestamp][rtr].SrcAs[fl.SrcAs] = avltree.New()
@@ -279,9 +360,58 @@ func (fdb *FlowDatabase) CleanUp() {
 	defer fdb.lock.Unlock()
 	for ts := range fdb.flows {
 		if ts < now-fdb.maxAge {
-			delete(fdb.flows, ts)
+			fdb.delete(ts)
 		}
 	}
+	fdb.updateStats()
+}
+
+// evict deletes the oldest flows until at most `maxFlows` are left. Flows that have
+// not been dumped to disk yet are dumped before. Flows arriving later for an evicted
+// timestamp are dropped. The caller must hold `lock`.
+func (fdb *FlowDatabase) evict() {
+	lastDump := atomic.LoadInt64(&fdb.lastDump)
+	for fdb.numFlows > fdb.maxFlows && len(fdb.counts) > 1 {
+		oldest := fdb.oldest()
+		evicted := fdb.counts[oldest]
+		if oldest > fdb.evicted {
+			fdb.evicted = oldest
+		}
+		if oldest >= lastDump {
+			for router, tg := range fdb.flows[oldest] {
+				go fdb.writeToDisk(oldest, router, tg.Any[0])
+			}
+		}
+		fdb.delete(oldest)
+		atomic.AddUint64(&stats.GlobalStats.DBEvictedFlows, uint64(evicted))
+		if debug.Level() > 0 {
+			glog.Warningf("evicted %d flows of %d to stay below %d flows", evicted, oldest, fdb.maxFlows)
+		}
+	}
+}
+
+// delete deletes all flows of timestamp `ts`. The caller must hold `lock`.
+func (fdb *FlowDatabase) delete(ts int64) {
+	delete(fdb.flows, ts)
+	fdb.numFlows -= fdb.counts[ts]
+	delete(fdb.counts, ts)
+}
+
+// oldest returns the oldest timestamp flows are kept for. The caller must hold `lock`.
+func (fdb *FlowDatabase) oldest() int64 {
+	var oldest int64
+	for ts := range fdb.counts {
+		if oldest == 0 || ts < oldest {
+			oldest = ts
+		}
+	}
+	return oldest
+}
+
+// updateStats exports the current occupancy. The caller must hold `lock`.
+func (fdb *FlowDatabase) updateStats() {
+	atomic.StoreInt64(&stats.GlobalStats.DBFlows, fdb.numFlows)
+	atomic.StoreInt64(&stats.GlobalStats.DBOldest, fdb.oldest())
 }
 
 // Dumper dumps all flows in `fdb` to hard drive that haven't been dumped yet
@@ -310,11 +440,20 @@ func (fdb *FlowDatabase) dumpToDisk(ts int64, router string) {
 	tree := fdb.flows[ts][router].Any[0]
 	fdb.lock.RUnlock()
 
+	fdb.writeToDisk(ts, router, tree)
+}
+
+// writeToDisk writes the flows in `tree` of `router` at `ts` to a file. Existing
+// dumps are never overwritten.
+func (fdb *FlowDatabase) writeToDisk(ts int64, router string, tree *avltree.Tree) {
+	if tree == nil {
+		return
+	}
 	flows := &netflow.Flows{}
 
 	tree.Each(dump, fdb.anonymize, flows)
 
-	if fdb.debug > 1 {
+	if debug.Level() > 1 {
 		glog.Warningf("flows contains %d flows", len(flows.Flows))
 	}
 	buffer, err := proto.Marshal(flows)
@@ -326,9 +465,16 @@ func (fdb *FlowDatabase) dumpToDisk(ts int64, router string) {
 	ymd := fmt.Sprintf("%04d-%02d-%02d", time.Unix(ts, 0).Year(), time.Unix(ts, 0).Month(), time.Unix(ts, 0).Day())
 	os.Mkdir(fmt.Sprintf("%s/%s", fdb.storage, ymd), 0700)
 
-	fh, err := os.Create(fmt.Sprintf("%s/%s/nf-%d-%s.tflow2.pb.gzip", fdb.storage, ymd, ts, router))
+	fh, err := os.OpenFile(fmt.Sprintf("%s/%s/nf-%d-%s.tflow2.pb.gzip", fdb.storage, ymd, ts, router), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		if debug.Level() > 0 {
+			glog.Warningf("not overwriting dump of %d for %s", ts, router)
+		}
+		return
+	}
 	if err != nil {
 		glog.Errorf("couldn't create file: %v", err)
+		return
 	}
 	defer fh.Close()
 
@@ -356,6 +502,12 @@ func dump(node *avltree.TreeNode, vals ...interface{}) {
 		// Remove information about particular IP addresses for privacy reason
 		flowcopy.SrcAddr = []byte{0, 0, 0, 0}
 		flowcopy.DstAddr = []byte{0, 0, 0, 0}
+
+		// Labels (e.g. HTTP hosts) and MAC addresses may identify users as well
+		flowcopy.Labels = nil
+		flowcopy.StaMac = nil
+		flowcopy.SrcMac = nil
+		flowcopy.DstMac = nil
 	}
 
 	flows.Flows = append(flows.Flows, &flowcopy)
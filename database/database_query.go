@@ -12,7 +12,9 @@
 package database
 
 import (
+	"bytes"
 	"compress/gzip"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -27,6 +29,7 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/google/tflow2/avltree"
 	"github.com/google/tflow2/convert"
+	"github.com/google/tflow2/debug"
 	"github.com/google/tflow2/netflow"
 	"github.com/google/tflow2/stats"
 )
@@ -40,7 +43,10 @@ type BreakDownMap struct {
 	Protocol   bool
 	IntIn      bool
 	IntOut     bool
+	IntInName  bool
+	IntOutName bool
 	NextHop    bool
+	BgpNextHop bool
 	SrcAsn     bool
 	DstAsn     bool
 	NextHopAsn bool
@@ -91,25 +97,29 @@ type concurrentResSum struct {
 
 // These constants are used in communication with the frontend
 const (
-	OpEqual        = 0
-	OpUnequal      = 1
-	OpSmaller      = 2
-	OpGreater      = 3
-	FieldTimestamp = 0
-	FieldRouter    = 1
-	FieldSrcAddr   = 2
-	FieldDstAddr   = 3
-	FieldProtocol  = 4
-	FieldIntIn     = 5
-	FieldIntOut    = 6
-	FieldNextHop   = 7
-	FieldSrcAs     = 8
-	FieldDstAs     = 9
-	FieldNextHopAs = 10
-	FieldSrcPfx    = 11
-	FieldDstPfx    = 12
-	FieldSrcPort   = 13
-	FieldDstPort   = 14
+	OpEqual         = 0
+	OpUnequal       = 1
+	OpSmaller       = 2
+	OpGreater       = 3
+	FieldTimestamp  = 0
+	FieldRouter     = 1
+	FieldSrcAddr    = 2
+	FieldDstAddr    = 3
+	FieldProtocol   = 4
+	FieldIntIn      = 5
+	FieldIntOut     = 6
+	FieldNextHop    = 7
+	FieldSrcAs      = 8
+	FieldDstAs      = 9
+	FieldNextHopAs  = 10
+	FieldSrcPfx     = 11
+	FieldDstPfx     = 12
+	FieldSrcPort    = 13
+	FieldDstPort    = 14
+	FieldIntInName  = 15
+	FieldIntOutName = 16
+	FieldConnID     = 17
+	FieldBgpNextHop = 18
 )
 
 // translateQuery translates a query from external representation to internal representaion
@@ -173,9 +183,25 @@ func translateQuery(e QueryExt) (Query, error) {
 			}
 			operand = convert.Uint16Byte(uint16(op))
 
+		case FieldIntInName:
+			operand = []byte(c.Operand)
+
+		case FieldIntOutName:
+			operand = []byte(c.Operand)
+
+		case FieldConnID:
+			op, err := hex.DecodeString(c.Operand)
+			if err != nil {
+				return q, err
+			}
+			operand = op
+
 		case FieldNextHop:
 			operand = convert.IPByteSlice(c.Operand)
 
+		case FieldBgpNextHop:
+			operand = convert.IPByteSlice(c.Operand)
+
 		case FieldSrcAs:
 			op, err := strconv.Atoi(c.Operand)
 			if err != nil {
@@ -229,13 +255,13 @@ func (fdb *FlowDatabase) loadFromDisc(ts int64, router string, query Query, ch c
 	filename := fmt.Sprintf("%s/%s/nf-%d-%s.tflow2.pb.gzip", fdb.storage, ymd, ts, router)
 	fh, err := os.Open(filename)
 	if err != nil {
-		if fdb.debug > 0 {
+		if debug.Level() > 0 {
 			glog.Errorf("unable to open file: %v", err)
 		}
 		ch <- nil
 		return
 	}
-	if fdb.debug > 1 {
+	if debug.Level() > 1 {
 		glog.Infof("sucessfully opened file: %s", filename)
 	}
 	defer fh.Close()
@@ -264,7 +290,7 @@ func (fdb *FlowDatabase) loadFromDisc(ts int64, router string, query Query, ch c
 		return
 	}
 
-	if fdb.debug > 1 {
+	if debug.Level() > 1 {
 		glog.Infof("file %s contains %d flows", filename, len(flows.Flows))
 	}
 
@@ -277,7 +303,7 @@ func (fdb *FlowDatabase) loadFromDisc(ts int64, router string, query Query, ch c
 
 	// Breakdown
 	resTime := make(map[string]uint64)
-	res.Each(breakdown, query.Breakdown, resSum, resTime)
+	res.Each(breakdown, query.Breakdown, resSum, resTime, uint64(fdb.samplerate))
 
 	ch <- resTime
 }
@@ -314,11 +340,31 @@ func validateFlow(fl *netflow.Flow, query Query) bool {
 				return false
 			}
 			continue
+		case FieldIntInName:
+			if fl.IntInName != string(c.Operand) {
+				return false
+			}
+			continue
+		case FieldIntOutName:
+			if fl.IntOutName != string(c.Operand) {
+				return false
+			}
+			continue
+		case FieldConnID:
+			if !bytes.Equal(fl.ConnectionId, c.Operand) {
+				return false
+			}
+			continue
 		case FieldNextHop:
 			if net.IP(fl.NextHop).String() != net.IP(c.Operand).String() {
 				return false
 			}
 			continue
+		case FieldBgpNextHop:
+			if net.IP(fl.BgpNextHop).String() != net.IP(c.Operand).String() {
+				return false
+			}
+			continue
 		case FieldSrcAs:
 			if fl.SrcAs != convert.Uint32b(c.Operand) {
 				return false
@@ -427,7 +473,7 @@ func (fdb *FlowDatabase) RunQuery(query string) ([][]string, error) {
 		// candidates keeps a list of all trees that fulfill the queries criteria
 		candidates := make([]*avltree.Tree, 0)
 		for _, c := range q.Cond {
-			if fdb.debug > 1 {
+			if debug.Level() > 1 {
 				glog.Infof("Adding tree to cancidates list: Field: %d, Value: %d", c.Field, c.Operand)
 			}
 			switch c.Field {
@@ -445,8 +491,16 @@ func (fdb *FlowDatabase) RunQuery(query string) ([][]string, error) {
 				candidates = append(candidates, fdb.flows[ts][rtr].IntIn[uint32(convert.Uint16b(c.Operand))])
 			case FieldIntOut:
 				candidates = append(candidates, fdb.flows[ts][rtr].IntOut[uint32(convert.Uint16b(c.Operand))])
+			case FieldIntInName:
+				candidates = append(candidates, fdb.flows[ts][rtr].IntInName[string(c.Operand)])
+			case FieldIntOutName:
+				candidates = append(candidates, fdb.flows[ts][rtr].IntOutName[string(c.Operand)])
+			case FieldConnID:
+				candidates = append(candidates, fdb.flows[ts][rtr].ConnID[hex.EncodeToString(c.Operand)])
 			case FieldNextHop:
 				candidates = append(candidates, fdb.flows[ts][rtr].NextHop[net.IP(c.Operand).String()])
+			case FieldBgpNextHop:
+				candidates = append(candidates, fdb.flows[ts][rtr].BgpNextHop[net.IP(c.Operand).String()])
 			case FieldSrcAs:
 				candidates = append(candidates, fdb.flows[ts][rtr].SrcAs[convert.Uint32b(c.Operand)])
 			case FieldDstAs:
@@ -470,7 +524,7 @@ func (fdb *FlowDatabase) RunQuery(query string) ([][]string, error) {
 		fdb.lock.RUnlock()
 
 		go func(candidates []*avltree.Tree, ch chan map[string]uint64, ts int64) {
-			if fdb.debug > 1 {
+			if debug.Level() > 1 {
 				glog.Infof("candidate trees: %d (%d)", len(candidates), ts)
 			}
 
@@ -483,7 +537,7 @@ func (fdb *FlowDatabase) RunQuery(query string) ([][]string, error) {
 
 			// Breakdown
 			resTime := make(map[string]uint64)
-			res.Each(breakdown, q.Breakdown, resSum, resTime)
+			res.Each(breakdown, q.Breakdown, resSum, resTime, uint64(fdb.samplerate))
 			ch <- resTime
 		}(candidates, resChannels[ts], ts)
 	}
@@ -542,7 +596,7 @@ func (fdb *FlowDatabase) RunQuery(query string) ([][]string, error) {
 			if _, ok := buckets[k.(string)]; !ok {
 				line = append(line, "0")
 			} else {
-				line = append(line, fmt.Sprintf("%d", buckets[k.(string)]/uint64(fdb.aggregation)*8*uint64(fdb.samplerate)))
+				line = append(line, fmt.Sprintf("%d", buckets[k.(string)]/uint64(fdb.aggregation)*8))
 			}
 		}
 
@@ -563,9 +617,10 @@ func (fdb *FlowDatabase) RunQuery(query string) ([][]string, error) {
 }
 
 // breakdown build all possible relevant keys of flows for flows in tree `node`
-// and builds sums for each key in order to allow us to find top combinations
+// and builds sums for each key in order to allow us to find top combinations.
+// Sizes are scaled by the sample rate unless the flow is unscalable or already scaled.
 func breakdown(node *avltree.TreeNode, vals ...interface{}) {
-	if len(vals) != 3 {
+	if len(vals) != 4 {
 		glog.Errorf("lacking arguments")
 		return
 	}
@@ -573,15 +628,24 @@ func breakdown(node *avltree.TreeNode, vals ...interface{}) {
 	bd := vals[0].(BreakDownMap)
 	sums := vals[1].(*concurrentResSum)
 	buckets := vals[2].(map[string]uint64)
+	samplerate := vals[3].(uint64)
 	fl := node.Value.(*netflow.Flow)
 
+	size := fl.Size
+	if !fl.Unscalable && !fl.Scaled {
+		size *= samplerate
+	}
+
 	// Build format string to build key
 	srcAddr := "_"
 	dstAddr := "_"
 	protocol := "_"
 	intIn := "_"
 	intOut := "_"
+	intInName := "_"
+	intOutName := "_"
 	nextHop := "_"
+	bgpNextHop := "_"
 	srcAs := "_"
 	dstAs := "_"
 	nextHopAs := "_"
@@ -605,9 +669,18 @@ func breakdown(node *avltree.TreeNode, vals ...interface{}) {
 	if bd.IntOut {
 		intOut = fmt.Sprintf("IntOut:%d", fl.IntOut)
 	}
+	if bd.IntInName {
+		intInName = fmt.Sprintf("IntInName:%s", fl.IntInName)
+	}
+	if bd.IntOutName {
+		intOutName = fmt.Sprintf("IntOutName:%s", fl.IntOutName)
+	}
 	if bd.NextHop {
 		nextHop = fmt.Sprintf("NH:%s", net.IP(fl.NextHop).String())
 	}
+	if bd.BgpNextHop {
+		bgpNextHop = fmt.Sprintf("BGP_NH:%s", net.IP(fl.BgpNextHop).String())
+	}
 	if bd.SrcAsn {
 		srcAs = fmt.Sprintf("SrcAS:%d", fl.SrcAs)
 	}
@@ -639,15 +712,22 @@ func breakdown(node *avltree.TreeNode, vals ...interface{}) {
 			dstPfx = fmt.Sprintf("DstNet:0.0.0.0/0")
 		}
 	}
+	// Protocols without ports are grouped apart from port 0
 	if bd.SrcPort {
 		srcPort = fmt.Sprintf("SrcPort:%d", fl.SrcPort)
+		if !fl.HasPorts() {
+			srcPort = "SrcPort:none"
+		}
 	}
 	if bd.DstPort {
 		dstPort = fmt.Sprintf("DstPort:%d", fl.DstPort)
+		if !fl.HasPorts() {
+			dstPort = "DstPort:none"
+		}
 	}
 
 	// Build key
-	key := fmt.Sprintf("%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s", srcAddr, dstAddr, protocol, intIn, intOut, nextHop, srcAs, dstAs, nextHopAs, srcPfx, dstPfx, srcPort, dstPort)
+	key := fmt.Sprintf("%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s,%s", srcAddr, dstAddr, protocol, intIn, intOut, intInName, intOutName, nextHop, bgpNextHop, srcAs, dstAs, nextHopAs, srcPfx, dstPfx, srcPort, dstPort)
 
 	// Remove underscores from key
 	key = strings.Replace(key, ",_,", ",", -1)
@@ -668,17 +748,17 @@ func breakdown(node *avltree.TreeNode, vals ...interface{}) {
 
 	// Build sum for key
 	if _, ok := buckets[key]; !ok {
-		buckets[key] = fl.Size
+		buckets[key] = size
 	} else {
-		buckets[key] += fl.Size
+		buckets[key] += size
 	}
 
 	// Build overall sum
 	sums.Lock.Lock()
 	if _, ok := sums.Values[key]; !ok {
-		sums.Values[key] = fl.Size
+		sums.Values[key] = size
 	} else {
-		sums.Values[key] += fl.Size
+		sums.Values[key] += size
 	}
 	sums.Lock.Unlock()
 }
@@ -0,0 +1,146 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/tflow2/avltree"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+// newTestDatabase creates a database keeping at most `maxFlows` flows without starting its workers
+func newTestDatabase(t *testing.T, maxFlows int64) *FlowDatabase {
+	return &FlowDatabase{
+		maxFlows:    maxFlows,
+		counts:      make(map[int64]int64),
+		aggregation: 60,
+		storage:     t.TempDir(),
+		flows:       make(FlowsByTimeRtr),
+		// Keep evicted flows from being dumped
+		lastDump: time.Now().Unix(),
+	}
+}
+
+// testFlow returns a flow of router 192.0.2.1 at `ts`
+func testFlow(ts int64) *netflow.Flow {
+	return &netflow.Flow{
+		Router:    []byte{192, 0, 2, 1},
+		Timestamp: ts,
+		SrcAddr:   []byte{10, 0, 0, 1},
+		DstAddr:   []byte{10, 0, 0, 2},
+		NextHop:   []byte{192, 0, 2, 254},
+		SrcPfx:    &netflow.Pfx{IP: []byte{10, 0, 0, 0}, Mask: []byte{255, 0, 0, 0}},
+		DstPfx:    &netflow.Pfx{IP: []byte{10, 0, 0, 0}, Mask: []byte{255, 0, 0, 0}},
+		Packets:   1,
+		Size:      1500,
+	}
+}
+
+func TestEvict(t *testing.T) {
+	fdb := newTestDatabase(t, 3)
+	evicted := atomic.LoadUint64(&stats.GlobalStats.DBEvictedFlows)
+
+	// The oldest timestamp is evicted, regardless of the order flows arrive in
+	for _, ts := range []int64{300, 100, 100, 200} {
+		fdb.Add(testFlow(ts))
+	}
+	if _, ok := fdb.flows[100]; ok {
+		t.Errorf("Expected flows of 100 to be evicted")
+	}
+	if _, ok := fdb.flows[200]; !ok {
+		t.Errorf("Expected flows of 200 to be kept")
+	}
+	if got := atomic.LoadUint64(&stats.GlobalStats.DBEvictedFlows) - evicted; got != 2 {
+		t.Errorf("Expected 2 flows evicted, got %d", got)
+	}
+	if n, oldest := atomic.LoadInt64(&stats.GlobalStats.DBFlows), atomic.LoadInt64(&stats.GlobalStats.DBOldest); n != 2 || oldest != 200 {
+		t.Errorf("Expected 2 flows in memory, the oldest of 200, got %d of %d", n, oldest)
+	}
+
+	// The newest timestamp is kept even if it exceeds the limit on its own
+	for i := 0; i < 4; i++ {
+		fdb.Add(testFlow(400))
+	}
+	if fdb.numFlows != 4 || len(fdb.flows) != 1 {
+		t.Errorf("Expected 4 flows of a single timestamp, got %d of %d", fdb.numFlows, len(fdb.flows))
+	}
+	if oldest := atomic.LoadInt64(&stats.GlobalStats.DBOldest); oldest != 400 {
+		t.Errorf("Expected the oldest flow of 400, got %d", oldest)
+	}
+}
+
+func TestEvictLateFlows(t *testing.T) {
+	fdb := newTestDatabase(t, 1)
+	fdb.Add(testFlow(100))
+	fdb.Add(testFlow(200))
+	evicted := atomic.LoadUint64(&stats.GlobalStats.DBEvictedFlows)
+
+	// Flows of evicted timestamps are dropped rather than recreating them
+	fdb.Add(testFlow(100))
+	fdb.Add(testFlow(50))
+	if _, ok := fdb.flows[100]; ok {
+		t.Errorf("Expected late flow of 100 to be dropped")
+	}
+	if _, ok := fdb.flows[50]; ok {
+		t.Errorf("Expected late flow of 50 to be dropped")
+	}
+	if fdb.numFlows != 1 || fdb.counts[200] != 1 {
+		t.Errorf("Expected only the flow of 200 to be kept, got %d flows", fdb.numFlows)
+	}
+	if got := atomic.LoadUint64(&stats.GlobalStats.DBEvictedFlows) - evicted; got != 2 {
+		t.Errorf("Expected 2 late flows counted as evicted, got %d", got)
+	}
+}
+
+func TestWriteToDiskKeepsDump(t *testing.T) {
+	fdb := newTestDatabase(t, 0)
+	ts := int64(1500000000)
+	for _, packets := range []uint32{1, 2} {
+		tree := avltree.New()
+		fl := testFlow(ts)
+		fl.Packets = packets
+		tree.Insert(fl, fl, ptrIsSmaller)
+		fdb.writeToDisk(ts, "192.0.2.1", tree)
+	}
+
+	tm := time.Unix(ts, 0)
+	file := fmt.Sprintf("%s/%04d-%02d-%02d/nf-%d-192.0.2.1.tflow2.pb.gzip", fdb.storage, tm.Year(), tm.Month(), tm.Day(), ts)
+	fh, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("Expected dump %s: %v", file, err)
+	}
+	defer fh.Close()
+	gz, err := gzip.NewReader(fh)
+	if err != nil {
+		t.Fatalf("Unable to decompress dump: %v", err)
+	}
+	buffer, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Unable to read dump: %v", err)
+	}
+	flows := &netflow.Flows{}
+	if err := proto.Unmarshal(buffer, flows); err != nil {
+		t.Fatalf("Unable to unmarshal dump: %v", err)
+	}
+	if len(flows.Flows) != 1 || flows.Flows[0].Packets != 1 {
+		t.Errorf("Expected the first dump to be kept, got %v", flows.Flows)
+	}
+}
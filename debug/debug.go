@@ -0,0 +1,70 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package debug keeps the debug level of tflow2. It is shared by all components,
+// so changing it at runtime takes effect immediately throughout the pipeline.
+// Single components can be raised above it via their own Local level.
+package debug
+
+import "sync/atomic"
+
+// MaxLevel is the highest debug level, dumping all packets and flows
+const MaxLevel = 3
+
+// level is the current debug level
+var level int32
+
+// SetLevel sets the debug level to `l`, capped to 0 through `MaxLevel`. It
+// returns the level set.
+func SetLevel(l int) int {
+	l = capLevel(l)
+	atomic.StoreInt32(&level, int32(l))
+	return l
+}
+
+// Level returns the current debug level
+func Level() int {
+	return int(atomic.LoadInt32(&level))
+}
+
+// Local is the debug level of a single component. The shared level applies
+// where it is higher, so the zero value follows the shared level.
+type Local struct {
+	level int32
+}
+
+// Set sets the level of the component to `l`, capped to 0 through `MaxLevel`.
+// It returns the level set.
+func (d *Local) Set(l int) int {
+	l = capLevel(l)
+	atomic.StoreInt32(&d.level, int32(l))
+	return l
+}
+
+// Level returns the debug level of the component, the higher of its own and
+// the shared level
+func (d *Local) Level() int {
+	if l := int(atomic.LoadInt32(&d.level)); l > Level() {
+		return l
+	}
+	return Level()
+}
+
+// capLevel caps `l` to 0 through `MaxLevel`
+func capLevel(l int) int {
+	if l < 0 {
+		return 0
+	}
+	if l > MaxLevel {
+		return MaxLevel
+	}
+	return l
+}
@@ -0,0 +1,50 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debug
+
+import "testing"
+
+func TestSetLevel(t *testing.T) {
+	defer SetLevel(0)
+
+	tests := []struct {
+		level    int
+		expected int
+	}{
+		{level: 2, expected: 2},
+		{level: -1, expected: 0},
+		{level: 100, expected: MaxLevel},
+	}
+	for _, test := range tests {
+		if l := SetLevel(test.level); l != test.expected || Level() != test.expected {
+			t.Errorf("%d: Expected level %d, got %d (%d)", test.level, test.expected, l, Level())
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	defer SetLevel(0)
+
+	var d Local
+	if d.Level() != 0 {
+		t.Errorf("Expected level 0, got %d", d.Level())
+	}
+	if l := d.Set(100); l != MaxLevel || d.Level() != MaxLevel || Level() != 0 {
+		t.Errorf("Expected the component raised to %d only, got %d (%d, shared %d)", MaxLevel, l, d.Level(), Level())
+	}
+
+	d.Set(1)
+	SetLevel(2)
+	if d.Level() != 2 {
+		t.Errorf("Expected the higher shared level 2, got %d", d.Level())
+	}
+}
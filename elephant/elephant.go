@@ -0,0 +1,130 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package elephant reports elephant flows, i.e. single flows whose byte or
+// packet count exceeds a threshold within one flow record
+package elephant
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+// Event is an elephant flow that was seen
+type Event struct {
+	Time     time.Time `json:"time"`
+	Router   string    `json:"router"`
+	Protocol uint32    `json:"protocol"`
+	SrcAddr  string    `json:"src_addr"`
+	SrcPort  uint32    `json:"src_port"`
+	DstAddr  string    `json:"dst_addr"`
+	DstPort  uint32    `json:"dst_port"`
+	Bytes    uint64    `json:"bytes"`
+	Packets  uint32    `json:"packets"`
+}
+
+// String returns the flow tuple and counts of the event
+func (e Event) String() string {
+	return fmt.Sprintf("router %s protocol %d %s:%d -> %s:%d, %d bytes, %d packets",
+		e.Router, e.Protocol, e.SrcAddr, e.SrcPort, e.DstAddr, e.DstPort, e.Bytes, e.Packets)
+}
+
+// Detector checks flows against byte and packet thresholds and keeps the last
+// events. It is safe for concurrent use.
+type Detector struct {
+	bytes   uint64
+	packets uint32
+
+	events []Event
+	next   int
+	size   int
+	lock   sync.Mutex
+}
+
+// New creates a new `Detector` reporting flows of more than `bytes` bytes or
+// `packets` packets. A threshold of 0 disables the respective check. The last
+// `size` events are kept.
+func New(bytes uint64, packets uint32, size int) *Detector {
+	return &Detector{
+		bytes:   bytes,
+		packets: packets,
+		events:  make([]Event, 0, size),
+		size:    size,
+	}
+}
+
+// Check reports `fl` if it exceeds a threshold and returns true if it did.
+// Counts must already be scaled by the sampling rate, if known.
+func (d *Detector) Check(fl *netflow.Flow) bool {
+	if (d.bytes == 0 || fl.Size <= d.bytes) && (d.packets == 0 || fl.Packets <= d.packets) {
+		return false
+	}
+
+	e := Event{
+		Time:     time.Now(),
+		Router:   net.IP(fl.Router).String(),
+		Protocol: fl.Protocol,
+		SrcAddr:  net.IP(fl.SrcAddr).String(),
+		SrcPort:  fl.SrcPort,
+		DstAddr:  net.IP(fl.DstAddr).String(),
+		DstPort:  fl.DstPort,
+		Bytes:    fl.Size,
+		Packets:  fl.Packets,
+	}
+	atomic.AddUint64(&stats.GlobalStats.ElephantFlows, 1)
+	glog.Warningf("Elephant flow: %s", e)
+	d.record(e)
+	return true
+}
+
+// record keeps `e`, replacing the oldest event if `size` events are kept already
+func (d *Detector) record(e Event) {
+	if d.size <= 0 {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.events) < d.size {
+		d.events = append(d.events, e)
+		return
+	}
+	d.events[d.next] = e
+	d.next = (d.next + 1) % d.size
+}
+
+// Events returns the kept events, oldest first
+func (d *Detector) Events() []Event {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	events := make([]Event, 0, len(d.events))
+	events = append(events, d.events[d.next:]...)
+	events = append(events, d.events[:d.next]...)
+	return events
+}
+
+// ServeHTTP sends the kept events as JSON
+func (d *Detector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d.Events()); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to marshal events: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package elephant
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/tflow2/netflow"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		bytes   uint64
+		packets uint32
+		fl      *netflow.Flow
+		want    bool
+	}{
+		{
+			name:  "Below byte threshold",
+			bytes: 1000000,
+			fl:    &netflow.Flow{Size: 1000000, Packets: 1000},
+			want:  false,
+		},
+		{
+			name:  "Above byte threshold",
+			bytes: 1000000,
+			fl:    &netflow.Flow{Size: 1000001, Packets: 1000},
+			want:  true,
+		},
+		{
+			name:    "Above packet threshold",
+			bytes:   1000000,
+			packets: 500,
+			fl:      &netflow.Flow{Size: 1000, Packets: 501},
+			want:    true,
+		},
+		{
+			name: "Disabled",
+			fl:   &netflow.Flow{Size: 1 << 40, Packets: 1 << 30},
+			want: false,
+		},
+	}
+
+	for _, test := range tests {
+		d := New(test.bytes, test.packets, 10)
+		if got := d.Check(test.fl); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	d := New(0, 1, 2)
+	for port := uint32(1); port <= 3; port++ {
+		d.Check(&netflow.Flow{
+			Router:   net.IP{192, 0, 2, 1},
+			Protocol: 6,
+			SrcAddr:  net.IP{10, 0, 0, 1},
+			DstAddr:  net.IP{10, 0, 0, 2},
+			SrcPort:  port,
+			DstPort:  443,
+			Packets:  2,
+		})
+	}
+
+	events := d.Events()
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if events[0].SrcPort != 2 || events[1].SrcPort != 3 {
+		t.Errorf("Expected the last events oldest first, got source ports %d and %d", events[0].SrcPort, events[1].SrcPort)
+	}
+	if events[1].SrcAddr != "10.0.0.1" || events[1].DstAddr != "10.0.0.2" || events[1].Router != "192.0.2.1" {
+		t.Errorf("Unexpected tuple %s", events[1])
+	}
+}
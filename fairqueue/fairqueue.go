@@ -0,0 +1,146 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fairqueue provides per exporter packet queues that are served using
+// deficit round robin. This way an exporter sending many or huge packets can
+// not starve other exporters of decode workers.
+package fairqueue
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/tflow2/stats"
+)
+
+// quantum is the number of bytes an exporter is allowed to have decoded per round
+const quantum = 9000
+
+// Packet is a packet waiting to be decoded
+type Packet struct {
+	Remote net.IP
+	Data   []byte
+}
+
+// queue is the queue of a single exporter
+type queue struct {
+	packets []Packet
+	deficit int
+	rs      *stats.RouterStats
+}
+
+// Scheduler keeps a queue per exporter and hands out packets to decode workers
+type Scheduler struct {
+	queueSize int
+	queues    map[string]*queue
+
+	// active holds the non empty queues in round robin order, next is the index of the queue served next
+	active []*queue
+	next   int
+
+	// closed is set once the scheduler is closed
+	closed bool
+
+	lock sync.Mutex
+	cond *sync.Cond
+}
+
+// New creates a new `Scheduler` holding up to `queueSize` packets per exporter
+func New(queueSize int) *Scheduler {
+	s := &Scheduler{
+		queueSize: queueSize,
+		queues:    make(map[string]*queue),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// Push queues packet `p`. It returns false if the exporters queue is full and the packet was dropped.
+func (s *Scheduler) Push(p Packet) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	key := p.Remote.String()
+	q, ok := s.queues[key]
+	if !ok {
+		q = &queue{rs: stats.Router(key)}
+		s.queues[key] = q
+	}
+
+	if len(q.packets) >= s.queueSize {
+		atomic.AddUint64(&q.rs.QueueDrops, 1)
+		return false
+	}
+
+	if len(q.packets) == 0 {
+		s.active = append(s.active, q)
+	}
+	q.packets = append(q.packets, p)
+	atomic.StoreUint64(&q.rs.QueueDepth, uint64(len(q.packets)))
+	s.cond.Signal()
+	return true
+}
+
+// Pop returns the next packet to decode. It blocks until a packet is available.
+// Once the scheduler is closed and all queued packets were returned it returns false.
+func (s *Scheduler) Pop() (Packet, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.active) == 0 {
+		if s.closed {
+			return Packet{}, false
+		}
+		s.cond.Wait()
+	}
+
+	for {
+		if s.next >= len(s.active) {
+			s.next = 0
+		}
+		q := s.active[s.next]
+
+		size := len(q.packets[0].Data)
+		if q.deficit < size {
+			q.deficit += quantum
+			s.next++
+			continue
+		}
+
+		p := q.packets[0]
+		q.packets[0] = Packet{}
+		q.packets = q.packets[1:]
+		q.deficit -= size
+		atomic.StoreUint64(&q.rs.QueueDepth, uint64(len(q.packets)))
+
+		if len(q.packets) == 0 {
+			// Idle exporters must not save up credit
+			q.deficit = 0
+			q.packets = nil
+			s.active = append(s.active[:s.next], s.active[s.next+1:]...)
+		}
+		return p, true
+	}
+}
+
+// Close stops accepting packets. Packets queued already are still returned by Pop.
+func (s *Scheduler) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	s.cond.Broadcast()
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fairqueue
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFairness(t *testing.T) {
+	noisy := net.IP{192, 0, 2, 1}
+	quiet := net.IP{192, 0, 2, 2}
+
+	s := New(100)
+	for i := 0; i < 10; i++ {
+		s.Push(Packet{Remote: noisy, Data: make([]byte, 8000)})
+	}
+	s.Push(Packet{Remote: quiet, Data: make([]byte, 100)})
+
+	// The quiet exporter has to be served within the first round
+	for i := 0; i < 2; i++ {
+		if p, _ := s.Pop(); p.Remote.Equal(quiet) {
+			return
+		}
+	}
+	t.Errorf("Packet of quiet exporter was not served within first round")
+}
+
+func TestQueueFull(t *testing.T) {
+	s := New(2)
+	remote := net.IP{192, 0, 2, 3}
+	for i := 0; i < 2; i++ {
+		if !s.Push(Packet{Remote: remote, Data: []byte{0}}) {
+			t.Errorf("Expected packet %d to be queued", i)
+		}
+	}
+	if s.Push(Packet{Remote: remote, Data: []byte{0}}) {
+		t.Errorf("Expected packet to be dropped on full queue")
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := New(2)
+	remote := net.IP{192, 0, 2, 4}
+	s.Push(Packet{Remote: remote, Data: []byte{0}})
+	s.Close()
+
+	if s.Push(Packet{Remote: remote, Data: []byte{1}}) {
+		t.Errorf("Expected packet to be dropped after close")
+	}
+	if p, ok := s.Pop(); !ok || p.Data[0] != 0 {
+		t.Errorf("Expected packet queued before close to be returned")
+	}
+	if _, ok := s.Pop(); ok {
+		t.Errorf("Expected no packet once closed and drained")
+	}
+}
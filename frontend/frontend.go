@@ -27,6 +27,7 @@ import (
 	"strings"
 
 	"github.com/google/tflow2/database"
+	"github.com/google/tflow2/recorder"
 	"github.com/google/tflow2/stats"
 	"github.com/golang/glog"
 )
@@ -36,12 +37,16 @@ type Frontend struct {
 	protocols map[string]string
 	indexHTML string
 	flowDB    *database.FlowDatabase
+
+	// recorder serves the last raw packets of exporters. It is nil if packets are not recorded.
+	recorder *recorder.Recorder
 }
 
-// New creates a new `Frontend`
-func New(addr string, protoNumsFilename string, fdb *database.FlowDatabase) *Frontend {
+// New creates a new `Frontend`. The packets kept by `rec` are served via /packets unless `rec` is nil.
+func New(addr string, protoNumsFilename string, fdb *database.FlowDatabase, rec *recorder.Recorder) *Frontend {
 	fe := &Frontend{
-		flowDB: fdb,
+		flowDB:   fdb,
+		recorder: rec,
 	}
 	fe.populateProtocols(protoNumsFilename)
 	fe.populateIndexHTML()
@@ -97,7 +102,16 @@ func (fe *Frontend) httpHandler(w http.ResponseWriter, r *http.Request) {
 	case "/query":
 		fe.queryHandler(w, r)
 	case "/varz":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
 		stats.Varz(w)
+	case "/metrics":
+		stats.PrometheusHandler().ServeHTTP(w, r)
+	case "/packets":
+		if fe.recorder == nil {
+			http.Error(w, "Packet recording is disabled", http.StatusNotFound)
+			return
+		}
+		fe.recorder.ServeHTTP(w, r)
 	case "/protocols":
 		fe.getProtocols(w, r)
 	case "/routers":
@@ -0,0 +1,273 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifserver
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/stats"
+)
+
+const (
+	// IngestPath is the path IPFIX messages are POSTed to
+	IngestPath = "/ipfix"
+
+	// ExporterHeader is the HTTP header carrying the exporters address. It is
+	// only honoured for requests of trusted proxies, otherwise the address the
+	// request was received from is used.
+	ExporterHeader = "X-Exporter-Address"
+
+	// maxIngestBody is the maximum size of a request body, before and after decompression
+	maxIngestBody = 16 << 20
+
+	// messageHeaderLen is the length of an IPFIX message header
+	messageHeaderLen = 16
+)
+
+// ListenHTTP serves the HTTP ingest handler on `addr`. TLS (and thus HTTP/2) is
+// used if `certFile` and `keyFile` are given. Requests of `trustedProxies` may
+// name the exporter via `ExporterHeader`. It returns an error if the address
+// can't be listened on or the certificate can't be loaded.
+func (ifs *IPFIXServer) ListenHTTP(addr string, certFile string, keyFile string, trustedProxies []*net.IPNet) error {
+	mux := http.NewServeMux()
+	mux.Handle(IngestPath, ifs)
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	tlsEnabled := certFile != "" && keyFile != ""
+	if tlsEnabled {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load certificate: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Listen: %v", err)
+	}
+	ifs.trustedProxies = trustedProxies
+	ifs.httpServer = srv
+
+	go func() {
+		var err error
+		if tlsEnabled {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != http.ErrServerClosed {
+			glog.Errorf("IPFIX HTTP ingest stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// ParseTrustedProxies parses a comma separated list of prefixes of proxies
+// trusted to name the exporter via `ExporterHeader`, e.g. "192.0.2.0/24".
+// Single addresses are taken as host prefixes.
+func ParseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	if spec == "" {
+		return proxies, nil
+	}
+
+	for _, elem := range strings.Split(spec, ",") {
+		if !strings.Contains(elem, "/") {
+			ip := net.ParseIP(elem)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", elem)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, pfx, err := net.ParseCIDR(elem)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q: %v", elem, err)
+		}
+		proxies = append(proxies, pfx)
+	}
+	return proxies, nil
+}
+
+// ServeHTTP receives POST requests carrying one or more concatenated IPFIX
+// messages. Bodies are framed before any message is processed, so a malformed
+// body is rejected as a whole. Messages failing to decode don't keep the others
+// from being ingested, the response reports how many were.
+func (ifs *IPFIXServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	atomic.AddUint64(&stats.GlobalStats.IPFIXHTTPRequests, 1)
+
+	remote, err := ifs.exporterAddress(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, status, err := readBody(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	msgs, err := splitMessages(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	failed := 0
+	for _, msg := range msgs {
+		atomic.AddUint64(&stats.GlobalStats.IPFIXHTTPMessages, 1)
+		if _, err := ifs.processHTTPMessage(remote, msg); err != nil {
+			failed++
+		}
+	}
+
+	if failed == len(msgs) && failed > 0 {
+		http.Error(w, fmt.Sprintf("Unable to decode %d messages", failed), http.StatusBadRequest)
+		return
+	}
+	if failed > 0 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Ingested %d of %d messages, unable to decode %d\n", len(msgs)-failed, len(msgs), failed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// splitMessages splits `body` into the IPFIX messages it carries, framed by the
+// length in their header. Each message gets its own copy, as decoding reverses
+// the buffer in place.
+func splitMessages(body []byte) ([][]byte, error) {
+	var msgs [][]byte
+	for len(body) > 0 {
+		if len(body) < messageHeaderLen {
+			return nil, fmt.Errorf("Truncated message header (%d bytes)", len(body))
+		}
+
+		length := int(binary.BigEndian.Uint16(body[2:4]))
+		if length < messageHeaderLen || length > len(body) {
+			return nil, fmt.Errorf("Invalid message length %d with %d bytes left", length, len(body))
+		}
+
+		msg := make([]byte, length)
+		copy(msg, body[:length])
+		msgs = append(msgs, msg)
+		body = body[length:]
+	}
+	return msgs, nil
+}
+
+// errPanic is returned for messages the decoder panicked on
+var errPanic = errors.New("panic processing message")
+
+// processHTTPMessage passes IPFIX message `msg` of `remote` over to
+// processMessage(), counting it and recovering from panics like messages
+// received via UDP or TCP
+func (ifs *IPFIXServer) processHTTPMessage(remote net.IP, msg []byte) (flows int, err error) {
+	// Only returning sets err, so it is left to errPanic if recovered from
+	err = errPanic
+	defer recoverPacket(remote, msg)
+
+	atomic.AddUint64(&stats.GlobalStats.IPFIXpackets, 1)
+	atomic.AddUint64(&stats.GlobalStats.IPFIXbytes, uint64(len(msg)))
+	return ifs.processMessage(remote, msg, 0)
+}
+
+// exporterAddress determines the address used to identify the exporter of
+// request `r`. `ExporterHeader` is ignored unless `r` was received from a
+// trusted proxy, so clients can't claim another exporters identity.
+func (ifs *IPFIXServer) exporterAddress(r *http.Request) (net.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse remote address %q: %v", r.RemoteAddr, err)
+	}
+	addr := host
+	if hdr := r.Header.Get(ExporterHeader); hdr != "" && ifs.trustedProxy(net.ParseIP(host)) {
+		addr = hdr
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid exporter address %q", addr)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+// trustedProxy returns true if `ip` is in one of the trusted proxy prefixes
+func (ifs *IPFIXServer) trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, pfx := range ifs.trustedProxies {
+		if pfx.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody reads the body of `r`, decompressing it according to its
+// Content-Encoding. Bodies decompressing to more than `maxIngestBody` bytes are
+// rejected, so a small compressed body can't exhaust memory. On error the HTTP
+// status to answer with is returned.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxIngestBody)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("Unable to decompress body: %v", err)
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("Unsupported content encoding %q", r.Header.Get("Content-Encoding"))
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxIngestBody+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Unable to read body: %v", err)
+	}
+	if len(b) > maxIngestBody {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("Body exceeds %d bytes", maxIngestBody)
+	}
+	return b, 0, nil
+}
@@ -13,21 +13,45 @@
 package ifserver
 
 import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/tflow2/convert"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/elephant"
+	"github.com/google/tflow2/fairqueue"
 	"github.com/google/tflow2/ipfix"
 	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/packet"
+	"github.com/google/tflow2/ratelimit"
+	"github.com/google/tflow2/recorder"
 	"github.com/google/tflow2/stats"
+	"github.com/google/tflow2/validate"
 )
 
+// tcpFlagsMask covers the TCP flags of a 16 bit tcpControlBits value
+const tcpFlagsMask = 0x0fff
+
+// netflowV9Version is the version number in the header of NetFlow v9 packets
+const netflowV9Version = 9
+
+// DefaultPacketSize is the size of the largest UDP message read if not configured
+const DefaultPacketSize = 8960
+
 // fieldMap describes what information is at what index in the slice
-// that we get from decoding a netflow packet
+// that we get from decoding a netflow packet. Indices are -1 if the
+// template doesn't carry the respective field.
 type fieldMap struct {
 	srcAddr  int
 	dstAddr  int
@@ -39,11 +63,95 @@ type fieldMap struct {
 	nextHop  int
 	family   int
 	vlan     int
-	ts       int
-	srcAsn   int
-	dstAsn   int
 	srcPort  int
 	dstPort  int
+	minTTL   int
+	maxTTL   int
+
+	// ports is the index of a field carrying both ports, as declared by an override
+	ports int
+
+	// srcMac and dstMac are the indices of the MAC addresses as received or,
+	// if only those are exported, as sent
+	srcMac int
+	dstMac int
+
+	// bgpNextHop is the index of the BGP next hop, nextHop the one of the
+	// forwarding next hop
+	bgpNextHop int
+
+	// Origin (srcAsn, dstAsn) and peer (srcPeerAsn, dstPeerAsn) ASNs
+	srcAsn     int
+	dstAsn     int
+	srcPeerAsn int
+	dstPeerAsn int
+
+	endReason       int
+	tcpFlags        int
+	tcpWindowSize   int
+	tcpWindowScale  int
+	ipHeaderSection int
+	dataLinkSection int
+	wlanSSID        int
+	wlanChannel     int
+	staMac          int
+	l2SegmentID     int
+	systemInitTime  int
+	appName         int
+	droppedBytes    int
+	droppedPackets  int
+	fwdStatus       int
+	ingressVRF      int
+	egressVRF       int
+
+	selectorAlgorithm     int
+	flowSelectorAlgorithm int
+
+	// tos, postTos, dscp and postDSCP are the indices of the ingress and egress
+	// type of service byte and DSCP
+	tos      int
+	postTos  int
+	dscp     int
+	postDSCP int
+
+	// observationTime is the index of the time the record was observed at, in
+	// seconds unless observationMillis is set
+	observationTime   int
+	observationMillis bool
+
+	// connectionID is the index of the connection or transaction identifier
+	connectionID int
+
+	// flowStart and flowEnd are the indices of the flows start and end time,
+	// in seconds unless flowMillis is set. If flowUptime is set they are in
+	// milliseconds since the exporter was initialized.
+	flowStart  int
+	flowEnd    int
+	flowMillis bool
+	flowUptime bool
+
+	// mplsLabels holds the index of the label stack section of each stack level, top level first
+	mplsLabels [ipfix.MplsLabel10 - ipfix.MplsLabel1 + 1]int
+
+	// Sampling parameters and sizes of sampled packets of PSAMP packet reports
+	samplingInterval       int
+	samplerRandomInterval  int
+	samplingPacketInterval int
+	samplingPacketSpace    int
+	dataLinkFrameSize      int
+	ipTotalLength          int
+
+	// labels lists string fields to be added to the flows labels
+	labels []labelField
+
+	// littleEndian lists the indices of fields the exporter sends in little endian byte order
+	littleEndian []int
+}
+
+// labelField describes a string field to be added to the flows labels
+type labelField struct {
+	index int
+	label string
 }
 
 // IPFIXServer represents a Netflow Collector instance
@@ -52,144 +160,1053 @@ type IPFIXServer struct {
 	// for later lookup in order to decode netflow packets
 	tmplCache *templateCache
 
+	// interfaces keeps the interface names announced in options data
+	interfaces *interfaceTable
+
+	// samplers keeps the sampling rates announced in options data
+	samplers *samplingTable
+
 	// receiver is the channel used to receive flows from the annotator layer
 	Output chan *netflow.Flow
 
-	// debug defines the debug level
-	debug int
+	// debug is the debug level of this server
+	debug debug.Local
 
 	// bgpAugment is used to decide if ASN information from netflow packets should be used
 	bgpAugment bool
+
+	// scheduler distributes packets to decode workers fairly among exporters.
+	// It is nil if packets are decoded by the goroutine reading them.
+	scheduler *fairqueue.Scheduler
+
+	// limiter caps the rate of flows sent to `Output`. It is nil if flows are not rate limited.
+	limiter *ratelimit.Bucket
+
+	// relay is set if packets are received from a relay prepending a relay header (see ipfix.RelayHeader)
+	relay bool
+
+	// netflowV9 decodes NetFlow v9 packets received on the IPFIX address. It is nil if they are not accepted.
+	netflowV9 PacketHandler
+
+	// stringLabels maps string fields to the label their value is stored as
+	stringLabels map[ipfix.FieldID]string
+
+	// peerASExporters holds the addresses of exporters sending peer instead of origin ASNs in SrcAs and DstAs
+	peerASExporters map[string]bool
+
+	// fieldOverrides holds per exporter overrides of how fields are decoded, keyed by exporter address
+	fieldOverrides map[string]FieldOverrides
+
+	// timeOffsets holds the seconds added to the timestamps of exporters with
+	// misconfigured clocks, keyed by exporter address
+	timeOffsets map[string]int64
+
+	// vrfMaps holds the VRFs of interfaces of exporters not exporting VRF IDs, keyed by exporter address
+	vrfMaps map[string]VRFMap
+
+	// validator checks decoded flows for impossible values. It is nil if flows are not validated.
+	validator *validate.Validator
+
+	// elephants reports flows exceeding a byte or packet threshold. It is nil if they are not reported.
+	elephants *elephant.Detector
+
+	// dropEmpty is set if flows without packets and bytes are dropped
+	dropEmpty bool
+
+	// collectorID is set on all flows to identify this collector instance
+	collectorID string
+
+	// outputTimeout is the time a flow may wait for `Output` to be drained before
+	// it is dropped, or the server panics if `outputPanic` is set. 0 waits forever.
+	outputTimeout time.Duration
+	outputPanic   bool
+
+	// lastStallLog is the unix time a stalled `Output` was last logged at
+	lastStallLog int64
+
+	// lastMissingLog is the unix time a flowset lacking its template was last logged at
+	lastMissingLog int64
+
+	// recorder keeps the last raw messages of each exporter. It is nil if messages are not recorded.
+	recorder *recorder.Recorder
+
+	// trustedProxies are the prefixes of proxies allowed to name the exporter of
+	// HTTP requests
+	trustedProxies []*net.IPNet
+
+	// conn (UDP), listener and conns (TCP) and httpServer receive messages. They
+	// are closed by Close, which also closes `done` and waits for `workers` to exit.
+	conn       *net.UDPConn
+	listener   net.Listener
+	conns      map[net.Conn]bool
+	connsLock  sync.Mutex
+	httpServer *http.Server
+	done       chan struct{}
+	workers    sync.WaitGroup
+	closeOnce  sync.Once
+
+	// packetSize is the size of the largest UDP message read, larger ones are truncated
+	packetSize int
+
+	// tcpReadTimeout is the time exporters connected via TCP have to send each message
+	tcpReadTimeout time.Duration
+
+	// closed is set once `Output` is closed. Messages are processed holding a read lock.
+	closed      bool
+	closingLock sync.RWMutex
+}
+
+// errClosed is returned for messages received while the server is closed
+var errClosed = errors.New("IPFIX server closed")
+
+// PacketHandler processes a raw packet received from `remote` and returns the number of flows passed on
+type PacketHandler func(remote net.IP, buffer []byte) int
+
+// Config configures an `IPFIXServer`. Zero values disable the respective feature
+// unless noted otherwise.
+type Config struct {
+	// ListenAddr is the address to receive IPFIX on
+	ListenAddr string
+
+	// Transport is the transport to receive IPFIX via, "udp" (default) or "tcp"
+	Transport string
+
+	// NumReaders is the number of workers reading and decoding messages, 1 if not set
+	NumReaders int
+
+	// BGPAugment is set if ASN information from the exporter is to be replaced via BIRD
+	BGPAugment bool
+
+	// QueueSize is the number of messages queued per exporter. If not 0 messages
+	// are decoded by `NumReaders` workers serving exporters round robin.
+	QueueSize int
+
+	// Relay is set if every UDP message is expected to start with a relay header
+	Relay bool
+
+	// NetflowV9 gets the NetFlow v9 packets received, which are dropped if it is nil
+	NetflowV9 PacketHandler
+
+	// Limiter limits the rate of flows passed on, flows exceeding it are dropped
+	Limiter *ratelimit.Bucket
+
+	// StringLabels are the string fields stored in the flows labels
+	StringLabels map[ipfix.FieldID]string
+
+	// PeerASExporters are the exporters whose SrcAs and DstAs are peer ASNs
+	PeerASExporters map[string]bool
+
+	// FieldOverrides are the fields of exporters decoded as configured there
+	FieldOverrides map[string]FieldOverrides
+
+	// TimeOffsets are the number of seconds timestamps of exporters are corrected by
+	TimeOffsets map[string]int64
+
+	// VRFMaps are the VRFs of the interfaces of exporters, used unless the exporter sent them
+	VRFMaps map[string]VRFMap
+
+	// Validator and Elephants check flows unless they are nil
+	Validator *validate.Validator
+	Elephants *elephant.Detector
+
+	// DropEmpty is set if flows without packets and bytes are to be dropped
+	DropEmpty bool
+
+	// CollectorID is the collector flows are tagged with
+	CollectorID string
+
+	// OutputTimeout is the time flows not taken from `Output` are dropped after,
+	// or cause a panic if `OutputPanic` is set
+	OutputTimeout time.Duration
+	OutputPanic   bool
+
+	// Recorder keeps the messages received unless it is nil
+	Recorder *recorder.Recorder
+
+	// TemplateTTL is the time templates not received again are expired after
+	TemplateTTL time.Duration
+
+	// ReadBuffer is the size of the receive buffer of the UDP socket in bytes
+	ReadBuffer int
+
+	// PacketSize is the size of the largest UDP message read, DefaultPacketSize if not set
+	PacketSize int
+
+	// TCPReadTimeout is the time exporters connected via TCP have to send each
+	// message before they are disconnected, DefaultTCPReadTimeout if not set
+	TCPReadTimeout time.Duration
 }
 
-// New creates and starts a new `NetflowServer` instance
-func New(listenAddr string, numReaders int, bgpAugment bool, debug int) *IPFIXServer {
+// New creates and starts a new `IPFIXServer` instance configured by `cfg`. It
+// returns an error if the address can't be listened on.
+func New(cfg Config) (*IPFIXServer, error) {
+	if cfg.Transport == "" {
+		cfg.Transport = "udp"
+	}
+	if cfg.NumReaders <= 0 {
+		cfg.NumReaders = 1
+	}
+	if cfg.PacketSize <= 0 {
+		cfg.PacketSize = DefaultPacketSize
+	}
+	if cfg.TCPReadTimeout <= 0 {
+		cfg.TCPReadTimeout = DefaultTCPReadTimeout
+	}
+
 	ifs := &IPFIXServer{
-		debug:      debug,
-		tmplCache:  newTemplateCache(),
-		Output:     make(chan *netflow.Flow),
-		bgpAugment: bgpAugment,
+		tmplCache:       newTemplateCache(cfg.TemplateTTL),
+		interfaces:      newInterfaceTable(),
+		samplers:        newSamplingTable(),
+		Output:          make(chan *netflow.Flow),
+		bgpAugment:      cfg.BGPAugment,
+		limiter:         cfg.Limiter,
+		relay:           cfg.Relay,
+		netflowV9:       cfg.NetflowV9,
+		stringLabels:    cfg.StringLabels,
+		peerASExporters: cfg.PeerASExporters,
+		fieldOverrides:  cfg.FieldOverrides,
+		timeOffsets:     cfg.TimeOffsets,
+		vrfMaps:         cfg.VRFMaps,
+		validator:       cfg.Validator,
+		elephants:       cfg.Elephants,
+		dropEmpty:       cfg.DropEmpty,
+		collectorID:     cfg.CollectorID,
+		outputTimeout:   cfg.OutputTimeout,
+		outputPanic:     cfg.OutputPanic,
+		recorder:        cfg.Recorder,
+		conns:           make(map[net.Conn]bool),
+		done:            make(chan struct{}),
+		packetSize:      cfg.PacketSize,
+		tcpReadTimeout:  cfg.TCPReadTimeout,
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", listenAddr)
-	if err != nil {
-		panic(fmt.Sprintf("ResolveUDPAddr: %v", err))
+	switch cfg.Transport {
+	case "udp":
+		addr, err := net.ResolveUDPAddr("udp", cfg.ListenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("ResolveUDPAddr: %v", err)
+		}
+		if ifs.conn, err = net.ListenUDP("udp", addr); err != nil {
+			return nil, fmt.Errorf("Listen: %v", err)
+		}
+		if cfg.ReadBuffer > 0 {
+			if err := ifs.conn.SetReadBuffer(cfg.ReadBuffer); err != nil {
+				ifs.conn.Close()
+				return nil, fmt.Errorf("SetReadBuffer: %v", err)
+			}
+		}
+		stats.RegisterSocket("ipfix", ifs.conn.LocalAddr().(*net.UDPAddr).Port)
+	case "tcp":
+		if cfg.Relay {
+			return nil, fmt.Errorf("Relay headers are only supported via UDP")
+		}
+		var err error
+		if ifs.listener, err = net.Listen("tcp", cfg.ListenAddr); err != nil {
+			return nil, fmt.Errorf("Listen: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown IPFIX transport %q", cfg.Transport)
 	}
 
-	con, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		panic(fmt.Sprintf("Listen: %v", err))
+	if cfg.TemplateTTL > 0 {
+		go ifs.expireTemplates(cfg.TemplateTTL)
+	}
+
+	if cfg.QueueSize > 0 {
+		ifs.scheduler = fairqueue.New(cfg.QueueSize)
+		for i := 0; i < cfg.NumReaders; i++ {
+			ifs.workers.Add(1)
+			go ifs.decodeWorker(i)
+		}
+	}
+
+	if ifs.listener != nil {
+		ifs.workers.Add(1)
+		go ifs.acceptTCP()
+		return ifs, nil
 	}
 
 	// Create goroutines that read netflow packet and process it
-	for i := 0; i < numReaders; i++ {
-		go func(num int) {
-			ifs.packetWorker(num, con)
-		}(i)
+	for i := 0; i < cfg.NumReaders; i++ {
+		ifs.workers.Add(1)
+		go ifs.packetWorker(i)
 	}
 
-	return ifs
+	return ifs, nil
+}
+
+// Close stops receiving messages and waits for messages being decoded. Then it
+// closes `Output`, which has to be drained until then.
+func (ifs *IPFIXServer) Close() error {
+	var err error
+	ifs.closeOnce.Do(func() {
+		close(ifs.done)
+		if ifs.conn != nil {
+			err = ifs.conn.Close()
+		}
+		if ifs.listener != nil {
+			err = ifs.listener.Close()
+			ifs.connsLock.Lock()
+			for conn := range ifs.conns {
+				conn.Close()
+			}
+			ifs.connsLock.Unlock()
+		}
+		if ifs.httpServer != nil {
+			ifs.httpServer.Close()
+		}
+		if ifs.scheduler != nil {
+			ifs.scheduler.Close()
+		}
+		ifs.workers.Wait()
+
+		// Wait for HTTP requests still being processed
+		ifs.closingLock.Lock()
+		ifs.closed = true
+		ifs.closingLock.Unlock()
+		close(ifs.Output)
+	})
+	return err
 }
 
-// packetWorker reads netflow packet from socket and handsoff processing to processFlowSets()
-func (ifs *IPFIXServer) packetWorker(identity int, conn *net.UDPConn) {
-	buffer := make([]byte, 8960)
+// isClosed returns true once Close was called
+func (ifs *IPFIXServer) isClosed() bool {
+	select {
+	case <-ifs.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetDebug raises the debug level of this server above the shared one to `l`.
+// It takes effect immediately, also for packets being processed.
+func (ifs *IPFIXServer) SetDebug(l int) {
+	ifs.debug.Set(l)
+}
+
+// packetWorker reads netflow packet from socket and handsoff processing to
+// processFlowSets() until the server is closed
+func (ifs *IPFIXServer) packetWorker(identity int) {
+	defer ifs.workers.Done()
+	ws := stats.Worker("ipfix", identity)
+	buffer := make([]byte, ifs.packetSize)
 	for {
-		length, remote, err := conn.ReadFromUDP(buffer)
+		length, remote, err := ifs.conn.ReadFromUDP(buffer)
 		if err != nil {
+			if ifs.isClosed() {
+				return
+			}
 			glog.Errorf("Error reading from socket: %v", err)
 			continue
 		}
 		atomic.AddUint64(&stats.GlobalStats.IPFIXpackets, 1)
 		atomic.AddUint64(&stats.GlobalStats.IPFIXbytes, uint64(length))
 
-		remote.IP = remote.IP.To4()
-		if remote.IP == nil {
-			glog.Errorf("Received IPv6 packet. Dropped.")
+		// IPv4 exporters are identified by their 4 byte address, IPv6 exporters by their 16 byte one
+		if ip := remote.IP.To4(); ip != nil {
+			remote.IP = ip
+		}
+
+		if ifs.scheduler != nil {
+			data := make([]byte, length)
+			copy(data, buffer[:length])
+			ifs.scheduler.Push(fairqueue.Packet{Remote: remote.IP, Data: data})
 			continue
 		}
 
-		ifs.processPacket(remote.IP, buffer[:length])
+		ws.CountPacket(ifs.processPacket(remote.IP, buffer[:length]))
+	}
+}
+
+// decodeWorker takes packets from the scheduler and processes them until it is closed
+func (ifs *IPFIXServer) decodeWorker(identity int) {
+	defer ifs.workers.Done()
+	ws := stats.Worker("ipfix", identity)
+	for {
+		p, ok := ifs.scheduler.Pop()
+		if !ok {
+			return
+		}
+		ws.CountPacket(ifs.processPacket(p.Remote, p.Data))
+	}
+}
+
+// processPacket takes a raw UDP packet, strips the relay header (if in relay mode)
+// and passes the IPFIX message over to processMessage(). It returns the number of flows passed on.
+func (ifs *IPFIXServer) processPacket(remote net.IP, buffer []byte) int {
+	defer recoverPacket(remote, buffer)
+	var receiveTime int64
+	if ifs.relay {
+		relayHdr, payload, err := ipfix.DecodeRelayHeader(buffer)
+		if err != nil {
+			stats.CountDecodeError("ipfix", "relay_header")
+			glog.Errorf("ipfix.DecodeRelayHeader: %v", err)
+			return 0
+		}
+
+		// Templates and flows are attributed to the exporter, not the relay
+		remote = relayHdr.Exporter
+		buffer = payload
+		receiveTime = int64(relayHdr.ReceiveTime)
+	}
+
+	// NetFlow v9 shares the version field position with IPFIX
+	if ifs.netflowV9 != nil && len(buffer) >= 2 && binary.BigEndian.Uint16(buffer) == netflowV9Version {
+		return ifs.netflowV9(remote, buffer)
 	}
+
+	flows, _ := ifs.processMessage(remote, buffer, receiveTime)
+	return flows
+}
+
+// outputStalled is the value a stalled `Output` panics with if `outputPanic` is
+// set. It is not recovered from, as that panic is asked for.
+type outputStalled string
+
+// logPanic logs panics recovered from by `recoverPacket`
+var logPanic = glog.Errorf
+
+// recoverPacket recovers from a panic processing `buffer` from `remote`, so a
+// malformed packet only costs its own flows rather than a worker. It must be
+// deferred by the function processing the packet. The packet isn't copied up
+// front to keep that off the hot path, so it is logged as left by decoding,
+// which reverses its bytes in place.
+func recoverPacket(remote net.IP, buffer []byte) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if _, ok := r.(outputStalled); ok {
+		panic(r)
+	}
+	atomic.AddUint64(&stats.GlobalStats.PacketPanics, 1)
+	atomic.AddUint64(&stats.Router(remote.String()).DecodeErrors, 1)
+
+	logPanic("Panic processing packet from %s: %v\n%d bytes as decoded (byte reversed): %s", remote, r, len(buffer), hex.EncodeToString(buffer))
 }
 
-// processPacket takes a raw netflow packet, send it to the decoder, updates template cache
-// (if there are templates in the packet) and passes the decoded packet over to processFlowSets()
-func (ifs *IPFIXServer) processPacket(remote net.IP, buffer []byte) {
+// processMessage takes a raw IPFIX message, send it to the decoder, updates template cache
+// (if there are templates in the message) and passes the decoded message over to processFlowSets().
+// Flows are timestamped with `receiveTime` or, if it is 0, the export time of the message
+// corrected by the exporters time offset. It returns the number of flows passed on.
+func (ifs *IPFIXServer) processMessage(remote net.IP, buffer []byte, receiveTime int64) (int, error) {
+	ifs.closingLock.RLock()
+	defer ifs.closingLock.RUnlock()
+	if ifs.closed {
+		return 0, errClosed
+	}
+
+	stats.Router(remote.String()).CountPacket(len(buffer))
+	if ifs.recorder != nil {
+		ifs.recorder.Record("ipfix", remote, buffer)
+	}
+
 	length := len(buffer)
 	packet, err := ipfix.Decode(buffer[:length], remote)
 	if err != nil {
-		glog.Errorf("ipfix.Decode: %v", err)
-		return
+		stats.CountDecodeError("ipfix", ipfix.Category(err))
+		atomic.AddUint64(&stats.Router(remote.String()).DecodeErrors, 1)
+		glog.Errorf("ipfix.Decode of packet from %s: %v", remote, err)
+		return 0, err
+	}
+
+	// The receive time is taken by the relay, so the exporters clock doesn't affect it
+	ts := int64(packet.Header.ExportTime) + ifs.timeOffsets[remote.String()]
+	if receiveTime != 0 {
+		ts = receiveTime
 	}
 
 	ifs.updateTemplateCache(remote, packet)
-	ifs.processFlowSets(remote, packet.Header.DomainID, packet.DataFlowSets(), int64(packet.Header.ExportTime), packet)
+	return ifs.processFlowSets(remote, packet.Header.DomainID, packet.DataFlowSets(), ts, packet), nil
 }
 
-// processFlowSets iterates over flowSets and calls processFlowSet() for each flow set
-func (ifs *IPFIXServer) processFlowSets(remote net.IP, domainID uint32, flowSets []*ipfix.Set, ts int64, packet *ipfix.Packet) {
+// processFlowSets iterates over flowSets and calls processFlowSet() for each flow set.
+// It returns the number of flows passed on.
+func (ifs *IPFIXServer) processFlowSets(remote net.IP, domainID uint32, flowSets []*ipfix.Set, ts int64, packet *ipfix.Packet) int {
 	addr := remote.String()
 	keyParts := make([]string, 3, 3)
+
+	// The sequence number counts data records. Records of sets without template can't be counted.
+	records := 0
+	flows := 0
+	complete := true
+	defer func() {
+		if !complete {
+			records = -1
+		}
+		stats.ObserveSequence(addr, domainID, packet.Header.SequenceNumber, records)
+		stats.Router(addr).CountDomainPacket(domainID, flows)
+	}()
+
 	for _, set := range flowSets {
-		template := ifs.tmplCache.get(convert.Uint32(remote), domainID, set.Header.SetID)
+		template := ifs.tmplCache.get(remote, domainID, set.Header.SetID)
 
 		if template == nil {
 			templateKey := makeTemplateKey(addr, domainID, set.Header.SetID, keyParts)
-			if ifs.debug > 0 {
+			atomic.AddUint64(&stats.GlobalStats.TemplateMisses, 1)
+			atomic.AddUint64(&stats.Router(addr).MissingTemplates, 1)
+			if ifs.debug.Level() > 0 {
 				glog.Warningf("Template for given FlowSet not found: %s", templateKey)
+			} else {
+				ifs.logMissingTemplate(templateKey)
 			}
+			complete = false
 			continue
 		}
 
-		records := template.DecodeFlowSet(*set)
-		if records == nil {
+		recs := template.DecodeFlowSet(*set)
+		if recs == nil {
 			glog.Warning("Error decoding FlowSet")
+			complete = false
+			continue
+		}
+		records += len(recs)
+		if template.ScopeFieldCount > 0 {
+			ifs.processOptions(template, recs, remote, domainID)
 			continue
 		}
-		ifs.processFlowSet(template, records, remote, ts, packet)
+		flows += ifs.processFlowSet(template, recs, remote, ts, packet)
 	}
+	return flows
 }
 
-// process generates Flow elements from records and pushes them into the `receiver` channel
-func (ifs *IPFIXServer) processFlowSet(template *ipfix.TemplateRecords, records []ipfix.FlowDataRecord, agent net.IP, ts int64, packet *ipfix.Packet) {
-	fm := generateFieldMap(template)
+// process generates Flow elements from records and pushes them into the `receiver` channel.
+// It returns the number of flows passed on.
+func (ifs *IPFIXServer) processFlowSet(template *ipfix.TemplateRecords, records []ipfix.FlowDataRecord, agent net.IP, ts int64, packet *ipfix.Packet) int {
+	addr := agent.String()
+	fm := generateFieldMap(template, ifs.stringLabels, ifs.fieldOverrides[addr], ifs.peerASExporters[addr])
+	rs := stats.Router(addr)
+	offset := ifs.timeOffsets[addr]
+	received := time.Now().UnixNano()
 
+	flows := 0
 	for _, r := range records {
-		if fm.family == 4 {
+		// Field indices of `fm` are only valid for records of the template's fields
+		if len(r.Values) != len(template.Records) {
+			glog.Warningf("Skipping record of %d fields decoded with template %d of %d fields", len(r.Values), template.Header.TemplateID, len(template.Records))
+			continue
+		}
+
+		// Values are kept in reverse byte order. Reversing fields sent in little
+		// endian turns them into the same order as all other fields.
+		for _, i := range fm.littleEndian {
+			convert.Reverse(r.Values[i])
+		}
+
+		// IPFIX headers carry no uptime, some exporters include their init time in data records
+		if fm.systemInitTime >= 0 {
+			observeInitTime(rs, addr, convert.Uint64(r.Values[fm.systemInitTime]))
+		}
+
+		// PSAMP packet reports carry a sampled header instead of the flow fields
+		hdrs := decodeSection(fm, r)
+		family := fm.family
+		if family == 0 && hdrs != nil {
+			family = hdrs.Family
+		}
+
+		if family == 4 {
 			atomic.AddUint64(&stats.GlobalStats.Flows4, 1)
-		} else if fm.family == 6 {
+		} else if family == 6 {
 			atomic.AddUint64(&stats.GlobalStats.Flows6, 1)
 		} else {
+			atomic.AddUint64(&stats.GlobalStats.DroppedUnknownFamily, 1)
 			glog.Warning("Unknown address family")
 			continue
 		}
 
 		var fl netflow.Flow
 		fl.Router = agent
-		fl.Timestamp = ts
-		fl.Family = uint32(fm.family)
-		fl.Packets = convert.Uint32(r.Values[fm.packets])
-		fl.Size = uint64(convert.Uint32(r.Values[fm.size]))
-		fl.Protocol = convert.Uint32(r.Values[fm.protocol])
-		fl.IntIn = convert.Uint32(r.Values[fm.intIn])
-		fl.IntOut = convert.Uint32(r.Values[fm.intOut])
-		fl.SrcPort = convert.Uint32(r.Values[fm.srcPort])
-		fl.DstPort = convert.Uint32(r.Values[fm.dstPort])
-		fl.SrcAddr = convert.Reverse(r.Values[fm.srcAddr])
-		fl.DstAddr = convert.Reverse(r.Values[fm.dstAddr])
-		fl.NextHop = convert.Reverse(r.Values[fm.nextHop])
-
-		if !ifs.bgpAugment {
-			fl.SrcAs = convert.Uint32(r.Values[fm.srcAsn])
-			fl.DstAs = convert.Uint32(r.Values[fm.dstAsn])
-		}
-
-		if ifs.debug > 2 {
+		fl.Received = received
+		fl.Timestamp = observationTime(fm, r, ts, offset)
+		fl.CollectorId = ifs.collectorID
+		fl.Family = uint32(family)
+		fl.Packets = packetsAt(r, fm.packets)
+		fl.Size = uint64At(r, fm.size)
+		fl.Protocol = uint32At(r, fm.protocol)
+		fl.IntIn = uint32At(r, fm.intIn)
+		fl.IntOut = uint32At(r, fm.intOut)
+		fl.SrcPort = uint32At(r, fm.srcPort)
+		fl.DstPort = uint32At(r, fm.dstPort)
+		if fm.ports >= 0 {
+			ports := convert.Uint32(r.Values[fm.ports])
+			fl.SrcPort = ports >> 16
+			fl.DstPort = ports & 0xffff
+		}
+		fl.SrcAddr = bytesAt(r, fm.srcAddr)
+		fl.DstAddr = bytesAt(r, fm.dstAddr)
+		fl.NextHop = bytesAt(r, fm.nextHop)
+		fl.BgpNextHop = bytesAt(r, fm.bgpNextHop)
+		fl.MinTtl = uint32At(r, fm.minTTL)
+		fl.MaxTtl = uint32At(r, fm.maxTTL)
+		fl.Vlan = uint32At(r, fm.vlan)
+		fl.SrcMac = macAt(r, fm.srcMac)
+		fl.DstMac = macAt(r, fm.dstMac)
+		fl.ForwardingStatus = uint32At(r, fm.fwdStatus)
+		decodeVRFs(&fl, fm, r, ifs.vrfMaps[addr])
+		if fm.droppedBytes >= 0 {
+			fl.DroppedBytes = convert.Uint64(r.Values[fm.droppedBytes])
+		}
+		if fm.droppedPackets >= 0 {
+			fl.DroppedPackets = convert.Uint64(r.Values[fm.droppedPackets])
+		}
+		decodeDuration(&fl, fm, r, int64(rs.InitTime()), offset)
+
+		// Flows are accounted to their start unless a mediator stamped them with their observation time
+		if fl.Start != 0 && fm.observationTime < 0 {
+			fl.Timestamp = fl.Start / 1000
+		}
+		fl.ConnectionId = bytesAt(r, fm.connectionID)
+
+		if fm.endReason >= 0 {
+			fl.EndReason = convert.Uint32(r.Values[fm.endReason])
+			rs.CountEndReason(fl.EndReason)
+		}
+
+		decodeSelector(&fl, fm, r, rs)
+		if fm.family == 0 {
+			decodePacketReport(&fl, fm, r, hdrs)
+		}
+		scaleSampled(&fl, fm, r, ifs.samplers.rate(addr, packet.Header.DomainID))
+		fl.IntInName = ifs.interfaces.name(addr, fl.IntIn)
+		fl.IntOutName = ifs.interfaces.name(addr, fl.IntOut)
+		decodeTCP(&fl, fm, r, hdrs)
+		decodeWlan(&fl, fm, r)
+		decodeSegment(&fl, fm, r)
+		decodeMPLS(&fl, fm, r)
+		decodeDSCP(&fl, fm, r)
+		if fm.appName >= 0 {
+			// Names in fixed length fields are padded with NUL bytes, variable length ones may be empty
+			fl.ApplicationName = strings.TrimRight(string(convert.Reverse(r.Values[fm.appName])), "\x00")
+		}
+
+		for _, lf := range fm.labels {
+			v := strings.TrimRight(string(convert.Reverse(r.Values[lf.index])), "\x00")
+			if v == "" {
+				continue
+			}
+			if fl.Labels == nil {
+				fl.Labels = make(map[string]string)
+			}
+			fl.Labels[lf.label] = v
+		}
+
+		decodeASNs(&fl, fm, r, ifs.bgpAugment)
+
+		if !fl.HasPorts() {
+			fl.SrcPort = 0
+			fl.DstPort = 0
+		}
+
+		if ifs.debug.Level() > 2 {
 			Dump(&fl)
 		}
 
-		ifs.Output <- &fl
+		if ifs.dropEmpty && fl.Packets == 0 && fl.Size == 0 {
+			atomic.AddUint64(&stats.GlobalStats.EmptyDropped, 1)
+			continue
+		}
+
+		if ifs.validator != nil && !ifs.validator.Keep("ipfix", &fl) {
+			continue
+		}
+		if ifs.elephants != nil {
+			ifs.elephants.Check(&fl)
+		}
+
+		rs.CountFlow(fl.Size)
+		if ifs.limiter != nil && !ifs.limiter.Allow() {
+			atomic.AddUint64(&stats.GlobalStats.RateLimited, 1)
+			continue
+		}
+
+		ifs.send(&fl)
+		flows++
+	}
+	return flows
+}
+
+// decodeASNs fills the ASNs of `fl`. Origin ASNs and the next hop ASN are
+// determined by the annotator if `bgpAugment` is set. BIRD has no notion of
+// the peer the flow was received from, so its ASN is always taken from the record.
+func decodeASNs(fl *netflow.Flow, fm *fieldMap, r ipfix.FlowDataRecord, bgpAugment bool) {
+	if fm.srcPeerAsn >= 0 {
+		fl.SrcPeerAs = convert.Uint32(r.Values[fm.srcPeerAsn])
+	}
+	if bgpAugment {
+		return
+	}
+
+	if fm.srcAsn >= 0 {
+		fl.SrcAs = convert.Uint32(r.Values[fm.srcAsn])
+	}
+	if fm.dstAsn >= 0 {
+		fl.DstAs = convert.Uint32(r.Values[fm.dstAsn])
+	}
+	if fm.dstPeerAsn >= 0 {
+		fl.NextHopAs = convert.Uint32(r.Values[fm.dstPeerAsn])
+	}
+}
+
+// decodeSelector marks `fl` as unscalable if the record was selected by a deterministic
+// selector. If a record carries both the packet and the flow selector algorithm
+// and they disagree, this is counted as mismatch and the flow is treated as unscalable
+// if either is deterministic.
+func decodeSelector(fl *netflow.Flow, fm *fieldMap, r ipfix.FlowDataRecord, rs *stats.RouterStats) {
+	var algs []uint32
+	if fm.selectorAlgorithm >= 0 {
+		algs = append(algs, convert.Uint32(r.Values[fm.selectorAlgorithm]))
+	}
+	if fm.flowSelectorAlgorithm >= 0 {
+		algs = append(algs, convert.Uint32(r.Values[fm.flowSelectorAlgorithm]))
+	}
+
+	for _, alg := range algs {
+		if !ipfix.ScalableSelector(alg) {
+			fl.Unscalable = true
+		}
+	}
+	if len(algs) == 2 && algs[0] != algs[1] {
+		atomic.AddUint64(&rs.SelectorMismatches, 1)
+	}
+}
+
+// uint32At returns the value at index `i` of `r`, 0 if `i` is -1 or out of range
+func uint32At(r ipfix.FlowDataRecord, i int) uint32 {
+	if i < 0 || i >= len(r.Values) {
+		return 0
+	}
+	return convert.Uint32(r.Values[i])
+}
+
+// uint64At returns the value at index `i` of `r`, 0 if `i` is -1 or out of range. Counters
+// may be exported with 8 bytes, which uint32At would truncate.
+func uint64At(r ipfix.FlowDataRecord, i int) uint64 {
+	if i < 0 || i >= len(r.Values) {
+		return 0
+	}
+	return convert.Uint64(r.Values[i])
+}
+
+// packetsAt returns the packet count at index `i` of `r`, 0 if `i` is -1 or out of range.
+// Counts exceeding the 32 bits of flows are capped rather than wrapped.
+func packetsAt(r ipfix.FlowDataRecord, i int) uint32 {
+	packets := uint64At(r, i)
+	if packets > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(packets)
+}
+
+// macAt returns the MAC address at index `i` of `r`, nil if `i` is -1 or out of range
+func macAt(r ipfix.FlowDataRecord, i int) net.HardwareAddr {
+	if i < 0 || i >= len(r.Values) {
+		return nil
+	}
+	return convert.MAC(r.Values[i])
+}
+
+// bytesAt returns the value at index `i` of `r` in network byte order, nil if `i` is -1 or out of range
+func bytesAt(r ipfix.FlowDataRecord, i int) []byte {
+	if i < 0 || i >= len(r.Values) {
+		return nil
+	}
+	return convert.Reverse(r.Values[i])
+}
+
+// decodeSection decodes the sampled packet header of the record, if any
+func decodeSection(fm *fieldMap, r ipfix.FlowDataRecord) *packet.Headers {
+	if fm.ipHeaderSection >= 0 {
+		return packet.DecodeIP(convert.Reverse(r.Values[fm.ipHeaderSection]))
+	}
+	if fm.dataLinkSection >= 0 {
+		return packet.DecodeEthernet(convert.Reverse(r.Values[fm.dataLinkSection]))
+	}
+	return nil
+}
+
+// decodePacketReport fills `fl` from the sampled packet header `hdrs` of a PSAMP
+// packet report
+func decodePacketReport(fl *netflow.Flow, fm *fieldMap, r ipfix.FlowDataRecord, hdrs *packet.Headers) {
+	if hdrs == nil {
+		return
+	}
+
+	fl.SrcAddr = hdrs.SrcAddr
+	fl.DstAddr = hdrs.DstAddr
+	fl.Protocol = uint32(hdrs.Protocol)
+	fl.SrcPort = uint32(hdrs.SrcPort)
+	fl.DstPort = uint32(hdrs.DstPort)
+	fl.MinTtl = uint32(hdrs.TTL)
+	fl.MaxTtl = uint32(hdrs.TTL)
+
+	// The section is usually truncated, so the size of the sampled packet is
+	// taken from the record or the IP header
+	fl.Packets = 1
+	switch {
+	case fm.dataLinkFrameSize >= 0:
+		fl.Size = uint64(uint32At(r, fm.dataLinkFrameSize))
+	case fm.ipTotalLength >= 0:
+		fl.Size = convert.Uint64(r.Values[fm.ipTotalLength])
+	default:
+		fl.Size = uint64(hdrs.Length)
+	}
+}
+
+// scaleSampled multiplies the counts of `fl` by the sampling rate the exporter
+// reported in the record or, if the record carries none, by `announced`, the
+// rate announced in options data (0 if unknown). Flows of deterministic selectors
+// aren't scaled.
+func scaleSampled(fl *netflow.Flow, fm *fieldMap, r ipfix.FlowDataRecord, announced uint32) {
+	rate := samplingRate(fm, r)
+	if rate == 0 {
+		rate = announced
+	}
+	if rate == 0 || fl.Unscalable {
+		return
+	}
+	fl.Packets = scalePackets(fl.Packets, rate)
+	fl.Size *= uint64(rate)
+	fl.DroppedPackets *= uint64(rate)
+	fl.DroppedBytes *= uint64(rate)
+	fl.Scaled = true
+	fl.SamplingRate = rate
+}
+
+// scalePackets returns `packets` multiplied by `rate`, capped at the 32 bits of
+// flows. Large counts of heavily sampled flows would wrap otherwise.
+func scalePackets(packets uint32, rate uint32) uint32 {
+	scaled := uint64(packets) * uint64(rate)
+	if scaled > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(scaled)
+}
+
+// samplingRate returns the number of packets represented by each sampled packet,
+// 0 if the record carries no sampling parameters. The PSAMP samplingPacketInterval
+// and samplingPacketSpace take precedence over the deprecated samplingInterval and
+// samplerRandomInterval.
+// samplingAlgorithm is not needed as both of its values select 1 out of N packets.
+func samplingRate(fm *fieldMap, r ipfix.FlowDataRecord) uint32 {
+	if fm.samplingPacketInterval >= 0 && fm.samplingPacketSpace >= 0 {
+		interval := uint32At(r, fm.samplingPacketInterval)
+		if interval > 0 {
+			return (interval + uint32At(r, fm.samplingPacketSpace)) / interval
+		}
+	}
+	if rate := uint32At(r, fm.samplingInterval); rate > 0 {
+		return rate
+	}
+	return uint32At(r, fm.samplerRandomInterval)
+}
+
+// decodeTCP fills TCP flags, window and MSS information of `fl` from exported fields or,
+// if present, from the sampled packet header `hdrs`
+func decodeTCP(fl *netflow.Flow, fm *fieldMap, r ipfix.FlowDataRecord, hdrs *packet.Headers) {
+	// Exporters send the flags as a single byte or, as of RFC 7125, as 16 bits
+	// whose upper 4 bits (the TCP data offset) are to be ignored
+	fl.TcpFlags = uint32At(r, fm.tcpFlags) & tcpFlagsMask
+	if fm.tcpWindowSize >= 0 {
+		fl.TcpWindowSize = convert.Uint32(r.Values[fm.tcpWindowSize])
+	}
+	if fm.tcpWindowScale >= 0 {
+		fl.TcpWindowScale = convert.Uint32(r.Values[fm.tcpWindowScale])
+	}
+
+	if hdrs == nil || hdrs.TCP == nil {
+		return
+	}
+	info := hdrs.TCP
+
+	if fm.tcpWindowSize < 0 {
+		fl.TcpWindowSize = uint32(info.Window)
+	}
+	if info.SYN {
+		fl.TcpMss = uint32(info.MSS)
+		if fm.tcpWindowScale < 0 {
+			fl.TcpWindowScale = uint32(info.WindowScale)
+		}
+	}
+}
+
+// decodeWlan fills the wireless information of `fl`
+func decodeWlan(fl *netflow.Flow, fm *fieldMap, r ipfix.FlowDataRecord) {
+	if fm.wlanSSID >= 0 {
+		// SSIDs in fixed length fields are padded with NUL bytes
+		fl.WlanSsid = strings.TrimRight(string(convert.Reverse(r.Values[fm.wlanSSID])), "\x00")
+	}
+	if fm.wlanChannel >= 0 {
+		fl.WlanChannel = convert.Uint32(r.Values[fm.wlanChannel])
+	}
+	if fm.staMac >= 0 {
+		fl.StaMac = convert.Reverse(r.Values[fm.staMac])
+	}
+}
+
+// decodeSegment fills the layer 2 segment of `fl`. The most significant byte of
+// layer2SegmentId is the network type. VXLAN VNIs and NVGRE VSIDs are 24 bits.
+func decodeSegment(fl *netflow.Flow, fm *fieldMap, r ipfix.FlowDataRecord) {
+	if fm.l2SegmentID < 0 {
+		return
+	}
+
+	v := convert.Uint64(r.Values[fm.l2SegmentID])
+	fl.L2SegmentType = uint32(v >> 56)
+	switch fl.L2SegmentType {
+	case ipfix.SegmentTypeVXLAN, ipfix.SegmentTypeNVGRE:
+		fl.L2SegmentId = v & 0xffffff
+	default:
+		fl.L2SegmentId = v & 0xffffffffffffff
+	}
+}
+
+// observeInitTime records init time `initTime` of router `addr` in milliseconds, logging reboots
+func observeInitTime(rs *stats.RouterStats, addr string, initTime uint64) {
+	if rs.ObserveInitTime(initTime) {
+		glog.Warningf("Router %s rebooted: init time moved to %d ms", addr, initTime)
+	}
+}
+
+// observationTime returns the time the record was observed at in seconds. Mediators
+// stamp records with it as they may export them long after, otherwise the export
+// time of the message `ts` is used. Observation times are corrected by `offset` seconds.
+func observationTime(fm *fieldMap, r ipfix.FlowDataRecord, ts int64, offset int64) int64 {
+	if fm.observationTime < 0 {
+		return ts
+	}
+	t := int64(convert.Uint64(r.Values[fm.observationTime]))
+	if fm.observationMillis {
+		t /= 1000
+	}
+	if t == 0 {
+		return ts
+	}
+	return t + offset
+}
+
+// decodeDuration fills start and end time of `fl`. Times relative to the exporters
+// uptime are made absolute using its init time `initTime` in milliseconds, and
+// left unknown if that is 0. Exporters sending start and end in different units
+// (seconds and milliseconds) are not supported. Known times are corrected by
+// `offset` seconds.
+func decodeDuration(fl *netflow.Flow, fm *fieldMap, r ipfix.FlowDataRecord, initTime int64, offset int64) {
+	unit := int64(1000)
+	base := int64(0)
+	if fm.flowMillis {
+		unit = 1
+	}
+	if fm.flowUptime {
+		if initTime == 0 {
+			return
+		}
+		unit = 1
+		base = initTime
+	}
+	if fm.flowStart >= 0 {
+		fl.Start = base + int64(convert.Uint64(r.Values[fm.flowStart]))*unit
+	}
+	if fm.flowEnd >= 0 {
+		fl.End = base + int64(convert.Uint64(r.Values[fm.flowEnd]))*unit
+	}
+	if fl.Start != 0 {
+		fl.Start += offset * 1000
+	}
+	if fl.End != 0 {
+		fl.End += offset * 1000
+	}
+}
+
+// decodeDSCP fills the type of service byte and ingress and egress DSCP of `fl`.
+// The DSCP information elements take precedence, otherwise the DSCP is taken from
+// the type of service byte. Routers not remarking may only export the ingress
+// DSCP, the egress DSCP is left unset then.
+func decodeDSCP(fl *netflow.Flow, fm *fieldMap, r ipfix.FlowDataRecord) {
+	if fm.tos >= 0 {
+		fl.Tos = convert.Uint32(r.Values[fm.tos])
+		fl.HasTos = true
+	}
+	fl.Dscp, fl.HasDscp = dscpAt(r, fm.dscp, fm.tos)
+	fl.PostDscp, fl.HasPostDscp = dscpAt(r, fm.postDSCP, fm.postTos)
+}
+
+// dscpAt returns the DSCP at index `dscp` of `r` or, if it is -1, the upper 6 bits
+// of the type of service byte at index `tos`. It returns false if neither is present.
+func dscpAt(r ipfix.FlowDataRecord, dscp int, tos int) (uint32, bool) {
+	if dscp >= 0 {
+		return convert.Uint32(r.Values[dscp]) & 0x3f, true
+	}
+	if tos >= 0 {
+		return convert.Uint32(r.Values[tos]) >> 2, true
+	}
+	return 0, false
+}
+
+// decodeMPLS fills the MPLS label stack of `fl` from the label stack sections of
+// the record. Levels the exporter doesn't send (or sends as all zeros) are skipped.
+// Each section carries label (20 bits), traffic class (3 bits) and bottom of stack
+// bit, decoding stops at the bottom of the stack.
+func decodeMPLS(fl *netflow.Flow, fm *fieldMap, r ipfix.FlowDataRecord) {
+	for _, i := range fm.mplsLabels {
+		if i < 0 {
+			continue
+		}
+		v := convert.Uint32(r.Values[i])
+		if v == 0 {
+			continue
+		}
+		fl.MplsLabels = append(fl.MplsLabels, v>>4)
+		if v&1 != 0 {
+			return
+		}
+	}
+}
+
+// send passes `fl` on to `Output`. If `Output` is not drained within `outputTimeout`,
+// e.g. because no consumer is attached, the flow is dropped or the server panics
+// instead of silently blocking the packet workers forever.
+func (ifs *IPFIXServer) send(fl *netflow.Flow) {
+	if ifs.outputTimeout == 0 {
+		ifs.Output <- fl
+		return
+	}
+
+	select {
+	case ifs.Output <- fl:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(ifs.outputTimeout)
+	defer timer.Stop()
+	select {
+	case ifs.Output <- fl:
+		return
+	case <-timer.C:
+	}
+
+	if ifs.outputPanic {
+		panic(outputStalled(fmt.Sprintf("IPFIX Output not drained for %v, is a consumer attached?", ifs.outputTimeout)))
+	}
+	atomic.AddUint64(&stats.GlobalStats.OutputDropped, 1)
+
+	// Log at most once per timeout to not flood the log while stalled
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&ifs.lastStallLog)
+	if now-last >= int64(ifs.outputTimeout/time.Second) && atomic.CompareAndSwapInt64(&ifs.lastStallLog, last, now) {
+		glog.Errorf("IPFIX Output not drained for %v, dropping flows. Is a consumer attached?", ifs.outputTimeout)
+	}
+}
+
+// logMissingTemplate warns about a flowset skipped for lack of template
+// `templateKey`. It logs at most once per minute, as exporters send many
+// flowsets until they resend their templates.
+func (ifs *IPFIXServer) logMissingTemplate(templateKey string) {
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&ifs.lastMissingLog)
+	if now-last >= 60 && atomic.CompareAndSwapInt64(&ifs.lastMissingLog, last, now) {
+		glog.Warningf("Skipping flowsets lacking their template (e.g. %s) until exporters resend it, %d skipped so far", templateKey, atomic.LoadUint64(&stats.GlobalStats.TemplateMisses))
 	}
 }
 
@@ -203,6 +1220,8 @@ func Dump(fl *netflow.Flow) {
 	fmt.Printf("DstAddr: %s\n", net.IP(fl.DstAddr).String())
 	fmt.Printf("Protocol: %d\n", fl.Protocol)
 	fmt.Printf("NextHop: %s\n", net.IP(fl.NextHop).String())
+	fmt.Printf("BgpNextHop: %s\n", net.IP(fl.BgpNextHop).String())
+	fmt.Printf("Vlan: %d\n", fl.Vlan)
 	fmt.Printf("IntIn: %d\n", fl.IntIn)
 	fmt.Printf("IntOut: %d\n", fl.IntOut)
 	fmt.Printf("Packets: %d\n", fl.Packets)
@@ -219,14 +1238,96 @@ func DumpTemplate(tmpl *ipfix.TemplateRecords) {
 }
 
 // generateFieldMap processes a TemplateRecord and populates a fieldMap accordingly
-// the FieldMap can then be used to read fields from a flow
-func generateFieldMap(template *ipfix.TemplateRecords) *fieldMap {
-	var fm fieldMap
+// the FieldMap can then be used to read fields from a flow. Fields found in `stringLabels`
+// are added to the list of labels. Fields found in `overrides` are decoded as the type
+// given there (or skipped) instead of their own. If `peerAS` is set SrcAs and DstAs are
+// mapped to the peer ASNs, as sent by routers configured to export peer instead of origin ASNs.
+func generateFieldMap(template *ipfix.TemplateRecords, stringLabels map[ipfix.FieldID]string, overrides FieldOverrides, peerAS bool) *fieldMap {
+	fm := fieldMap{
+		srcAddr:  -1,
+		dstAddr:  -1,
+		protocol: -1,
+		packets:  -1,
+		size:     -1,
+		intIn:    -1,
+		intOut:   -1,
+		nextHop:  -1,
+		vlan:     -1,
+		srcPort:  -1,
+		dstPort:  -1,
+		minTTL:   -1,
+		maxTTL:   -1,
+		ports:    -1,
+
+		srcMac: -1,
+		dstMac: -1,
+
+		bgpNextHop: -1,
+
+		srcAsn:     -1,
+		dstAsn:     -1,
+		srcPeerAsn: -1,
+		dstPeerAsn: -1,
+
+		endReason:       -1,
+		tcpFlags:        -1,
+		tcpWindowSize:   -1,
+		tcpWindowScale:  -1,
+		ipHeaderSection: -1,
+		dataLinkSection: -1,
+		wlanSSID:        -1,
+		wlanChannel:     -1,
+		staMac:          -1,
+		l2SegmentID:     -1,
+		systemInitTime:  -1,
+		appName:         -1,
+		droppedBytes:    -1,
+		droppedPackets:  -1,
+		fwdStatus:       -1,
+		ingressVRF:      -1,
+		egressVRF:       -1,
+
+		selectorAlgorithm:     -1,
+		flowSelectorAlgorithm: -1,
+
+		samplingInterval:       -1,
+		samplerRandomInterval:  -1,
+		samplingPacketInterval: -1,
+		samplingPacketSpace:    -1,
+		dataLinkFrameSize:      -1,
+		ipTotalLength:          -1,
+		connectionID:           -1,
+		observationTime:        -1,
+		tos:                    -1,
+		postTos:                -1,
+		dscp:                   -1,
+		postDSCP:               -1,
+		flowStart:              -1,
+		flowEnd:                -1,
+	}
+	for l := range fm.mplsLabels {
+		fm.mplsLabels[l] = -1
+	}
 	i := -1
 	for _, f := range template.Records {
 		i++
 
-		switch f.Type {
+		typ := f.Type
+		if o, ok := overrides[template.FieldID(i)]; ok && o.Retype {
+			if o.Type == ignoreField {
+				continue
+			}
+			typ = o.Type
+		} else if label, ok := stringLabels[template.FieldID(i)]; ok {
+			fm.labels = append(fm.labels, labelField{index: i, label: label})
+			continue
+		}
+
+		if overrides[template.FieldID(i)].LittleEndian {
+			fm.littleEndian = append(fm.littleEndian, i)
+		}
+
+		switch typ {
 		case ipfix.IPv4SrcAddr:
 			fm.srcAddr = i
 			fm.family = 4
@@ -251,14 +1352,140 @@ func generateFieldMap(template *ipfix.TemplateRecords) *fieldMap {
 			fm.nextHop = i
 		case ipfix.IPv6NextHop:
 			fm.nextHop = i
+		case ipfix.SrcVlan, ipfix.Dot1qVlanID:
+			fm.vlan = i
+		case ipfix.DstVlan, ipfix.PostDot1qVlanID:
+			// The egress VLAN is only used if the ingress VLAN isn't exported
+			if fm.vlan < 0 {
+				fm.vlan = i
+			}
+		case ipfix.InSrcMac:
+			fm.srcMac = i
+		case ipfix.OutSrcMac:
+			// Addresses as sent are only used if those as received aren't exported
+			if fm.srcMac < 0 {
+				fm.srcMac = i
+			}
+		case ipfix.InDstMac:
+			fm.dstMac = i
+		case ipfix.OutDstMac:
+			if fm.dstMac < 0 {
+				fm.dstMac = i
+			}
+		case ipfix.BGPIPv4NextHop:
+			fm.bgpNextHop = i
+		case ipfix.BgpIPv6NextHop:
+			fm.bgpNextHop = i
 		case ipfix.L4SrcPort:
 			fm.srcPort = i
 		case ipfix.L4DstPort:
 			fm.dstPort = i
+		case combinedPorts:
+			fm.ports = i
+		case ipfix.MplsLabel1, ipfix.MplsLabel2, ipfix.MplsLabel3, ipfix.MplsLabel4, ipfix.MplsLabel5,
+			ipfix.MplsLabel6, ipfix.MplsLabel7, ipfix.MplsLabel8, ipfix.MplsLabel9, ipfix.MplsLabel10:
+			fm.mplsLabels[typ-ipfix.MplsLabel1] = i
+		case ipfix.SrcTos:
+			fm.tos = i
+		case ipfix.DstTos:
+			fm.postTos = i
+		case ipfix.IPDiffServCodePoint:
+			fm.dscp = i
+		case ipfix.PostIPDiffServCodePoint:
+			fm.postDSCP = i
+		case ipfix.ObservationTimeSeconds:
+			fm.observationTime = i
+		case ipfix.ObservationTimeMillis:
+			fm.observationTime = i
+			fm.observationMillis = true
+		case ipfix.ConnectionTransactionID:
+			fm.connectionID = i
+		case ipfix.FlowStartSeconds:
+			fm.flowStart = i
+		case ipfix.FlowEndSeconds:
+			fm.flowEnd = i
+		case ipfix.FlowStartMilliseconds:
+			fm.flowStart = i
+			fm.flowMillis = true
+		case ipfix.FlowEndMilliseconds:
+			fm.flowEnd = i
+			fm.flowMillis = true
+		case ipfix.FirstSwitched:
+			fm.flowStart = i
+			fm.flowUptime = true
+		case ipfix.LastSwitched:
+			fm.flowEnd = i
+			fm.flowUptime = true
+		case ipfix.MinTTL:
+			fm.minTTL = i
+		case ipfix.MaxTTL:
+			fm.maxTTL = i
 		case ipfix.SrcAs:
-			fm.srcAsn = i
+			if peerAS {
+				fm.srcPeerAsn = i
+			} else {
+				fm.srcAsn = i
+			}
 		case ipfix.DstAs:
-			fm.dstAsn = i
+			if peerAS {
+				fm.dstPeerAsn = i
+			} else {
+				fm.dstAsn = i
+			}
+		case ipfix.BgpPrevAdjacentAsNumber:
+			fm.srcPeerAsn = i
+		case ipfix.BgpNextAdjacentAsNumber:
+			fm.dstPeerAsn = i
+		case ipfix.FlowEndReason:
+			fm.endReason = i
+		case ipfix.TCPFlags:
+			fm.tcpFlags = i
+		case ipfix.TCPWindowSize:
+			fm.tcpWindowSize = i
+		case ipfix.TCPWindowScale:
+			fm.tcpWindowScale = i
+		case ipfix.IPHeaderPacketSection:
+			fm.ipHeaderSection = i
+		case ipfix.DataLinkFrameSection:
+			fm.dataLinkSection = i
+		case ipfix.WlanSSID:
+			fm.wlanSSID = i
+		case ipfix.WlanChannelID:
+			fm.wlanChannel = i
+		case ipfix.StaMacAddress:
+			fm.staMac = i
+		case ipfix.SystemInitTimeMillis:
+			fm.systemInitTime = i
+		case ipfix.ApplicationName:
+			fm.appName = i
+		case ipfix.DroppedOctetDeltaCount:
+			fm.droppedBytes = i
+		case ipfix.DroppedPacketDeltaCount:
+			fm.droppedPackets = i
+		case ipfix.ForwardingStatus:
+			fm.fwdStatus = i
+		case ipfix.IngressVRFID:
+			fm.ingressVRF = i
+		case ipfix.EgressVRFID:
+			fm.egressVRF = i
+		case ipfix.Layer2SegmentID:
+			fm.l2SegmentID = i
+		case ipfix.SamplingInterval:
+			fm.samplingInterval = i
+		case ipfix.FlowSamplerRandomInterval:
+			fm.samplerRandomInterval = i
+		case ipfix.SamplingPacketInterval:
+			fm.samplingPacketInterval = i
+		case ipfix.SamplingPacketSpace:
+			fm.samplingPacketSpace = i
+		case ipfix.DataLinkFrameSize:
+			fm.dataLinkFrameSize = i
+		case ipfix.IPTotalLength:
+			fm.ipTotalLength = i
+		case ipfix.SelectorAlgorithm:
+			fm.selectorAlgorithm = i
+		case ipfix.FlowSelectorAlgorithm:
+			fm.flowSelectorAlgorithm = i
 		}
 	}
 	return &fm
@@ -268,8 +1495,51 @@ func generateFieldMap(template *ipfix.TemplateRecords) *fieldMap {
 func (ifs *IPFIXServer) updateTemplateCache(remote net.IP, p *ipfix.Packet) {
 	templRecs := p.GetTemplateRecords()
 	for _, tr := range templRecs {
-		ifs.tmplCache.set(convert.Uint32(remote), tr.Packet.Header.DomainID, tr.Header.TemplateID, *tr)
+		if err := checkTemplate(tr); err != nil {
+			atomic.AddUint64(&stats.GlobalStats.TemplatesInvalid, 1)
+			if ifs.debug.Level() > 0 {
+				glog.Warningf("Skipping template %d of %s: %v", tr.Header.TemplateID, remote, err)
+			}
+			continue
+		}
+		ifs.tmplCache.set(remote, tr.Packet.Header.DomainID, tr.Header.TemplateID, *tr)
+	}
+}
+
+// ParseStringLabels parses a comma separated list of string fields to be stored as
+// labels. Each element is of the form [enterprise/]type=label, e.g. "460=http.host".
+func ParseStringLabels(spec string) (map[ipfix.FieldID]string, error) {
+	labels := make(map[ipfix.FieldID]string)
+	if spec == "" {
+		return labels, nil
+	}
+
+	for _, elem := range strings.Split(spec, ",") {
+		parts := strings.SplitN(elem, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid element %q, expected [enterprise/]type=label", elem)
+		}
+
+		var id ipfix.FieldID
+		typ := parts[0]
+		if i := strings.Index(typ, "/"); i >= 0 {
+			pen, err := strconv.ParseUint(typ[:i], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid enterprise number in %q: %v", elem, err)
+			}
+			id.Enterprise = uint32(pen)
+			typ = typ[i+1:]
+		}
+
+		// Some vendors document enterprise specific types with the enterprise bit set
+		t, err := strconv.ParseUint(typ, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid type in %q: %v", elem, err)
+		}
+		id.Type = uint16(t) &^ ipfix.EnterpriseBit
+		labels[id] = parts[1]
 	}
+	return labels, nil
 }
 
 // makeTemplateKey creates a string of the 3 tuple router address, source id and template id
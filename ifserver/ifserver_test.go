@@ -0,0 +1,2234 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/convert"
+	"github.com/google/tflow2/ipfix"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+// long is a string that needs the 3 byte length prefix of variable length fields
+var long = string(bytes.Repeat([]byte("a"), 300))
+
+// field is a field of a test template
+type field struct {
+	typ        uint16
+	enterprise uint32
+	value      []byte
+
+	// varlen makes the field variable length
+	varlen bool
+}
+
+// buildPacket creates an IPFIX message carrying a template with `fields` and a single data record
+func buildPacket(templateID uint16, fields []field) []byte {
+	return buildOptionsPacket(templateID, 0, fields)
+}
+
+// buildOptionsPacket creates an IPFIX message carrying an options template with
+// `fields`, the first `scopeFields` of them being scope fields, and a single
+// data record. A regular template is used if `scopeFields` is 0.
+func buildOptionsPacket(templateID uint16, scopeFields uint16, fields []field) []byte {
+	setID := uint16(ipfix.TemplateSetID)
+	tmpl := &bytes.Buffer{}
+	binary.Write(tmpl, binary.BigEndian, templateID)
+	binary.Write(tmpl, binary.BigEndian, uint16(len(fields)))
+	if scopeFields > 0 {
+		setID = ipfix.OptionsTemplateSetID
+		binary.Write(tmpl, binary.BigEndian, scopeFields)
+	}
+	data := &bytes.Buffer{}
+	for _, f := range fields {
+		length := uint16(len(f.value))
+		if f.varlen {
+			length = ipfix.VariableLength
+			if len(f.value) < 255 {
+				data.WriteByte(byte(len(f.value)))
+			} else {
+				data.WriteByte(255)
+				binary.Write(data, binary.BigEndian, uint16(len(f.value)))
+			}
+		}
+		data.Write(f.value)
+
+		if f.enterprise != 0 {
+			binary.Write(tmpl, binary.BigEndian, f.typ|ipfix.EnterpriseBit)
+			binary.Write(tmpl, binary.BigEndian, length)
+			binary.Write(tmpl, binary.BigEndian, f.enterprise)
+		} else {
+			binary.Write(tmpl, binary.BigEndian, f.typ)
+			binary.Write(tmpl, binary.BigEndian, length)
+		}
+	}
+
+	sets := &bytes.Buffer{}
+	binary.Write(sets, binary.BigEndian, setID)
+	binary.Write(sets, binary.BigEndian, uint16(tmpl.Len()+4))
+	sets.Write(tmpl.Bytes())
+	binary.Write(sets, binary.BigEndian, templateID)
+	binary.Write(sets, binary.BigEndian, uint16(data.Len()+4))
+	sets.Write(data.Bytes())
+
+	pkt := &bytes.Buffer{}
+	binary.Write(pkt, binary.BigEndian, uint16(10))
+	binary.Write(pkt, binary.BigEndian, uint16(sets.Len()+16))
+	binary.Write(pkt, binary.BigEndian, uint32(1500000000))
+	binary.Write(pkt, binary.BigEndian, uint32(1))
+	binary.Write(pkt, binary.BigEndian, uint32(0))
+	pkt.Write(sets.Bytes())
+	return pkt.Bytes()
+}
+
+func newTestServer() *IPFIXServer {
+	return &IPFIXServer{
+		tmplCache:  newTemplateCache(0),
+		interfaces: newInterfaceTable(),
+		samplers:   newSamplingTable(),
+		Output:     make(chan *netflow.Flow, 10),
+	}
+}
+
+func TestDecodeWlan(t *testing.T) {
+	ssid := make([]byte, 32)
+	copy(ssid, "corp-wifi")
+
+	pkt := buildPacket(256, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.IPv4NextHop, value: []byte{10, 0, 0, 254}},
+		{typ: ipfix.InBytes, value: []byte{0, 0, 5, 220}},
+		{typ: ipfix.InPkts, value: []byte{0, 0, 0, 1}},
+		{typ: ipfix.Protocol, value: []byte{6}},
+		{typ: ipfix.WlanSSID, value: ssid},
+		{typ: ipfix.WlanChannelID, value: []byte{36}},
+		{typ: ipfix.StaMacAddress, value: []byte{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01}},
+		// Vendor specific field must not break decoding of the record
+		{typ: 1, enterprise: 14179, value: []byte{0xff, 0xff}},
+	})
+
+	ifs := newTestServer()
+	ifs.processPacket(net.IP{192, 0, 2, 1}, pkt)
+
+	if len(ifs.Output) != 1 {
+		t.Fatalf("Expected 1 flow, got %d", len(ifs.Output))
+	}
+	fl := <-ifs.Output
+
+	if fl.WlanSsid != "corp-wifi" {
+		t.Errorf("Expected SSID %q, got %q", "corp-wifi", fl.WlanSsid)
+	}
+	if fl.WlanChannel != 36 {
+		t.Errorf("Expected channel 36, got %d", fl.WlanChannel)
+	}
+	if mac := net.HardwareAddr(fl.StaMac).String(); mac != "02:00:5e:10:00:01" {
+		t.Errorf("Expected station MAC 02:00:5e:10:00:01, got %s", mac)
+	}
+	if fl.Size != 1500 {
+		t.Errorf("Expected size 1500, got %d", fl.Size)
+	}
+	if !net.IP(fl.SrcAddr).Equal(net.IP{10, 0, 0, 1}) {
+		t.Errorf("Expected source 10.0.0.1, got %s", net.IP(fl.SrcAddr))
+	}
+}
+
+func TestStringLabels(t *testing.T) {
+	labels, err := ParseStringLabels("460=http.host,461=http.target,35632/57660=tls.sni")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	pkt := buildPacket(257, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.IPv4NextHop, value: []byte{10, 0, 0, 254}},
+		{typ: ipfix.HTTPRequestHost, value: []byte("example.com"), varlen: true},
+		{typ: ipfix.HTTPRequestTarget, value: []byte(long), varlen: true},
+		{typ: 57660, enterprise: 35632, value: []byte("tls.example.com"), varlen: true},
+		{typ: ipfix.InBytes, value: []byte{0, 0, 5, 220}},
+	})
+
+	ifs := newTestServer()
+	ifs.stringLabels = labels
+	ifs.processPacket(net.IP{192, 0, 2, 1}, pkt)
+
+	if len(ifs.Output) != 1 {
+		t.Fatalf("Expected 1 flow, got %d", len(ifs.Output))
+	}
+	fl := <-ifs.Output
+
+	expected := map[string]string{
+		"http.host":   "example.com",
+		"http.target": long,
+		"tls.sni":     "tls.example.com",
+	}
+	for k, v := range expected {
+		if fl.Labels[k] != v {
+			t.Errorf("Expected label %s=%q, got %q", k, v, fl.Labels[k])
+		}
+	}
+	if fl.Size != 1500 {
+		t.Errorf("Expected size 1500 after variable length fields, got %d", fl.Size)
+	}
+}
+
+func TestParseStringLabelsInvalid(t *testing.T) {
+	for _, spec := range []string{"460", "x=http.host", "460=", "a/460=http.host"} {
+		if _, err := ParseStringLabels(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestHTTPIngest(t *testing.T) {
+	msg := buildPacket(258, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.IPv4NextHop, value: []byte{10, 0, 0, 254}},
+		{typ: ipfix.InBytes, value: []byte{0, 0, 5, 220}},
+	})
+	body := append(append([]byte{}, msg...), msg...)
+
+	// Requests built by httptest are received from 192.0.2.1
+	ifs := newTestServer()
+	ifs.trustedProxies, _ = ParseTrustedProxies("192.0.2.0/24")
+	packets := atomic.LoadUint64(&stats.GlobalStats.IPFIXpackets)
+	req := httptest.NewRequest(http.MethodPost, IngestPath, bytes.NewReader(body))
+	req.Header.Set(ExporterHeader, "198.51.100.1")
+	w := httptest.NewRecorder()
+	ifs.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if n := atomic.LoadUint64(&stats.GlobalStats.IPFIXpackets) - packets; n != 2 {
+		t.Errorf("Expected 2 messages counted as packets, got %d", n)
+	}
+	if len(ifs.Output) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(ifs.Output))
+	}
+	fl := <-ifs.Output
+	<-ifs.Output
+	if !net.IP(fl.Router).Equal(net.IP{198, 51, 100, 1}) {
+		t.Errorf("Expected router 198.51.100.1, got %s", net.IP(fl.Router))
+	}
+
+	// Clients other than trusted proxies can't claim another exporter
+	ifs.trustedProxies, _ = ParseTrustedProxies("203.0.113.1")
+	req = httptest.NewRequest(http.MethodPost, IngestPath, bytes.NewReader(msg))
+	req.Header.Set(ExporterHeader, "198.51.100.1")
+	ifs.ServeHTTP(httptest.NewRecorder(), req)
+	if fl := <-ifs.Output; !net.IP(fl.Router).Equal(net.IP{192, 0, 2, 1}) {
+		t.Errorf("Expected router 192.0.2.1 of untrusted client, got %s", net.IP(fl.Router))
+	}
+
+	// Truncated second message, nothing is ingested
+	req = httptest.NewRequest(http.MethodPost, IngestPath, bytes.NewReader(body[:len(body)-1]))
+	w = httptest.NewRecorder()
+	ifs.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for truncated body, got %d", http.StatusBadRequest, w.Code)
+	}
+	if len(ifs.Output) != 0 {
+		t.Errorf("Expected no flows of truncated body, got %d", len(ifs.Output))
+	}
+
+	// Messages failing to decode don't keep others from being ingested
+	invalid := append([]byte{}, msg...)
+	binary.BigEndian.PutUint16(invalid, 9)
+	req = httptest.NewRequest(http.MethodPost, IngestPath, bytes.NewReader(append(invalid, msg...)))
+	w = httptest.NewRecorder()
+	ifs.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Ingested 1 of 2 messages") {
+		t.Errorf("Expected status %d reporting partial success, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if len(ifs.Output) != 1 {
+		t.Errorf("Expected 1 flow of the valid message, got %d", len(ifs.Output))
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies("192.0.2.0/24,2001:db8::1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(proxies) != 2 || !proxies[0].Contains(net.IP{192, 0, 2, 200}) || !proxies[1].Contains(net.ParseIP("2001:db8::1")) || proxies[1].Contains(net.ParseIP("2001:db8::2")) {
+		t.Errorf("Unexpected proxies %v", proxies)
+	}
+
+	for _, spec := range []string{"192.0.2.0/33", "proxy", "192.0.2.1,"} {
+		if _, err := ParseTrustedProxies(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestListenHTTPError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer ln.Close()
+
+	ifs := newTestServer()
+	if err := ifs.ListenHTTP(ln.Addr().String(), "", "", nil); err == nil {
+		t.Errorf("Expected error listening on an address in use")
+	}
+	if err := ifs.ListenHTTP("127.0.0.1:0", "missing.pem", "missing.key", nil); err == nil {
+		t.Errorf("Expected error for a missing certificate")
+	}
+}
+
+func TestHTTPIngestGzip(t *testing.T) {
+	msg := buildPacket(460, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.InBytes, value: []byte{0, 0, 5, 220}},
+	})
+	compress := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	ifs := newTestServer()
+	req := httptest.NewRequest(http.MethodPost, IngestPath, bytes.NewReader(compress(msg)))
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	ifs.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusNoContent, w.Code, w.Body.String())
+	}
+	if len(ifs.Output) != 1 {
+		t.Fatalf("Expected 1 flow, got %d", len(ifs.Output))
+	}
+
+	// Decompression bomb
+	req = httptest.NewRequest(http.MethodPost, IngestPath, bytes.NewReader(compress(make([]byte, maxIngestBody+1))))
+	req.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	ifs.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for oversized body, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, IngestPath, bytes.NewReader(msg))
+	req.Header.Set("Content-Encoding", "br")
+	w = httptest.NewRecorder()
+	ifs.ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status %d for unknown encoding, got %d", http.StatusUnsupportedMediaType, w.Code)
+	}
+}
+
+func TestDecodeASNs(t *testing.T) {
+	asn := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+
+	pkt := buildPacket(259, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.IPv4NextHop, value: []byte{10, 0, 0, 254}},
+		{typ: ipfix.SrcAs, value: asn(64496)},
+		{typ: ipfix.DstAs, value: asn(64497)},
+		{typ: ipfix.BgpPrevAdjacentAsNumber, value: asn(64498)},
+		{typ: ipfix.BgpNextAdjacentAsNumber, value: asn(64499)},
+	})
+	peerPkt := buildPacket(260, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.IPv4NextHop, value: []byte{10, 0, 0, 254}},
+		{typ: ipfix.SrcAs, value: asn(64510)},
+		{typ: ipfix.DstAs, value: asn(64511)},
+	})
+
+	ifs := newTestServer()
+	ifs.peerASExporters = map[string]bool{"192.0.2.2": true}
+	ifs.processPacket(net.IP{192, 0, 2, 1}, pkt)
+	ifs.processPacket(net.IP{192, 0, 2, 2}, peerPkt)
+
+	if len(ifs.Output) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(ifs.Output))
+	}
+
+	tests := []struct {
+		name      string
+		srcAs     uint32
+		dstAs     uint32
+		srcPeerAs uint32
+		nextHopAs uint32
+	}{
+		{name: "origin", srcAs: 64496, dstAs: 64497, srcPeerAs: 64498, nextHopAs: 64499},
+		{name: "peer", srcPeerAs: 64510, nextHopAs: 64511},
+	}
+	for _, test := range tests {
+		fl := <-ifs.Output
+		if fl.SrcAs != test.srcAs || fl.DstAs != test.dstAs || fl.SrcPeerAs != test.srcPeerAs || fl.NextHopAs != test.nextHopAs {
+			t.Errorf("%s: Expected ASNs %d/%d peers %d/%d, got %d/%d peers %d/%d", test.name,
+				test.srcAs, test.dstAs, test.srcPeerAs, test.nextHopAs,
+				fl.SrcAs, fl.DstAs, fl.SrcPeerAs, fl.NextHopAs)
+		}
+	}
+}
+
+func TestFieldOverrides(t *testing.T) {
+	overrides, err := ParseFieldOverrides("192.0.2.1/2=ignore,192.0.2.1/9/12=packets")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fields := []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.IPv4NextHop, value: []byte{10, 0, 0, 254}},
+		{typ: ipfix.InPkts, value: []byte{0xde, 0xad, 0xbe, 0xef}},
+		{typ: 12, enterprise: 9, value: []byte{0, 0, 0, 3}},
+	}
+
+	ifs := newTestServer()
+	ifs.fieldOverrides = overrides
+	ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(261, fields))
+	ifs.processPacket(net.IP{192, 0, 2, 2}, buildPacket(261, fields))
+
+	if len(ifs.Output) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(ifs.Output))
+	}
+	if fl := <-ifs.Output; fl.Packets != 3 {
+		t.Errorf("Expected overridden packet count 3, got %d", fl.Packets)
+	}
+	if fl := <-ifs.Output; fl.Packets != 0xdeadbeef {
+		t.Errorf("Expected packet count %d of other exporter, got %d", 0xdeadbeef, fl.Packets)
+	}
+}
+
+func TestLittleEndianOverride(t *testing.T) {
+	overrides, err := ParseFieldOverrides("192.0.2.1/1=little_endian,192.0.2.1/9/12=packets,192.0.2.1/9/12=little_endian")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fields := []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.InBytes, value: []byte{0xdc, 0x05, 0, 0}},
+		{typ: 12, enterprise: 9, value: []byte{3, 0, 0, 0}},
+	}
+
+	ifs := newTestServer()
+	ifs.fieldOverrides = overrides
+	ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(262, fields))
+	ifs.processPacket(net.IP{192, 0, 2, 2}, buildPacket(262, fields))
+
+	if len(ifs.Output) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(ifs.Output))
+	}
+	if fl := <-ifs.Output; fl.Size != 1500 || fl.Packets != 3 {
+		t.Errorf("Expected 3 packets/1500 bytes, got %d/%d", fl.Packets, fl.Size)
+	}
+	if fl := <-ifs.Output; fl.Size != 0xdc050000 {
+		t.Errorf("Expected %d bytes in network byte order of other exporter, got %d", 0xdc050000, fl.Size)
+	}
+}
+
+func TestCombinedPortsOverride(t *testing.T) {
+	overrides, err := ParseFieldOverrides("192.0.2.1/9/20=ports")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fields := []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.Protocol, value: []byte{6}},
+		{typ: 20, enterprise: 9, value: []byte{0xc3, 0x50, 0x01, 0xbb}},
+	}
+
+	ifs := newTestServer()
+	ifs.fieldOverrides = overrides
+	ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(263, fields))
+	ifs.processPacket(net.IP{192, 0, 2, 2}, buildPacket(263, fields))
+
+	if len(ifs.Output) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(ifs.Output))
+	}
+	if fl := <-ifs.Output; fl.SrcPort != 50000 || fl.DstPort != 443 {
+		t.Errorf("Expected ports 50000 -> 443, got %d -> %d", fl.SrcPort, fl.DstPort)
+	}
+	if fl := <-ifs.Output; fl.SrcPort != 0 || fl.DstPort != 0 {
+		t.Errorf("Expected no ports for exporter without override, got %d -> %d", fl.SrcPort, fl.DstPort)
+	}
+}
+
+func TestVRFMap(t *testing.T) {
+	vrfMaps, err := ParseVRFMaps("192.0.2.1/1=10,192.0.2.1/2=20")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		fields  []field
+		ingress uint32
+		egress  uint32
+	}{
+		{
+			name:    "Mapped",
+			ingress: 10,
+			egress:  20,
+		},
+		{
+			name:    "Exported ingress VRF",
+			fields:  []field{{typ: ipfix.IngressVRFID, value: []byte{0, 0, 0, 30}}},
+			ingress: 30,
+			egress:  20,
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+			{typ: ipfix.InputSnmp, value: []byte{0, 0, 0, 1}},
+			{typ: ipfix.OutputSnmp, value: []byte{0, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.vrfMaps = vrfMaps
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(450+i), fields))
+		ifs.processPacket(net.IP{192, 0, 2, 2}, buildPacket(uint16(450+i), fields))
+		if len(ifs.Output) != 2 {
+			t.Fatalf("%s: Expected 2 flows, got %d", test.name, len(ifs.Output))
+		}
+		if fl := <-ifs.Output; fl.IngressVrf != test.ingress || fl.EgressVrf != test.egress {
+			t.Errorf("%s: Expected VRFs %d/%d, got %d/%d", test.name, test.ingress, test.egress, fl.IngressVrf, fl.EgressVrf)
+		}
+		if fl := <-ifs.Output; fl.EgressVrf != 0 {
+			t.Errorf("%s: Expected no egress VRF for unmapped exporter, got %d", test.name, fl.EgressVrf)
+		}
+	}
+
+	for _, spec := range []string{"192.0.2.1=3", "192.0.2.1/x=3", "192.0.2.1/1=x", "x/1=3"} {
+		if _, err := ParseVRFMaps(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestParseFieldOverridesInvalid(t *testing.T) {
+	for _, spec := range []string{"192.0.2.1/2", "192.0.2.1=packets", "192.0.2.1/2=foo", "x/2=packets", "192.0.2.1/a/2=packets", "192.0.2.1/1/2/3=packets"} {
+		if _, err := ParseFieldOverrides(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestDecodeSelector(t *testing.T) {
+	tests := []struct {
+		name       string
+		fields     []field
+		unscalable bool
+	}{
+		{
+			name:   "No selector",
+			fields: nil,
+		},
+		{
+			name:   "Random selection",
+			fields: []field{{typ: ipfix.SelectorAlgorithm, value: []byte{ipfix.SelectorRandomNOutOfN}}},
+		},
+		{
+			name:       "Hash based selection",
+			fields:     []field{{typ: ipfix.SelectorAlgorithm, value: []byte{ipfix.SelectorHashCRC}}},
+			unscalable: true,
+		},
+		{
+			name: "Mismatching flow selector",
+			fields: []field{
+				{typ: ipfix.SelectorAlgorithm, value: []byte{ipfix.SelectorSystematicCount}},
+				{typ: ipfix.FlowSelectorAlgorithm, value: []byte{ipfix.SelectorPropertyMatch}},
+			},
+			unscalable: true,
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+			{typ: ipfix.IPv4NextHop, value: []byte{10, 0, 0, 254}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(300+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		if fl := <-ifs.Output; fl.Unscalable != test.unscalable {
+			t.Errorf("%s: Expected unscalable %v, got %v", test.name, test.unscalable, fl.Unscalable)
+		}
+	}
+}
+
+func TestDecodeSegment(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   []byte
+		segType uint32
+		segID   uint64
+	}{
+		{
+			name:    "VXLAN",
+			value:   []byte{ipfix.SegmentTypeVXLAN, 0, 0, 0, 0, 0x01, 0xe2, 0x40},
+			segType: ipfix.SegmentTypeVXLAN,
+			segID:   123456,
+		},
+		{
+			name:    "NVGRE",
+			value:   []byte{ipfix.SegmentTypeNVGRE, 0, 0, 0, 0xff, 0x00, 0x10, 0x00},
+			segType: ipfix.SegmentTypeNVGRE,
+			segID:   4096,
+		},
+		{
+			name:    "Unknown",
+			value:   []byte{0x7f, 0, 0, 0, 0x01, 0x00, 0x00, 0x00},
+			segType: 0x7f,
+			segID:   1 << 24,
+		},
+	}
+
+	for i, test := range tests {
+		fields := []field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+			{typ: ipfix.IPv4NextHop, value: []byte{10, 0, 0, 254}},
+			{typ: ipfix.Layer2SegmentID, value: test.value},
+		}
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(310+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		fl := <-ifs.Output
+		if fl.L2SegmentType != test.segType || fl.L2SegmentId != test.segID {
+			t.Errorf("%s: Expected segment %d/%d, got %d/%d", test.name, test.segType, test.segID, fl.L2SegmentType, fl.L2SegmentId)
+		}
+	}
+}
+
+func TestDecodeMPLS(t *testing.T) {
+	// Label stack entries of labels 16001, 24005 and 299776 (bottom of stack)
+	top := []byte{0x03, 0xe8, 0x10}
+	middle := []byte{0x05, 0xdc, 0x50}
+	bottom := []byte{0x49, 0x30, 0x01}
+
+	tests := []struct {
+		name   string
+		fields []field
+		labels []uint32
+	}{
+		{
+			name: "Full stack",
+			fields: []field{
+				{typ: ipfix.MplsLabel1, value: top},
+				{typ: ipfix.MplsLabel2, value: middle},
+				{typ: ipfix.MplsLabel3, value: bottom},
+			},
+			labels: []uint32{16001, 24005, 299776},
+		},
+		{
+			name: "Subset of levels",
+			fields: []field{
+				{typ: ipfix.MplsLabel3, value: bottom},
+				{typ: ipfix.MplsLabel1, value: top},
+			},
+			labels: []uint32{16001, 299776},
+		},
+		{
+			name: "Unused levels after bottom of stack",
+			fields: []field{
+				{typ: ipfix.MplsLabel1, value: top},
+				{typ: ipfix.MplsLabel2, value: bottom},
+				{typ: ipfix.MplsLabel3, value: middle},
+				{typ: ipfix.MplsLabel4, value: []byte{0, 0, 0}},
+			},
+			labels: []uint32{16001, 299776},
+		},
+		{
+			name: "No label stack",
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(350+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		if fl := <-ifs.Output; !reflect.DeepEqual(fl.MplsLabels, test.labels) {
+			t.Errorf("%s: Expected label stack %v, got %v", test.name, test.labels, fl.MplsLabels)
+		}
+	}
+}
+
+func TestPacketReport(t *testing.T) {
+	// Ethernet frame of a 1500 byte IPv4 TCP packet from 10.0.0.1:443 to 10.0.0.2:51000, truncated after the ports
+	frame := []byte{
+		0x02, 0x00, 0x00, 0x00, 0x00, 0x02, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x08, 0x00,
+		0x45, 0x00, 0x05, 0xdc, 0x00, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		10, 0, 0, 1, 10, 0, 0, 2,
+		0x01, 0xbb, 0xc7, 0x38,
+	}
+
+	tests := []struct {
+		name    string
+		fields  []field
+		flows   int
+		packets uint32
+		size    uint64
+	}{
+		{
+			name: "Unsampled",
+			fields: []field{
+				{typ: ipfix.DataLinkFrameSection, value: frame, varlen: true},
+			},
+			flows:   1,
+			packets: 1,
+			size:    1500,
+		},
+		{
+			name: "Systematic count based sampling",
+			fields: []field{
+				{typ: ipfix.DataLinkFrameSection, value: frame, varlen: true},
+				{typ: ipfix.DataLinkFrameSize, value: []byte{0x05, 0xea}},
+				{typ: ipfix.SamplingPacketInterval, value: []byte{0, 0, 0, 1}},
+				{typ: ipfix.SamplingPacketSpace, value: []byte{0, 0, 0, 99}},
+			},
+			flows:   1,
+			packets: 100,
+			size:    151400,
+		},
+		{
+			name: "Deterministic selector",
+			fields: []field{
+				{typ: ipfix.DataLinkFrameSection, value: frame, varlen: true},
+				{typ: ipfix.SamplingInterval, value: []byte{0, 0, 0, 10}},
+				{typ: ipfix.SelectorAlgorithm, value: []byte{ipfix.SelectorHashCRC}},
+			},
+			flows:   1,
+			packets: 1,
+			size:    1500,
+		},
+		{
+			name: "Truncated IP header",
+			fields: []field{
+				{typ: ipfix.DataLinkFrameSection, value: frame[:24], varlen: true},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(320+i), test.fields))
+		if len(ifs.Output) != test.flows {
+			t.Fatalf("%s: Expected %d flows, got %d", test.name, test.flows, len(ifs.Output))
+		}
+		if test.flows == 0 {
+			continue
+		}
+
+		fl := <-ifs.Output
+		if fl.Family != 4 || !net.IP(fl.SrcAddr).Equal(net.IP{10, 0, 0, 1}) || !net.IP(fl.DstAddr).Equal(net.IP{10, 0, 0, 2}) {
+			t.Errorf("%s: Expected IPv4 flow 10.0.0.1 -> 10.0.0.2, got family %d %s -> %s", test.name, fl.Family, net.IP(fl.SrcAddr), net.IP(fl.DstAddr))
+		}
+		if fl.Protocol != 6 || fl.SrcPort != 443 || fl.DstPort != 51000 {
+			t.Errorf("%s: Expected TCP 443 -> 51000, got %d %d -> %d", test.name, fl.Protocol, fl.SrcPort, fl.DstPort)
+		}
+		if fl.Packets != test.packets || fl.Size != test.size {
+			t.Errorf("%s: Expected %d packets/%d bytes, got %d/%d", test.name, test.packets, test.size, fl.Packets, fl.Size)
+		}
+	}
+}
+
+func TestInterfaceNames(t *testing.T) {
+	ifs := newTestServer()
+	rtr := net.IP{192, 0, 2, 1}
+
+	announce := func(index byte, name string) {
+		ifName := make([]byte, 16)
+		copy(ifName, name)
+		ifs.processPacket(rtr, buildOptionsPacket(400, 1, []field{
+			{typ: ipfix.InputSnmp, value: []byte{0, 0, 0, index}},
+			{typ: ipfix.IfName, value: ifName},
+		}))
+	}
+	flow := func() *netflow.Flow {
+		ifs.processPacket(rtr, buildPacket(401, []field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+			{typ: ipfix.InputSnmp, value: []byte{0, 0, 0, 7}},
+			{typ: ipfix.OutputSnmp, value: []byte{0, 0, 0, 8}},
+		}))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("Expected 1 flow, got %d", len(ifs.Output))
+		}
+		return <-ifs.Output
+	}
+
+	announce(7, "xe-0/0/0")
+	announce(8, "xe-0/0/1")
+	if len(ifs.Output) != 0 {
+		t.Fatalf("Options data must not produce flows, got %d", len(ifs.Output))
+	}
+	if fl := flow(); fl.IntInName != "xe-0/0/0" || fl.IntOutName != "xe-0/0/1" {
+		t.Errorf("Expected interfaces xe-0/0/0 -> xe-0/0/1, got %q -> %q", fl.IntInName, fl.IntOutName)
+	}
+
+	// After a reindex index 7 names another interface and xe-0/0/1 is gone from index 8
+	announce(7, "xe-0/0/1")
+	if fl := flow(); fl.IntInName != "xe-0/0/1" || fl.IntOutName != "" {
+		t.Errorf("Expected interfaces xe-0/0/1 -> unknown, got %q -> %q", fl.IntInName, fl.IntOutName)
+	}
+	if remaps := stats.Router(rtr.String()).InterfaceRemaps; remaps != 1 {
+		t.Errorf("Expected 1 remap, got %d", remaps)
+	}
+}
+
+func TestSamplingRate(t *testing.T) {
+	interval := field{typ: ipfix.SamplingInterval, value: []byte{0, 0, 0, 10}}
+	tests := []struct {
+		name    string
+		fields  []field
+		packets uint32
+		scaled  bool
+	}{
+		{
+			name:    "No sampling parameters",
+			packets: 2,
+		},
+		{
+			name:    "samplingInterval",
+			fields:  []field{interval, {typ: ipfix.SamplingAlgorithm, value: []byte{1}}},
+			packets: 20,
+			scaled:  true,
+		},
+		{
+			name: "samplingPacketInterval and samplingPacketSpace take precedence",
+			fields: []field{
+				interval,
+				{typ: ipfix.SamplingPacketInterval, value: []byte{0, 0, 0, 1}},
+				{typ: ipfix.SamplingPacketSpace, value: []byte{0, 0, 0, 99}},
+			},
+			packets: 200,
+			scaled:  true,
+		},
+		{
+			name: "Zero samplingPacketInterval",
+			fields: []field{
+				interval,
+				{typ: ipfix.SamplingPacketInterval, value: []byte{0, 0, 0, 0}},
+				{typ: ipfix.SamplingPacketSpace, value: []byte{0, 0, 0, 99}},
+			},
+			packets: 20,
+			scaled:  true,
+		},
+		{
+			name:    "samplerRandomInterval",
+			fields:  []field{{typ: ipfix.FlowSamplerRandomInterval, value: []byte{0, 0, 3, 232}}},
+			packets: 2000,
+			scaled:  true,
+		},
+		{
+			name:    "Unsampled",
+			fields:  []field{{typ: ipfix.SamplingInterval, value: []byte{0, 0, 0, 1}}},
+			packets: 2,
+			scaled:  true,
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+			{typ: ipfix.InPkts, value: []byte{0, 0, 0, 2}},
+			{typ: ipfix.InBytes, value: []byte{0, 0, 0, 100}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(330+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		fl := <-ifs.Output
+		if fl.Packets != test.packets || fl.Size != uint64(test.packets)*50 || fl.Scaled != test.scaled {
+			t.Errorf("%s: Expected %d packets/%d bytes (scaled %v), got %d/%d (%v)", test.name, test.packets, test.packets*50, test.scaled, fl.Packets, fl.Size, fl.Scaled)
+		}
+		if test.scaled && fl.Packets/fl.SamplingRate != 2 {
+			t.Errorf("%s: Expected the 2 exported packets to be recoverable, got %d at rate %d", test.name, fl.Packets/fl.SamplingRate, fl.SamplingRate)
+		}
+	}
+}
+
+func TestSampledPacketsCapped(t *testing.T) {
+	ifs := newTestServer()
+	ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(586, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.InPkts, value: []byte{0x40, 0, 0, 0}},
+		{typ: ipfix.InBytes, value: []byte{0, 0, 0, 100}},
+		{typ: ipfix.SamplingInterval, value: []byte{0, 0, 0, 10}},
+	}))
+	if len(ifs.Output) != 1 {
+		t.Fatalf("Expected 1 flow, got %d", len(ifs.Output))
+	}
+	if fl := <-ifs.Output; fl.Packets != math.MaxUint32 || fl.Size != 1000 || !fl.Scaled {
+		t.Errorf("Expected packets capped at %d and 1000 bytes, got %d and %d (scaled %v)", uint32(math.MaxUint32), fl.Packets, fl.Size, fl.Scaled)
+	}
+}
+
+func TestAnnouncedSamplingRate(t *testing.T) {
+	ifs := newTestServer()
+	rtr := net.IP{192, 0, 2, 1}
+
+	// inDomain sets the observation domain ID of message `pkt`
+	inDomain := func(pkt []byte, domainID byte) []byte {
+		pkt[15] = domainID
+		return pkt
+	}
+	flow := func(domainID byte, fields ...field) *netflow.Flow {
+		fields = append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+			{typ: ipfix.InPkts, value: []byte{0, 0, 0, 2}},
+			{typ: ipfix.InBytes, value: []byte{0, 0, 0, 100}},
+		}, fields...)
+		ifs.processPacket(rtr, inDomain(buildPacket(561, fields), domainID))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("Expected 1 flow, got %d", len(ifs.Output))
+		}
+		return <-ifs.Output
+	}
+
+	if fl := flow(1); fl.Packets != 2 || fl.Scaled {
+		t.Errorf("Expected 2 unscaled packets before announcement, got %d (scaled %v)", fl.Packets, fl.Scaled)
+	}
+
+	ifs.processPacket(rtr, inDomain(buildOptionsPacket(560, 1, []field{
+		{typ: ipfix.SelectorID, value: []byte{0, 0, 0, 1}},
+		{typ: ipfix.SamplingPacketInterval, value: []byte{0, 0, 0, 1}},
+		{typ: ipfix.SamplingPacketSpace, value: []byte{0, 0, 0, 99}},
+	}), 1))
+	if len(ifs.Output) != 0 {
+		t.Fatalf("Options data must not produce flows, got %d", len(ifs.Output))
+	}
+
+	if fl := flow(1); fl.Packets != 200 || fl.Size != 10000 || !fl.Scaled {
+		t.Errorf("Expected 200 packets/10000 bytes (scaled), got %d/%d (%v)", fl.Packets, fl.Size, fl.Scaled)
+	}
+	if fl := flow(2); fl.Packets != 2 || fl.Scaled {
+		t.Errorf("Expected 2 unscaled packets in other domain, got %d (scaled %v)", fl.Packets, fl.Scaled)
+	}
+	if fl := flow(1, field{typ: ipfix.SamplingInterval, value: []byte{0, 0, 0, 10}}); fl.Packets != 20 {
+		t.Errorf("Expected rate of record to take precedence, got %d packets", fl.Packets)
+	}
+
+	options := ifs.Options()
+	if len(options) != 1 || options[0].Exporter != "192.0.2.1" || len(options[0].SamplingRates) != 1 || options[0].SamplingRates[1] != 100 {
+		t.Errorf("Expected announced rate 100 of domain 1 of 192.0.2.1, got %+v", options)
+	}
+}
+
+func TestCollectorID(t *testing.T) {
+	ifs := newTestServer()
+	ifs.collectorID = "fra1"
+	ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(340, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+	}))
+	if len(ifs.Output) != 1 {
+		t.Fatalf("Expected 1 flow, got %d", len(ifs.Output))
+	}
+	if fl := <-ifs.Output; fl.CollectorId != "fra1" {
+		t.Errorf("Expected collector ID fra1, got %q", fl.CollectorId)
+	}
+}
+
+func TestDecodeConnectionID(t *testing.T) {
+	overrides, err := ParseFieldOverrides("192.0.2.2/9/12240=connection_id")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		exporter net.IP
+		field    field
+		expected []byte
+	}{
+		{
+			name:     "connectionTransactionId",
+			exporter: net.IP{192, 0, 2, 1},
+			field:    field{typ: ipfix.ConnectionTransactionID, value: []byte{0, 0, 0, 0, 0, 0x01, 0xe2, 0x40}},
+			expected: []byte{0, 0, 0, 0, 0, 0x01, 0xe2, 0x40},
+		},
+		{
+			name:     "Variable length vendor element",
+			exporter: net.IP{192, 0, 2, 2},
+			field:    field{typ: 12240, enterprise: 9, value: []byte("c0ffee-4711"), varlen: true},
+			expected: []byte("c0ffee-4711"),
+		},
+	}
+
+	for i, test := range tests {
+		ifs := newTestServer()
+		ifs.fieldOverrides = overrides
+		ifs.processPacket(test.exporter, buildPacket(uint16(343+i), []field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+			test.field,
+		}))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		if fl := <-ifs.Output; !bytes.Equal(fl.ConnectionId, test.expected) {
+			t.Errorf("%s: Expected connection ID %x, got %x", test.name, test.expected, fl.ConnectionId)
+		}
+	}
+}
+
+func TestObservationTime(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   []field
+		expected int64
+	}{
+		{
+			name:     "Export time",
+			expected: 1500000000,
+		},
+		{
+			name:     "observationTimeSeconds",
+			fields:   []field{{typ: ipfix.ObservationTimeSeconds, value: []byte{0x59, 0x68, 0x2e, 0xc4}}},
+			expected: 1499999940,
+		},
+		{
+			name:     "observationTimeMilliseconds",
+			fields:   []field{{typ: ipfix.ObservationTimeMillis, value: []byte{0, 0, 0x01, 0x5d, 0x3e, 0xf5, 0xc3, 0xbb}}},
+			expected: 1499999880,
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(360+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		if fl := <-ifs.Output; fl.Timestamp != test.expected {
+			t.Errorf("%s: Expected timestamp %d, got %d", test.name, test.expected, fl.Timestamp)
+		}
+	}
+}
+
+func TestTimeOffset(t *testing.T) {
+	tests := []struct {
+		name      string
+		exporter  net.IP
+		fields    []field
+		timestamp int64
+		start     int64
+	}{
+		{
+			name:      "Export time",
+			exporter:  net.IP{192, 0, 2, 1},
+			timestamp: 1499992800,
+		},
+		{
+			name:      "Observation and start time",
+			exporter:  net.IP{192, 0, 2, 1},
+			fields:    []field{{typ: ipfix.ObservationTimeSeconds, value: []byte{0x59, 0x68, 0x2e, 0xc4}}, {typ: ipfix.FlowStartSeconds, value: []byte{0x59, 0x68, 0x2e, 0xc4}}},
+			timestamp: 1499992740,
+			start:     1499992740000,
+		},
+		{
+			name:      "Exporter without offset",
+			exporter:  net.IP{192, 0, 2, 2},
+			timestamp: 1500000000,
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.timeOffsets = map[string]int64{"192.0.2.1": -7200}
+		ifs.processPacket(test.exporter, buildPacket(uint16(400+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		fl := <-ifs.Output
+		if fl.Timestamp != test.timestamp || fl.Start != test.start {
+			t.Errorf("%s: Expected timestamp %d and start %d, got %d and %d", test.name, test.timestamp, test.start, fl.Timestamp, fl.Start)
+		}
+	}
+}
+
+func TestPortlessProtocols(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   []field
+		protocol uint32
+		srcPort  uint32
+		dstPort  uint32
+	}{
+		{
+			name:     "GRE",
+			fields:   []field{{typ: ipfix.Protocol, value: []byte{47}}},
+			protocol: 47,
+		},
+		{
+			name:     "ESP",
+			fields:   []field{{typ: ipfix.Protocol, value: []byte{50}}},
+			protocol: 50,
+		},
+		{
+			name: "ESP with port fields",
+			fields: []field{
+				{typ: ipfix.Protocol, value: []byte{50}},
+				{typ: ipfix.L4SrcPort, value: []byte{0x12, 0x34}},
+				{typ: ipfix.L4DstPort, value: []byte{0x56, 0x78}},
+			},
+			protocol: 50,
+		},
+		{
+			name: "UDP",
+			fields: []field{
+				{typ: ipfix.Protocol, value: []byte{17}},
+				{typ: ipfix.L4SrcPort, value: []byte{0x12, 0x34}},
+				{typ: ipfix.L4DstPort, value: []byte{0x00, 0x35}},
+			},
+			protocol: 17,
+			srcPort:  0x1234,
+			dstPort:  53,
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(370+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		fl := <-ifs.Output
+		if fl.Protocol != test.protocol || fl.SrcPort != test.srcPort || fl.DstPort != test.dstPort || fl.HasPorts() != (test.srcPort != 0) {
+			t.Errorf("%s: Expected protocol %d ports %d/%d, got %d ports %d/%d", test.name, test.protocol, test.srcPort, test.dstPort, fl.Protocol, fl.SrcPort, fl.DstPort)
+		}
+	}
+}
+
+func TestDecodeApplicationName(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []field
+		want   string
+	}{
+		{
+			name: "Variable length",
+			fields: []field{
+				{typ: ipfix.ApplicationTag, value: []byte{3, 0, 0, 0, 80}},
+				{typ: ipfix.ApplicationName, value: []byte("http"), varlen: true},
+			},
+			want: "http",
+		},
+		{
+			name:   "Empty",
+			fields: []field{{typ: ipfix.ApplicationName, value: []byte{}, varlen: true}},
+		},
+		{
+			name:   "Fixed length padded",
+			fields: []field{{typ: ipfix.ApplicationName, value: []byte("ssh\x00\x00\x00\x00\x00")}},
+			want:   "ssh",
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(390+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		fl := <-ifs.Output
+		if fl.ApplicationName != test.want {
+			t.Errorf("%s: Expected application name %q, got %q", test.name, test.want, fl.ApplicationName)
+		}
+	}
+}
+
+func TestDropEmpty(t *testing.T) {
+	fields := []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.InBytes, value: []byte{0, 0, 0, 0}},
+		{typ: ipfix.InPkts, value: []byte{0, 0, 0, 0}},
+	}
+
+	ifs := newTestServer()
+	ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(470, fields))
+	if len(ifs.Output) != 1 {
+		t.Fatalf("Expected empty flow to be kept by default, got %d flows", len(ifs.Output))
+	}
+	<-ifs.Output
+
+	dropped := atomic.LoadUint64(&stats.GlobalStats.EmptyDropped)
+	ifs.dropEmpty = true
+	ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(470, fields))
+	if len(ifs.Output) != 0 {
+		t.Errorf("Expected empty flow to be dropped, got %d flows", len(ifs.Output))
+	}
+	if got := atomic.LoadUint64(&stats.GlobalStats.EmptyDropped) - dropped; got != 1 {
+		t.Errorf("Expected 1 empty flow counted, got %d", got)
+	}
+}
+
+func TestDecodeCounters(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  []field
+		bytes   uint64
+		packets uint32
+	}{
+		{
+			name: "4 byte counters",
+			fields: []field{
+				{typ: ipfix.InBytes, value: []byte{0, 0, 5, 220}},
+				{typ: ipfix.InPkts, value: []byte{0, 0, 0, 1}},
+			},
+			bytes:   1500,
+			packets: 1,
+		},
+		{
+			name: "2 byte counters",
+			fields: []field{
+				{typ: ipfix.InBytes, value: []byte{5, 220}},
+				{typ: ipfix.InPkts, value: []byte{0, 1}},
+			},
+			bytes:   1500,
+			packets: 1,
+		},
+		{
+			name: "8 byte counters beyond 32 bits",
+			fields: []field{
+				{typ: ipfix.InBytes, value: []byte{0, 0, 0, 0x01, 0x2a, 0x05, 0xf2, 0}},
+				{typ: ipfix.InPkts, value: []byte{0, 0, 0, 0, 0, 0x37, 0x8e, 0xdc}},
+			},
+			bytes:   5000000000,
+			packets: 3641052,
+		},
+		{
+			name: "Packets exceeding 32 bits",
+			fields: []field{
+				{typ: ipfix.InBytes, value: []byte{0, 0, 0x10, 0, 0, 0, 0, 0}},
+				{typ: ipfix.InPkts, value: []byte{0, 0, 0, 0x01, 0, 0, 0, 0}},
+			},
+			bytes:   1 << 44,
+			packets: math.MaxUint32,
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(562+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		if fl := <-ifs.Output; fl.Size != test.bytes || fl.Packets != test.packets {
+			t.Errorf("%s: Expected %d bytes and %d packets, got %d and %d", test.name, test.bytes, test.packets, fl.Size, fl.Packets)
+		}
+	}
+}
+
+func TestDecodeDropped(t *testing.T) {
+	tests := []struct {
+		name      string
+		fields    []field
+		bytes     uint64
+		packets   uint64
+		fwdStatus uint32
+	}{
+		{
+			name:   "Forwarded",
+			fields: []field{{typ: ipfix.InBytes, value: []byte{0, 0, 5, 220}}},
+		},
+		{
+			name: "Dropped",
+			fields: []field{
+				{typ: ipfix.DroppedOctetDeltaCount, value: []byte{0, 0, 0, 1, 0, 0, 0, 0}},
+				{typ: ipfix.DroppedPacketDeltaCount, value: []byte{0, 0, 0, 3}},
+				{typ: ipfix.ForwardingStatus, value: []byte{0x82}},
+			},
+			bytes:     1 << 32,
+			packets:   3,
+			fwdStatus: 0x82,
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(420+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		fl := <-ifs.Output
+		if fl.DroppedBytes != test.bytes || fl.DroppedPackets != test.packets || fl.ForwardingStatus != test.fwdStatus {
+			t.Errorf("%s: Expected %d bytes and %d packets dropped with status %#x, got %d, %d and %#x", test.name, test.bytes, test.packets, test.fwdStatus, fl.DroppedBytes, fl.DroppedPackets, fl.ForwardingStatus)
+		}
+	}
+}
+
+func TestProcessPacketFlows(t *testing.T) {
+	fields := []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+	}
+
+	ifs := newTestServer()
+	if flows := ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(440, fields)); flows != 1 {
+		t.Errorf("Expected 1 flow passed on, got %d", flows)
+	}
+	if flows := ifs.processPacket(net.IP{192, 0, 2, 1}, []byte{0, 10}); flows != 0 {
+		t.Errorf("Expected no flows of undecodable packet, got %d", flows)
+	}
+}
+
+func TestNetflowV9Dispatch(t *testing.T) {
+	var received []byte
+	ifs := newTestServer()
+	ifs.netflowV9 = func(remote net.IP, buffer []byte) int {
+		received = buffer
+		return 2
+	}
+
+	v9 := []byte{0, 9, 0, 0}
+	if flows := ifs.processPacket(net.IP{192, 0, 2, 1}, v9); flows != 2 {
+		t.Errorf("Expected 2 flows of NetFlow v9 packet, got %d", flows)
+	}
+	if !reflect.DeepEqual(received, v9) {
+		t.Errorf("Expected NetFlow v9 packet %v to be passed on, got %v", v9, received)
+	}
+
+	received = nil
+	fields := []field{{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}}}
+	if flows := ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(480, fields)); flows != 1 {
+		t.Errorf("Expected 1 flow of IPFIX packet, got %d", flows)
+	}
+	if received != nil {
+		t.Errorf("Expected IPFIX packet not to be passed to NetFlow v9 handler")
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	fields := []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+	}
+
+	var stream []byte
+	stream = append(stream, buildPacket(490, fields)...)
+	stream = append(stream, buildPacket(491, fields)...)
+
+	// A reader returning a single byte per read splits messages at every position
+	ifs := newTestServer()
+	if err := ifs.readStream(net.IP{192, 0, 2, 1}, iotest.OneByteReader(bytes.NewReader(stream))); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(ifs.Output) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(ifs.Output))
+	}
+	if fl := <-ifs.Output; !net.IP(fl.Router).Equal(net.IP{192, 0, 2, 1}) {
+		t.Errorf("Expected flow of router 192.0.2.1, got %s", net.IP(fl.Router))
+	}
+
+	tests := []struct {
+		name   string
+		stream []byte
+	}{
+		{
+			name:   "Truncated header",
+			stream: []byte{0, 10},
+		},
+		{
+			name:   "Truncated message",
+			stream: stream[:len(stream)-1],
+		},
+		{
+			name:   "Wrong version",
+			stream: []byte{0, 9, 0, 16},
+		},
+		{
+			name:   "Length below header",
+			stream: []byte{0, 10, 0, 4},
+		},
+	}
+	for _, test := range tests {
+		if err := newTestServer().readStream(net.IP{192, 0, 2, 1}, bytes.NewReader(test.stream)); err == nil {
+			t.Errorf("%s: Expected error", test.name)
+		}
+	}
+}
+
+func TestReadStreamTimeout(t *testing.T) {
+	msg := buildPacket(492, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+	})
+
+	tests := []struct {
+		name  string
+		sent  []byte
+		flows int
+	}{
+		{name: "Idle exporter", sent: msg, flows: 1},
+		{name: "Exporter gone within a message", sent: msg[:len(msg)-1]},
+	}
+	for _, test := range tests {
+		ifs := newTestServer()
+		ifs.tcpReadTimeout = 50 * time.Millisecond
+		collector, exporter := net.Pipe()
+		go exporter.Write(test.sent)
+
+		errs := make(chan error)
+		go func() {
+			errs <- ifs.readStream(net.IP{192, 0, 2, 1}, connReader{Reader: bufio.NewReader(collector), conn: collector})
+		}()
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Errorf("%s: Expected error", test.name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: Expected the stream to time out", test.name)
+		}
+		if len(ifs.Output) != test.flows {
+			t.Errorf("%s: Expected %d flows, got %d", test.name, test.flows, len(ifs.Output))
+		}
+		collector.Close()
+		exporter.Close()
+	}
+}
+
+func TestIPv6Exporter(t *testing.T) {
+	v4 := net.IP{192, 0, 2, 1}
+	v6 := net.ParseIP("2001:db8::1")
+
+	// Both exporters use the same template ID for different templates
+	ifs := newTestServer()
+	ifs.processPacket(v6, buildPacket(510, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+	}))
+	ifs.processPacket(v4, buildPacket(510, []field{
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+	}))
+	if len(ifs.Output) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(ifs.Output))
+	}
+	for _, rtr := range []net.IP{v6, v4} {
+		fl := <-ifs.Output
+		if !net.IP(fl.Router).Equal(rtr) || !net.IP(fl.SrcAddr).Equal(net.IP{10, 0, 0, 1}) {
+			t.Errorf("Expected flow of %s from 10.0.0.1, got %s from %s", rtr, net.IP(fl.Router), net.IP(fl.SrcAddr))
+		}
+	}
+
+	// IPv4 exporters share their templates whatever the representation of their address
+	if ifs.tmplCache.get(v4.To16(), 0, 510) == nil {
+		t.Errorf("Expected template of %s to be found by its 16 byte address", v4)
+	}
+	if ifs.tmplCache.get(net.ParseIP("2001:db8::2"), 0, 510) != nil {
+		t.Errorf("Expected no template of 2001:db8::2")
+	}
+}
+
+func TestDecodeNextHops(t *testing.T) {
+	tests := []struct {
+		name       string
+		fields     []field
+		nextHop    net.IP
+		bgpNextHop net.IP
+	}{
+		{
+			name:    "Forwarding next hop only",
+			fields:  []field{{typ: ipfix.IPv4NextHop, value: []byte{10, 0, 0, 254}}},
+			nextHop: net.IP{10, 0, 0, 254},
+		},
+		{
+			name: "ECMP member of BGP path",
+			fields: []field{
+				{typ: ipfix.IPv4NextHop, value: []byte{10, 0, 0, 253}},
+				{typ: ipfix.BGPIPv4NextHop, value: []byte{192, 0, 2, 100}},
+			},
+			nextHop:    net.IP{10, 0, 0, 253},
+			bgpNextHop: net.IP{192, 0, 2, 100},
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(430+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		fl := <-ifs.Output
+		if !net.IP(fl.NextHop).Equal(test.nextHop) || !net.IP(fl.BgpNextHop).Equal(test.bgpNextHop) {
+			t.Errorf("%s: Expected next hop %s and BGP next hop %s, got %s and %s", test.name, test.nextHop, test.bgpNextHop, net.IP(fl.NextHop), net.IP(fl.BgpNextHop))
+		}
+	}
+}
+
+func TestDecodeVlan(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []field
+		vlan   uint32
+	}{
+		{
+			name: "Not exported",
+		},
+		{
+			name:   "Ingress VLAN",
+			fields: []field{{typ: ipfix.SrcVlan, value: []byte{0, 100}}},
+			vlan:   100,
+		},
+		{
+			name:   "802.1Q VLAN",
+			fields: []field{{typ: ipfix.Dot1qVlanID, value: []byte{0x0f, 0xa0}}},
+			vlan:   4000,
+		},
+		{
+			name:   "Egress VLAN only",
+			fields: []field{{typ: ipfix.DstVlan, value: []byte{0, 200}}},
+			vlan:   200,
+		},
+		{
+			name:   "802.1Q egress VLAN only",
+			fields: []field{{typ: ipfix.PostDot1qVlanID, value: []byte{0, 201}}},
+			vlan:   201,
+		},
+		{
+			name: "Egress before ingress VLAN",
+			fields: []field{
+				{typ: ipfix.DstVlan, value: []byte{0, 200}},
+				{typ: ipfix.SrcVlan, value: []byte{0, 100}},
+			},
+			vlan: 100,
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(480+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		if fl := <-ifs.Output; fl.Vlan != test.vlan {
+			t.Errorf("%s: Expected VLAN %d, got %d", test.name, test.vlan, fl.Vlan)
+		}
+	}
+}
+
+func TestDecodeTCPFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []field
+		flags  uint32
+	}{
+		{
+			name: "Not exported",
+		},
+		{
+			name:   "Single byte",
+			fields: []field{{typ: ipfix.TCPFlags, value: []byte{0x02}}},
+			flags:  0x02,
+		},
+		{
+			name:   "Two bytes",
+			fields: []field{{typ: ipfix.TCPFlags, value: []byte{0x01, 0x12}}},
+			flags:  0x112,
+		},
+		{
+			name:   "Two bytes with data offset",
+			fields: []field{{typ: ipfix.TCPFlags, value: []byte{0x50, 0x18}}},
+			flags:  0x18,
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+			{typ: ipfix.Protocol, value: []byte{6}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(500+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		if fl := <-ifs.Output; fl.TcpFlags != test.flags {
+			t.Errorf("%s: Expected TCP flags %#x, got %#x", test.name, test.flags, fl.TcpFlags)
+		}
+	}
+}
+
+func TestDecodeMACs(t *testing.T) {
+	src := []byte{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01}
+	dst := []byte{0x02, 0x00, 0x5e, 0x10, 0x00, 0x02}
+	post := []byte{0x02, 0x00, 0x5e, 0x10, 0x00, 0x03}
+
+	tests := []struct {
+		name   string
+		fields []field
+		srcMac string
+		dstMac string
+	}{
+		{
+			name: "Not exported",
+		},
+		{
+			name: "As received",
+			fields: []field{
+				{typ: ipfix.InSrcMac, value: src},
+				{typ: ipfix.InDstMac, value: dst},
+				{typ: ipfix.OutDstMac, value: post},
+			},
+			srcMac: "02:00:5e:10:00:01",
+			dstMac: "02:00:5e:10:00:02",
+		},
+		{
+			name:   "As sent only",
+			fields: []field{{typ: ipfix.OutSrcMac, value: post}},
+			srcMac: "02:00:5e:10:00:03",
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(550+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		fl := <-ifs.Output
+		if mac := net.HardwareAddr(fl.SrcMac).String(); mac != test.srcMac {
+			t.Errorf("%s: Expected source MAC %q, got %q", test.name, test.srcMac, mac)
+		}
+		if mac := net.HardwareAddr(fl.DstMac).String(); mac != test.dstMac {
+			t.Errorf("%s: Expected destination MAC %q, got %q", test.name, test.dstMac, mac)
+		}
+	}
+}
+
+func TestDecodeDSCP(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   []field
+		dscp     uint32
+		hasDSCP  bool
+		postDSCP uint32
+		hasPost  bool
+	}{
+		{
+			name: "Not exported",
+		},
+		{
+			name:    "Ingress only",
+			fields:  []field{{typ: ipfix.SrcTos, value: []byte{0xb8}}},
+			dscp:    46,
+			hasDSCP: true,
+		},
+		{
+			name: "Remarked",
+			fields: []field{
+				{typ: ipfix.IPDiffServCodePoint, value: []byte{46}},
+				{typ: ipfix.PostIPDiffServCodePoint, value: []byte{0}},
+			},
+			dscp:    46,
+			hasDSCP: true,
+			hasPost: true,
+		},
+		{
+			name: "postIpClassOfService",
+			fields: []field{
+				{typ: ipfix.SrcTos, value: []byte{0x00}},
+				{typ: ipfix.DstTos, value: []byte{0x68}},
+			},
+			hasDSCP:  true,
+			postDSCP: 26,
+			hasPost:  true,
+		},
+	}
+
+	for i, test := range tests {
+		fields := append([]field{
+			{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		}, test.fields...)
+
+		ifs := newTestServer()
+		ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(uint16(380+i), fields))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		fl := <-ifs.Output
+		if fl.Dscp != test.dscp || fl.HasDscp != test.hasDSCP || fl.PostDscp != test.postDSCP || fl.HasPostDscp != test.hasPost {
+			t.Errorf("%s: Expected DSCP %d (%v) post DSCP %d (%v), got %d (%v) %d (%v)", test.name, test.dscp, test.hasDSCP, test.postDSCP, test.hasPost, fl.Dscp, fl.HasDscp, fl.PostDscp, fl.HasPostDscp)
+		}
+	}
+}
+
+func TestDecodeTOS(t *testing.T) {
+	ifs := newTestServer()
+	ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(540, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.SrcTos, value: []byte{0xb9}},
+	}))
+	ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(541, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+	}))
+	if len(ifs.Output) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(ifs.Output))
+	}
+
+	// The ECN bits are kept, the DSCP is the upper 6 bits
+	if fl := <-ifs.Output; fl.Tos != 0xb9 || !fl.HasTos || fl.Tos>>2 != fl.Dscp || fl.Dscp != 46 {
+		t.Errorf("Expected ToS 0xb9 with DSCP 46, got %#x (%v) with DSCP %d", fl.Tos, fl.HasTos, fl.Dscp)
+	}
+	if fl := <-ifs.Output; fl.Tos != 0 || fl.HasTos {
+		t.Errorf("Expected no ToS, got %#x (%v)", fl.Tos, fl.HasTos)
+	}
+}
+
+func TestDecodeDuration(t *testing.T) {
+	ifs := newTestServer()
+	ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(341, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.FlowStartMilliseconds, value: []byte{0, 0, 0x01, 0x5d, 0x3e, 0xf7, 0x98, 0x00}},
+		{typ: ipfix.FlowEndMilliseconds, value: []byte{0, 0, 0x01, 0x5d, 0x3e, 0xf7, 0x9f, 0xd0}},
+	}))
+	ifs.processPacket(net.IP{192, 0, 2, 1}, buildPacket(342, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.FlowStartSeconds, value: []byte{0x59, 0x68, 0x2f, 0x00}},
+		{typ: ipfix.FlowEndSeconds, value: []byte{0x59, 0x68, 0x2f, 0x02}},
+	}))
+	if len(ifs.Output) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(ifs.Output))
+	}
+	if fl := <-ifs.Output; fl.Start != 1500000000000 || fl.End != 1500000002000 {
+		t.Errorf("Expected flow from 1500000000000 to 1500000002000, got %d to %d", fl.Start, fl.End)
+	}
+	if fl := <-ifs.Output; fl.Start != 1500000000000 || fl.End != 1500000002000 {
+		t.Errorf("Expected flow from 1500000000000 to 1500000002000 (seconds), got %d to %d", fl.Start, fl.End)
+	}
+}
+
+func TestFlowStartTimestamp(t *testing.T) {
+	initTime := []byte{0, 0, 0x01, 0x5d, 0x3e, 0xe8, 0x55, 0xc0}
+	uptimes := []field{
+		{typ: ipfix.FirstSwitched, value: []byte{0, 0, 0x13, 0x88}},
+		{typ: ipfix.LastSwitched, value: []byte{0, 0, 0xfd, 0xe8}},
+	}
+	addrs := []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+	}
+
+	tests := []struct {
+		name      string
+		rtr       net.IP
+		options   []field
+		fields    []field
+		start     int64
+		end       int64
+		timestamp int64
+	}{
+		{
+			name:      "No flow start",
+			rtr:       net.IP{192, 0, 2, 61},
+			timestamp: 1500000000,
+		},
+		{
+			name:      "Flow start in seconds",
+			rtr:       net.IP{192, 0, 2, 62},
+			fields:    []field{{typ: ipfix.FlowStartSeconds, value: []byte{0x59, 0x68, 0x2e, 0xc4}}},
+			start:     1499999940000,
+			timestamp: 1499999940,
+		},
+		{
+			name:      "Unknown flow start",
+			rtr:       net.IP{192, 0, 2, 66},
+			fields:    []field{{typ: ipfix.FlowStartSeconds, value: []byte{0, 0, 0, 0}}},
+			timestamp: 1500000000,
+		},
+		{
+			name:      "Uptimes without init time",
+			rtr:       net.IP{192, 0, 2, 63},
+			fields:    uptimes,
+			timestamp: 1500000000,
+		},
+		{
+			name:      "Uptimes with init time in record",
+			rtr:       net.IP{192, 0, 2, 64},
+			fields:    append([]field{{typ: ipfix.SystemInitTimeMillis, value: initTime}}, uptimes...),
+			start:     1499999005000,
+			end:       1499999065000,
+			timestamp: 1499999005,
+		},
+		{
+			name: "Uptimes with init time in options data",
+			rtr:  net.IP{192, 0, 2, 65},
+			options: []field{
+				{typ: ipfix.InputSnmp, value: []byte{0, 0, 0, 1}},
+				{typ: ipfix.SystemInitTimeMillis, value: initTime},
+			},
+			fields:    uptimes,
+			start:     1499999005000,
+			end:       1499999065000,
+			timestamp: 1499999005,
+		},
+	}
+
+	for i, test := range tests {
+		ifs := newTestServer()
+		if test.options != nil {
+			ifs.processPacket(test.rtr, buildOptionsPacket(uint16(520+i), 1, test.options))
+		}
+		ifs.processPacket(test.rtr, buildPacket(uint16(530+i), append(addrs, test.fields...)))
+		if len(ifs.Output) != 1 {
+			t.Fatalf("%s: Expected 1 flow, got %d", test.name, len(ifs.Output))
+		}
+		if fl := <-ifs.Output; fl.Start != test.start || fl.End != test.end || fl.Timestamp != test.timestamp {
+			t.Errorf("%s: Expected flow from %d to %d at %d, got %d to %d at %d", test.name, test.start, test.end, test.timestamp, fl.Start, fl.End, fl.Timestamp)
+		}
+	}
+}
+
+func TestTemplateCacheConcurrency(t *testing.T) {
+	c := newTemplateCache(0)
+	tmpl := ipfix.TemplateRecords{
+		Header:  &ipfix.TemplateRecordHeader{FieldCount: 1, TemplateID: 570},
+		Records: []*ipfix.TemplateRecord{{Type: ipfix.InBytes, Length: 4}},
+	}
+
+	// Run with -race: workers of different exporters and domains update and read the cache at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rtr := net.IP{192, 0, 2, byte(70 + i%2)}
+			for j := 0; j < 200; j++ {
+				domainID := uint32(j % 3)
+				id := uint16(570 + j%4)
+				c.set(rtr, domainID, id, tmpl)
+				c.add(rtr, domainID+3, id, tmpl)
+				if c.get(rtr, domainID, id) == nil {
+					t.Errorf("Template %d of domain %d of %s missing after set", id, domainID, rtr)
+					return
+				}
+				c.templates()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 2 exporters with 6 domains of 4 templates each
+	if n := len(c.templates()); n != 48 {
+		t.Errorf("Expected 48 templates, got %d", n)
+	}
+}
+
+func TestTemplateExpiry(t *testing.T) {
+	c := newTemplateCache(0)
+	rtr := net.IP{192, 0, 2, 72}
+	tmpl := ipfix.TemplateRecords{
+		Header:  &ipfix.TemplateRecordHeader{FieldCount: 1, TemplateID: 580},
+		Records: []*ipfix.TemplateRecord{{Type: ipfix.InBytes, Length: 4}},
+	}
+	c.set(rtr, 0, 580, tmpl)
+	c.set(rtr, 0, 581, tmpl)
+	c.seen[cacheKey{exporterKey(rtr), 0, 580}] = time.Now().Add(-time.Hour)
+
+	if n := c.expire(time.Now().Add(-30 * time.Minute)); n != 1 {
+		t.Errorf("Expected 1 expired template, got %d", n)
+	}
+	if c.get(rtr, 0, 580) != nil {
+		t.Errorf("Expected template 580 to be expired")
+	}
+	if c.get(rtr, 0, 581) == nil {
+		t.Errorf("Expected template 581 to be kept")
+	}
+
+	// Resent templates are cached again
+	c.set(rtr, 0, 580, tmpl)
+	if c.get(rtr, 0, 580) == nil {
+		t.Errorf("Expected resent template 580 to be cached")
+	}
+
+	if n := c.expire(time.Now().Add(time.Minute)); n != 2 || len(c.cache) != 0 {
+		t.Errorf("Expected 2 expired templates and no exporter left, got %d and %d", n, len(c.cache))
+	}
+
+	// Templates older than the TTL are absent before the sweeper removed them
+	c = newTemplateCache(30 * time.Minute)
+	c.set(rtr, 0, 580, tmpl)
+	c.seen[cacheKey{exporterKey(rtr), 0, 580}] = time.Now().Add(-time.Hour)
+	if c.get(rtr, 0, 580) != nil {
+		t.Errorf("Expected template 580 older than the TTL to be absent")
+	}
+	c.set(rtr, 0, 580, tmpl)
+	if c.get(rtr, 0, 580) == nil {
+		t.Errorf("Expected refreshed template 580 to be cached")
+	}
+	c.expire(time.Now().Add(time.Minute))
+}
+
+func TestRouterCounters(t *testing.T) {
+	ifs := newTestServer()
+	rtr := net.IP{192, 0, 2, 73}
+	pkt := buildPacket(582, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.InBytes, value: []byte{0, 0, 5, 220}},
+	})
+	size := len(pkt)
+	ifs.processPacket(rtr, pkt)
+	ifs.processPacket(rtr, []byte{0, 10, 0, 1})
+
+	c := stats.Snapshot()["192.0.2.73"]
+	if c.Packets != 2 || c.Bytes != uint64(size+4) || c.DecodeErrors != 1 || c.Flows != 1 || c.Templates != 1 || c.LastPacket == 0 {
+		t.Errorf("Expected 2 packets of %d bytes, 1 decode error, 1 flow and 1 template, got %+v", size+4, c)
+	}
+	if d := c.Domains[0]; len(c.Domains) != 1 || d.Packets != 1 || d.Flows != 1 || d.LastPacket == 0 {
+		t.Errorf("Expected 1 packet with 1 flow of domain 0, got %+v", c.Domains)
+	}
+}
+
+func TestClose(t *testing.T) {
+	newServer := func(addr string, transport string) (*IPFIXServer, error) {
+		return New(Config{ListenAddr: addr, Transport: transport, NumReaders: 2, ReadBuffer: 1 << 20})
+	}
+	ifs, err := newServer("127.0.0.1:0", "udp")
+	if err != nil {
+		t.Fatalf("Unable to start server: %v", err)
+	}
+	if ifs.packetSize != DefaultPacketSize {
+		t.Errorf("Expected default packet size %d, got %d", DefaultPacketSize, ifs.packetSize)
+	}
+	if _, err := newServer(ifs.conn.LocalAddr().String(), "udp"); err == nil {
+		t.Errorf("Expected error listening on address in use")
+	}
+
+	exporter, err := net.Dial("udp", ifs.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Close()
+	exporter.Write(buildPacket(583, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: ipfix.InBytes, value: []byte{0, 0, 5, 220}},
+	}))
+	select {
+	case <-ifs.Output:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No flow received")
+	}
+
+	if err := ifs.Close(); err != nil {
+		t.Errorf("Unexpected error closing server: %v", err)
+	}
+	if _, ok := <-ifs.Output; ok {
+		t.Errorf("Expected Output to be closed")
+	}
+
+	ifs, err = newServer("127.0.0.1:0", "tcp")
+	if err != nil {
+		t.Fatalf("Unable to start TCP server: %v", err)
+	}
+	conn, err := net.Dial("tcp", ifs.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ifs.Close()
+	if _, ok := <-ifs.Output; ok {
+		t.Errorf("Expected Output of TCP server to be closed")
+	}
+}
+
+func TestMissingTemplate(t *testing.T) {
+	ifs := newTestServer()
+	missing := atomic.LoadUint64(&stats.GlobalStats.TemplateMisses)
+
+	// Message carrying a single data set of unknown template 584
+	ifs.processPacket(net.IP{192, 0, 2, 74}, []byte{0, 10, 0, 24, 0x59, 0x68, 0x2f, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0x02, 0x48, 0, 8, 1, 2, 3, 4})
+	if n := atomic.LoadUint64(&stats.GlobalStats.TemplateMisses) - missing; n != 1 {
+		t.Errorf("Expected 1 flowset lacking its template, got %d", n)
+	}
+	if n := stats.Snapshot()["192.0.2.74"].MissingTemplates; n != 1 {
+		t.Errorf("Expected 1 flowset lacking its template for 192.0.2.74, got %d", n)
+	}
+}
+
+func TestUnknownFamily(t *testing.T) {
+	ifs := newTestServer()
+	dropped := atomic.LoadUint64(&stats.GlobalStats.DroppedUnknownFamily)
+	ifs.processPacket(net.IP{192, 0, 2, 75}, buildPacket(585, []field{
+		{typ: ipfix.InBytes, value: []byte{0, 0, 5, 220}},
+	}))
+	if n := atomic.LoadUint64(&stats.GlobalStats.DroppedUnknownFamily) - dropped; n != 1 || len(ifs.Output) != 0 {
+		t.Errorf("Expected 1 flow without addresses dropped, got %d dropped and %d passed on", n, len(ifs.Output))
+	}
+}
+
+func TestOutputTimeout(t *testing.T) {
+	ifs := &IPFIXServer{
+		Output:        make(chan *netflow.Flow),
+		outputTimeout: 10 * time.Millisecond,
+	}
+
+	dropped := atomic.LoadUint64(&stats.GlobalStats.OutputDropped)
+	ifs.send(&netflow.Flow{})
+	if n := atomic.LoadUint64(&stats.GlobalStats.OutputDropped) - dropped; n != 1 {
+		t.Errorf("Expected 1 dropped flow, got %d", n)
+	}
+
+	ifs.outputPanic = true
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic on stalled output")
+		}
+	}()
+	ifs.send(&netflow.Flow{})
+}
+
+func TestRecoverPacket(t *testing.T) {
+	var logged string
+	logPanic = func(format string, args ...interface{}) {
+		logged = fmt.Sprintf(format, args...)
+	}
+	defer func() { logPanic = glog.Errorf }()
+
+	// The handler panics after reversing the packet in place, as decoding does.
+	// The packet is logged as left, without copying each packet up front.
+	ifs := newTestServer()
+	ifs.netflowV9 = func(remote net.IP, buffer []byte) int {
+		convert.Reverse(buffer)
+		panic("index out of range")
+	}
+	panics := atomic.LoadUint64(&stats.GlobalStats.PacketPanics)
+	if n := ifs.processPacket(net.IP{192, 0, 2, 76}, []byte{0, 9, 0, 1}); n != 0 {
+		t.Errorf("Expected no flows of packet panicking, got %d", n)
+	}
+	if n := atomic.LoadUint64(&stats.GlobalStats.PacketPanics) - panics; n != 1 {
+		t.Errorf("Expected 1 packet panic, got %d", n)
+	}
+	if !strings.HasSuffix(logged, "\n4 bytes as decoded (byte reversed): 01000900") {
+		t.Errorf("Expected packet 00090001 to be logged as decoded, got %q", logged)
+	}
+
+	// Panics on stalled output are asked for and not recovered from
+	ifs.netflowV9 = func(remote net.IP, buffer []byte) int {
+		panic(outputStalled("stalled"))
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic on stalled output")
+		}
+	}()
+	ifs.processPacket(net.IP{192, 0, 2, 76}, []byte{0, 9, 0, 1})
+}
+
+func TestTemplateWarmup(t *testing.T) {
+	fields := []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: 57660, enterprise: 35632, value: []byte("tls.example.com"), varlen: true},
+	}
+	exporter := net.IP{192, 0, 2, 1}
+
+	peer := newTestServer()
+	peer.processPacket(exporter, buildPacket(410, fields))
+	buf := &bytes.Buffer{}
+	if err := peer.ExportTemplates(buf); err != nil {
+		t.Fatalf("Unable to export templates: %v", err)
+	}
+
+	// A template received from the exporter before the import is kept
+	ifs := newTestServer()
+	ifs.processPacket(exporter, buildPacket(411, fields[:2]))
+	ifs.processPacket(exporter, buildPacket(410, fields[:2]))
+	n, err := ifs.ImportTemplates(bytes.NewReader(append([]byte{}, buf.Bytes()...)))
+	if err != nil {
+		t.Fatalf("Unable to import templates: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("Expected no template to be imported, got %d", n)
+	}
+
+	ifs = newTestServer()
+	n, err = ifs.ImportTemplates(buf)
+	if err != nil {
+		t.Fatalf("Unable to import templates: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 template to be imported, got %d", n)
+	}
+
+	want := peer.tmplCache.get(exporter, 0, 410)
+	got := ifs.tmplCache.get(exporter, 0, 410)
+	if got == nil {
+		t.Fatalf("Imported template not found")
+	}
+	if !reflect.DeepEqual(got.Header, want.Header) || !reflect.DeepEqual(got.Records, want.Records) || !reflect.DeepEqual(got.EnterpriseNumbers, want.EnterpriseNumbers) {
+		t.Errorf("Expected template %v %v %v, got %v %v %v", want.Header, want.Records, want.EnterpriseNumbers, got.Header, got.Records, got.EnterpriseNumbers)
+	}
+}
+
+func TestImportInvalidTemplates(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields string
+		id     int
+	}{
+		{name: "Enterprise number of IANA field", fields: `{"type": 8, "length": 4, "enterprise": 35632}`, id: 413},
+		{name: "Record exceeding a message", fields: `{"type": 8, "length": 40000}, {"type": 12, "length": 40000}`, id: 414},
+		{name: "Reserved template ID", fields: `{"type": 8, "length": 4}`, id: 255},
+	}
+
+	// Invalid templates are skipped without stopping the import
+	var templates []string
+	for _, test := range tests {
+		templates = append(templates, fmt.Sprintf(`{"exporter": "192.0.2.1", "template_id": %d, "fields": [%s]}`, test.id, test.fields))
+	}
+	templates = append(templates, `{"exporter": "192.0.2.1", "template_id": 412, "fields": [{"type": 8, "length": 4}, {"type": 12, "length": 0}]}`)
+
+	ifs := newTestServer()
+	invalid := atomic.LoadUint64(&stats.GlobalStats.TemplatesInvalid)
+	if n, err := ifs.ImportTemplates(strings.NewReader("[" + strings.Join(templates, ",") + "]")); err != nil || n != 1 {
+		t.Errorf("Expected only the valid template imported, got %d (%v)", n, err)
+	}
+	if got := atomic.LoadUint64(&stats.GlobalStats.TemplatesInvalid) - invalid; got != uint64(len(tests)) {
+		t.Errorf("Expected %d invalid templates, got %d", len(tests), got)
+	}
+	for _, test := range tests {
+		if ifs.tmplCache.get(net.IP{192, 0, 2, 1}, 0, uint16(test.id)) != nil {
+			t.Errorf("%s: Expected invalid template not to be cached", test.name)
+		}
+	}
+
+	// Fields of length 0 are accepted, as they are when received from exporters
+	if ifs.tmplCache.get(net.IP{192, 0, 2, 1}, 0, 412) == nil {
+		t.Errorf("Expected template with a field of length 0 to be cached")
+	}
+
+	// The same checks apply to templates received from exporters
+	invalid = atomic.LoadUint64(&stats.GlobalStats.TemplatesInvalid)
+	pkt := buildPacket(414, []field{
+		{typ: ipfix.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: ipfix.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+	})
+	binary.BigEndian.PutUint16(pkt[26:], 40000)
+	binary.BigEndian.PutUint16(pkt[30:], 40000)
+	ifs.processPacket(net.IP{192, 0, 2, 77}, pkt)
+	if got := atomic.LoadUint64(&stats.GlobalStats.TemplatesInvalid) - invalid; got != 1 {
+		t.Errorf("Expected received template counted as invalid, got %d", got)
+	}
+	if ifs.tmplCache.get(net.IP{192, 0, 2, 77}, 0, 414) != nil {
+		t.Errorf("Expected invalid received template not to be cached")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifserver
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/convert"
+	"github.com/google/tflow2/ipfix"
+	"github.com/google/tflow2/stats"
+)
+
+// interfaces maps the interface indices of a single exporter to names and back
+type interfaces struct {
+	byIndex map[uint32]string
+	byName  map[string]uint32
+}
+
+// interfaceTable keeps the interface names exporters announce in options data records
+type interfaceTable struct {
+	routers map[string]*interfaces
+	lock    sync.RWMutex
+}
+
+// newInterfaceTable creates and initializes a new `interfaceTable` instance
+func newInterfaceTable() *interfaceTable {
+	return &interfaceTable{routers: make(map[string]*interfaces)}
+}
+
+// update records `name` for interface `index` of router `rtr`. It returns true
+// if the index was known under another name or the name under another index
+// before, i.e. the router renumbered its interfaces.
+func (t *interfaceTable) update(rtr string, index uint32, name string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ifs, ok := t.routers[rtr]
+	if !ok {
+		ifs = &interfaces{
+			byIndex: make(map[uint32]string),
+			byName:  make(map[string]uint32),
+		}
+		t.routers[rtr] = ifs
+	}
+
+	remap := false
+	if old, ok := ifs.byIndex[index]; ok && old != name {
+		delete(ifs.byName, old)
+		remap = true
+	}
+	if old, ok := ifs.byName[name]; ok && old != index {
+		delete(ifs.byIndex, old)
+		remap = true
+	}
+
+	ifs.byIndex[index] = name
+	ifs.byName[name] = index
+	return remap
+}
+
+// name returns the name of interface `index` of router `rtr`, "" if unknown
+func (t *interfaceTable) name(rtr string, index uint32) string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	ifs, ok := t.routers[rtr]
+	if !ok {
+		return ""
+	}
+	return ifs.byIndex[index]
+}
+
+// processOptions updates the interface table from options data records scoped
+// by an interface index and carrying the interfaces name, and records the init
+// time of the exporter and the sampling rate of observation domain `domainID`
+// if options data carries them. Other options data is ignored.
+func (ifs *IPFIXServer) processOptions(template *ipfix.TemplateRecords, records []ipfix.FlowDataRecord, agent net.IP, domainID uint32) {
+	index := -1
+	name := -1
+	initTime := -1
+	sampling := fieldMap{samplingInterval: -1, samplerRandomInterval: -1, samplingPacketInterval: -1, samplingPacketSpace: -1}
+	for i := range template.Records {
+		switch template.FieldID(i) {
+		case ipfix.FieldID{Type: ipfix.InputSnmp}, ipfix.FieldID{Type: ipfix.OutputSnmp}:
+			if i < int(template.ScopeFieldCount) {
+				index = i
+			}
+		case ipfix.FieldID{Type: ipfix.IfName}:
+			name = i
+		case ipfix.FieldID{Type: ipfix.SystemInitTimeMillis}:
+			initTime = i
+		case ipfix.FieldID{Type: ipfix.SamplingInterval}:
+			sampling.samplingInterval = i
+		case ipfix.FieldID{Type: ipfix.FlowSamplerRandomInterval}:
+			sampling.samplerRandomInterval = i
+		case ipfix.FieldID{Type: ipfix.SamplingPacketInterval}:
+			sampling.samplingPacketInterval = i
+		case ipfix.FieldID{Type: ipfix.SamplingPacketSpace}:
+			sampling.samplingPacketSpace = i
+		}
+	}
+
+	addr := agent.String()
+	for _, r := range records {
+		if initTime >= 0 {
+			observeInitTime(stats.Router(addr), addr, convert.Uint64(r.Values[initTime]))
+		}
+		if rate := samplingRate(&sampling, r); rate > 0 && ifs.samplers.update(addr, domainID, rate) {
+			glog.Infof("Router %s changed sampling rate of domain %d to %d", addr, domainID, rate)
+		}
+		if index < 0 || name < 0 {
+			continue
+		}
+
+		n := strings.TrimRight(string(convert.Reverse(r.Values[name])), "\x00")
+		if n == "" {
+			continue
+		}
+
+		i := convert.Uint32(r.Values[index])
+		if ifs.interfaces.update(addr, i, n) {
+			atomic.AddUint64(&stats.Router(addr).InterfaceRemaps, 1)
+			glog.Warningf("Router %s reindexed interfaces: %s is now index %d", addr, n, i)
+		}
+	}
+}
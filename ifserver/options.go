@@ -0,0 +1,78 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// ExporterOptions is the configuration an exporter announced in options data records
+type ExporterOptions struct {
+	Exporter string `json:"exporter"`
+
+	// Interfaces maps interface indices to names
+	Interfaces map[uint32]string `json:"interfaces,omitempty"`
+
+	// SamplingRates maps observation domain IDs to sampling rates
+	SamplingRates map[uint32]uint32 `json:"sampling_rates,omitempty"`
+}
+
+// Options returns the options data announced by each exporter, sorted by exporter
+func (ifs *IPFIXServer) Options() []ExporterOptions {
+	byExporter := make(map[string]*ExporterOptions)
+	get := func(rtr string) *ExporterOptions {
+		o, ok := byExporter[rtr]
+		if !ok {
+			o = &ExporterOptions{Exporter: rtr}
+			byExporter[rtr] = o
+		}
+		return o
+	}
+
+	ifs.interfaces.lock.RLock()
+	for rtr, t := range ifs.interfaces.routers {
+		o := get(rtr)
+		o.Interfaces = make(map[uint32]string, len(t.byIndex))
+		for index, name := range t.byIndex {
+			o.Interfaces[index] = name
+		}
+	}
+	ifs.interfaces.lock.RUnlock()
+
+	ifs.samplers.lock.RLock()
+	for key, rate := range ifs.samplers.rates {
+		o := get(key.rtr)
+		if o.SamplingRates == nil {
+			o.SamplingRates = make(map[uint32]uint32)
+		}
+		o.SamplingRates[key.domainID] = rate
+	}
+	ifs.samplers.lock.RUnlock()
+
+	options := make([]ExporterOptions, 0, len(byExporter))
+	for _, o := range byExporter {
+		options = append(options, *o)
+	}
+	sort.Slice(options, func(i, j int) bool { return options[i].Exporter < options[j].Exporter })
+	return options
+}
+
+// ServeOptions sends the options data announced by each exporter as JSON
+func (ifs *IPFIXServer) ServeOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ifs.Options()); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to encode options: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifserver
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/tflow2/ipfix"
+)
+
+const (
+	// ignoreField is the target of fields that are not to be decoded at all
+	ignoreField = 0
+
+	// littleEndian is the pseudo field marking a field as sent in little endian byte order
+	littleEndian = "little_endian"
+
+	// combinedPorts is the target of nonstandard 4 byte fields carrying the source
+	// port in their upper and the destination port in their lower 16 bits. The
+	// highest non enterprise type is used as it is not going to be assigned.
+	combinedPorts = 0x7fff
+)
+
+// overrideTargets maps the flow fields an override may name to the
+// information element the overridden field is decoded as
+var overrideTargets = map[string]uint16{
+	"ignore":           ignoreField,
+	"bytes":            ipfix.InBytes,
+	"packets":          ipfix.InPkts,
+	"protocol":         ipfix.Protocol,
+	"int_in":           ipfix.InputSnmp,
+	"int_out":          ipfix.OutputSnmp,
+	"src_port":         ipfix.L4SrcPort,
+	"dst_port":         ipfix.L4DstPort,
+	"ports":            combinedPorts,
+	"src_as":           ipfix.SrcAs,
+	"dst_as":           ipfix.DstAs,
+	"src_peer_as":      ipfix.BgpPrevAdjacentAsNumber,
+	"next_hop_as":      ipfix.BgpNextAdjacentAsNumber,
+	"end_reason":       ipfix.FlowEndReason,
+	"tcp_window_size":  ipfix.TCPWindowSize,
+	"tcp_window_scale": ipfix.TCPWindowScale,
+	"wlan_ssid":        ipfix.WlanSSID,
+	"wlan_channel":     ipfix.WlanChannelID,
+	"sta_mac":          ipfix.StaMacAddress,
+	"connection_id":    ipfix.ConnectionTransactionID,
+}
+
+// FieldOverride describes how a field of an exporter is decoded
+type FieldOverride struct {
+	// Type is the information element the field is decoded as instead of its
+	// own type (or ignoreField to skip it). Only used if Retype is set.
+	Type   uint16
+	Retype bool
+
+	// LittleEndian is set for fields the exporter sends in little endian
+	// instead of network byte order
+	LittleEndian bool
+}
+
+// FieldOverrides maps fields of an exporter to how they are decoded
+type FieldOverrides map[ipfix.FieldID]FieldOverride
+
+// ParseFieldOverrides parses a comma separated list of per exporter field overrides.
+// Each element is of the form exporter/[enterprise/]type=field, e.g. "192.0.2.1/2=ignore"
+// or "192.0.2.1/9/1=packets". The pseudo field little_endian marks a field as sent in
+// little endian byte order, e.g. "192.0.2.1/1=little_endian", and may be combined with
+// another override of the same field. The result is keyed by exporter address.
+func ParseFieldOverrides(spec string) (map[string]FieldOverrides, error) {
+	overrides := make(map[string]FieldOverrides)
+	if spec == "" {
+		return overrides, nil
+	}
+
+	for _, elem := range strings.Split(spec, ",") {
+		parts := strings.SplitN(elem, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid element %q, expected exporter/[enterprise/]type=field", elem)
+		}
+
+		target, ok := overrideTargets[parts[1]]
+		if !ok && parts[1] != littleEndian {
+			return nil, fmt.Errorf("unknown field %q in %q", parts[1], elem)
+		}
+
+		keys := strings.Split(parts[0], "/")
+		if len(keys) < 2 || len(keys) > 3 {
+			return nil, fmt.Errorf("invalid element %q, expected exporter/[enterprise/]type=field", elem)
+		}
+
+		ip := net.ParseIP(keys[0])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid exporter address in %q", elem)
+		}
+
+		var id ipfix.FieldID
+		if len(keys) == 3 {
+			pen, err := strconv.ParseUint(keys[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid enterprise number in %q: %v", elem, err)
+			}
+			id.Enterprise = uint32(pen)
+		}
+
+		t, err := strconv.ParseUint(keys[len(keys)-1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid type in %q: %v", elem, err)
+		}
+		id.Type = uint16(t) &^ ipfix.EnterpriseBit
+
+		addr := ip.String()
+		if overrides[addr] == nil {
+			overrides[addr] = make(FieldOverrides)
+		}
+		o := overrides[addr][id]
+		if parts[1] == littleEndian {
+			o.LittleEndian = true
+		} else {
+			o.Type = target
+			o.Retype = true
+		}
+		overrides[addr][id] = o
+	}
+	return overrides, nil
+}
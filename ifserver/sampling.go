@@ -0,0 +1,51 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifserver
+
+import "sync"
+
+// samplingKey identifies an observation domain of an exporter
+type samplingKey struct {
+	rtr      string
+	domainID uint32
+}
+
+// samplingTable keeps the sampling rates exporters announce in options data records
+type samplingTable struct {
+	rates map[samplingKey]uint32
+	lock  sync.RWMutex
+}
+
+// newSamplingTable creates and initializes a new `samplingTable` instance
+func newSamplingTable() *samplingTable {
+	return &samplingTable{rates: make(map[samplingKey]uint32)}
+}
+
+// update records sampling rate `rate` for observation domain `domainID` of
+// router `rtr`. It returns true if a different rate was known before.
+func (t *samplingTable) update(rtr string, domainID uint32, rate uint32) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	key := samplingKey{rtr: rtr, domainID: domainID}
+	old, ok := t.rates[key]
+	t.rates[key] = rate
+	return ok && old != rate
+}
+
+// rate returns the sampling rate of observation domain `domainID` of router `rtr`, 0 if unknown
+func (t *samplingTable) rate(rtr string, domainID uint32) uint32 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.rates[samplingKey{rtr: rtr, domainID: domainID}]
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/fairqueue"
+	"github.com/google/tflow2/stats"
+)
+
+// ipfixVersion is the version number in the header of IPFIX messages
+const ipfixVersion = 10
+
+// DefaultTCPReadTimeout is the time an exporter connected via TCP has to send
+// each message if not configured
+const DefaultTCPReadTimeout = 10 * time.Minute
+
+// deadliner is implemented by streams whose reads can time out
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// connReader is a buffered reader of `conn` whose reads can time out
+type connReader struct {
+	*bufio.Reader
+	conn net.Conn
+}
+
+// SetReadDeadline implements deadliner
+func (c connReader) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// acceptTCP accepts connections of exporters sending IPFIX over TCP (RFC 7011,
+// section 10.4) until the server is closed
+func (ifs *IPFIXServer) acceptTCP() {
+	defer ifs.workers.Done()
+	for {
+		conn, err := ifs.listener.Accept()
+		if err != nil {
+			if ifs.isClosed() {
+				return
+			}
+			glog.Errorf("Error accepting connection: %v", err)
+			continue
+		}
+
+		ifs.connsLock.Lock()
+		if ifs.isClosed() {
+			ifs.connsLock.Unlock()
+			conn.Close()
+			return
+		}
+		ifs.conns[conn] = true
+		ifs.workers.Add(1)
+		ifs.connsLock.Unlock()
+		go ifs.connWorker(conn)
+	}
+}
+
+// connWorker reads IPFIX messages from `conn` until the exporter or Close closes it.
+// Templates are kept per exporter address as for UDP, so they survive reconnects.
+func (ifs *IPFIXServer) connWorker(conn net.Conn) {
+	defer ifs.workers.Done()
+	defer func() {
+		ifs.connsLock.Lock()
+		delete(ifs.conns, conn)
+		ifs.connsLock.Unlock()
+		conn.Close()
+	}()
+
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+	remote := addr.IP
+	if ip := remote.To4(); ip != nil {
+		remote = ip
+	}
+
+	if err := ifs.readStream(remote, connReader{Reader: bufio.NewReader(conn), conn: conn}); err != nil && !ifs.isClosed() {
+		glog.Errorf("IPFIX connection from %s: %v", addr, err)
+	}
+}
+
+// readStream passes each IPFIX message read from `r` over to processPacket().
+// Messages are framed by the length in their header. It returns nil once `r`
+// ends between messages, an error if the stream can't be framed. If `r` can time
+// out each message has to be read within `tcpReadTimeout`, so exporters gone
+// silent or away without closing the connection don't keep it open forever.
+func (ifs *IPFIXServer) readStream(remote net.IP, r io.Reader) error {
+	d, _ := r.(deadliner)
+	hdr := make([]byte, 4)
+	for {
+		if d != nil && ifs.tcpReadTimeout > 0 {
+			if err := d.SetReadDeadline(time.Now().Add(ifs.tcpReadTimeout)); err != nil {
+				return fmt.Errorf("unable to set read deadline: %v", err)
+			}
+		}
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return fmt.Errorf("no message within %v", ifs.tcpReadTimeout)
+			}
+			return fmt.Errorf("truncated message header: %v", err)
+		}
+
+		if version := binary.BigEndian.Uint16(hdr[0:2]); version != ipfixVersion {
+			return fmt.Errorf("unknown message version %d", version)
+		}
+		length := int(binary.BigEndian.Uint16(hdr[2:4]))
+		if length < messageHeaderLen {
+			return fmt.Errorf("invalid message length %d", length)
+		}
+
+		// Decode reverses the buffer in place, so each message gets its own
+		// buffer rather than sharing one that is still being decoded
+		msg := make([]byte, length)
+		copy(msg, hdr)
+		if _, err := io.ReadFull(r, msg[len(hdr):]); err != nil {
+			return fmt.Errorf("truncated message of %d bytes: %v", length, err)
+		}
+		atomic.AddUint64(&stats.GlobalStats.IPFIXpackets, 1)
+		atomic.AddUint64(&stats.GlobalStats.IPFIXbytes, uint64(length))
+
+		if ifs.scheduler != nil {
+			ifs.scheduler.Push(fairqueue.Packet{Remote: remote, Data: msg})
+			continue
+		}
+		ifs.processPacket(remote, msg)
+	}
+}
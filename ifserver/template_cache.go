@@ -12,45 +12,305 @@
 package ifserver
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/golang/glog"
 	"github.com/google/tflow2/ipfix"
+	"github.com/google/tflow2/stats"
 )
 
+// CachedTemplate is a template of an exporter as exchanged between collectors
+type CachedTemplate struct {
+	Exporter        string          `json:"exporter"`
+	DomainID        uint32          `json:"domain_id"`
+	TemplateID      uint16          `json:"template_id"`
+	ScopeFieldCount uint16          `json:"scope_field_count,omitempty"`
+	Fields          []TemplateField `json:"fields"`
+}
+
+// TemplateField is a field of a `CachedTemplate`
+type TemplateField struct {
+	Type       uint16 `json:"type"`
+	Length     uint16 `json:"length"`
+	Enterprise uint32 `json:"enterprise,omitempty"`
+}
+
+// templateCache keeps the templates of all exporters, keyed by exporter, domain
+// and template ID. It is shared by all workers and safe for concurrent use.
 type templateCache struct {
-	cache map[uint32]map[uint32]map[uint16]ipfix.TemplateRecords
-	lock  sync.RWMutex
+	cache map[string]map[uint32]map[uint16]ipfix.TemplateRecords
+
+	// seen holds the time each template was last received (or imported) at
+	seen map[cacheKey]time.Time
+
+	// ttl is the age templates are considered absent at, until they are received
+	// again or removed by `expire`. 0 keeps templates forever.
+	ttl time.Duration
+
+	lock sync.RWMutex
 }
 
-// newTemplateCache creates and initializes a new `templateCache` instance
-func newTemplateCache() *templateCache {
-	return &templateCache{cache: make(map[uint32]map[uint32]map[uint16]ipfix.TemplateRecords)}
+// cacheKey identifies a template in `templateCache`
+type cacheKey struct {
+	exporter   string
+	domainID   uint32
+	templateID uint16
 }
 
-func (c *templateCache) set(rtr uint32, domainID uint32, templateID uint16, records ipfix.TemplateRecords) {
+// exporterKey returns the key of exporter `rtr` in the cache. IPv4 exporters are
+// keyed by their 4 byte address whatever the representation of `rtr`, IPv6
+// exporters by their 16 byte address.
+func exporterKey(rtr net.IP) string {
+	if ip := rtr.To4(); ip != nil {
+		return string(ip)
+	}
+	return string(rtr.To16())
+}
+
+// newTemplateCache creates and initializes a new `templateCache` instance keeping
+// templates for `ttl`
+func newTemplateCache(ttl time.Duration) *templateCache {
+	return &templateCache{
+		cache: make(map[string]map[uint32]map[uint16]ipfix.TemplateRecords),
+		seen:  make(map[cacheKey]time.Time),
+		ttl:   ttl,
+	}
+}
+
+// set stores `records` as template `templateID` of domain `domainID` of exporter `rtr`
+func (c *templateCache) set(rtr net.IP, domainID uint32, templateID uint16, records ipfix.TemplateRecords) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	if _, ok := c.cache[rtr]; !ok {
-		c.cache[rtr] = make(map[uint32]map[uint16]ipfix.TemplateRecords)
+	key := exporterKey(rtr)
+	if _, ok := c.cache[key]; !ok {
+		c.cache[key] = make(map[uint32]map[uint16]ipfix.TemplateRecords)
 	}
-	if _, ok := c.cache[rtr][domainID]; !ok {
-		c.cache[rtr][domainID] = make(map[uint16]ipfix.TemplateRecords)
+	if _, ok := c.cache[key][domainID]; !ok {
+		c.cache[key][domainID] = make(map[uint16]ipfix.TemplateRecords)
 	}
-	c.cache[rtr][domainID][templateID] = records
+	c.cache[key][domainID][templateID] = records
+	c.touch(cacheKey{key, domainID, templateID})
 }
 
-func (c *templateCache) get(rtr uint32, domainID uint32, templateID uint16) *ipfix.TemplateRecords {
+// get returns a copy of template `templateID` of domain `domainID` of exporter `rtr`, nil if unknown
+// or not received within the TTL
+func (c *templateCache) get(rtr net.IP, domainID uint32, templateID uint16) *ipfix.TemplateRecords {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
-	if _, ok := c.cache[rtr]; !ok {
+	key := exporterKey(rtr)
+	if _, ok := c.cache[key]; !ok {
+		return nil
+	}
+	if _, ok := c.cache[key][domainID]; !ok {
 		return nil
 	}
-	if _, ok := c.cache[rtr][domainID]; !ok {
+	if _, ok := c.cache[key][domainID][templateID]; !ok {
 		return nil
 	}
-	if _, ok := c.cache[rtr][domainID][templateID]; !ok {
+	if c.ttl > 0 && time.Since(c.seen[cacheKey{key, domainID, templateID}]) > c.ttl {
 		return nil
 	}
-	ret := c.cache[rtr][domainID][templateID]
+	ret := c.cache[key][domainID][templateID]
 	return &ret
 }
+
+// add stores `records` unless a template with the same key is cached already. It
+// returns true if the template was stored.
+func (c *templateCache) add(rtr net.IP, domainID uint32, templateID uint16, records ipfix.TemplateRecords) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := exporterKey(rtr)
+	if _, ok := c.cache[key][domainID][templateID]; ok {
+		return false
+	}
+	if _, ok := c.cache[key]; !ok {
+		c.cache[key] = make(map[uint32]map[uint16]ipfix.TemplateRecords)
+	}
+	if _, ok := c.cache[key][domainID]; !ok {
+		c.cache[key][domainID] = make(map[uint16]ipfix.TemplateRecords)
+	}
+	c.cache[key][domainID][templateID] = records
+	c.touch(cacheKey{key, domainID, templateID})
+	return true
+}
+
+// touch records the receipt of template `k`, counting it for its exporter if it
+// is new. `c.lock` must be held.
+func (c *templateCache) touch(k cacheKey) {
+	if _, ok := c.seen[k]; !ok {
+		atomic.AddInt64(&stats.Router(net.IP(k.exporter).String()).Templates, 1)
+	}
+	c.seen[k] = time.Now()
+}
+
+// expire removes templates last received before `before`, so flowsets of their
+// IDs aren't decoded until the exporter sent the template again. It returns the
+// number of templates removed.
+func (c *templateCache) expire(before time.Time) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n := 0
+	for k, t := range c.seen {
+		if !t.Before(before) {
+			continue
+		}
+		delete(c.seen, k)
+		atomic.AddInt64(&stats.Router(net.IP(k.exporter).String()).Templates, -1)
+		delete(c.cache[k.exporter][k.domainID], k.templateID)
+		if len(c.cache[k.exporter][k.domainID]) == 0 {
+			delete(c.cache[k.exporter], k.domainID)
+		}
+		if len(c.cache[k.exporter]) == 0 {
+			delete(c.cache, k.exporter)
+		}
+		n++
+	}
+	return n
+}
+
+// templates returns all cached templates
+func (c *templateCache) templates() []CachedTemplate {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	templates := make([]CachedTemplate, 0)
+	for rtr, domains := range c.cache {
+		exporter := net.IP(rtr)
+		for domainID, tmpls := range domains {
+			for templateID, tmpl := range tmpls {
+				t := CachedTemplate{
+					Exporter:        exporter.String(),
+					DomainID:        domainID,
+					TemplateID:      templateID,
+					ScopeFieldCount: tmpl.ScopeFieldCount,
+				}
+				for i, r := range tmpl.Records {
+					f := TemplateField{Type: r.Type, Length: r.Length}
+					if i < len(tmpl.EnterpriseNumbers) {
+						f.Enterprise = tmpl.EnterpriseNumbers[i]
+					}
+					t.Fields = append(t.Fields, f)
+				}
+				templates = append(templates, t)
+			}
+		}
+	}
+	return templates
+}
+
+// expireTemplates removes templates not received within `ttl` from the cache,
+// checking every minute (or every `ttl` if shorter) until the server is closed
+func (ifs *IPFIXServer) expireTemplates(ttl time.Duration) {
+	interval := time.Minute
+	if ttl < interval {
+		interval = ttl
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ifs.done:
+			return
+		}
+		if n := ifs.tmplCache.expire(time.Now().Add(-ttl)); n > 0 {
+			atomic.AddUint64(&stats.GlobalStats.TemplatesExpired, uint64(n))
+			glog.Infof("Expired %d templates not received within %v", n, ttl)
+		}
+	}
+}
+
+// ExportTemplates writes all cached templates to `w` as JSON, to be imported by
+// another collector using `ImportTemplates`
+func (ifs *IPFIXServer) ExportTemplates(w io.Writer) error {
+	return json.NewEncoder(w).Encode(ifs.tmplCache.templates())
+}
+
+// ImportTemplates reads templates written by `ExportTemplates` from `r` into the
+// cache, so flows can be decoded before exporters resend their templates.
+// Templates received from exporters in the meantime are kept. Templates failing
+// the checks applied to received ones are skipped and counted as invalid. It
+// returns the number of templates imported.
+func (ifs *IPFIXServer) ImportTemplates(r io.Reader) (int, error) {
+	var templates []CachedTemplate
+	if err := json.NewDecoder(r).Decode(&templates); err != nil {
+		return 0, fmt.Errorf("unable to decode templates: %v", err)
+	}
+
+	n := 0
+	for _, t := range templates {
+		ip := net.ParseIP(t.Exporter)
+		if ip == nil {
+			atomic.AddUint64(&stats.GlobalStats.TemplatesInvalid, 1)
+			glog.Warningf("Skipping template %d: invalid exporter address %q", t.TemplateID, t.Exporter)
+			continue
+		}
+		if len(t.Fields) > math.MaxUint16 {
+			atomic.AddUint64(&stats.GlobalStats.TemplatesInvalid, 1)
+			glog.Warningf("Skipping template %d of %s: %d fields exceed the field count", t.TemplateID, t.Exporter, len(t.Fields))
+			continue
+		}
+
+		tmpl := ipfix.TemplateRecords{
+			Header:            &ipfix.TemplateRecordHeader{FieldCount: uint16(len(t.Fields)), TemplateID: t.TemplateID},
+			EnterpriseNumbers: make([]uint32, 0, len(t.Fields)),
+			ScopeFieldCount:   t.ScopeFieldCount,
+		}
+		for _, f := range t.Fields {
+			tmpl.Records = append(tmpl.Records, &ipfix.TemplateRecord{Type: f.Type, Length: f.Length})
+			tmpl.EnterpriseNumbers = append(tmpl.EnterpriseNumbers, f.Enterprise)
+		}
+		if err := checkTemplate(&tmpl); err != nil {
+			atomic.AddUint64(&stats.GlobalStats.TemplatesInvalid, 1)
+			glog.Warningf("Skipping template %d of %s: %v", t.TemplateID, t.Exporter, err)
+			continue
+		}
+		if ifs.tmplCache.add(ip, t.DomainID, t.TemplateID, tmpl) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// checkTemplate returns an error if records of `tmpl` can't be decoded, as they
+// exceed a message, or its fields are inconsistent. It applies to templates
+// received from exporters and imported ones alike.
+func checkTemplate(tmpl *ipfix.TemplateRecords) error {
+	if tmpl.Header.TemplateID <= ipfix.SetIDTemplateMax {
+		return fmt.Errorf("reserved template ID")
+	}
+	if int(tmpl.ScopeFieldCount) > len(tmpl.Records) {
+		return fmt.Errorf("%d scope fields out of %d", tmpl.ScopeFieldCount, len(tmpl.Records))
+	}
+
+	size := 0
+	for i, f := range tmpl.Records {
+		if i < len(tmpl.EnterpriseNumbers) && tmpl.EnterpriseNumbers[i] != 0 && f.Type&ipfix.EnterpriseBit == 0 {
+			return fmt.Errorf("field %d of type %d has enterprise number %d", i, f.Type, tmpl.EnterpriseNumbers[i])
+		}
+		if f.Length != ipfix.VariableLength {
+			size += int(f.Length)
+		}
+	}
+	if size > ipfix.MaxPacketSize {
+		return fmt.Errorf("records of %d bytes exceed a message", size)
+	}
+	return nil
+}
+
+// ServeTemplates sends all cached templates to a peer collector warming up its cache
+func (ifs *IPFIXServer) ServeTemplates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := ifs.ExportTemplates(w); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to export templates: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ifserver
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/tflow2/ipfix"
+	"github.com/google/tflow2/netflow"
+)
+
+// VRFMap maps interfaces (ifIndex) of an exporter to the ID of their VRF
+type VRFMap map[uint32]uint32
+
+// ParseVRFMaps parses a comma separated list of per exporter interface to VRF
+// mappings. Each element is of the form exporter/ifindex=vrf, e.g. "192.0.2.1/12=3".
+// The result is keyed by exporter address.
+func ParseVRFMaps(spec string) (map[string]VRFMap, error) {
+	maps := make(map[string]VRFMap)
+	if spec == "" {
+		return maps, nil
+	}
+
+	for _, elem := range strings.Split(spec, ",") {
+		parts := strings.SplitN(elem, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid element %q, expected exporter/ifindex=vrf", elem)
+		}
+
+		keys := strings.Split(parts[0], "/")
+		if len(keys) != 2 {
+			return nil, fmt.Errorf("invalid element %q, expected exporter/ifindex=vrf", elem)
+		}
+
+		ip := net.ParseIP(keys[0])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid exporter address in %q", elem)
+		}
+
+		ifIndex, err := strconv.ParseUint(keys[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface index in %q: %v", elem, err)
+		}
+
+		vrf, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VRF ID in %q: %v", elem, err)
+		}
+
+		addr := ip.String()
+		if maps[addr] == nil {
+			maps[addr] = make(VRFMap)
+		}
+		maps[addr][uint32(ifIndex)] = uint32(vrf)
+	}
+	return maps, nil
+}
+
+// decodeVRFs fills the ingress and egress VRF of `fl`. VRF IDs sent by the
+// exporter take precedence, `vrfs` is only consulted for the missing ones.
+func decodeVRFs(fl *netflow.Flow, fm *fieldMap, r ipfix.FlowDataRecord, vrfs VRFMap) {
+	if fm.ingressVRF >= 0 {
+		fl.IngressVrf = uint32At(r, fm.ingressVRF)
+	} else {
+		fl.IngressVrf = vrfs[fl.IntIn]
+	}
+
+	if fm.egressVRF >= 0 {
+		fl.EgressVrf = uint32At(r, fm.egressVRF)
+	} else {
+		fl.EgressVrf = vrfs[fl.IntOut]
+	}
+}
@@ -30,56 +30,104 @@ const SetIDTemplateMax = 255
 // TemplateSetID is the set ID reserved for template sets
 const TemplateSetID = 2
 
-// errorIncompatibleVersion prints an error message in case the detected version is not supported
-func errorIncompatibleVersion(version uint16) error {
-	return fmt.Errorf("IPFIX: Incompatible protocol version v%d, only v10 is supported", version)
-}
+// EnterpriseBit is set in the type of enterprise specific fields
+const EnterpriseBit = 0x8000
+
+// sizeOfEnterpriseNumber is the size of the enterprise number following enterprise specific fields
+const sizeOfEnterpriseNumber = 4
+
+// OptionsTemplateSetID is the set ID reserved for options template sets
+const OptionsTemplateSetID = 3
+
+// MaxPacketSize is the size of the largest message Decode handles, the most the
+// length in the message header can tell
+const MaxPacketSize = 65535
+
+// minBufferSize is the size of the buffer smaller messages are decoded in
+const minBufferSize = 1500
+
+// bufferSlack is the room kept in front of the data, as decoding a template at
+// the start of the buffer steps one field before it
+const bufferSlack = 4
 
 // Decode is the main function of this package. It converts raw packet bytes to Packet struct.
+// Errors returned are of type *DecodeError.
 func Decode(raw []byte, remote net.IP) (*Packet, error) {
 	data := convert.Reverse(raw) //TODO: Make it endian aware. This assumes a little endian machine
 
 	pSize := len(data)
-	bufSize := 1500
-	buffer := [1500]byte{}
+	if pSize < int(sizeOfHeader) {
+		return nil, newDecodeError(ErrShortBuffer, nil, "%d bytes, message header needs %d", pSize, sizeOfHeader)
+	}
 
-	if pSize > bufSize {
-		panic("Buffer too small\n")
+	if pSize > MaxPacketSize {
+		// The header is at the end of the reversed data
+		hdr := make([]byte, sizeOfHeader)
+		copy(hdr, data[pSize-int(sizeOfHeader):])
+		return nil, newDecodeError(ErrPacketTooLarge, (*Header)(unsafe.Pointer(&hdr[0])), "%d bytes, at most %d supported", pSize, MaxPacketSize)
 	}
 
-	// copy data into array as arrays allow us to cast the shit out of it
-	for i := 0; i < pSize; i++ {
-		buffer[bufSize-pSize+i] = data[i]
+	// copy data into the end of the buffer, so we can cast the shit out of it
+	bufSize := minBufferSize
+	if pSize+bufferSlack > bufSize {
+		bufSize = pSize + bufferSlack
 	}
+	buffer := make([]byte, bufSize)
+	copy(buffer[bufSize-pSize:], data)
 
-	bufferPtr := unsafe.Pointer(&buffer)
+	bufferPtr := unsafe.Pointer(&buffer[0])
 	bufferMinPtr := unsafe.Pointer(uintptr(bufferPtr) + uintptr(bufSize) - uintptr(pSize))
 	headerPtr := unsafe.Pointer(uintptr(bufferPtr) + uintptr(bufSize) - uintptr(sizeOfHeader))
 
 	var packet Packet
-	packet.Buffer = buffer[:]
+	packet.Buffer = buffer
 	packet.Header = (*Header)(headerPtr)
 
 	if packet.Header.Version != 10 {
-		return nil, errorIncompatibleVersion(packet.Header.Version)
+		return nil, newDecodeError(ErrUnknownVersion, packet.Header, "v%d, only v10 is supported", packet.Header.Version)
+	}
+
+	if int(packet.Header.Length) != pSize {
+		return nil, newDecodeError(ErrLengthMismatch, packet.Header, "%d bytes, header says %d", pSize, packet.Header.Length)
 	}
 
 	//Pre-allocate some room for templates to avoid later copying
 	packet.Templates = make([]*TemplateRecords, 0, numPreAllocRecs)
 
 	for uintptr(headerPtr) > uintptr(bufferMinPtr) {
+		remaining := uintptr(headerPtr) - uintptr(bufferMinPtr)
+		if remaining < sizeOfSetHeader {
+			return nil, newDecodeError(ErrShortBuffer, packet.Header, "%d bytes left, set header needs %d", remaining, sizeOfSetHeader)
+		}
+
 		ptr := unsafe.Pointer(uintptr(headerPtr) - sizeOfSetHeader)
 
 		fls := &Set{
 			Header: (*SetHeader)(ptr),
 		}
 
-		if fls.Header.SetID == TemplateSetID {
+		if uintptr(fls.Header.Length) < sizeOfSetHeader || uintptr(fls.Header.Length) > remaining {
+			return nil, newDecodeError(ErrBadSetLength, packet.Header, "set %d has length %d with %d bytes left", fls.Header.SetID, fls.Header.Length, remaining)
+		}
+
+		switch {
+		case fls.Header.SetID == TemplateSetID:
 			// Template
-			decodeTemplate(&packet, ptr, uintptr(fls.Header.Length)-sizeOfSetHeader, remote)
-		} else if fls.Header.SetID > SetIDTemplateMax {
+			err := decodeTemplate(&packet, ptr, uintptr(fls.Header.Length)-sizeOfSetHeader, remote, false)
+			if err != nil {
+				return nil, err
+			}
+		case fls.Header.SetID == OptionsTemplateSetID:
+			// Options template
+			err := decodeTemplate(&packet, ptr, uintptr(fls.Header.Length)-sizeOfSetHeader, remote, true)
+			if err != nil {
+				return nil, err
+			}
+		case fls.Header.SetID > SetIDTemplateMax:
 			// Actual data packet
 			decodeData(&packet, ptr, uintptr(fls.Header.Length)-sizeOfSetHeader)
+		default:
+			return nil, newDecodeError(ErrUnknownSetID, packet.Header, "set id %d is reserved", fls.Header.SetID)
 		}
 
 		headerPtr = unsafe.Pointer(uintptr(headerPtr) - uintptr(fls.Header.Length))
@@ -91,38 +139,75 @@ func Decode(raw []byte, remote net.IP) (*Packet, error) {
 // decodeData decodes a flowSet from `packet`
 func decodeData(packet *Packet, headerPtr unsafe.Pointer, size uintptr) {
 	flsh := (*SetHeader)(unsafe.Pointer(headerPtr))
-	data := unsafe.Pointer(uintptr(headerPtr) - uintptr(flsh.Length))
+	// The `size` bytes of records precede the header. Pointing at them rather than
+	// at the start of the set keeps the pointer within the buffer for the first set.
+	data := unsafe.Pointer(uintptr(headerPtr) - size)
 
 	fls := &Set{
 		Header:  flsh,
-		Records: (*(*[1<<31 - 1]byte)(data))[sizeOfSetHeader:flsh.Length],
+		Records: (*(*[1<<31 - 1]byte)(data))[:size],
 	}
 
 	packet.FlowSets = append(packet.FlowSets, fls)
 }
 
-// decodeTemplate decodes a template from `packet`
-func decodeTemplate(packet *Packet, end unsafe.Pointer, size uintptr, remote net.IP) {
+// decodeTemplate decodes a template (or an options template if `options` is set) from `packet`
+func decodeTemplate(packet *Packet, end unsafe.Pointer, size uintptr, remote net.IP, options bool) error {
+	headerSize := sizeOfTemplateRecordHeader
+	if options {
+		headerSize = sizeOfOptionsTemplateRecordHeader
+	}
+
 	min := uintptr(end) - size
 	for uintptr(end) > min {
-		headerPtr := unsafe.Pointer(uintptr(end) - sizeOfTemplateRecordHeader)
+		// Anything shorter than a template record header is padding
+		if uintptr(end)-min < headerSize {
+			break
+		}
+		headerPtr := unsafe.Pointer(uintptr(end) - headerSize)
 
 		tmplRecs := &TemplateRecords{}
-		tmplRecs.Header = (*TemplateRecordHeader)(unsafe.Pointer(headerPtr))
+		if options {
+			optsHeader := (*OptionsTemplateRecordHeader)(unsafe.Pointer(headerPtr))
+			tmplRecs.Header = &optsHeader.TemplateRecordHeader
+			tmplRecs.ScopeFieldCount = optsHeader.ScopeFieldCount
+			if tmplRecs.ScopeFieldCount == 0 || tmplRecs.ScopeFieldCount > tmplRecs.Header.FieldCount {
+				return newDecodeError(ErrBadTemplate, packet.Header, "options template %d has %d scope fields out of %d", tmplRecs.Header.TemplateID, tmplRecs.ScopeFieldCount, tmplRecs.Header.FieldCount)
+			}
+		} else {
+			tmplRecs.Header = (*TemplateRecordHeader)(unsafe.Pointer(headerPtr))
+		}
 		tmplRecs.Packet = packet
 		tmplRecs.Records = make([]*TemplateRecord, 0, numPreAllocRecs)
+		tmplRecs.EnterpriseNumbers = make([]uint32, 0, numPreAllocRecs)
 
-		ptr := unsafe.Pointer(uintptr(headerPtr) - sizeOfTemplateRecordHeader)
+		ptr := unsafe.Pointer(uintptr(headerPtr) - sizeOfTemplateRecord)
 		var i uint16
 		for i = 0; i < tmplRecs.Header.FieldCount; i++ {
+			if uintptr(ptr) < min {
+				return newDecodeError(ErrBadTemplate, packet.Header, "template %d with %d fields exceeds set", tmplRecs.Header.TemplateID, tmplRecs.Header.FieldCount)
+			}
 			rec := (*TemplateRecord)(unsafe.Pointer(ptr))
 			tmplRecs.Records = append(tmplRecs.Records, rec)
 			ptr = unsafe.Pointer(uintptr(ptr) - sizeOfTemplateRecord)
+
+			// Enterprise specific fields are followed by the enterprise number.
+			// They are kept with the enterprise bit set so they never match an IANA field.
+			var pen uint32
+			if rec.Type&EnterpriseBit != 0 {
+				if uintptr(ptr) < min {
+					return newDecodeError(ErrBadTemplate, packet.Header, "template %d with %d fields exceeds set", tmplRecs.Header.TemplateID, tmplRecs.Header.FieldCount)
+				}
+				pen = *(*uint32)(ptr)
+				ptr = unsafe.Pointer(uintptr(ptr) - sizeOfEnterpriseNumber)
+			}
+			tmplRecs.EnterpriseNumbers = append(tmplRecs.EnterpriseNumbers, pen)
 		}
 
 		packet.Templates = append(packet.Templates, tmplRecs)
-		end = unsafe.Pointer(uintptr(end) - uintptr(tmplRecs.Header.FieldCount)*sizeOfTemplateRecord - sizeOfTemplateRecordHeader)
+		end = unsafe.Pointer(uintptr(ptr) + sizeOfTemplateRecord)
 	}
+	return nil
 }
 
 // PrintHeader prints the header of `packet`
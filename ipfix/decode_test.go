@@ -0,0 +1,250 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/tflow2/convert"
+)
+
+// header is a IPFIX message header of a message with length 0, export time 1500000000, sequence 1 and domain 42
+var header = []byte{0, 10, 0, 0, 0x59, 0x68, 0x2f, 0x00, 0, 0, 0, 1, 0, 0, 0, 42}
+
+// withHeader creates a message carrying `sets` with the length set accordingly
+func withHeader(sets ...byte) []byte {
+	msg := append(append([]byte{}, header...), sets...)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)))
+	return msg
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      []byte
+		expected error
+	}{
+		{
+			name:     "Valid packet",
+			raw:      withHeader(0, 2, 0, 12, 1, 0, 0, 1, 0, 8, 0, 4),
+			expected: nil,
+		},
+		{
+			name:     "Jumbo message",
+			raw:      withHeader(append([]byte{1, 0, 0x23, 0x2c}, make([]byte, 9000)...)...),
+			expected: nil,
+		},
+		{
+			name:     "Truncated header",
+			raw:      append([]byte{}, header[:10]...),
+			expected: ErrShortBuffer,
+		},
+		{
+			name:     "Packet too large",
+			raw:      withHeader(make([]byte, MaxPacketSize)...),
+			expected: ErrPacketTooLarge,
+		},
+		{
+			name:     "Netflow v9",
+			raw:      append([]byte{0, 9}, header[2:]...),
+			expected: ErrUnknownVersion,
+		},
+		{
+			name:     "Length mismatch",
+			raw:      append(withHeader(0, 2, 0, 12, 1, 0, 0, 1, 0, 8, 0, 4), 0, 0, 0, 0),
+			expected: ErrLengthMismatch,
+		},
+		{
+			name:     "Zero set length",
+			raw:      withHeader(1, 0, 0, 0),
+			expected: ErrBadSetLength,
+		},
+		{
+			name:     "Set length exceeds packet",
+			raw:      withHeader(1, 0, 0, 64, 0, 0, 0, 0),
+			expected: ErrBadSetLength,
+		},
+		{
+			name:     "Truncated set header",
+			raw:      withHeader(1, 0),
+			expected: ErrShortBuffer,
+		},
+		{
+			name:     "Reserved set id",
+			raw:      withHeader(0, 1, 0, 4),
+			expected: ErrUnknownSetID,
+		},
+		{
+			name:     "Template with more fields than set",
+			raw:      withHeader(0, 2, 0, 12, 1, 0, 0, 5, 0, 8, 0, 4),
+			expected: ErrBadTemplate,
+		},
+		{
+			name:     "Options template without scope",
+			raw:      withHeader(0, 3, 0, 14, 1, 0, 0, 1, 0, 0, 0, 82, 0, 32),
+			expected: ErrBadTemplate,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Decode(test.raw, net.IP{192, 0, 2, 1})
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("Test %q: Unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+
+		de, ok := err.(*DecodeError)
+		if !ok {
+			t.Errorf("Test %q: Expected *DecodeError, got %v", test.name, err)
+			continue
+		}
+		if de.Err != test.expected {
+			t.Errorf("Test %q: Expected %v, got %v", test.name, test.expected, de.Err)
+		}
+	}
+}
+
+func TestCategory(t *testing.T) {
+	err := newDecodeError(ErrBadSetLength, nil, "")
+	if c := Category(err); c != "bad_set_length" {
+		t.Errorf("Expected category bad_set_length, got %s", c)
+	}
+	if c := Category(ErrShortBuffer); c != "short_buffer" {
+		t.Errorf("Expected category short_buffer, got %s", c)
+	}
+}
+
+func TestDecodeErrorHeader(t *testing.T) {
+	_, err := Decode(withHeader(0, 1, 0, 4), net.IP{192, 0, 2, 1})
+	de, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatalf("Expected *DecodeError, got %v", err)
+	}
+	if de.Header == nil {
+		t.Fatalf("Expected header to be set")
+	}
+	if de.Header.Version != 10 || de.Header.DomainID != 42 || de.Header.Length != 20 || de.Header.SequenceNumber != 1 {
+		t.Errorf("Unexpected header %s", de.Header)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "v10 domain 42 length 20") {
+		t.Errorf("Expected header in error message, got %q", msg)
+	}
+
+	// Packets too large need to be rejected before being copied into the buffer
+	_, err = Decode(withHeader(make([]byte, 1500)...), net.IP{192, 0, 2, 1})
+	if de, ok := err.(*DecodeError); !ok || de.Header == nil || de.Header.DomainID != 42 {
+		t.Errorf("Expected header of oversized packet, got %v", err)
+	}
+}
+
+func TestDecodeOptionsTemplate(t *testing.T) {
+	// Options template 256 scoped by ingressInterface carrying interfaceName
+	msg := withHeader(0, 3, 0, 18, 1, 0, 0, 2, 0, 1, 0, 10, 0, 4, 0, 82, 0, 32)
+	p, err := Decode(msg, net.IP{192, 0, 2, 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(p.Templates) != 1 {
+		t.Fatalf("Expected 1 template, got %d", len(p.Templates))
+	}
+
+	tmpl := p.Templates[0]
+	if tmpl.Header.TemplateID != 256 || tmpl.Header.FieldCount != 2 || tmpl.ScopeFieldCount != 1 {
+		t.Errorf("Expected template 256 with 2 fields and 1 scope field, got %d with %d/%d", tmpl.Header.TemplateID, tmpl.Header.FieldCount, tmpl.ScopeFieldCount)
+	}
+	if tmpl.Records[0].Type != InputSnmp || tmpl.Records[1].Type != IfName || tmpl.Records[1].Length != 32 {
+		t.Errorf("Unexpected fields %d/%d (%d)", tmpl.Records[0].Type, tmpl.Records[1].Type, tmpl.Records[1].Length)
+	}
+}
+
+func TestDecodeVariableLength(t *testing.T) {
+	// Template 256 with a variable length applicationId followed by both addresses,
+	// and a data set with a 1 byte and a 3 byte length prefixed application ID
+	msg := withHeader(
+		0, 2, 0, 20, 1, 0, 0, 3, 0, 95, 0xff, 0xff, 0, 8, 0, 4, 0, 12, 0, 4,
+		1, 0, 0, 31,
+		3, 20, 0, 80, 10, 0, 0, 1, 10, 0, 0, 2,
+		255, 0, 4, 20, 0, 1, 187, 10, 0, 0, 3, 10, 0, 0, 4,
+	)
+	p, err := Decode(msg, net.IP{192, 0, 2, 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(p.Templates) != 1 || p.Templates[0].Records[0].Length != VariableLength {
+		t.Fatalf("Expected 1 template with a variable length field, got %d", len(p.Templates))
+	}
+
+	sets := p.DataFlowSets()
+	if len(sets) != 1 {
+		t.Fatalf("Expected 1 data set, got %d", len(sets))
+	}
+	recs := p.Templates[0].DecodeFlowSet(*sets[0])
+	if len(recs) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(recs))
+	}
+
+	tests := []struct {
+		appID []byte
+		src   net.IP
+		dst   net.IP
+	}{
+		{appID: []byte{20, 0, 80}, src: net.IP{10, 0, 0, 1}, dst: net.IP{10, 0, 0, 2}},
+		{appID: []byte{20, 0, 1, 187}, src: net.IP{10, 0, 0, 3}, dst: net.IP{10, 0, 0, 4}},
+	}
+	for i, test := range tests {
+		v := recs[i].Values
+		if appID := convert.Reverse(v[0]); !bytes.Equal(appID, test.appID) {
+			t.Errorf("Record %d: Expected application ID %v, got %v", i, test.appID, appID)
+		}
+		if src, dst := net.IP(convert.Reverse(v[1])), net.IP(convert.Reverse(v[2])); !src.Equal(test.src) || !dst.Equal(test.dst) {
+			t.Errorf("Record %d: Expected %s -> %s, got %s -> %s", i, test.src, test.dst, src, dst)
+		}
+	}
+}
+
+func TestDecodeJumbo(t *testing.T) {
+	// Data set of 2250 sourceIPv4Address records, followed by the template so it
+	// ends up at the start of the decode buffer
+	data := []byte{1, 0, 0x23, 0x2c}
+	for i := 0; i < 2250; i++ {
+		data = append(data, 10, 0, byte(i>>8), byte(i))
+	}
+	msg := withHeader(append(data, 0, 2, 0, 12, 1, 0, 0, 1, 0, 8, 0, 4)...)
+	p, err := Decode(msg, net.IP{192, 0, 2, 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(p.Templates) != 1 || p.Templates[0].Header.TemplateID != 256 {
+		t.Fatalf("Expected template 256, got %d templates", len(p.Templates))
+	}
+
+	sets := p.DataFlowSets()
+	if len(sets) != 1 {
+		t.Fatalf("Expected 1 data set, got %d", len(sets))
+	}
+	recs := p.Templates[0].DecodeFlowSet(*sets[0])
+	if len(recs) != 2250 {
+		t.Fatalf("Expected 2250 records, got %d", len(recs))
+	}
+	for _, i := range []int{0, 2249} {
+		expected := net.IP{10, 0, byte(i >> 8), byte(i)}
+		if src := net.IP(convert.Reverse(recs[i].Values[0])); !src.Equal(expected) {
+			t.Errorf("Record %d: Expected %s, got %s", i, expected, src)
+		}
+	}
+}
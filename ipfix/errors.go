@@ -0,0 +1,107 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfix
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by Decode. They are wrapped in a *DecodeError.
+var (
+	// ErrShortBuffer is returned if a packet ends in the middle of a header
+	ErrShortBuffer = errors.New("IPFIX: short buffer")
+
+	// ErrPacketTooLarge is returned if a packet exceeds the size the decoder can handle
+	ErrPacketTooLarge = errors.New("IPFIX: packet too large")
+
+	// ErrUnknownVersion is returned if a packet is not IPFIX (version 10)
+	ErrUnknownVersion = errors.New("IPFIX: unknown version")
+
+	// ErrBadSetLength is returned if the length of a set is smaller than its header or exceeds the packet
+	ErrBadSetLength = errors.New("IPFIX: bad set length")
+
+	// ErrUnknownSetID is returned for sets with a reserved set ID
+	ErrUnknownSetID = errors.New("IPFIX: unknown set id")
+
+	// ErrBadTemplate is returned if a template record exceeds its set
+	ErrBadTemplate = errors.New("IPFIX: bad template")
+
+	// ErrLengthMismatch is returned if the length in the message header differs from the packet size
+	ErrLengthMismatch = errors.New("IPFIX: length mismatch")
+)
+
+// errorCategories maps errors to short names used to count them
+var errorCategories = map[error]string{
+	ErrShortBuffer:    "short_buffer",
+	ErrPacketTooLarge: "packet_too_large",
+	ErrUnknownVersion: "unknown_version",
+	ErrBadSetLength:   "bad_set_length",
+	ErrUnknownSetID:   "unknown_set_id",
+	ErrBadTemplate:    "bad_template",
+	ErrLengthMismatch: "length_mismatch",
+}
+
+// DecodeError describes why decoding a packet failed
+type DecodeError struct {
+	// Err is one of the Err* errors of this package
+	Err error
+
+	// Header is a copy of the header of the packet. It is nil if the packet is too short to carry a header.
+	Header *Header
+
+	// Detail describes the error further
+	Detail string
+}
+
+// newDecodeError creates a new `DecodeError`. `hdr` is copied as it points into the packets buffer.
+func newDecodeError(err error, hdr *Header, format string, args ...interface{}) *DecodeError {
+	de := &DecodeError{
+		Err:    err,
+		Detail: fmt.Sprintf(format, args...),
+	}
+	if hdr != nil {
+		h := *hdr
+		de.Header = &h
+	}
+	return de
+}
+
+// Error implements the error interface. If the header could be parsed it is
+// included, e.g. "IPFIX: length mismatch: 120 bytes, header says 124 (v10 domain 42 ...)".
+func (e *DecodeError) Error() string {
+	msg := e.Err.Error()
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Header != nil {
+		msg += " (" + e.Header.String() + ")"
+	}
+	return msg
+}
+
+// Unwrap returns the underlying Err* error
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Category returns a short name describing the kind of `err`, e.g. "short_buffer".
+// It returns "other" for errors not returned by this package.
+func Category(err error) string {
+	if de, ok := err.(*DecodeError); ok {
+		err = de.Err
+	}
+	if c, ok := errorCategories[err]; ok {
+		return c
+	}
+	return "other"
+}
@@ -11,6 +11,9 @@
 
 package ipfix
 
+// SrcAs and DstAs are bgpSourceAsNumber and bgpDestinationAsNumber, i.e. the
+// origin ASNs of the source and destination prefixes. The ASNs of the adjacent
+// peers are BgpPrevAdjacentAsNumber and BgpNextAdjacentAsNumber.
 const (
 	InBytes                   = 1
 	InPkts                    = 2
@@ -108,4 +111,85 @@ const (
 	ApplicationDescription    = 94
 	ApplicationTag            = 95
 	ApplicationName           = 96
+	PostIPDiffServCodePoint   = 98
+	BgpNextAdjacentAsNumber   = 128
+	BgpPrevAdjacentAsNumber   = 129
+	DroppedOctetDeltaCount    = 132
+	DroppedPacketDeltaCount   = 133
+	FlowEndReason             = 136
+	WlanChannelID             = 146
+	WlanSSID                  = 147
+	FlowID                    = 148
+	IPDiffServCodePoint       = 195
+	FlowStartSeconds          = 150
+	FlowEndSeconds            = 151
+	FlowStartMilliseconds     = 152
+	FlowEndMilliseconds       = 153
+	TCPWindowSize             = 186
+	TCPOptions                = 209
+	IPTotalLength             = 224
+	IngressVRFID              = 234
+	EgressVRFID               = 235
+	TCPWindowScale            = 238
+	Dot1qVlanID               = 243
+	PostDot1qVlanID           = 254
+	ConnectionTransactionID   = 280
+	IPHeaderPacketSection     = 313
+	DataLinkFrameSection      = 315
+	ObservationTimeSeconds    = 322
+	ObservationTimeMillis     = 323
+	SystemInitTimeMillis      = 160
+	SelectorID                = 302
+	SelectorAlgorithm         = 304
+	SamplingPacketInterval    = 305
+	SamplingPacketSpace       = 306
+	DataLinkFrameSize         = 312
+	Layer2SegmentID           = 351
+	StaMacAddress             = 365
+	StaIPv4Address            = 366
+	HTTPRequestMethod         = 459
+	HTTPRequestHost           = 460
+	FlowSelectorAlgorithm     = 390
+	HTTPRequestTarget         = 461
+)
+
+// Values of the flowEndReason information element as defined in RFC 7012
+const (
+	EndReasonIdleTimeout     = 1
+	EndReasonActiveTimeout   = 2
+	EndReasonEndOfFlow       = 3
+	EndReasonForcedEnd       = 4
+	EndReasonLackOfResources = 5
+)
+
+// Values of the selectorAlgorithm and flowSelectorAlgorithm information elements
+// as defined in RFC 5477 and the IANA PSAMP parameters registry
+const (
+	SelectorSystematicCount      = 1
+	SelectorSystematicTime       = 2
+	SelectorRandomNOutOfN        = 3
+	SelectorUniformProbabilistic = 4
+	SelectorPropertyMatch        = 5
+	SelectorHashBOB              = 6
+	SelectorHashIPSX             = 7
+	SelectorHashCRC              = 8
+	SelectorFlowStateDependent   = 9
+)
+
+// ScalableSelector returns whether counts of records selected by selector algorithm
+// `alg` can be scaled by a sampling rate. This is only the case for count, time and
+// random based selection. Filtering and hash based selection is deterministic, so
+// the selected records are not representative of the traffic.
+func ScalableSelector(alg uint32) bool {
+	switch alg {
+	case SelectorSystematicCount, SelectorSystematicTime, SelectorRandomNOutOfN, SelectorUniformProbabilistic:
+		return true
+	}
+	return false
+}
+
+// Network types carried in the most significant byte of layer2SegmentId
+const (
+	SegmentTypeVXLAN = 1
+	SegmentTypeNVGRE = 2
 )
@@ -151,7 +151,10 @@
 // using this package.
 package ipfix
 
-import "unsafe"
+import (
+	"fmt"
+	"unsafe"
+)
 
 // Header is an IPFIX message header
 type Header struct {
@@ -174,6 +177,11 @@ type Header struct {
 	Version uint16
 }
 
+// String returns a short description of the header for logging
+func (h *Header) String() string {
+	return fmt.Sprintf("v%d domain %d length %d sequence %d export time %d", h.Version, h.DomainID, h.Length, h.SequenceNumber, h.ExportTime)
+}
+
 // Set represents a Set as described in RFC7011
 type Set struct {
 	Header  *SetHeader
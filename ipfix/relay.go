@@ -0,0 +1,93 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfix
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Relay header format as prepended to IPFIX messages by forwarders relaying
+// packets from many exporters to a central collector. All fields are in
+// network byte order.
+//
+//    0                   1                   2                   3
+//    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//   |                      Magic ("TFRL")                           |
+//   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//   |    Version    |    Family     |           Reserved            |
+//   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//   |                  Receive Time (unix seconds)                  |
+//   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//   |        Exporter Address (4 bytes if Family is 4, 16 if 6)     |
+//   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//   |                     IPFIX Message ...                         |
+//   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+const (
+	// RelayMagic identifies a relay header
+	RelayMagic = 0x5446524c
+
+	// RelayVersion is the supported version of the relay header
+	RelayVersion = 1
+
+	// relayHeaderLen is the length of the relay header without the exporter address
+	relayHeaderLen = 12
+)
+
+// RelayHeader represents the header a relay prepends to an IPFIX message
+type RelayHeader struct {
+	// Exporter is the address of the device that originally sent the IPFIX message
+	Exporter net.IP
+
+	// ReceiveTime is the time the relay received the IPFIX message from the exporter
+	ReceiveTime uint32
+}
+
+// DecodeRelayHeader decodes the relay header at the beginning of `raw`. It
+// returns the header and the IPFIX message following it.
+func DecodeRelayHeader(raw []byte) (*RelayHeader, []byte, error) {
+	if len(raw) < relayHeaderLen {
+		return nil, nil, fmt.Errorf("relay header too short: %d bytes", len(raw))
+	}
+
+	if magic := binary.BigEndian.Uint32(raw[0:4]); magic != RelayMagic {
+		return nil, nil, fmt.Errorf("invalid relay header magic: %#x", magic)
+	}
+
+	if raw[4] != RelayVersion {
+		return nil, nil, fmt.Errorf("unsupported relay header version: %d", raw[4])
+	}
+
+	var addrLen int
+	switch raw[5] {
+	case 4:
+		addrLen = net.IPv4len
+	case 6:
+		addrLen = net.IPv6len
+	default:
+		return nil, nil, fmt.Errorf("unknown relay header address family: %d", raw[5])
+	}
+
+	if len(raw) < relayHeaderLen+addrLen {
+		return nil, nil, fmt.Errorf("relay header too short for address family %d: %d bytes", raw[5], len(raw))
+	}
+
+	hdr := &RelayHeader{
+		ReceiveTime: binary.BigEndian.Uint32(raw[8:12]),
+		Exporter:    make(net.IP, addrLen),
+	}
+	copy(hdr.Exporter, raw[relayHeaderLen:relayHeaderLen+addrLen])
+
+	return hdr, raw[relayHeaderLen+addrLen:], nil
+}
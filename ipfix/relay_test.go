@@ -0,0 +1,82 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfix
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDecodeRelayHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      []byte
+		wantErr  bool
+		exporter net.IP
+		ts       uint32
+		payload  int
+	}{
+		{
+			name: "IPv4 exporter",
+			raw: []byte{
+				'T', 'F', 'R', 'L', 1, 4, 0, 0,
+				0x59, 0x68, 0x2f, 0x00,
+				192, 0, 2, 1,
+				0, 10, 0, 16,
+			},
+			exporter: net.IP{192, 0, 2, 1},
+			ts:       1500000000,
+			payload:  4,
+		},
+		{
+			name: "Truncated IPv6 exporter",
+			raw: []byte{
+				'T', 'F', 'R', 'L', 1, 6, 0, 0,
+				0x59, 0x68, 0x2f, 0x00,
+				0x20, 0x01, 0x0d, 0xb8,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Plain IPFIX message",
+			raw: []byte{
+				0, 10, 0, 16, 0x59, 0x68, 0x2f, 0x00,
+				0, 0, 0, 1, 0, 0, 0, 0,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		hdr, payload, err := DecodeRelayHeader(test.raw)
+		if err != nil {
+			if !test.wantErr {
+				t.Errorf("Test %q: Unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if test.wantErr {
+			t.Errorf("Test %q: Expected error, got none", test.name)
+			continue
+		}
+
+		if !hdr.Exporter.Equal(test.exporter) {
+			t.Errorf("Test %q: Expected exporter %s, got %s", test.name, test.exporter, hdr.Exporter)
+		}
+		if hdr.ReceiveTime != test.ts {
+			t.Errorf("Test %q: Expected receive time %d, got %d", test.name, test.ts, hdr.ReceiveTime)
+		}
+		if len(payload) != test.payload {
+			t.Errorf("Test %q: Expected %d bytes of payload, got %d", test.name, test.payload, len(payload))
+		}
+	}
+}
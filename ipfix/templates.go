@@ -16,6 +16,12 @@ import "unsafe"
 const (
 	// numPreAllocFlowDataRecs is number of elements to pre allocate in DataRecs slice
 	numPreAllocFlowDataRecs = 20
+
+	// VariableLength is the field length used in templates for variable length fields
+	VariableLength = 65535
+
+	// longVariableLength is the length prefix announcing a 2 byte length to follow
+	longVariableLength = 255
 )
 
 // TemplateRecordHeader represents the header of a template record
@@ -35,6 +41,18 @@ type TemplateRecordHeader struct {
 
 var sizeOfTemplateRecordHeader = unsafe.Sizeof(TemplateRecordHeader{})
 
+// OptionsTemplateRecordHeader is the header of an options template record.
+// Like all structures overlaying the reversed buffer its fields are in reverse order.
+type OptionsTemplateRecordHeader struct {
+	// Number of scope fields in this Options Template Record. The scope
+	// fields are the first fields of the record and MUST NOT be zero.
+	ScopeFieldCount uint16
+
+	TemplateRecordHeader
+}
+
+var sizeOfOptionsTemplateRecordHeader = unsafe.Sizeof(OptionsTemplateRecordHeader{})
+
 // TemplateRecords is a single template that describes structure of a Flow Record
 // (actual Netflow data).
 type TemplateRecords struct {
@@ -46,6 +64,30 @@ type TemplateRecords struct {
 	Packet *Packet
 
 	Values [][]byte
+
+	// EnterpriseNumbers holds the enterprise number of each field in Records, 0 for IANA fields
+	EnterpriseNumbers []uint32
+
+	// ScopeFieldCount is the number of scope fields of options templates, 0 for templates
+	ScopeFieldCount uint16
+}
+
+// FieldID identifies an information element
+type FieldID struct {
+	// Enterprise is the private enterprise number, 0 for IANA information elements
+	Enterprise uint32
+
+	// Type is the information element identifier without the enterprise bit
+	Type uint16
+}
+
+// FieldID returns the ID of the `i`th field of the template
+func (dtpl *TemplateRecords) FieldID(i int) FieldID {
+	id := FieldID{Type: dtpl.Records[i].Type &^ EnterpriseBit}
+	if i < len(dtpl.EnterpriseNumbers) {
+		id.Enterprise = dtpl.EnterpriseNumbers[i]
+	}
+	return id
 }
 
 //TemplateRecord represents a Template Record as described in RFC3954
@@ -90,6 +132,12 @@ func (dtpl *TemplateRecords) DecodeFlowSet(set Set) (list []FlowDataRecord) {
 		if record.Values == nil {
 			return
 		}
+
+		// Records of templates without (or with only empty) fields take no
+		// space, so the rest of the set can't be told apart from padding
+		if count == 0 {
+			return
+		}
 		list = append(list, record)
 		n = n - count
 	}
@@ -97,18 +145,38 @@ func (dtpl *TemplateRecords) DecodeFlowSet(set Set) (list []FlowDataRecord) {
 	return
 }
 
-// parseFieldValues reads actual fields values from a Data Record utilizing a template
+// parseFieldValues reads actual fields values from a Data Record utilizing a template.
+// Variable length fields are prefixed with their length as described in RFC 7011 section 7.
 func parseFieldValues(flows []byte, fields []*TemplateRecord) ([][]byte, int) {
 	count := 0
 	n := len(flows)
 	values := make([][]byte, len(fields))
 	for i, f := range fields {
-		if n < int(f.Length) {
+		length := int(f.Length)
+		if f.Length == VariableLength {
+			if n < 1 {
+				return nil, 0
+			}
+			length = int(flows[n-1])
+			n--
+			count++
+
+			if length == longVariableLength {
+				if n < 2 {
+					return nil, 0
+				}
+				length = int(flows[n-1])<<8 | int(flows[n-2])
+				n -= 2
+				count += 2
+			}
+		}
+
+		if n < length {
 			return nil, 0
 		}
-		values[i] = flows[n-int(f.Length) : n]
-		count += int(f.Length)
-		n -= int(f.Length)
+		values[i] = flows[n-length : n]
+		count += length
+		n -= length
 	}
 	return values, count
 }
@@ -0,0 +1,123 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfix
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/tflow2/convert"
+)
+
+// varlenTemplate is a template with a short and a long variable length field followed by a fixed length field
+var varlenTemplate = TemplateRecords{
+	Header: &TemplateRecordHeader{FieldCount: 3, TemplateID: 256},
+	Records: []*TemplateRecord{
+		{Type: HTTPRequestHost, Length: VariableLength},
+		{Type: HTTPRequestTarget, Length: VariableLength},
+		{Type: InBytes, Length: 4},
+	},
+}
+
+// varlenRecord creates a data record of `varlenTemplate` as sent by the exporter
+func varlenRecord(host string, target string, size []byte) []byte {
+	rec := append([]byte{byte(len(host))}, host...)
+	rec = append(rec, 255, byte(len(target)>>8), byte(len(target)))
+	rec = append(rec, target...)
+	return append(rec, size...)
+}
+
+func TestDecodeFlowSetVariableLength(t *testing.T) {
+	target := string(bytes.Repeat([]byte("a"), 300))
+	records := append(varlenRecord("example.com", target, []byte{0, 0, 5, 220}), varlenRecord("", "/", []byte{0, 0, 0, 64})...)
+
+	// Records are decoded from the reversed buffer, as done by Decode
+	recs := varlenTemplate.DecodeFlowSet(Set{
+		Header:  &SetHeader{SetID: 256, Length: uint16(len(records) + 4)},
+		Records: convert.Reverse(records),
+	})
+	if len(recs) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(recs))
+	}
+
+	tests := []struct {
+		host   string
+		target string
+		size   uint32
+	}{
+		{host: "example.com", target: target, size: 1500},
+		{host: "", target: "/", size: 64},
+	}
+	for i, test := range tests {
+		v := recs[i].Values
+		if host := string(convert.Reverse(v[0])); host != test.host {
+			t.Errorf("Record %d: Expected host %q, got %q", i, test.host, host)
+		}
+		if target := string(convert.Reverse(v[1])); target != test.target {
+			t.Errorf("Record %d: Expected target of %d bytes, got %d", i, len(test.target), len(target))
+		}
+		if size := convert.Uint32(v[2]); size != test.size {
+			t.Errorf("Record %d: Expected size %d, got %d", i, test.size, size)
+		}
+	}
+}
+
+func TestParseFieldValuesTruncated(t *testing.T) {
+	rec := varlenRecord("example.com", "/", []byte{0, 0, 5, 220})
+	tests := []struct {
+		name   string
+		record []byte
+	}{
+		{
+			name:   "Missing short length",
+			record: rec[:0],
+		},
+		{
+			name:   "Short value truncated",
+			record: rec[:5],
+		},
+		{
+			name:   "Long length truncated",
+			record: rec[:14],
+		},
+		{
+			name:   "Fixed length value truncated",
+			record: rec[:len(rec)-1],
+		},
+	}
+
+	for _, test := range tests {
+		record := append([]byte{}, test.record...)
+		if values, _ := parseFieldValues(convert.Reverse(record), varlenTemplate.Records); values != nil {
+			t.Errorf("%s: Expected no values, got %d", test.name, len(values))
+		}
+	}
+
+	values, n := parseFieldValues(convert.Reverse(append([]byte{}, rec...)), varlenTemplate.Records)
+	if values == nil || n != len(rec) {
+		t.Errorf("Expected complete record of %d bytes, got %d", len(rec), n)
+	}
+}
+
+func TestDecodeFlowSetEmptyRecords(t *testing.T) {
+	tmpl := TemplateRecords{
+		Header:  &TemplateRecordHeader{FieldCount: 1, TemplateID: 257},
+		Records: []*TemplateRecord{{Type: HTTPRequestHost, Length: 0}},
+	}
+	recs := tmpl.DecodeFlowSet(Set{
+		Header:  &SetHeader{SetID: 257, Length: 12},
+		Records: make([]byte, 8),
+	})
+	if len(recs) != 0 {
+		t.Errorf("Expected empty records to be taken as padding, got %d records", len(recs))
+	}
+}
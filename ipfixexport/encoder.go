@@ -0,0 +1,278 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfixexport
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/google/tflow2/ipfix"
+	"github.com/google/tflow2/netflow"
+)
+
+const (
+	// maxMessageSize is the maximum size of an IPFIX message. It is chosen to
+	// avoid IP fragmentation on common links.
+	maxMessageSize = 1400
+
+	// messageHeaderLen is the length of an IPFIX message header
+	messageHeaderLen = 16
+
+	// setHeaderLen is the length of a set header
+	setHeaderLen = 4
+
+	// Template IDs used for exported flows
+	templateIDIPv4 = 256
+	templateIDIPv6 = 257
+)
+
+// Information elements not (yet) used on the decode side
+const (
+	octetDeltaCount     = 1
+	packetDeltaCount    = 2
+	exporterIPv4Address = 130
+)
+
+// templateField is a field of an export template
+type templateField struct {
+	typ    uint16
+	length uint16
+}
+
+// template describes the structure of exported data records
+type template struct {
+	id        uint16
+	fields    []templateField
+	recordLen int
+}
+
+// newTemplate creates a template with fields `fields`
+func newTemplate(id uint16, fields []templateField) *template {
+	t := &template{
+		id:     id,
+		fields: fields,
+	}
+	for _, f := range fields {
+		t.recordLen += int(f.length)
+	}
+	return t
+}
+
+// commonFields are part of the templates of both address families
+var commonFields = []templateField{
+	{typ: ipfix.Protocol, length: 1},
+	{typ: ipfix.L4SrcPort, length: 2},
+	{typ: ipfix.L4DstPort, length: 2},
+	{typ: ipfix.InputSnmp, length: 4},
+	{typ: ipfix.OutputSnmp, length: 4},
+	{typ: packetDeltaCount, length: 8},
+	{typ: octetDeltaCount, length: 8},
+	{typ: ipfix.SrcAs, length: 4},
+	{typ: ipfix.DstAs, length: 4},
+	{typ: ipfix.BgpNextAdjacentAsNumber, length: 4},
+	{typ: ipfix.BgpPrevAdjacentAsNumber, length: 4},
+	{typ: exporterIPv4Address, length: 4},
+	{typ: ipfix.FlowStartSeconds, length: 4},
+}
+
+var templateIPv4 = newTemplate(templateIDIPv4, append([]templateField{
+	{typ: ipfix.IPv4SrcAddr, length: 4},
+	{typ: ipfix.IPv4DstAddr, length: 4},
+	{typ: ipfix.IPv4NextHop, length: 4},
+}, commonFields...))
+
+var templateIPv6 = newTemplate(templateIDIPv6, append([]templateField{
+	{typ: ipfix.IPv6SrcAddr, length: 16},
+	{typ: ipfix.IPv6DstAddr, length: 16},
+	{typ: ipfix.IPv6NextHop, length: 16},
+}, commonFields...))
+
+// encoder builds IPFIX messages from flows
+type encoder struct {
+	domainID uint32
+
+	// sequence is the number of data records sent in this observation domain
+	sequence uint32
+
+	// current message and position of the header of the currently open set (0 if none)
+	msg      []byte
+	setStart int
+	setID    uint16
+	records  int
+
+	// msgs are the finished messages
+	msgs [][]byte
+}
+
+// encode converts `flows` into IPFIX messages prepended with the templates if `withTemplates` is set
+func (e *encoder) encode(flows []*netflow.Flow, exportTime uint32, withTemplates bool) [][]byte {
+	e.msgs = nil
+	e.startMessage()
+
+	if withTemplates {
+		e.writeTemplates()
+	}
+
+	for _, fl := range flows {
+		tmpl := templateFor(fl)
+		if tmpl == nil {
+			continue
+		}
+
+		needed := tmpl.recordLen
+		if e.setID != tmpl.id {
+			needed += setHeaderLen
+		}
+		if len(e.msg)+needed > maxMessageSize {
+			e.finishMessage(exportTime)
+			e.startMessage()
+		}
+
+		if e.setID != tmpl.id {
+			e.closeSet()
+			e.openSet(tmpl.id)
+		}
+		e.writeRecord(tmpl, fl)
+	}
+
+	if e.records > 0 || withTemplates {
+		e.finishMessage(exportTime)
+	}
+	return e.msgs
+}
+
+// templateFor returns the template used to export `fl`
+func templateFor(fl *netflow.Flow) *template {
+	switch fl.Family {
+	case 4:
+		return templateIPv4
+	case 6:
+		return templateIPv6
+	}
+	return nil
+}
+
+func (e *encoder) startMessage() {
+	e.msg = make([]byte, messageHeaderLen, maxMessageSize)
+	e.setStart = 0
+	e.setID = 0
+	e.records = 0
+}
+
+func (e *encoder) finishMessage(exportTime uint32) {
+	e.closeSet()
+	binary.BigEndian.PutUint16(e.msg[0:2], 10)
+	binary.BigEndian.PutUint16(e.msg[2:4], uint16(len(e.msg)))
+	binary.BigEndian.PutUint32(e.msg[4:8], exportTime)
+	binary.BigEndian.PutUint32(e.msg[8:12], e.sequence)
+	binary.BigEndian.PutUint32(e.msg[12:16], e.domainID)
+
+	e.sequence += uint32(e.records)
+	e.msgs = append(e.msgs, e.msg)
+}
+
+func (e *encoder) openSet(id uint16) {
+	e.setStart = len(e.msg)
+	e.setID = id
+	e.msg = append(e.msg, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(e.msg[e.setStart:], id)
+}
+
+func (e *encoder) closeSet() {
+	if e.setStart == 0 {
+		return
+	}
+	binary.BigEndian.PutUint16(e.msg[e.setStart+2:], uint16(len(e.msg)-e.setStart))
+	e.setStart = 0
+	e.setID = 0
+}
+
+// writeTemplates writes a template set carrying both templates
+func (e *encoder) writeTemplates() {
+	e.openSet(ipfix.TemplateSetID)
+	for _, tmpl := range []*template{templateIPv4, templateIPv6} {
+		e.msg = appendUint16(e.msg, tmpl.id)
+		e.msg = appendUint16(e.msg, uint16(len(tmpl.fields)))
+		for _, f := range tmpl.fields {
+			e.msg = appendUint16(e.msg, f.typ)
+			e.msg = appendUint16(e.msg, f.length)
+		}
+	}
+	e.closeSet()
+}
+
+// writeRecord writes `fl` as data record of template `tmpl`
+func (e *encoder) writeRecord(tmpl *template, fl *netflow.Flow) {
+	for _, f := range tmpl.fields {
+		switch f.typ {
+		case ipfix.IPv4SrcAddr, ipfix.IPv6SrcAddr:
+			e.msg = appendAddr(e.msg, fl.SrcAddr, int(f.length))
+		case ipfix.IPv4DstAddr, ipfix.IPv6DstAddr:
+			e.msg = appendAddr(e.msg, fl.DstAddr, int(f.length))
+		case ipfix.IPv4NextHop, ipfix.IPv6NextHop:
+			e.msg = appendAddr(e.msg, fl.NextHop, int(f.length))
+		case exporterIPv4Address:
+			e.msg = appendAddr(e.msg, fl.Router, int(f.length))
+		case ipfix.Protocol:
+			e.msg = append(e.msg, byte(fl.Protocol))
+		case ipfix.L4SrcPort:
+			e.msg = appendUint16(e.msg, uint16(fl.SrcPort))
+		case ipfix.L4DstPort:
+			e.msg = appendUint16(e.msg, uint16(fl.DstPort))
+		case ipfix.InputSnmp:
+			e.msg = appendUint32(e.msg, fl.IntIn)
+		case ipfix.OutputSnmp:
+			e.msg = appendUint32(e.msg, fl.IntOut)
+		case packetDeltaCount:
+			e.msg = appendUint64(e.msg, uint64(fl.Packets))
+		case octetDeltaCount:
+			e.msg = appendUint64(e.msg, fl.Size)
+		case ipfix.SrcAs:
+			e.msg = appendUint32(e.msg, fl.SrcAs)
+		case ipfix.DstAs:
+			e.msg = appendUint32(e.msg, fl.DstAs)
+		case ipfix.BgpNextAdjacentAsNumber:
+			e.msg = appendUint32(e.msg, fl.NextHopAs)
+		case ipfix.BgpPrevAdjacentAsNumber:
+			e.msg = appendUint32(e.msg, fl.SrcPeerAs)
+		case ipfix.FlowStartSeconds:
+			e.msg = appendUint32(e.msg, uint32(fl.Timestamp))
+		}
+	}
+	e.records++
+}
+
+// appendAddr appends `addr` as address of `length` bytes. Missing addresses are sent as all zeros.
+func appendAddr(b []byte, addr []byte, length int) []byte {
+	ip := net.IP(addr)
+	if length == net.IPv4len {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+	if ip == nil {
+		ip = make(net.IP, length)
+	}
+	return append(b, ip...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipfixexport
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/tflow2/convert"
+	"github.com/google/tflow2/ipfix"
+	"github.com/google/tflow2/netflow"
+)
+
+func TestEncode(t *testing.T) {
+	flows := make([]*netflow.Flow, 0)
+	for i := 0; i < 50; i++ {
+		flows = append(flows, &netflow.Flow{
+			Router:  []byte{192, 0, 2, 1},
+			Family:  4,
+			SrcAddr: []byte{10, 0, 0, byte(i)},
+			DstAddr: []byte{10, 0, 1, 1},
+			NextHop: []byte{10, 0, 0, 254},
+			Packets: 10,
+			Size:    uint64(1000 + i),
+			SrcAs:   64496,
+		})
+	}
+	flows = append(flows, &netflow.Flow{
+		Family:  6,
+		SrcAddr: net.ParseIP("2001:db8::1"),
+		DstAddr: net.ParseIP("2001:db8::2"),
+	})
+
+	e := &encoder{domainID: 7}
+	msgs := e.encode(flows, 1500000000, true)
+	if len(msgs) < 2 {
+		t.Fatalf("Expected flows to be split over several messages, got %d", len(msgs))
+	}
+
+	var templates []*ipfix.TemplateRecords
+	records := 0
+	for i, msg := range msgs {
+		if len(msg) > maxMessageSize {
+			t.Errorf("Message %d exceeds maximum size: %d bytes", i, len(msg))
+		}
+
+		p, err := ipfix.Decode(msg, net.IP{127, 0, 0, 1})
+		if err != nil {
+			t.Fatalf("Unable to decode message %d: %v", i, err)
+		}
+		if p.Header.DomainID != 7 {
+			t.Errorf("Expected domain 7, got %d", p.Header.DomainID)
+		}
+		if p.Header.SequenceNumber != uint32(records) {
+			t.Errorf("Message %d: Expected sequence number %d, got %d", i, records, p.Header.SequenceNumber)
+		}
+		templates = append(templates, p.GetTemplateRecords()...)
+
+		for _, set := range p.DataFlowSets() {
+			for _, tmpl := range templates {
+				if tmpl.Header.TemplateID != set.Header.SetID {
+					continue
+				}
+				recs := tmpl.DecodeFlowSet(*set)
+				if set.Header.SetID == templateIDIPv4 && records == 0 {
+					if size := convert.Uint64(recs[0].Values[9]); size != 1000 {
+						t.Errorf("Expected octets 1000, got %d", size)
+					}
+					if src := net.IP(convert.Reverse(recs[0].Values[0])); !src.Equal(net.IP{10, 0, 0, 0}) {
+						t.Errorf("Expected source 10.0.0.0, got %s", src)
+					}
+				}
+				records += len(recs)
+			}
+		}
+	}
+
+	if len(templates) != 2 {
+		t.Errorf("Expected 2 templates, got %d", len(templates))
+	}
+	if records != len(flows) {
+		t.Errorf("Expected %d records, got %d", len(flows), records)
+	}
+}
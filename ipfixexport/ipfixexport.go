@@ -0,0 +1,119 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipfixexport re-encodes annotated flows as IPFIX and sends them to
+// upstream collectors, turning tflow2 into an aggregating IPFIX proxy
+package ipfixexport
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+// templateRefresh is the interval templates are resent in as required for UDP transport by RFC 7011
+const templateRefresh = 30 * time.Second
+
+// Exporter represents an IPFIX exporter sending flows to upstream collectors
+type Exporter struct {
+	conns         []net.Conn
+	flushInterval time.Duration
+	enc           *encoder
+	lastTemplates time.Time
+	latency       *stats.Histogram
+
+	// Input is the channel used to receive flows from the annotator layer
+	Input chan *netflow.Flow
+}
+
+// New creates a new `Exporter` sending flows to the collectors `collectors`
+// (host:port) using observation domain `domainID`. Flows are sent at least
+// every `flushInterval`.
+func New(collectors []string, domainID uint32, flushInterval time.Duration) (*Exporter, error) {
+	e := &Exporter{
+		flushInterval: flushInterval,
+		enc:           &encoder{domainID: domainID},
+		latency:       stats.Latency("ipfix"),
+		Input:         make(chan *netflow.Flow, 1024),
+	}
+
+	for _, c := range collectors {
+		conn, err := net.Dial("udp", c)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to collector %s: %v", c, err)
+		}
+		e.conns = append(e.conns, conn)
+	}
+
+	go e.worker()
+	return e, nil
+}
+
+// worker collects flows and sends them once enough have accumulated to fill a
+// message. It sends the remaining flows and returns once `Input` is closed.
+func (e *Exporter) worker() {
+	// A message is sent as soon as enough flows for a full message are available
+	batchSize := (maxMessageSize - messageHeaderLen - setHeaderLen) / templateIPv6.recordLen
+	batch := make([]*netflow.Flow, 0, batchSize)
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case fl, ok := <-e.Input:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			batch = append(batch, fl)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		e.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send encodes `batch` and sends the resulting messages to all collectors
+func (e *Exporter) send(batch []*netflow.Flow) {
+	now := time.Now()
+	withTemplates := now.Sub(e.lastTemplates) >= templateRefresh
+	if len(batch) == 0 && !withTemplates {
+		return
+	}
+	if withTemplates {
+		e.lastTemplates = now
+	}
+
+	for _, msg := range e.enc.encode(batch, uint32(now.Unix()), withTemplates) {
+		for _, conn := range e.conns {
+			if _, err := conn.Write(msg); err != nil {
+				atomic.AddUint64(&stats.GlobalStats.IPFIXExportErrors, 1)
+				if debug.Level() > 0 {
+					glog.Warningf("unable to send IPFIX message to %s: %v", conn.RemoteAddr(), err)
+				}
+			}
+		}
+		atomic.AddUint64(&stats.GlobalStats.IPFIXExportMessages, 1)
+	}
+	atomic.AddUint64(&stats.GlobalStats.IPFIXExportFlows, uint64(len(batch)))
+	for _, fl := range batch {
+		e.latency.Observe(fl.Received)
+	}
+}
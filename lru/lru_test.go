@@ -0,0 +1,60 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEviction(t *testing.T) {
+	c := New(2, 0)
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	// Touch "a" so that "b" is the least recently used entry
+	c.Get("a")
+	c.Set("c", 3)
+
+	tests := []struct {
+		key   string
+		found bool
+	}{
+		{key: "a", found: true},
+		{key: "b", found: false},
+		{key: "c", found: true},
+	}
+
+	for _, test := range tests {
+		_, ok := c.Get(test.key)
+		if ok != test.found {
+			t.Errorf("Key %s: Expected found=%v, got %v", test.key, test.found, ok)
+		}
+	}
+
+	if c.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", c.Len())
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c := New(10, time.Millisecond)
+	c.Set("a", 1)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Expected entry to be expired")
+	}
+	if c.Len() != 0 {
+		t.Errorf("Expected expired entry to be removed, got %d entries", c.Len())
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netflow
+
+// Transport protocols carrying source and destination ports
+const (
+	protoTCP     = 6
+	protoUDP     = 17
+	protoDCCP    = 33
+	protoSCTP    = 132
+	protoUDPLite = 136
+)
+
+// HasPorts returns whether the protocol of the flow carries ports. Flows of
+// other protocols (e.g. ICMP, GRE, ESP) report no ports, whatever the exporter
+// sent in the port fields.
+func (fl *Flow) HasPorts() bool {
+	switch fl.Protocol {
+	case protoTCP, protoUDP, protoDCCP, protoSCTP, protoUDPLite:
+		return true
+	}
+	return false
+}
+
+// Bps returns the bit rate of the flow in bits per second. See `seconds` for the
+// time the bytes are spread over. Counts are taken as they are: flows scaled by
+// the collector (Scaled) already account for sampling, for all others the
+// caller has to apply its samplerate.
+func (fl *Flow) Bps(window int64) float64 {
+	s := fl.seconds(window)
+	if s == 0 {
+		return 0
+	}
+	return float64(fl.Size) * 8 / s
+}
+
+// Pps returns the packet rate of the flow in packets per second, like `Bps`
+func (fl *Flow) Pps(window int64) float64 {
+	s := fl.seconds(window)
+	if s == 0 {
+		return 0
+	}
+	return float64(fl.Packets) / s
+}
+
+// seconds returns the time the counts of the flow are spread over. The flows own
+// duration takes precedence if the exporter sent start and end of the flow and
+// they are at least a millisecond apart. Otherwise the aggregation `window` (in
+// seconds) the flow was accounted in is used. It returns 0 if neither is known.
+func (fl *Flow) seconds(window int64) float64 {
+	if fl.Start > 0 && fl.End > fl.Start {
+		return float64(fl.End-fl.Start) / 1000
+	}
+	if window > 0 {
+		return float64(window)
+	}
+	return 0
+}
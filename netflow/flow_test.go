@@ -0,0 +1,61 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netflow
+
+import (
+	"testing"
+)
+
+func TestRates(t *testing.T) {
+	tests := []struct {
+		name   string
+		fl     Flow
+		window int64
+		bps    float64
+		pps    float64
+	}{
+		{
+			name:   "Aggregation window",
+			fl:     Flow{Size: 7500, Packets: 60},
+			window: 60,
+			bps:    1000,
+			pps:    1,
+		},
+		{
+			name:   "Flow duration takes precedence",
+			fl:     Flow{Size: 7500, Packets: 60, Start: 1500000000000, End: 1500000002000},
+			window: 60,
+			bps:    30000,
+			pps:    30,
+		},
+		{
+			name:   "Single packet flow",
+			fl:     Flow{Size: 1500, Packets: 1, Start: 1500000000000, End: 1500000000000},
+			window: 60,
+			bps:    200,
+			pps:    1.0 / 60,
+		},
+		{
+			name: "Unknown duration",
+			fl:   Flow{Size: 1500, Packets: 1},
+		},
+	}
+
+	for _, test := range tests {
+		if bps := test.fl.Bps(test.window); bps != test.bps {
+			t.Errorf("%s: Expected %f bps, got %f", test.name, test.bps, bps)
+		}
+		if pps := test.fl.Pps(test.window); pps != test.pps {
+			t.Errorf("%s: Expected %f pps, got %f", test.name, test.pps, pps)
+		}
+	}
+}
@@ -12,6 +12,7 @@ It has these top-level messages:
 	Pfx
 	Flow
 	Flows
+	Filter
 */
 package netflow
 
@@ -19,6 +20,11 @@ import proto "github.com/golang/protobuf/proto"
 import fmt "fmt"
 import math "math"
 
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+)
+
 // Reference imports to suppress errors if they are not otherwise used.
 var _ = proto.Marshal
 var _ = fmt.Errorf
@@ -77,7 +83,9 @@ type Flow struct {
 	IntIn uint32 `protobuf:"varint,8,opt,name=int_in,json=intIn" json:"int_in,omitempty"`
 	// SNMP interface if flow was transmitted on
 	IntOut uint32 `protobuf:"varint,9,opt,name=int_out,json=intOut" json:"int_out,omitempty"`
-	// Next Hop IP address
+	// Forwarding next hop IP address, i.e. the next hop the router selected for
+	// the flow (ipNextHopIPv4Address/ipNextHopIPv6Address). With ECMP this is
+	// the path taken, which may differ from bgp_next_hop.
 	NextHop []byte `protobuf:"bytes,10,opt,name=next_hop,json=nextHop,proto3" json:"next_hop,omitempty"`
 	// SRC ASN
 	SrcAs uint32 `protobuf:"varint,11,opt,name=src_as,json=srcAs" json:"src_as,omitempty"`
@@ -95,6 +103,114 @@ type Flow struct {
 	SrcPort uint32 `protobuf:"varint,17,opt,name=src_port,json=srcPort" json:"src_port,omitempty"`
 	// DST port
 	DstPort uint32 `protobuf:"varint,18,opt,name=dst_port,json=dstPort" json:"dst_port,omitempty"`
+	// Reason the flow was terminated by the exporter (IPFIX flowEndReason)
+	EndReason uint32 `protobuf:"varint,19,opt,name=end_reason,json=endReason" json:"end_reason,omitempty"`
+	// Free form attributes attached to the flow by annotators
+	Labels map[string]string `protobuf:"bytes,20,rep,name=labels" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// TCP window size as exported or observed in a sampled TCP header
+	TcpWindowSize uint32 `protobuf:"varint,21,opt,name=tcp_window_size,json=tcpWindowSize" json:"tcp_window_size,omitempty"`
+	// TCP window scale as exported or observed in a sampled TCP SYN
+	TcpWindowScale uint32 `protobuf:"varint,22,opt,name=tcp_window_scale,json=tcpWindowScale" json:"tcp_window_scale,omitempty"`
+	// TCP maximum segment size observed in a sampled TCP SYN
+	TcpMss uint32 `protobuf:"varint,23,opt,name=tcp_mss,json=tcpMss" json:"tcp_mss,omitempty"`
+	// SSID of the wireless network the flow was observed on
+	WlanSsid string `protobuf:"bytes,24,opt,name=wlan_ssid,json=wlanSsid" json:"wlan_ssid,omitempty"`
+	// Channel of the wireless network the flow was observed on
+	WlanChannel uint32 `protobuf:"varint,25,opt,name=wlan_channel,json=wlanChannel" json:"wlan_channel,omitempty"`
+	// MAC address of the wireless station
+	StaMac []byte `protobuf:"bytes,26,opt,name=sta_mac,json=staMac,proto3" json:"sta_mac,omitempty"`
+	// ASN of the peer the flow was received from (IPFIX bgpPrevAdjacentAsNumber).
+	// The ASN of the peer the flow is sent to is stored in next_hop_as.
+	SrcPeerAs uint32 `protobuf:"varint,27,opt,name=src_peer_as,json=srcPeerAs" json:"src_peer_as,omitempty"`
+	// Set if the flow was selected deterministically (e.g. PSAMP hash based
+	// selection). Its counts are raw samples that must not be scaled by the sample rate.
+	Unscalable bool `protobuf:"varint,28,opt,name=unscalable" json:"unscalable,omitempty"`
+	// Network type of the layer 2 segment (IPFIX layer2SegmentId), e.g. 1 for VXLAN, 2 for NVGRE
+	L2SegmentType uint32 `protobuf:"varint,29,opt,name=l2_segment_type,json=l2SegmentType" json:"l2_segment_type,omitempty"`
+	// Layer 2 segment ID, i.e. the VNI for VXLAN and the VSID for NVGRE
+	L2SegmentId uint64 `protobuf:"varint,30,opt,name=l2_segment_id,json=l2SegmentId" json:"l2_segment_id,omitempty"`
+	// Names of the interfaces flow was received on and transmitted on as announced
+	// by the exporter (or looked up via SNMP). Unlike int_in and int_out they are
+	// stable across reindexing.
+	IntInName  string `protobuf:"bytes,31,opt,name=int_in_name,json=intInName" json:"int_in_name,omitempty"`
+	IntOutName string `protobuf:"bytes,32,opt,name=int_out_name,json=intOutName" json:"int_out_name,omitempty"`
+	// Bitmask of the annotations applied to the flow (see annotator.Enriched*)
+	Enrichments uint32 `protobuf:"varint,33,opt,name=enrichments" json:"enrichments,omitempty"`
+	// Set if packets and size were already multiplied by the sampling rate the
+	// exporter reported along with the flow. They are not scaled by the sample rate again.
+	Scaled bool `protobuf:"varint,34,opt,name=scaled" json:"scaled,omitempty"`
+	// ID of the collector instance that received the flow
+	CollectorId string `protobuf:"bytes,35,opt,name=collector_id,json=collectorId" json:"collector_id,omitempty"`
+	// Minimum and maximum TTL (hop limit for IPv6) of the flows packets
+	MinTtl uint32 `protobuf:"varint,36,opt,name=min_ttl,json=minTtl" json:"min_ttl,omitempty"`
+	MaxTtl uint32 `protobuf:"varint,37,opt,name=max_ttl,json=maxTtl" json:"max_ttl,omitempty"`
+	// Set if the TTL deviates from the TTL typically seen for the flows source
+	TtlAnomaly bool `protobuf:"varint,38,opt,name=ttl_anomaly,json=ttlAnomaly" json:"ttl_anomaly,omitempty"`
+	// MPLS label stack, top label first
+	MplsLabels []uint32 `protobuf:"varint,39,rep,packed,name=mpls_labels,json=mplsLabels" json:"mpls_labels,omitempty"`
+	// Start and end of the flow in milliseconds since the epoch, 0 if unknown
+	Start int64 `protobuf:"varint,40,opt,name=start" json:"start,omitempty"`
+	End   int64 `protobuf:"varint,41,opt,name=end" json:"end,omitempty"`
+	// Identifier of the connection or transaction the flow belongs to, as sent
+	// by the exporter (connectionTransactionId). Shared by the flows of both
+	// directions of a session.
+	ConnectionId []byte `protobuf:"bytes,42,opt,name=connection_id,json=connectionId,proto3" json:"connection_id,omitempty"`
+	// DSCP of the packets as received (dscp) and as sent after remarking
+	// (post_dscp). Only valid if has_dscp or has_post_dscp are set, as 0 is a
+	// valid code point.
+	Dscp        uint32 `protobuf:"varint,43,opt,name=dscp" json:"dscp,omitempty"`
+	HasDscp     bool   `protobuf:"varint,44,opt,name=has_dscp,json=hasDscp" json:"has_dscp,omitempty"`
+	PostDscp    uint32 `protobuf:"varint,45,opt,name=post_dscp,json=postDscp" json:"post_dscp,omitempty"`
+	HasPostDscp bool   `protobuf:"varint,46,opt,name=has_post_dscp,json=hasPostDscp" json:"has_post_dscp,omitempty"`
+	// Name of the application the flow belongs to, as classified by the exporter
+	ApplicationName string `protobuf:"bytes,47,opt,name=application_name,json=applicationName" json:"application_name,omitempty"`
+	// Time the flow was decoded by the collector in nanoseconds since the epoch.
+	// Used to measure the latency of the pipeline, not related to the flows timestamp.
+	Received int64 `protobuf:"varint,48,opt,name=received" json:"received,omitempty"`
+	// Bytes and packets of the flow dropped by the exporter, not included in
+	// size and packets
+	DroppedBytes   uint64 `protobuf:"varint,49,opt,name=dropped_bytes,json=droppedBytes" json:"dropped_bytes,omitempty"`
+	DroppedPackets uint64 `protobuf:"varint,50,opt,name=dropped_packets,json=droppedPackets" json:"dropped_packets,omitempty"`
+	// Forwarding status as sent by the exporter: status in the two most
+	// significant bits (1 forwarded, 2 dropped, 3 consumed), reason in the others
+	ForwardingStatus uint32 `protobuf:"varint,51,opt,name=forwarding_status,json=forwardingStatus" json:"forwarding_status,omitempty"`
+	// BGP next hop IP address of the route the flow matched
+	// (bgpNextHopIPv4Address/bgpNextHopIPv6Address)
+	BgpNextHop []byte `protobuf:"bytes,52,opt,name=bgp_next_hop,json=bgpNextHop,proto3" json:"bgp_next_hop,omitempty"`
+	// Number of AS hops to the destination according to the AS path of its
+	// route (0 if unknown or originated locally)
+	AsPathLength uint32 `protobuf:"varint,53,opt,name=as_path_length,json=asPathLength" json:"as_path_length,omitempty"`
+	// VRF IDs of the interfaces the flow was received and sent on, as exported
+	// (ingressVRFID/egressVRFID) or statically mapped from the interface
+	IngressVrf uint32 `protobuf:"varint,54,opt,name=ingress_vrf,json=ingressVrf" json:"ingress_vrf,omitempty"`
+	EgressVrf  uint32 `protobuf:"varint,55,opt,name=egress_vrf,json=egressVrf" json:"egress_vrf,omitempty"`
+	// VLAN ID the flow was received on (vlanId, dot1qVlanId) or, if only that is
+	// exported, sent on (postVlanId, postDot1qVlanId). 0 if not exported.
+	Vlan uint32 `protobuf:"varint,56,opt,name=vlan" json:"vlan,omitempty"`
+	// TCP flags seen in the flows packets, ORed (tcpControlBits). The data offset
+	// bits of the 16 bit encoding are not included.
+	TcpFlags uint32 `protobuf:"varint,57,opt,name=tcp_flags,json=tcpFlags" json:"tcp_flags,omitempty"`
+	// Type of service byte of the packets as received (ipClassOfService),
+	// including the ECN bits. The DSCP is its upper 6 bits. Only valid if has_tos
+	// is set.
+	Tos    uint32 `protobuf:"varint,58,opt,name=tos" json:"tos,omitempty"`
+	HasTos bool   `protobuf:"varint,59,opt,name=has_tos,json=hasTos" json:"has_tos,omitempty"`
+	// Source and destination MAC addresses of the flows frames as received
+	// (sourceMacAddress, destinationMacAddress) or, if only those are exported,
+	// as sent (postSourceMacAddress, postDestinationMacAddress)
+	SrcMac []byte `protobuf:"bytes,60,opt,name=src_mac,json=srcMac,proto3" json:"src_mac,omitempty"`
+	DstMac []byte `protobuf:"bytes,61,opt,name=dst_mac,json=dstMac,proto3" json:"dst_mac,omitempty"`
+	// ISO 3166-1 country codes of source and destination address as found in
+	// the GeoIP database, empty if unknown or not routable
+	SrcCountry string `protobuf:"bytes,62,opt,name=src_country,json=srcCountry" json:"src_country,omitempty"`
+	DstCountry string `protobuf:"bytes,63,opt,name=dst_country,json=dstCountry" json:"dst_country,omitempty"`
+	// Sampling rate packets and size were multiplied by if scaled is set, 0
+	// otherwise. Dividing by it yields the counts the exporter sent.
+	SamplingRate uint32 `protobuf:"varint,64,opt,name=sampling_rate,json=samplingRate" json:"sampling_rate,omitempty"`
+	// Host names of source and destination address as found via reverse DNS,
+	// empty if they have no PTR record or weren't looked up yet
+	SrcHost string `protobuf:"bytes,65,opt,name=src_host,json=srcHost" json:"src_host,omitempty"`
+	DstHost string `protobuf:"bytes,66,opt,name=dst_host,json=dstHost" json:"dst_host,omitempty"`
 }
 
 func (m *Flow) Reset()                    { *m = Flow{} }
@@ -228,6 +344,342 @@ func (m *Flow) GetDstPort() uint32 {
 	return 0
 }
 
+func (m *Flow) GetEndReason() uint32 {
+	if m != nil {
+		return m.EndReason
+	}
+	return 0
+}
+
+func (m *Flow) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *Flow) GetTcpWindowSize() uint32 {
+	if m != nil {
+		return m.TcpWindowSize
+	}
+	return 0
+}
+
+func (m *Flow) GetTcpWindowScale() uint32 {
+	if m != nil {
+		return m.TcpWindowScale
+	}
+	return 0
+}
+
+func (m *Flow) GetTcpMss() uint32 {
+	if m != nil {
+		return m.TcpMss
+	}
+	return 0
+}
+
+func (m *Flow) GetWlanSsid() string {
+	if m != nil {
+		return m.WlanSsid
+	}
+	return ""
+}
+
+func (m *Flow) GetWlanChannel() uint32 {
+	if m != nil {
+		return m.WlanChannel
+	}
+	return 0
+}
+
+func (m *Flow) GetStaMac() []byte {
+	if m != nil {
+		return m.StaMac
+	}
+	return nil
+}
+
+func (m *Flow) GetSrcPeerAs() uint32 {
+	if m != nil {
+		return m.SrcPeerAs
+	}
+	return 0
+}
+
+func (m *Flow) GetUnscalable() bool {
+	if m != nil {
+		return m.Unscalable
+	}
+	return false
+}
+
+func (m *Flow) GetL2SegmentType() uint32 {
+	if m != nil {
+		return m.L2SegmentType
+	}
+	return 0
+}
+
+func (m *Flow) GetL2SegmentId() uint64 {
+	if m != nil {
+		return m.L2SegmentId
+	}
+	return 0
+}
+
+func (m *Flow) GetIntInName() string {
+	if m != nil {
+		return m.IntInName
+	}
+	return ""
+}
+
+func (m *Flow) GetIntOutName() string {
+	if m != nil {
+		return m.IntOutName
+	}
+	return ""
+}
+
+func (m *Flow) GetEnrichments() uint32 {
+	if m != nil {
+		return m.Enrichments
+	}
+	return 0
+}
+
+func (m *Flow) GetScaled() bool {
+	if m != nil {
+		return m.Scaled
+	}
+	return false
+}
+
+func (m *Flow) GetCollectorId() string {
+	if m != nil {
+		return m.CollectorId
+	}
+	return ""
+}
+
+func (m *Flow) GetMinTtl() uint32 {
+	if m != nil {
+		return m.MinTtl
+	}
+	return 0
+}
+
+func (m *Flow) GetMaxTtl() uint32 {
+	if m != nil {
+		return m.MaxTtl
+	}
+	return 0
+}
+
+func (m *Flow) GetTtlAnomaly() bool {
+	if m != nil {
+		return m.TtlAnomaly
+	}
+	return false
+}
+
+func (m *Flow) GetMplsLabels() []uint32 {
+	if m != nil {
+		return m.MplsLabels
+	}
+	return nil
+}
+
+func (m *Flow) GetStart() int64 {
+	if m != nil {
+		return m.Start
+	}
+	return 0
+}
+
+func (m *Flow) GetEnd() int64 {
+	if m != nil {
+		return m.End
+	}
+	return 0
+}
+
+func (m *Flow) GetConnectionId() []byte {
+	if m != nil {
+		return m.ConnectionId
+	}
+	return nil
+}
+
+func (m *Flow) GetDscp() uint32 {
+	if m != nil {
+		return m.Dscp
+	}
+	return 0
+}
+
+func (m *Flow) GetHasDscp() bool {
+	if m != nil {
+		return m.HasDscp
+	}
+	return false
+}
+
+func (m *Flow) GetPostDscp() uint32 {
+	if m != nil {
+		return m.PostDscp
+	}
+	return 0
+}
+
+func (m *Flow) GetHasPostDscp() bool {
+	if m != nil {
+		return m.HasPostDscp
+	}
+	return false
+}
+
+func (m *Flow) GetApplicationName() string {
+	if m != nil {
+		return m.ApplicationName
+	}
+	return ""
+}
+
+func (m *Flow) GetReceived() int64 {
+	if m != nil {
+		return m.Received
+	}
+	return 0
+}
+
+func (m *Flow) GetDroppedBytes() uint64 {
+	if m != nil {
+		return m.DroppedBytes
+	}
+	return 0
+}
+
+func (m *Flow) GetDroppedPackets() uint64 {
+	if m != nil {
+		return m.DroppedPackets
+	}
+	return 0
+}
+
+func (m *Flow) GetForwardingStatus() uint32 {
+	if m != nil {
+		return m.ForwardingStatus
+	}
+	return 0
+}
+
+func (m *Flow) GetBgpNextHop() []byte {
+	if m != nil {
+		return m.BgpNextHop
+	}
+	return nil
+}
+
+func (m *Flow) GetAsPathLength() uint32 {
+	if m != nil {
+		return m.AsPathLength
+	}
+	return 0
+}
+
+func (m *Flow) GetIngressVrf() uint32 {
+	if m != nil {
+		return m.IngressVrf
+	}
+	return 0
+}
+
+func (m *Flow) GetEgressVrf() uint32 {
+	if m != nil {
+		return m.EgressVrf
+	}
+	return 0
+}
+
+func (m *Flow) GetVlan() uint32 {
+	if m != nil {
+		return m.Vlan
+	}
+	return 0
+}
+
+func (m *Flow) GetTcpFlags() uint32 {
+	if m != nil {
+		return m.TcpFlags
+	}
+	return 0
+}
+
+func (m *Flow) GetTos() uint32 {
+	if m != nil {
+		return m.Tos
+	}
+	return 0
+}
+
+func (m *Flow) GetHasTos() bool {
+	if m != nil {
+		return m.HasTos
+	}
+	return false
+}
+
+func (m *Flow) GetSrcMac() []byte {
+	if m != nil {
+		return m.SrcMac
+	}
+	return nil
+}
+
+func (m *Flow) GetDstMac() []byte {
+	if m != nil {
+		return m.DstMac
+	}
+	return nil
+}
+
+func (m *Flow) GetSrcCountry() string {
+	if m != nil {
+		return m.SrcCountry
+	}
+	return ""
+}
+
+func (m *Flow) GetDstCountry() string {
+	if m != nil {
+		return m.DstCountry
+	}
+	return ""
+}
+
+func (m *Flow) GetSamplingRate() uint32 {
+	if m != nil {
+		return m.SamplingRate
+	}
+	return 0
+}
+
+func (m *Flow) GetSrcHost() string {
+	if m != nil {
+		return m.SrcHost
+	}
+	return ""
+}
+
+func (m *Flow) GetDstHost() string {
+	if m != nil {
+		return m.DstHost
+	}
+	return ""
+}
+
 // Flows defines a groups of flows
 type Flows struct {
 	// Group of flows
@@ -246,38 +698,229 @@ func (m *Flows) GetFlows() []*Flow {
 	return nil
 }
 
+// Filter selects the flows sent to a subscriber. Unset criteria match all flows.
+type Filter struct {
+	// IP protocol of the flows
+	Protocol uint32 `protobuf:"varint,1,opt,name=protocol" json:"protocol,omitempty"`
+	// Source or destination ASN of the flows
+	As uint32 `protobuf:"varint,2,opt,name=as" json:"as,omitempty"`
+	// Prefix the source or destination address of the flows is in
+	Prefix *Pfx `protobuf:"bytes,3,opt,name=prefix" json:"prefix,omitempty"`
+}
+
+func (m *Filter) Reset()                    { *m = Filter{} }
+func (m *Filter) String() string            { return proto.CompactTextString(m) }
+func (*Filter) ProtoMessage()               {}
+func (*Filter) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *Filter) GetProtocol() uint32 {
+	if m != nil {
+		return m.Protocol
+	}
+	return 0
+}
+
+func (m *Filter) GetAs() uint32 {
+	if m != nil {
+		return m.As
+	}
+	return 0
+}
+
+func (m *Filter) GetPrefix() *Pfx {
+	if m != nil {
+		return m.Prefix
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Pfx)(nil), "netflow.pfx")
 	proto.RegisterType((*Flow)(nil), "netflow.Flow")
 	proto.RegisterType((*Flows)(nil), "netflow.Flows")
+	proto.RegisterType((*Filter)(nil), "netflow.Filter")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for Subscriber service
+
+type SubscriberClient interface {
+	// Subscribe streams all flows matching the filter as they are received
+	Subscribe(ctx context.Context, in *Filter, opts ...grpc.CallOption) (Subscriber_SubscribeClient, error)
+}
+
+type subscriberClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewSubscriberClient(cc *grpc.ClientConn) SubscriberClient {
+	return &subscriberClient{cc}
+}
+
+func (c *subscriberClient) Subscribe(ctx context.Context, in *Filter, opts ...grpc.CallOption) (Subscriber_SubscribeClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Subscriber_serviceDesc.Streams[0], c.cc, "/netflow.Subscriber/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &subscriberSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Subscriber_SubscribeClient interface {
+	Recv() (*Flow, error)
+	grpc.ClientStream
+}
+
+type subscriberSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *subscriberSubscribeClient) Recv() (*Flow, error) {
+	m := new(Flow)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for Subscriber service
+
+type SubscriberServer interface {
+	// Subscribe streams all flows matching the filter as they are received
+	Subscribe(*Filter, Subscriber_SubscribeServer) error
+}
+
+func RegisterSubscriberServer(s *grpc.Server, srv SubscriberServer) {
+	s.RegisterService(&_Subscriber_serviceDesc, srv)
+}
+
+func _Subscriber_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Filter)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SubscriberServer).Subscribe(m, &subscriberSubscribeServer{stream})
+}
+
+type Subscriber_SubscribeServer interface {
+	Send(*Flow) error
+	grpc.ServerStream
+}
+
+type subscriberSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *subscriberSubscribeServer) Send(m *Flow) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Subscriber_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "netflow.Subscriber",
+	HandlerType: (*SubscriberServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Subscriber_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "netflow.proto",
 }
 
 func init() { proto.RegisterFile("netflow.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 383 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x6c, 0x51, 0x5d, 0xab, 0xd3, 0x40,
-	0x10, 0x25, 0x4d, 0x9b, 0xb4, 0x93, 0xe6, 0xaa, 0x0b, 0xea, 0x28, 0x22, 0xa1, 0x22, 0x44, 0x90,
-	0xfb, 0x70, 0xfd, 0x05, 0xf7, 0x45, 0xec, 0x93, 0x25, 0x7f, 0x20, 0xc4, 0x7c, 0x60, 0xb8, 0x49,
-	0x76, 0xd9, 0x99, 0xd2, 0xe8, 0xbf, 0xf6, 0x1f, 0xc8, 0xec, 0xa6, 0xf5, 0xc5, 0xb7, 0x3d, 0xe7,
-	0xcc, 0x9c, 0x3d, 0x33, 0x03, 0xe9, 0xd4, 0x72, 0x37, 0xe8, 0xcb, 0xbd, 0xb1, 0x9a, 0xb5, 0x8a,
-	0x17, 0x78, 0xf8, 0x04, 0xa1, 0xe9, 0x66, 0x75, 0x07, 0xab, 0xe3, 0x09, 0x83, 0x2c, 0xc8, 0xf7,
-	0xc5, 0xea, 0x78, 0x52, 0x0a, 0xd6, 0x63, 0x45, 0x4f, 0xb8, 0x72, 0x8c, 0x7b, 0x1f, 0xfe, 0x84,
-	0xb0, 0xfe, 0x3a, 0xe8, 0x8b, 0x7a, 0x05, 0x91, 0xd5, 0x67, 0x6e, 0xed, 0xd2, 0xb0, 0x20, 0xe1,
-	0xbb, 0x6a, 0xec, 0x87, 0x5f, 0xae, 0x2d, 0x2d, 0x16, 0xa4, 0xde, 0xc0, 0x96, 0x6c, 0x5d, 0x56,
-	0x4d, 0x63, 0x31, 0x74, 0x1d, 0x31, 0xd9, 0xfa, 0xb1, 0x69, 0xac, 0x48, 0x0d, 0xb1, 0x97, 0xd6,
-	0x5e, 0x6a, 0x88, 0x9d, 0xf4, 0x16, 0xb6, 0x2e, 0x6b, 0xad, 0x07, 0xdc, 0x38, 0xbf, 0x1b, 0x56,
-	0x08, 0xb1, 0xa9, 0xea, 0xa7, 0x96, 0x09, 0x23, 0x27, 0x5d, 0xa1, 0x04, 0xa7, 0xfe, 0x77, 0x8b,
-	0x71, 0x16, 0xe4, 0xeb, 0xc2, 0xbd, 0xd5, 0x4b, 0x88, 0xfa, 0x89, 0xcb, 0x7e, 0xc2, 0xad, 0x2b,
-	0xde, 0xf4, 0x13, 0x1f, 0x27, 0xf5, 0x1a, 0x62, 0xa1, 0xf5, 0x99, 0x71, 0xe7, 0xf3, 0xf6, 0x13,
-	0x7f, 0x3f, 0xb3, 0x84, 0x9a, 0xda, 0x99, 0xcb, 0x9f, 0xda, 0x20, 0xf8, 0x50, 0x82, 0xbf, 0x69,
-	0x23, 0x56, 0x6e, 0x14, 0xc2, 0xc4, 0x5b, 0xc9, 0x20, 0x24, 0xb4, 0x1b, 0x83, 0x70, 0xef, 0x69,
-	0x19, 0x82, 0xd4, 0x7b, 0x48, 0xae, 0x46, 0xa2, 0xa5, 0x4e, 0xdb, 0x2d, 0x5e, 0x8f, 0xa4, 0xde,
-	0xc1, 0x8e, 0xfb, 0xb1, 0x25, 0xae, 0x46, 0x83, 0x77, 0x59, 0x90, 0x87, 0xc5, 0x3f, 0x42, 0x7d,
-	0x04, 0x59, 0x53, 0x69, 0xba, 0x19, 0x9f, 0x65, 0x41, 0x9e, 0x3c, 0xec, 0xef, 0x6f, 0x47, 0xec,
-	0xe6, 0x42, 0x82, 0x9c, 0xba, 0x59, 0xca, 0xe4, 0x6f, 0x29, 0x7b, 0xfe, 0xbf, 0xb2, 0x86, 0x58,
-	0xca, 0x96, 0x23, 0x18, 0x6d, 0x19, 0x5f, 0xf8, 0x9d, 0x89, 0x81, 0xb6, 0x7c, 0x3d, 0x82, 0x93,
-	0x94, 0x97, 0xa4, 0x49, 0x5b, 0x3e, 0x7c, 0x86, 0x8d, 0x9c, 0x9c, 0xd4, 0x07, 0xd8, 0x88, 0x25,
-	0x61, 0x90, 0x85, 0x79, 0xf2, 0x90, 0xde, 0xfe, 0x10, 0xb9, 0xf0, 0xda, 0x8f, 0xc8, 0x1d, 0xe8,
-	0xcb, 0xdf, 0x00, 0x00, 0x00, 0xff, 0xff, 0x74, 0xa2, 0x1d, 0x5c, 0x6d, 0x02, 0x00, 0x00,
+	// 1225 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x6c, 0x56, 0x69, 0x6f, 0x1b, 0x37,
+	0x10, 0x85, 0x2c, 0x5b, 0xb6, 0x28, 0xc9, 0x76, 0xd8, 0x1c, 0x8c, 0x73, 0x29, 0x72, 0x0e, 0xa5,
+	0x49, 0xdc, 0xc4, 0xe9, 0x91, 0xa3, 0x97, 0x93, 0x36, 0x88, 0x81, 0x24, 0x35, 0xd6, 0x41, 0x0b,
+	0xf4, 0xcb, 0x82, 0xda, 0xa5, 0xa4, 0x45, 0x76, 0xc9, 0x05, 0x67, 0x64, 0x4b, 0xfd, 0x1b, 0xfd,
+	0xc3, 0xc5, 0x0c, 0x57, 0x92, 0x5d, 0xe4, 0x1b, 0xe7, 0xbd, 0xc7, 0xd1, 0x5c, 0x3b, 0x94, 0xe8,
+	0x58, 0x83, 0xc3, 0xdc, 0x9d, 0xee, 0x95, 0xde, 0xa1, 0x93, 0xeb, 0x95, 0xd9, 0x7b, 0x20, 0xea,
+	0xe5, 0x70, 0x2a, 0x37, 0xc5, 0xca, 0xe1, 0x91, 0xaa, 0x75, 0x6b, 0xfd, 0x76, 0xb4, 0x72, 0x78,
+	0x24, 0xa5, 0x58, 0x2d, 0x34, 0x7c, 0x56, 0x2b, 0x8c, 0xf0, 0xb9, 0xf7, 0xef, 0xb6, 0x58, 0x7d,
+	0x9b, 0xbb, 0x53, 0x79, 0x59, 0x34, 0xbc, 0x9b, 0xa0, 0xf1, 0xd5, 0x85, 0xca, 0x22, 0x7c, 0xa8,
+	0x8b, 0x2c, 0x9f, 0xf1, 0xb5, 0x4e, 0x54, 0x59, 0xf2, 0xaa, 0xd8, 0x00, 0x9f, 0xc4, 0x3a, 0x4d,
+	0xbd, 0xaa, 0xf3, 0x8d, 0x75, 0xf0, 0xc9, 0x41, 0x9a, 0x7a, 0xa2, 0x52, 0xc0, 0x40, 0xad, 0x06,
+	0x2a, 0x05, 0x64, 0x6a, 0x47, 0x6c, 0x70, 0xac, 0x89, 0xcb, 0xd5, 0x1a, 0xfb, 0x5b, 0xd8, 0x52,
+	0x89, 0xf5, 0x52, 0x27, 0x9f, 0x0d, 0x82, 0x6a, 0x30, 0x35, 0x37, 0x29, 0x70, 0xc8, 0xfe, 0x31,
+	0x6a, 0xbd, 0x5b, 0xeb, 0xaf, 0x46, 0x7c, 0x96, 0x97, 0x44, 0x23, 0xb3, 0x18, 0x67, 0x56, 0x6d,
+	0xb0, 0x78, 0x2d, 0xb3, 0x78, 0x68, 0xe5, 0x15, 0xb1, 0x4e, 0xb0, 0x9b, 0xa0, 0x6a, 0x86, 0x78,
+	0x33, 0x8b, 0x7f, 0x4c, 0x90, 0x82, 0xb2, 0x66, 0x8a, 0xf1, 0xd8, 0x95, 0x4a, 0x84, 0xa0, 0xc8,
+	0x7e, 0xe7, 0x4a, 0x72, 0xc5, 0xa9, 0x80, 0x6a, 0x05, 0x57, 0x94, 0x08, 0x10, 0xcc, 0x69, 0x80,
+	0x6a, 0x07, 0x98, 0x92, 0x00, 0x79, 0x53, 0xb4, 0xe6, 0x8e, 0x88, 0xeb, 0x30, 0xd7, 0xac, 0x7c,
+	0x1d, 0x80, 0xbc, 0x2e, 0x9a, 0x98, 0x15, 0x06, 0x50, 0x17, 0xa5, 0xda, 0xec, 0xd6, 0xfa, 0xf5,
+	0x68, 0x09, 0xc8, 0xbb, 0x82, 0xca, 0x14, 0x97, 0xc3, 0xa9, 0xda, 0xea, 0xd6, 0xfa, 0xad, 0xfd,
+	0xf6, 0xde, 0xa2, 0x89, 0xc3, 0x69, 0x44, 0x81, 0x1c, 0x0d, 0xa7, 0x24, 0xa3, 0xdf, 0x26, 0xd9,
+	0xf6, 0x97, 0x64, 0x29, 0x20, 0xc9, 0xaa, 0x26, 0x94, 0xce, 0xa3, 0xba, 0x10, 0x6a, 0x46, 0x0e,
+	0x9c, 0xc7, 0x79, 0x13, 0x98, 0x92, 0x81, 0xa2, 0x4b, 0x44, 0xdd, 0x10, 0xc2, 0xd8, 0x34, 0xf6,
+	0x46, 0x83, 0xb3, 0xea, 0xab, 0x90, 0x80, 0xb1, 0x69, 0xc4, 0x80, 0x7c, 0x2a, 0x1a, 0xb9, 0x1e,
+	0x98, 0x1c, 0xd4, 0xc5, 0x6e, 0xbd, 0xdf, 0xda, 0xbf, 0xba, 0xf8, 0x69, 0x1a, 0x94, 0xbd, 0xf7,
+	0xcc, 0xfd, 0x6e, 0xd1, 0xcf, 0xa2, 0x4a, 0x28, 0xef, 0x89, 0x2d, 0x4c, 0xca, 0xf8, 0x34, 0xb3,
+	0xa9, 0x3b, 0x8d, 0xb9, 0x57, 0x97, 0xd8, 0x6d, 0x07, 0x93, 0xf2, 0x2f, 0x46, 0x8f, 0xa9, 0x69,
+	0x7d, 0xb1, 0x7d, 0x56, 0x97, 0xe8, 0xdc, 0xa8, 0xcb, 0x2c, 0xdc, 0x5c, 0x0a, 0x09, 0xa5, 0x3e,
+	0x92, 0xb2, 0x00, 0x50, 0x57, 0x42, 0x1f, 0x31, 0x29, 0x3f, 0x00, 0xc8, 0x6b, 0xa2, 0x79, 0x9a,
+	0x6b, 0x1b, 0x03, 0x64, 0xa9, 0x52, 0xdd, 0x5a, 0xbf, 0x19, 0x6d, 0x10, 0x70, 0x0c, 0x59, 0x2a,
+	0x6f, 0x8b, 0x36, 0x93, 0xc9, 0x58, 0x5b, 0x6b, 0x72, 0x75, 0x95, 0xaf, 0xb6, 0x08, 0x7b, 0x13,
+	0x20, 0x72, 0x0c, 0xa8, 0xe3, 0x42, 0x27, 0x6a, 0x27, 0x0c, 0x3a, 0xa0, 0xfe, 0xa0, 0x13, 0xea,
+	0x2b, 0xd7, 0xd2, 0x18, 0x4f, 0x7d, 0xbd, 0x16, 0xca, 0x42, 0xe5, 0x34, 0xc6, 0x73, 0xdf, 0xc5,
+	0xc4, 0x52, 0xc8, 0x7a, 0x90, 0x1b, 0x75, 0xbd, 0x5b, 0xeb, 0x6f, 0x44, 0x67, 0x10, 0xaa, 0x41,
+	0xbe, 0x1f, 0x83, 0x19, 0x15, 0xc6, 0x62, 0x8c, 0xb3, 0xd2, 0xa8, 0x1b, 0xa1, 0x06, 0xf9, 0xfe,
+	0x71, 0x40, 0x3f, 0xcd, 0x4a, 0x23, 0x7b, 0xa2, 0x73, 0x46, 0x97, 0xa5, 0xea, 0x26, 0x4f, 0x75,
+	0x6b, 0xa1, 0x3a, 0x4c, 0x29, 0x96, 0x30, 0xdc, 0xb1, 0xd5, 0x85, 0x51, 0xb7, 0x38, 0xcd, 0x26,
+	0x4f, 0xf8, 0x47, 0x5d, 0x18, 0xd9, 0x15, 0xed, 0x6a, 0xca, 0x83, 0xa0, 0xcb, 0x02, 0x11, 0x46,
+	0xbd, 0x52, 0xb4, 0x8c, 0xf5, 0x59, 0x32, 0x26, 0x8f, 0xa0, 0x6e, 0x87, 0x42, 0x9c, 0x81, 0xe8,
+	0xc3, 0xe6, 0x06, 0xa4, 0xaa, 0xc7, 0xb9, 0x54, 0x16, 0xd5, 0x30, 0x71, 0x79, 0x6e, 0x12, 0x74,
+	0x9e, 0xc2, 0xdb, 0x65, 0xdf, 0xad, 0x05, 0x76, 0x98, 0x52, 0x0d, 0x8b, 0xcc, 0xc6, 0x88, 0xb9,
+	0xba, 0x13, 0x9a, 0x53, 0x64, 0xf6, 0x13, 0x72, 0x71, 0x0b, 0x3d, 0x65, 0xe2, 0x6e, 0x45, 0xe8,
+	0x29, 0x11, 0xb7, 0x44, 0x0b, 0x31, 0x8f, 0xb5, 0x75, 0x85, 0xce, 0x67, 0xea, 0x5e, 0xa8, 0x1e,
+	0x62, 0x7e, 0x10, 0x10, 0x12, 0x14, 0x65, 0x0e, 0x71, 0x35, 0x79, 0xf7, 0xbb, 0xf5, 0x7e, 0x27,
+	0x12, 0x04, 0x85, 0x79, 0x93, 0x17, 0xc5, 0x1a, 0xa0, 0xf6, 0xa8, 0xfa, 0xfc, 0x49, 0x05, 0x43,
+	0x6e, 0x8b, 0xba, 0xb1, 0xa9, 0x7a, 0xc0, 0x18, 0x1d, 0xe5, 0xae, 0xe8, 0x24, 0xce, 0x5a, 0x93,
+	0x60, 0xe6, 0x2c, 0xc5, 0xff, 0x35, 0x77, 0xb9, 0xbd, 0x04, 0x0f, 0x53, 0x5a, 0x28, 0x29, 0x24,
+	0xa5, 0x7a, 0xc8, 0x41, 0xf2, 0x99, 0x3e, 0x98, 0xb1, 0x86, 0x98, 0xf1, 0x47, 0x1c, 0xdf, 0xfa,
+	0x58, 0xc3, 0x6f, 0x44, 0x5d, 0x13, 0xcd, 0xd2, 0x01, 0x06, 0xee, 0x71, 0xb5, 0xb6, 0x1c, 0x20,
+	0x93, 0x3d, 0xd1, 0xa1, 0x7b, 0x4b, 0xc1, 0x1e, 0x5f, 0x6e, 0x8d, 0x35, 0x1c, 0xcd, 0x35, 0x0f,
+	0xc4, 0xb6, 0x2e, 0xcb, 0x3c, 0x4b, 0x34, 0x47, 0xc5, 0x3d, 0xfb, 0x86, 0xeb, 0xba, 0x75, 0x06,
+	0xe7, 0xc6, 0xed, 0x88, 0x0d, 0x6f, 0x12, 0x93, 0x9d, 0x98, 0x54, 0x3d, 0xe1, 0xb4, 0x16, 0x36,
+	0xe5, 0x96, 0x7a, 0x57, 0x96, 0x26, 0x8d, 0x07, 0x33, 0x34, 0xa0, 0x9e, 0xf2, 0xe8, 0xb4, 0x2b,
+	0xf0, 0x35, 0x61, 0xf2, 0xbe, 0xd8, 0x9a, 0x8b, 0xe6, 0xeb, 0x74, 0x9f, 0x65, 0x9b, 0x15, 0x7c,
+	0x14, 0x50, 0xf9, 0x50, 0x5c, 0x18, 0x3a, 0x7f, 0xaa, 0x7d, 0x9a, 0xd9, 0x51, 0x0c, 0xa8, 0x71,
+	0x02, 0xea, 0x19, 0x67, 0xb7, 0xbd, 0x24, 0x8e, 0x19, 0xa7, 0x89, 0x1b, 0x8c, 0xca, 0x78, 0xb1,
+	0x42, 0xbf, 0xe5, 0xaa, 0x8a, 0xc1, 0xa8, 0xfc, 0x58, 0x6d, 0xd1, 0x3b, 0x62, 0x93, 0xca, 0xa0,
+	0x71, 0x1c, 0xe7, 0xc6, 0x8e, 0x70, 0xac, 0xbe, 0x63, 0x5f, 0x6d, 0x0d, 0x47, 0x1a, 0xc7, 0xef,
+	0x19, 0xa3, 0x3e, 0x67, 0x76, 0xe4, 0x0d, 0x40, 0x7c, 0xe2, 0x87, 0xea, 0x7b, 0x96, 0x88, 0x0a,
+	0xfa, 0xd3, 0x0f, 0x79, 0x39, 0x2d, 0xf9, 0x1f, 0xaa, 0xe5, 0xb4, 0xa0, 0xa5, 0x58, 0x3d, 0xc9,
+	0xb5, 0x55, 0xcf, 0x43, 0xe7, 0xe8, 0x4c, 0xed, 0xa1, 0x5d, 0x31, 0xcc, 0xf5, 0x08, 0xd4, 0x8b,
+	0xd0, 0x1e, 0x4c, 0xca, 0xb7, 0x64, 0xd3, 0x84, 0xa0, 0x03, 0xf5, 0x92, 0x61, 0x3a, 0xd2, 0x90,
+	0x52, 0xc3, 0x08, 0x7d, 0x15, 0x26, 0x7f, 0xac, 0xe1, 0x53, 0x20, 0x68, 0x03, 0xd0, 0x6a, 0xf8,
+	0xb1, 0x5a, 0x0d, 0x3e, 0xa1, 0xd5, 0x70, 0x25, 0x6c, 0x63, 0x22, 0x7e, 0x0a, 0x44, 0x0a, 0x48,
+	0xc4, 0xad, 0xb0, 0x33, 0x12, 0x37, 0xa1, 0x75, 0xa8, 0x7e, 0x0e, 0x9f, 0x21, 0xf8, 0xe4, 0x4d,
+	0x40, 0x48, 0x40, 0x37, 0xe7, 0x82, 0x5f, 0x82, 0x20, 0x05, 0x9c, 0x0b, 0x76, 0x45, 0x07, 0x74,
+	0x51, 0xe6, 0xd4, 0x02, 0xaf, 0xd1, 0xa8, 0x5f, 0x43, 0xd1, 0xe6, 0x60, 0xa4, 0xd1, 0xcc, 0xd7,
+	0xfc, 0xd8, 0x01, 0xaa, 0x03, 0x76, 0x41, 0x81, 0xbe, 0x73, 0xb0, 0x58, 0xf3, 0x4c, 0xbd, 0x0e,
+	0x54, 0x0a, 0x48, 0xd4, 0xce, 0x0b, 0xd1, 0x3a, 0xb3, 0xab, 0xa9, 0x10, 0x9f, 0xcd, 0x8c, 0x5f,
+	0xf7, 0x66, 0x44, 0x47, 0xfa, 0xa4, 0x4e, 0x74, 0x3e, 0x31, 0xfc, 0xb2, 0x37, 0xa3, 0x60, 0xbc,
+	0x5c, 0x79, 0x5e, 0xeb, 0x3d, 0x12, 0x6b, 0xb4, 0xeb, 0x41, 0xee, 0x8a, 0x35, 0xda, 0xfc, 0xa0,
+	0x6a, 0xfc, 0x14, 0x74, 0xce, 0x3d, 0x05, 0x51, 0xe0, 0x7a, 0x7f, 0x8b, 0xc6, 0xdb, 0x2c, 0x47,
+	0x73, 0xfe, 0x79, 0xaf, 0xfd, 0xef, 0x79, 0xdf, 0x14, 0x2b, 0x1a, 0xaa, 0x3f, 0x11, 0x2b, 0x1a,
+	0xe4, 0x1d, 0xd1, 0x28, 0xbd, 0x19, 0x66, 0x53, 0x55, 0xff, 0xd2, 0x0b, 0x17, 0xb8, 0xfd, 0x57,
+	0x42, 0x1c, 0x4f, 0x06, 0x90, 0xf8, 0x6c, 0x60, 0xbc, 0x7c, 0x2c, 0x9a, 0x0b, 0x4b, 0x6e, 0x2d,
+	0x83, 0xe1, 0x5f, 0xdf, 0x39, 0x1f, 0xdd, 0x93, 0xda, 0xa0, 0xc1, 0x3f, 0xfe, 0xec, 0xbf, 0x01,
+	0x00, 0x4d, 0xbf, 0xa0, 0x1e, 0x28, 0x09, 0x00, 0x00,
 }
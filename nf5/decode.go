@@ -0,0 +1,89 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nf5
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// Version is the version number found in the first two bytes of NetFlow v5 packets
+	Version = 5
+
+	// HeaderLen is the length of the packet header in bytes
+	HeaderLen = 24
+
+	// RecordLen is the length of a flow record in bytes
+	RecordLen = 48
+
+	// MaxRecords is the maximum number of flow records in a packet
+	MaxRecords = 30
+)
+
+// Decode converts raw packet bytes to a Packet struct
+func Decode(raw []byte) (*Packet, error) {
+	if len(raw) < HeaderLen {
+		return nil, fmt.Errorf("NF5: Short packet of %d bytes, header needs %d", len(raw), HeaderLen)
+	}
+
+	be := binary.BigEndian
+	p := &Packet{
+		Header: Header{
+			Version:          be.Uint16(raw[0:]),
+			Count:            be.Uint16(raw[2:]),
+			SysUpTime:        be.Uint32(raw[4:]),
+			UnixSecs:         be.Uint32(raw[8:]),
+			UnixNsecs:        be.Uint32(raw[12:]),
+			FlowSequence:     be.Uint32(raw[16:]),
+			EngineType:       raw[20],
+			EngineID:         raw[21],
+			SamplingInterval: be.Uint16(raw[22:]),
+		},
+	}
+
+	if p.Header.Version != Version {
+		return nil, fmt.Errorf("NF5: Incompatible protocol version v%d, only v5 is supported", p.Header.Version)
+	}
+	count := int(p.Header.Count)
+	if count > MaxRecords {
+		return nil, fmt.Errorf("NF5: Packet claims %d records, at most %d are allowed", count, MaxRecords)
+	}
+	if len(raw) < HeaderLen+count*RecordLen {
+		return nil, fmt.Errorf("NF5: Short packet of %d bytes, %d records need %d", len(raw), count, HeaderLen+count*RecordLen)
+	}
+
+	p.Records = make([]FlowRecord, count)
+	for i := range p.Records {
+		b := raw[HeaderLen+i*RecordLen:]
+		r := &p.Records[i]
+		copy(r.SrcAddr[:], b[0:4])
+		copy(r.DstAddr[:], b[4:8])
+		copy(r.NextHop[:], b[8:12])
+		r.Input = be.Uint16(b[12:])
+		r.Output = be.Uint16(b[14:])
+		r.DPkts = be.Uint32(b[16:])
+		r.DOctets = be.Uint32(b[20:])
+		r.First = be.Uint32(b[24:])
+		r.Last = be.Uint32(b[28:])
+		r.SrcPort = be.Uint16(b[32:])
+		r.DstPort = be.Uint16(b[34:])
+		r.TCPFlags = b[37]
+		r.Prot = b[38]
+		r.Tos = b[39]
+		r.SrcAs = be.Uint16(b[40:])
+		r.DstAs = be.Uint16(b[42:])
+		r.SrcMask = b[44]
+		r.DstMask = b[45]
+	}
+	return p, nil
+}
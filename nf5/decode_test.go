@@ -0,0 +1,91 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nf5
+
+import "testing"
+
+// packet is a NetFlow v5 packet carrying a single TCP flow, sampled 1 out of 100
+var packet = []byte{
+	// Header
+	0, 5, 0, 1, 0, 0, 0x27, 0x10, 0x59, 0x68, 0x2f, 0x00, 0, 0, 0, 0,
+	0, 0, 0, 42, 1, 2, 0x40, 100,
+	// Record
+	10, 0, 0, 1, 10, 0, 0, 2, 192, 0, 2, 1,
+	0, 7, 0, 8, 0, 0, 0, 3, 0, 0, 0x05, 0xdc,
+	0, 0, 0x03, 0xe8, 0, 0, 0x07, 0xd0,
+	0x30, 0x39, 0, 80, 0, 0x12, 6, 0xb8,
+	0xfd, 0xe8, 0, 65, 24, 16, 0, 0,
+}
+
+func TestDecode(t *testing.T) {
+	p, err := Decode(packet)
+	if err != nil {
+		t.Fatalf("Decoding packet failed: %v", err)
+	}
+
+	h := p.Header
+	if h.Count != 1 || h.SysUpTime != 10000 || h.UnixSecs != 1500000000 || h.FlowSequence != 42 || h.EngineType != 1 || h.EngineID != 2 {
+		t.Errorf("Unexpected header %+v", h)
+	}
+	if rate := h.SamplingRate(); rate != 100 {
+		t.Errorf("Expected sampling rate 100, got %d", rate)
+	}
+
+	if len(p.Records) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(p.Records))
+	}
+	expected := FlowRecord{
+		SrcAddr:  [4]byte{10, 0, 0, 1},
+		DstAddr:  [4]byte{10, 0, 0, 2},
+		NextHop:  [4]byte{192, 0, 2, 1},
+		Input:    7,
+		Output:   8,
+		DPkts:    3,
+		DOctets:  1500,
+		First:    1000,
+		Last:     2000,
+		SrcPort:  12345,
+		DstPort:  80,
+		TCPFlags: 0x12,
+		Prot:     6,
+		Tos:      0xb8,
+		SrcAs:    65000,
+		DstAs:    65,
+		SrcMask:  24,
+		DstMask:  16,
+	}
+	if p.Records[0] != expected {
+		t.Errorf("Expected record %+v, got %+v", expected, p.Records[0])
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tooMany := append([]byte{}, packet...)
+	tooMany[3] = MaxRecords + 1
+	v9 := append([]byte{}, packet...)
+	v9[1] = 9
+
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{name: "Short header", raw: packet[:HeaderLen-1]},
+		{name: "Truncated record", raw: packet[:len(packet)-1]},
+		{name: "Too many records", raw: tooMany},
+		{name: "Wrong version", raw: v9},
+	}
+	for _, test := range tests {
+		if _, err := Decode(test.raw); err == nil {
+			t.Errorf("%s: Expected error", test.name)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nf5 provides structures and functions to decode NetFlow v5 packets.
+//
+// NetFlow v5 has no templates: a packet is a fixed size header followed by up
+// to 30 fixed size flow records, so packets are decoded without keeping state.
+//
+//	+--------+--------+--------+-----+--------+
+//	| Packet | Flow   | Flow   |     | Flow   |
+//	| Header | Record | Record | ... | Record |
+//	+--------+--------+--------+-----+--------+
+//
+// Field names and comments follow the Cisco NetFlow export datagram format
+// documentation.
+package nf5
+
+// Header is the NetFlow version 5 header
+type Header struct {
+	// Version of the export format, 5
+	Version uint16
+
+	// Number of flow records in this packet (1 to 30)
+	Count uint16
+
+	// Time in milliseconds since the export device booted
+	SysUpTime uint32
+
+	// Seconds and residual nanoseconds since 0000 UTC 1970
+	UnixSecs  uint32
+	UnixNsecs uint32
+
+	// Sequence counter of total flows seen
+	FlowSequence uint32
+
+	// Type and slot number of the flow-switching engine
+	EngineType uint8
+	EngineID   uint8
+
+	// The first two bits hold the sampling mode, the remaining 14 bits the sampling interval
+	SamplingInterval uint16
+}
+
+// SamplingRate returns the number of packets represented by each sampled packet,
+// 0 if the exporter doesn't report sampling
+func (h *Header) SamplingRate() uint32 {
+	return uint32(h.SamplingInterval & 0x3fff)
+}
+
+// FlowRecord is a NetFlow version 5 flow record. Addresses are in network byte order.
+type FlowRecord struct {
+	// Source, destination and next hop IP addresses
+	SrcAddr [4]byte
+	DstAddr [4]byte
+	NextHop [4]byte
+
+	// SNMP indices of input and output interfaces
+	Input  uint16
+	Output uint16
+
+	// Packets and total number of layer 3 bytes in the flow
+	DPkts   uint32
+	DOctets uint32
+
+	// SysUpTime at start and at the time the last packet of the flow was received
+	First uint32
+	Last  uint32
+
+	// TCP/UDP source and destination port number or equivalent
+	SrcPort uint16
+	DstPort uint16
+
+	// Cumulative OR of TCP flags
+	TCPFlags uint8
+
+	// IP protocol type (for example, TCP = 6; UDP = 17)
+	Prot uint8
+
+	// IP type of service
+	Tos uint8
+
+	// Autonomous system number of the source and destination, either origin or peer
+	SrcAs uint16
+	DstAs uint16
+
+	// Source and destination address prefix mask bits
+	SrcMask uint8
+	DstMask uint8
+}
+
+// Packet is a decoded representation of a single NetFlow v5 UDP packet
+type Packet struct {
+	Header  Header
+	Records []FlowRecord
+}
@@ -30,6 +30,17 @@ const FlowSetIDTemplateMax = 255
 // TemplateFlowSetID is the FlowSetID reserved for template flow sets
 const TemplateFlowSetID = 0
 
+// MaxPacketSize is the size of the largest packet Decode handles, the most a UDP
+// datagram can carry
+const MaxPacketSize = 65535
+
+// minBufferSize is the size of the buffer smaller packets are decoded in
+const minBufferSize = 1500
+
+// bufferSlack is the room kept in front of the data, as decoding a template at
+// the start of the buffer steps one field before it
+const bufferSlack = 4
+
 // errorIncompatibleVersion prints an error message in case the detected version is not supported
 func errorIncompatibleVersion(version uint16) error {
 	return fmt.Errorf("NF9: Incompatible protocol version v%d, only v9 is supported", version)
@@ -40,24 +51,24 @@ func Decode(raw []byte, remote net.IP) (*Packet, error) {
 	data := convert.Reverse(raw) //TODO: Make it endian aware. This assumes a little endian machine
 
 	pSize := len(data)
-	bufSize := 1500
-	buffer := [1500]byte{}
-
-	if pSize > bufSize {
-		panic("Buffer too small\n")
+	if pSize > MaxPacketSize {
+		return nil, fmt.Errorf("NF9: Packet of %d bytes too large, at most %d supported", pSize, MaxPacketSize)
 	}
 
-	// copy data into array as arrays allow us to cast the shit out of it
-	for i := 0; i < pSize; i++ {
-		buffer[bufSize-pSize+i] = data[i]
+	// copy data into the end of the buffer, so we can cast the shit out of it
+	bufSize := minBufferSize
+	if pSize+bufferSlack > bufSize {
+		bufSize = pSize + bufferSlack
 	}
+	buffer := make([]byte, bufSize)
+	copy(buffer[bufSize-pSize:], data)
 
-	bufferPtr := unsafe.Pointer(&buffer)
+	bufferPtr := unsafe.Pointer(&buffer[0])
 	bufferMinPtr := unsafe.Pointer(uintptr(bufferPtr) + uintptr(bufSize) - uintptr(pSize))
 	headerPtr := unsafe.Pointer(uintptr(bufferPtr) + uintptr(bufSize) - uintptr(sizeOfHeader))
 
 	var packet Packet
-	packet.Buffer = buffer[:]
+	packet.Buffer = buffer
 	packet.Header = (*Header)(headerPtr)
 
 	if packet.Header.Version != 9 {
@@ -91,11 +102,13 @@ func Decode(raw []byte, remote net.IP) (*Packet, error) {
 // decodeData decodes a flowSet from `packet`
 func decodeData(packet *Packet, headerPtr unsafe.Pointer, size uintptr) {
 	flsh := (*FlowSetHeader)(unsafe.Pointer(headerPtr))
-	data := unsafe.Pointer(uintptr(headerPtr) - uintptr(flsh.Length))
+	// The `size` bytes of records precede the header. Pointing at them rather than
+	// at the start of the set keeps the pointer within the buffer for the first set.
+	data := unsafe.Pointer(uintptr(headerPtr) - size)
 
 	fls := &FlowSet{
 		Header: flsh,
-		Flows:  (*(*[1<<31 - 1]byte)(data))[sizeOfFlowSetHeader:flsh.Length],
+		Flows:  (*(*[1<<31 - 1]byte)(data))[:size],
 	}
 
 	packet.FlowSets = append(packet.FlowSets, fls)
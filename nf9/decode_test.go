@@ -12,8 +12,11 @@
 package nf9
 
 import (
+	"encoding/binary"
 	"net"
 	"testing"
+
+	"github.com/google/tflow2/convert"
 )
 
 func TestDecode(t *testing.T) {
@@ -31,6 +34,41 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestDecodeJumbo(t *testing.T) {
+	// Header, data flowset of 2250 IPV4_SRC_ADDR records and the template last, so
+	// it ends up at the start of the decode buffer
+	pkt := []byte{0, 9, 0, 2, 0, 0, 0, 1, 0x59, 0x68, 0x2f, 0x00, 0, 0, 0, 1, 0, 0, 0, 42}
+	pkt = append(pkt, 1, 0, 0, 0)
+	for i := 0; i < 2250; i++ {
+		pkt = append(pkt, 10, 0, byte(i>>8), byte(i))
+	}
+	binary.BigEndian.PutUint16(pkt[22:24], uint16(len(pkt)-20))
+	pkt = append(pkt, 0, 0, 0, 12, 1, 0, 0, 1, 0, 8, 0, 4)
+
+	packet, err := Decode(pkt, net.IP{192, 0, 2, 1})
+	if err != nil {
+		t.Fatalf("Decoding packet failed: %v", err)
+	}
+	if len(packet.Templates) != 1 || packet.Templates[0].Header.TemplateID != 256 {
+		t.Fatalf("Expected template 256, got %d templates", len(packet.Templates))
+	}
+
+	sets := packet.DataFlowSets()
+	if len(sets) != 1 {
+		t.Fatalf("Expected 1 data flowset, got %d", len(sets))
+	}
+	recs := packet.Templates[0].DecodeFlowSet(*sets[0])
+	if len(recs) != 2250 {
+		t.Fatalf("Expected 2250 records, got %d", len(recs))
+	}
+	for _, i := range []int{0, 2249} {
+		expected := net.IP{10, 0, byte(i >> 8), byte(i)}
+		if src := net.IP(convert.Reverse(recs[i].Values[0])); !src.Equal(expected) {
+			t.Errorf("Record %d: Expected %s, got %s", i, expected, src)
+		}
+	}
+}
+
 func testEq(a, b []byte) bool {
 
 	if a == nil && b == nil {
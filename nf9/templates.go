@@ -90,6 +90,12 @@ func (dtpl *TemplateRecords) DecodeFlowSet(set FlowSet) (list []FlowDataRecord)
 		if record.Values == nil {
 			return
 		}
+
+		// Records of templates without (or with only empty) fields take no
+		// space, so the rest of the set can't be told apart from padding
+		if count == 0 {
+			return
+		}
 		list = append(list, record)
 		n = n - count
 	}
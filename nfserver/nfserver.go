@@ -13,21 +13,36 @@
 package nfserver
 
 import (
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/google/tflow2/convert"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/elephant"
+	"github.com/google/tflow2/fairqueue"
 	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/nf5"
 	"github.com/google/tflow2/nf9"
+	"github.com/google/tflow2/ratelimit"
+	"github.com/google/tflow2/recorder"
 	"github.com/google/tflow2/stats"
+	"github.com/google/tflow2/validate"
 )
 
+// tcpFlagsMask covers the TCP flags of a 16 bit TCP_FLAGS value
+const tcpFlagsMask = 0x0fff
+
 // fieldMap describes what information is at what index in the slice
-// that we get from decoding a netflow packet
+// that we get from decoding a netflow packet. Indices are -1 if the
+// template doesn't carry the respective field.
 type fieldMap struct {
 	srcAddr  int
 	dstAddr  int
@@ -39,11 +54,31 @@ type fieldMap struct {
 	nextHop  int
 	family   int
 	vlan     int
-	ts       int
 	srcAsn   int
 	dstAsn   int
-	srcPort  int
-	dstPort  int
+
+	// srcPort and dstPort are -1 if the template doesn't carry them
+	srcPort int
+	dstPort int
+
+	// minTTL and maxTTL are -1 if the template doesn't carry them
+	minTTL int
+	maxTTL int
+
+	// firstSwitched and lastSwitched are -1 if the template doesn't carry them
+	firstSwitched int
+	lastSwitched  int
+
+	// tos and postTos are -1 if the template doesn't carry them
+	tos     int
+	postTos int
+
+	// bgpNextHop is -1 if the template doesn't carry it. nextHop is the
+	// forwarding next hop.
+	bgpNextHop int
+
+	// tcpFlags is -1 if the template doesn't carry it
+	tcpFlags int
 }
 
 // NetflowServer represents a Netflow Collector instance
@@ -55,23 +90,133 @@ type NetflowServer struct {
 	// receiver is the channel used to receive flows from the annotator layer
 	Output chan *netflow.Flow
 
-	// debug defines the debug level
-	debug int
-
 	// bgpAugment is used to decide if ASN information from netflow packets should be used
 	bgpAugment bool
+
+	// scheduler distributes packets to decode workers fairly among exporters.
+	// It is nil if packets are decoded by the goroutine reading them.
+	scheduler *fairqueue.Scheduler
+
+	// limiter caps the rate of flows sent to `Output`. It is nil if flows are not rate limited.
+	limiter *ratelimit.Bucket
+
+	// timeOffsets holds the seconds added to the timestamps of exporters with
+	// misconfigured clocks, keyed by exporter address
+	timeOffsets map[string]int64
+
+	// validator checks decoded flows for impossible values. It is nil if flows are not validated.
+	validator *validate.Validator
+
+	// elephants reports flows exceeding a byte or packet threshold. It is nil if they are not reported.
+	elephants *elephant.Detector
+
+	// dropEmpty is set if flows without packets and bytes are dropped
+	dropEmpty bool
+
+	// collectorID is set on all flows to identify this collector instance
+	collectorID string
+
+	// outputTimeout is the time a flow may wait for `Output` to be drained before
+	// it is dropped, or the server panics if `outputPanic` is set. 0 waits forever.
+	outputTimeout time.Duration
+	outputPanic   bool
+
+	// lastStallLog is the unix time a stalled `Output` was last logged at
+	lastStallLog int64
+
+	// lastMissingLog is the unix time a flowset lacking its template was last logged at
+	lastMissingLog int64
+
+	// recorder keeps the last raw packets of each exporter. It is nil if packets are not recorded.
+	recorder *recorder.Recorder
+
+	// packetSize is the size of the largest packet read, larger ones are truncated
+	packetSize int
 }
 
-// New creates and starts a new `NetflowServer` instance
-func New(listenAddr string, numReaders int, bgpAugment bool, debug int) *NetflowServer {
+// DefaultPacketSize is the size of the largest packet read if not configured
+const DefaultPacketSize = 8960
+
+// Config configures a `NetflowServer`. Zero values disable the respective feature
+// unless noted otherwise.
+type Config struct {
+	// ListenAddr is the UDP address to receive NetFlow on
+	ListenAddr string
+
+	// NumReaders is the number of workers reading and decoding packets, 1 if not set
+	NumReaders int
+
+	// BGPAugment is set if ASN information from the exporter is to be replaced via BIRD
+	BGPAugment bool
+
+	// QueueSize is the number of packets queued per exporter. If not 0 packets
+	// are decoded by `NumReaders` workers serving exporters round robin.
+	QueueSize int
+
+	// Limiter limits the rate of flows passed on, flows exceeding it are dropped
+	Limiter *ratelimit.Bucket
+
+	// TimeOffsets are the number of seconds timestamps of exporters are corrected by
+	TimeOffsets map[string]int64
+
+	// Validator and Elephants check flows unless they are nil
+	Validator *validate.Validator
+	Elephants *elephant.Detector
+
+	// DropEmpty is set if flows without packets and bytes are to be dropped
+	DropEmpty bool
+
+	// CollectorID is the collector flows are tagged with
+	CollectorID string
+
+	// OutputTimeout is the time flows not taken from `Output` are dropped after,
+	// or cause a panic if `OutputPanic` is set
+	OutputTimeout time.Duration
+	OutputPanic   bool
+
+	// Recorder keeps the packets received unless it is nil
+	Recorder *recorder.Recorder
+
+	// TemplateTTL is the time templates not received again are expired after
+	TemplateTTL time.Duration
+
+	// ReadBuffer is the size of the receive buffer of the socket in bytes
+	ReadBuffer int
+
+	// PacketSize is the size of the largest packet read, DefaultPacketSize if not set
+	PacketSize int
+}
+
+// New creates and starts a new `NetflowServer` instance configured by `cfg`
+func New(cfg Config) *NetflowServer {
+	if cfg.NumReaders <= 0 {
+		cfg.NumReaders = 1
+	}
+	if cfg.PacketSize <= 0 {
+		cfg.PacketSize = DefaultPacketSize
+	}
+
 	nfs := &NetflowServer{
-		debug:      debug,
-		tmplCache:  newTemplateCache(),
-		Output:     make(chan *netflow.Flow),
-		bgpAugment: bgpAugment,
+		tmplCache:     newTemplateCache(cfg.TemplateTTL),
+		Output:        make(chan *netflow.Flow),
+		bgpAugment:    cfg.BGPAugment,
+		limiter:       cfg.Limiter,
+		timeOffsets:   cfg.TimeOffsets,
+		validator:     cfg.Validator,
+		elephants:     cfg.Elephants,
+		dropEmpty:     cfg.DropEmpty,
+		collectorID:   cfg.CollectorID,
+		outputTimeout: cfg.OutputTimeout,
+		outputPanic:   cfg.OutputPanic,
+		recorder:      cfg.Recorder,
+		packetSize:    cfg.PacketSize,
+	}
+
+	if cfg.TemplateTTL > 0 {
+		go nfs.expireTemplates(cfg.TemplateTTL)
 	}
 
-	addr, err := net.ResolveUDPAddr("udp", listenAddr)
+	addr, err := net.ResolveUDPAddr("udp", cfg.ListenAddr)
 	if err != nil {
 		panic(fmt.Sprintf("ResolveUDPAddr: %v", err))
 	}
@@ -80,9 +225,22 @@ func New(listenAddr string, numReaders int, bgpAugment bool, debug int) *Netflow
 	if err != nil {
 		panic(fmt.Sprintf("Listen: %v", err))
 	}
+	if cfg.ReadBuffer > 0 {
+		if err := con.SetReadBuffer(cfg.ReadBuffer); err != nil {
+			panic(fmt.Sprintf("SetReadBuffer: %v", err))
+		}
+	}
+	stats.RegisterSocket("netflow", con.LocalAddr().(*net.UDPAddr).Port)
+
+	if cfg.QueueSize > 0 {
+		nfs.scheduler = fairqueue.New(cfg.QueueSize)
+		for i := 0; i < cfg.NumReaders; i++ {
+			go nfs.decodeWorker(i)
+		}
+	}
 
 	// Create goroutines that read netflow packet and process it
-	for i := 0; i < numReaders; i++ {
+	for i := 0; i < cfg.NumReaders; i++ {
 		go func(num int) {
 			nfs.packetWorker(num, con)
 		}(i)
@@ -93,7 +251,8 @@ func New(listenAddr string, numReaders int, bgpAugment bool, debug int) *Netflow
 
 // packetWorker reads netflow packet from socket and handsoff processing to processFlowSets()
 func (nfs *NetflowServer) packetWorker(identity int, conn *net.UDPConn) {
-	buffer := make([]byte, 8960)
+	ws := stats.Worker("netflow", identity)
+	buffer := make([]byte, nfs.packetSize)
 	for {
 		length, remote, err := conn.ReadFromUDP(buffer)
 		if err != nil {
@@ -103,41 +262,119 @@ func (nfs *NetflowServer) packetWorker(identity int, conn *net.UDPConn) {
 		atomic.AddUint64(&stats.GlobalStats.Netflow9packets, 1)
 		atomic.AddUint64(&stats.GlobalStats.Netflow9bytes, uint64(length))
 
-		remote.IP = remote.IP.To4()
-		if remote.IP == nil {
-			glog.Errorf("Received IPv6 packet. Dropped.")
+		// IPv4 exporters are identified by their 4 byte address, IPv6 exporters by their 16 byte one
+		if ip := remote.IP.To4(); ip != nil {
+			remote.IP = ip
+		}
+
+		if nfs.scheduler != nil {
+			data := make([]byte, length)
+			copy(data, buffer[:length])
+			nfs.scheduler.Push(fairqueue.Packet{Remote: remote.IP, Data: data})
 			continue
 		}
 
-		nfs.processPacket(remote.IP, buffer[:length])
+		ws.CountPacket(nfs.processPacket(remote.IP, buffer[:length]))
+	}
+}
+
+// decodeWorker takes packets from the scheduler and processes them
+func (nfs *NetflowServer) decodeWorker(identity int) {
+	ws := stats.Worker("netflow", identity)
+	for {
+		p, ok := nfs.scheduler.Pop()
+		if !ok {
+			return
+		}
+		ws.CountPacket(nfs.processPacket(p.Remote, p.Data))
 	}
 }
 
+// ProcessPacket processes a raw NetFlow v5 or v9 packet from `remote` received by
+// another server, e.g. on the IPFIX address. It returns the number of flows passed on.
+func (nfs *NetflowServer) ProcessPacket(remote net.IP, buffer []byte) int {
+	return nfs.processPacket(remote, buffer)
+}
+
 // processPacket takes a raw netflow packet, send it to the decoder, updates template cache
-// (if there are templates in the packet) and passes the decoded packet over to processFlowSets()
-func (nfs *NetflowServer) processPacket(remote net.IP, buffer []byte) {
+// (if there are templates in the packet) and passes the decoded packet over to processFlowSets().
+// It returns the number of flows passed on.
+func (nfs *NetflowServer) processPacket(remote net.IP, buffer []byte) int {
+	defer recoverPacket(remote, buffer)
+	stats.Router(remote.String()).CountPacket(len(buffer))
+	if nfs.recorder != nil {
+		nfs.recorder.Record("netflow", remote, buffer)
+	}
+
+	// NetFlow v5 packets have no templates and are decoded separately
+	if len(buffer) >= 2 && binary.BigEndian.Uint16(buffer) == nf5.Version {
+		return nfs.processV5Packet(remote, buffer)
+	}
+
 	length := len(buffer)
 	packet, err := nf9.Decode(buffer[:length], remote)
 	if err != nil {
+		stats.CountDecodeError("netflow", "nf9")
+		atomic.AddUint64(&stats.Router(remote.String()).DecodeErrors, 1)
 		glog.Errorf("nf9packet.Decode: %v", err)
-		return
+		return 0
+	}
+
+	if stats.Router(remote.String()).ObserveUptime(packet.Header.SysUpTime) {
+		glog.Warningf("Router %s rebooted: uptime went back to %d ms", remote, packet.Header.SysUpTime)
 	}
 
+	// NetFlow v9 sequence numbers count export packets
+	stats.ObserveSequence(remote.String(), packet.Header.SourceID, packet.Header.SequenceNumber, 1)
+
 	nfs.updateTemplateCache(remote, packet)
-	nfs.processFlowSets(remote, packet.Header.SourceID, packet.DataFlowSets(), int64(packet.Header.UnixSecs), packet)
+	ts := int64(packet.Header.UnixSecs) + nfs.timeOffsets[remote.String()]
+	return nfs.processFlowSets(remote, packet.Header.SourceID, packet.DataFlowSets(), ts, packet)
 }
 
-// processFlowSets iterates over flowSets and calls processFlowSet() for each flow set
-func (nfs *NetflowServer) processFlowSets(remote net.IP, sourceID uint32, flowSets []*nf9.FlowSet, ts int64, packet *nf9.Packet) {
+// outputStalled is the value a stalled `Output` panics with if `outputPanic` is
+// set. It is not recovered from, as that panic is asked for.
+type outputStalled string
+
+// logPanic logs panics recovered from by `recoverPacket`
+var logPanic = glog.Errorf
+
+// recoverPacket recovers from a panic processing `buffer` from `remote`, so a
+// malformed packet only costs its own flows rather than a worker. It must be
+// deferred by the function processing the packet. The packet isn't copied up
+// front to keep that off the hot path, so it is logged as left by decoding,
+// which reverses its bytes in place.
+func recoverPacket(remote net.IP, buffer []byte) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if _, ok := r.(outputStalled); ok {
+		panic(r)
+	}
+	atomic.AddUint64(&stats.GlobalStats.PacketPanics, 1)
+	atomic.AddUint64(&stats.Router(remote.String()).DecodeErrors, 1)
+
+	logPanic("Panic processing packet from %s: %v\n%d bytes as decoded (byte reversed): %s", remote, r, len(buffer), hex.EncodeToString(buffer))
+}
+
+// processFlowSets iterates over flowSets and calls processFlowSet() for each flow set.
+// It returns the number of flows passed on.
+func (nfs *NetflowServer) processFlowSets(remote net.IP, sourceID uint32, flowSets []*nf9.FlowSet, ts int64, packet *nf9.Packet) int {
 	addr := remote.String()
 	keyParts := make([]string, 3, 3)
+	flows := 0
 	for _, set := range flowSets {
-		template := nfs.tmplCache.get(convert.Uint32(remote), sourceID, set.Header.FlowSetID)
+		template := nfs.tmplCache.get(remote, sourceID, set.Header.FlowSetID)
 
 		if template == nil {
 			templateKey := makeTemplateKey(addr, sourceID, set.Header.FlowSetID, keyParts)
-			if nfs.debug > 0 {
+			atomic.AddUint64(&stats.GlobalStats.TemplateMisses, 1)
+			atomic.AddUint64(&stats.Router(addr).MissingTemplates, 1)
+			if debug.Level() > 0 {
 				glog.Warningf("Template for given FlowSet not found: %s", templateKey)
+			} else {
+				nfs.logMissingTemplate(templateKey)
 			}
 			continue
 		}
@@ -147,49 +384,215 @@ func (nfs *NetflowServer) processFlowSets(remote net.IP, sourceID uint32, flowSe
 			glog.Warning("Error decoding FlowSet")
 			continue
 		}
-		nfs.processFlowSet(template, records, remote, ts, packet)
+		flows += nfs.processFlowSet(template, records, remote, ts, packet)
 	}
+	stats.Router(addr).CountDomainPacket(sourceID, flows)
+	return flows
 }
 
-// process generates Flow elements from records and pushes them into the `receiver` channel
-func (nfs *NetflowServer) processFlowSet(template *nf9.TemplateRecords, records []nf9.FlowDataRecord, agent net.IP, ts int64, packet *nf9.Packet) {
+// process generates Flow elements from records and pushes them into the `receiver` channel.
+// It returns the number of flows passed on.
+func (nfs *NetflowServer) processFlowSet(template *nf9.TemplateRecords, records []nf9.FlowDataRecord, agent net.IP, ts int64, packet *nf9.Packet) int {
 	fm := generateFieldMap(template)
+	rs := stats.Router(agent.String())
+	received := time.Now().UnixNano()
 
+	flows := 0
 	for _, r := range records {
+		// Field indices of `fm` are only valid for records of the template's fields
+		if len(r.Values) != len(template.Records) {
+			glog.Warningf("Skipping record of %d fields decoded with template %d of %d fields", len(r.Values), template.Header.TemplateID, len(template.Records))
+			continue
+		}
+
 		if fm.family == 4 {
 			atomic.AddUint64(&stats.GlobalStats.Flows4, 1)
 		} else if fm.family == 6 {
 			atomic.AddUint64(&stats.GlobalStats.Flows6, 1)
 		} else {
+			atomic.AddUint64(&stats.GlobalStats.DroppedUnknownFamily, 1)
 			glog.Warning("Unknown address family")
 			continue
 		}
 
 		var fl netflow.Flow
 		fl.Router = agent
+		fl.Received = received
 		fl.Timestamp = ts
+		fl.CollectorId = nfs.collectorID
 		fl.Family = uint32(fm.family)
-		fl.Packets = convert.Uint32(r.Values[fm.packets])
-		fl.Size = uint64(convert.Uint32(r.Values[fm.size]))
-		fl.Protocol = convert.Uint32(r.Values[fm.protocol])
-		fl.IntIn = convert.Uint32(r.Values[fm.intIn])
-		fl.IntOut = convert.Uint32(r.Values[fm.intOut])
-		fl.SrcPort = convert.Uint32(r.Values[fm.srcPort])
-		fl.DstPort = convert.Uint32(r.Values[fm.dstPort])
-		fl.SrcAddr = convert.Reverse(r.Values[fm.srcAddr])
-		fl.DstAddr = convert.Reverse(r.Values[fm.dstAddr])
-		fl.NextHop = convert.Reverse(r.Values[fm.nextHop])
+		fl.Packets = packetsAt(r, fm.packets)
+		fl.Size = uint64At(r, fm.size)
+		fl.Protocol = uint32At(r, fm.protocol)
+		fl.IntIn = uint32At(r, fm.intIn)
+		fl.IntOut = uint32At(r, fm.intOut)
+		if fl.HasPorts() && fm.srcPort >= 0 {
+			fl.SrcPort = convert.Uint32(r.Values[fm.srcPort])
+		}
+		if fl.HasPorts() && fm.dstPort >= 0 {
+			fl.DstPort = convert.Uint32(r.Values[fm.dstPort])
+		}
+		fl.SrcAddr = bytesAt(r, fm.srcAddr)
+		fl.DstAddr = bytesAt(r, fm.dstAddr)
+		fl.NextHop = bytesAt(r, fm.nextHop)
+		if fm.bgpNextHop >= 0 {
+			fl.BgpNextHop = convert.Reverse(r.Values[fm.bgpNextHop])
+		}
+		if fm.minTTL >= 0 {
+			fl.MinTtl = convert.Uint32(r.Values[fm.minTTL])
+		}
+		if fm.maxTTL >= 0 {
+			fl.MaxTtl = convert.Uint32(r.Values[fm.maxTTL])
+		}
+		if fm.vlan >= 0 {
+			fl.Vlan = convert.Uint32(r.Values[fm.vlan])
+		}
+		if fm.tcpFlags >= 0 {
+			// Exporters sending TCP_FLAGS as 2 bytes may include the header length
+			fl.TcpFlags = convert.Uint32(r.Values[fm.tcpFlags]) & tcpFlagsMask
+		}
+
+		// DSCP are the upper 6 bits of the type of service byte
+		if fm.tos >= 0 {
+			fl.Tos = convert.Uint32(r.Values[fm.tos])
+			fl.HasTos = true
+			fl.Dscp = fl.Tos >> 2
+			fl.HasDscp = true
+		}
+		if fm.postTos >= 0 {
+			fl.PostDscp = convert.Uint32(r.Values[fm.postTos]) >> 2
+			fl.HasPostDscp = true
+		}
+
+		// Switched times are uptimes in milliseconds, the header tells when the router booted
+		boot := ts*1000 - int64(packet.Header.SysUpTime)
+		if fm.firstSwitched >= 0 {
+			fl.Start = boot + int64(convert.Uint32(r.Values[fm.firstSwitched]))
+		}
+		if fm.lastSwitched >= 0 {
+			fl.End = boot + int64(convert.Uint32(r.Values[fm.lastSwitched]))
+		}
 
 		if !nfs.bgpAugment {
-			fl.SrcAs = convert.Uint32(r.Values[fm.srcAsn])
-			fl.DstAs = convert.Uint32(r.Values[fm.dstAsn])
+			fl.SrcAs = uint32At(r, fm.srcAsn)
+			fl.DstAs = uint32At(r, fm.dstAsn)
 		}
 
-		if nfs.debug > 2 {
-			Dump(&fl)
+		if nfs.pass(&fl, rs) {
+			flows++
 		}
+	}
+	return flows
+}
+
+// pass drops `fl` if it is empty (and `dropEmpty` is set), invalid or exceeds
+// the rate limit and sends it to `Output` otherwise. It returns true if `fl` was sent.
+func (nfs *NetflowServer) pass(fl *netflow.Flow, rs *stats.RouterStats) bool {
+	if debug.Level() > 2 {
+		Dump(fl)
+	}
+
+	if nfs.dropEmpty && fl.Packets == 0 && fl.Size == 0 {
+		atomic.AddUint64(&stats.GlobalStats.EmptyDropped, 1)
+		return false
+	}
+
+	if nfs.validator != nil && !nfs.validator.Keep("netflow", fl) {
+		return false
+	}
+	if nfs.elephants != nil {
+		nfs.elephants.Check(fl)
+	}
+
+	rs.CountFlow(fl.Size)
+	if nfs.limiter != nil && !nfs.limiter.Allow() {
+		atomic.AddUint64(&stats.GlobalStats.RateLimited, 1)
+		return false
+	}
+
+	nfs.send(fl)
+	return true
+}
+
+// uint32At returns the value at index `i` of `r`, 0 if `i` is -1 or out of range
+func uint32At(r nf9.FlowDataRecord, i int) uint32 {
+	if i < 0 || i >= len(r.Values) {
+		return 0
+	}
+	return convert.Uint32(r.Values[i])
+}
+
+// uint64At returns the value at index `i` of `r`, 0 if `i` is -1 or out of range. Counters
+// may be exported with 8 bytes, which uint32At would truncate.
+func uint64At(r nf9.FlowDataRecord, i int) uint64 {
+	if i < 0 || i >= len(r.Values) {
+		return 0
+	}
+	return convert.Uint64(r.Values[i])
+}
+
+// packetsAt returns the packet count at index `i` of `r`, 0 if `i` is -1 or out of range.
+// Counts exceeding the 32 bits of flows are capped rather than wrapped.
+func packetsAt(r nf9.FlowDataRecord, i int) uint32 {
+	packets := uint64At(r, i)
+	if packets > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(packets)
+}
+
+// bytesAt returns the value at index `i` of `r` in network byte order, nil if `i` is -1 or out of range
+func bytesAt(r nf9.FlowDataRecord, i int) []byte {
+	if i < 0 || i >= len(r.Values) {
+		return nil
+	}
+	return convert.Reverse(r.Values[i])
+}
+
+// send passes `fl` on to `Output`. If `Output` is not drained within `outputTimeout`,
+// e.g. because no consumer is attached, the flow is dropped or the server panics
+// instead of silently blocking the packet workers forever.
+func (nfs *NetflowServer) send(fl *netflow.Flow) {
+	if nfs.outputTimeout == 0 {
+		nfs.Output <- fl
+		return
+	}
 
-		nfs.Output <- &fl
+	select {
+	case nfs.Output <- fl:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(nfs.outputTimeout)
+	defer timer.Stop()
+	select {
+	case nfs.Output <- fl:
+		return
+	case <-timer.C:
+	}
+
+	if nfs.outputPanic {
+		panic(outputStalled(fmt.Sprintf("Netflow Output not drained for %v, is a consumer attached?", nfs.outputTimeout)))
+	}
+	atomic.AddUint64(&stats.GlobalStats.OutputDropped, 1)
+
+	// Log at most once per timeout to not flood the log while stalled
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&nfs.lastStallLog)
+	if now-last >= int64(nfs.outputTimeout/time.Second) && atomic.CompareAndSwapInt64(&nfs.lastStallLog, last, now) {
+		glog.Errorf("Netflow Output not drained for %v, dropping flows. Is a consumer attached?", nfs.outputTimeout)
+	}
+}
+
+// logMissingTemplate warns about a flowset skipped for lack of template
+// `templateKey`. It logs at most once per minute, as exporters send many
+// flowsets until they resend their templates.
+func (nfs *NetflowServer) logMissingTemplate(templateKey string) {
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&nfs.lastMissingLog)
+	if now-last >= 60 && atomic.CompareAndSwapInt64(&nfs.lastMissingLog, last, now) {
+		glog.Warningf("Skipping flowsets lacking their template (e.g. %s) until exporters resend it, %d skipped so far", templateKey, atomic.LoadUint64(&stats.GlobalStats.TemplateMisses))
 	}
 }
 
@@ -203,6 +606,8 @@ func Dump(fl *netflow.Flow) {
 	fmt.Printf("DstAddr: %s\n", net.IP(fl.DstAddr).String())
 	fmt.Printf("Protocol: %d\n", fl.Protocol)
 	fmt.Printf("NextHop: %s\n", net.IP(fl.NextHop).String())
+	fmt.Printf("BgpNextHop: %s\n", net.IP(fl.BgpNextHop).String())
+	fmt.Printf("Vlan: %d\n", fl.Vlan)
 	fmt.Printf("IntIn: %d\n", fl.IntIn)
 	fmt.Printf("IntOut: %d\n", fl.IntOut)
 	fmt.Printf("Packets: %d\n", fl.Packets)
@@ -221,7 +626,29 @@ func DumpTemplate(tmpl *nf9.TemplateRecords) {
 // generateFieldMap processes a TemplateRecord and populates a fieldMap accordingly
 // the FieldMap can then be used to read fields from a flow
 func generateFieldMap(template *nf9.TemplateRecords) *fieldMap {
-	var fm fieldMap
+	fm := fieldMap{
+		srcAddr:       -1,
+		dstAddr:       -1,
+		protocol:      -1,
+		packets:       -1,
+		size:          -1,
+		intIn:         -1,
+		intOut:        -1,
+		nextHop:       -1,
+		srcAsn:        -1,
+		dstAsn:        -1,
+		srcPort:       -1,
+		dstPort:       -1,
+		minTTL:        -1,
+		maxTTL:        -1,
+		firstSwitched: -1,
+		lastSwitched:  -1,
+		tos:           -1,
+		postTos:       -1,
+		bgpNextHop:    -1,
+		vlan:          -1,
+		tcpFlags:      -1,
+	}
 	i := -1
 	for _, f := range template.Records {
 		i++
@@ -251,6 +678,17 @@ func generateFieldMap(template *nf9.TemplateRecords) *fieldMap {
 			fm.nextHop = i
 		case nf9.IPv6NextHop:
 			fm.nextHop = i
+		case nf9.SrcVlan:
+			fm.vlan = i
+		case nf9.DstVlan:
+			// The egress VLAN is only used if the ingress VLAN isn't exported
+			if fm.vlan < 0 {
+				fm.vlan = i
+			}
+		case nf9.BGPIPv4NextHop:
+			fm.bgpNextHop = i
+		case nf9.BgpIPv6NextHop:
+			fm.bgpNextHop = i
 		case nf9.L4SrcPort:
 			fm.srcPort = i
 		case nf9.L4DstPort:
@@ -259,6 +697,20 @@ func generateFieldMap(template *nf9.TemplateRecords) *fieldMap {
 			fm.srcAsn = i
 		case nf9.DstAs:
 			fm.dstAsn = i
+		case nf9.MinTTL:
+			fm.minTTL = i
+		case nf9.TCPFlags:
+			fm.tcpFlags = i
+		case nf9.MaxTTL:
+			fm.maxTTL = i
+		case nf9.SrcTos:
+			fm.tos = i
+		case nf9.DstTos:
+			fm.postTos = i
+		case nf9.FirstSwitched:
+			fm.firstSwitched = i
+		case nf9.LastSwitched:
+			fm.lastSwitched = i
 		}
 	}
 	return &fm
@@ -268,7 +720,14 @@ func generateFieldMap(template *nf9.TemplateRecords) *fieldMap {
 func (nfs *NetflowServer) updateTemplateCache(remote net.IP, p *nf9.Packet) {
 	templRecs := p.GetTemplateRecords()
 	for _, tr := range templRecs {
-		nfs.tmplCache.set(convert.Uint32(remote), tr.Packet.Header.SourceID, tr.Header.TemplateID, *tr)
+		if err := checkTemplate(tr); err != nil {
+			atomic.AddUint64(&stats.GlobalStats.TemplatesInvalid, 1)
+			if debug.Level() > 0 {
+				glog.Warningf("Skipping template %d of %s: %v", tr.Header.TemplateID, remote, err)
+			}
+			continue
+		}
+		nfs.tmplCache.set(remote, tr.Packet.Header.SourceID, tr.Header.TemplateID, *tr)
 	}
 }
 
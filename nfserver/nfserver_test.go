@@ -0,0 +1,239 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/nf9"
+	"github.com/google/tflow2/stats"
+)
+
+// field is a field of a test template
+type field struct {
+	typ   uint16
+	value []byte
+}
+
+// buildPacket creates a NetFlow v9 packet carrying a template with `fields` and a single data record
+func buildPacket(templateID uint16, fields []field) []byte {
+	tmpl := &bytes.Buffer{}
+	binary.Write(tmpl, binary.BigEndian, templateID)
+	binary.Write(tmpl, binary.BigEndian, uint16(len(fields)))
+	data := &bytes.Buffer{}
+	for _, f := range fields {
+		binary.Write(tmpl, binary.BigEndian, f.typ)
+		binary.Write(tmpl, binary.BigEndian, uint16(len(f.value)))
+		data.Write(f.value)
+	}
+	for data.Len()%4 != 0 {
+		data.WriteByte(0)
+	}
+
+	pkt := &bytes.Buffer{}
+	binary.Write(pkt, binary.BigEndian, uint16(9))
+	binary.Write(pkt, binary.BigEndian, uint16(2))
+	binary.Write(pkt, binary.BigEndian, uint32(10000))      // SysUpTime
+	binary.Write(pkt, binary.BigEndian, uint32(1500000000)) // UnixSecs
+	binary.Write(pkt, binary.BigEndian, uint32(1))          // SequenceNumber
+	binary.Write(pkt, binary.BigEndian, uint32(0))          // SourceID
+	binary.Write(pkt, binary.BigEndian, uint16(nf9.TemplateFlowSetID))
+	binary.Write(pkt, binary.BigEndian, uint16(4+tmpl.Len()))
+	pkt.Write(tmpl.Bytes())
+	binary.Write(pkt, binary.BigEndian, templateID)
+	binary.Write(pkt, binary.BigEndian, uint16(4+data.Len()))
+	pkt.Write(data.Bytes())
+	return pkt.Bytes()
+}
+
+func newTestServer() *NetflowServer {
+	return &NetflowServer{
+		tmplCache: newTemplateCache(0),
+		Output:    make(chan *netflow.Flow, 10),
+	}
+}
+
+// v5Packet is a NetFlow v5 packet carrying a single TCP flow, sampled 1 out of 100
+var v5Packet = []byte{
+	// Header
+	0, 5, 0, 1, 0, 0, 0x27, 0x10, 0x59, 0x68, 0x2f, 0x00, 0, 0, 0, 0,
+	0, 0, 0, 42, 1, 2, 0x40, 100,
+	// Record
+	10, 0, 0, 1, 10, 0, 0, 2, 192, 0, 2, 1,
+	0, 7, 0, 8, 0, 0, 0, 3, 0, 0, 0x05, 0xdc,
+	0, 0, 0x03, 0xe8, 0, 0, 0x07, 0xd0,
+	0x30, 0x39, 0, 80, 0, 0x12, 6, 0xb8,
+	0xfd, 0xe8, 0, 65, 24, 16, 0, 0,
+}
+
+func TestProcessV5Packet(t *testing.T) {
+	nfs := newTestServer()
+	if n := nfs.processPacket(net.IP{192, 0, 2, 1}, append([]byte{}, v5Packet...)); n != 1 {
+		t.Fatalf("Expected 1 flow, got %d", n)
+	}
+
+	fl := <-nfs.Output
+	if !net.IP(fl.SrcAddr).Equal(net.IP{10, 0, 0, 1}) || !net.IP(fl.DstAddr).Equal(net.IP{10, 0, 0, 2}) || !net.IP(fl.NextHop).Equal(net.IP{192, 0, 2, 1}) {
+		t.Errorf("Unexpected addresses %v -> %v via %v", net.IP(fl.SrcAddr), net.IP(fl.DstAddr), net.IP(fl.NextHop))
+	}
+	if fl.Packets != 300 || fl.Size != 150000 || !fl.Scaled || fl.SamplingRate != 100 {
+		t.Errorf("Expected 300 packets and 150000 bytes scaled by 100, got %d packets and %d bytes (scaled %v by %d)", fl.Packets, fl.Size, fl.Scaled, fl.SamplingRate)
+	}
+	if fl.SrcPort != 12345 || fl.DstPort != 80 || fl.TcpFlags != 0x12 || fl.Dscp != 46 {
+		t.Errorf("Expected ports 12345 -> 80, flags 0x12 and DSCP 46, got %d -> %d, %#x and %d", fl.SrcPort, fl.DstPort, fl.TcpFlags, fl.Dscp)
+	}
+	if fl.SrcAs != 65000 || fl.DstAs != 65 || fl.Start != 1500000000*1000-10000+1000 || fl.End != 1500000000*1000-10000+2000 {
+		t.Errorf("Unexpected ASNs %d -> %d or times %d - %d", fl.SrcAs, fl.DstAs, fl.Start, fl.End)
+	}
+}
+
+func TestScalePackets(t *testing.T) {
+	tests := []struct {
+		packets  uint32
+		rate     uint32
+		expected uint32
+	}{
+		{packets: 3, rate: 100, expected: 300},
+		{packets: math.MaxUint32 / 2, rate: 2, expected: math.MaxUint32 - 1},
+		{packets: math.MaxUint32 / 2, rate: 3, expected: math.MaxUint32},
+		{packets: 1 << 20, rate: 0x3fff, expected: math.MaxUint32},
+	}
+
+	for _, test := range tests {
+		if got := scalePackets(test.packets, test.rate); got != test.expected {
+			t.Errorf("Expected %d packets scaled by %d to be %d, got %d", test.packets, test.rate, test.expected, got)
+		}
+	}
+
+	// Counts are capped rather than wrapped
+	pkt := append([]byte{}, v5Packet...)
+	binary.BigEndian.PutUint32(pkt[24+16:], 1<<26)
+	nfs := newTestServer()
+	nfs.processPacket(net.IP{192, 0, 2, 1}, pkt)
+	if fl := <-nfs.Output; fl.Packets != math.MaxUint32 {
+		t.Errorf("Expected packets capped at %d, got %d", uint32(math.MaxUint32), fl.Packets)
+	}
+}
+
+func TestProcessTemplateWithoutPorts(t *testing.T) {
+	// Templates may lack ports and TTLs, e.g. for ICMP only exporters
+	pkt := buildPacket(256, []field{
+		{typ: nf9.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+		{typ: nf9.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+		{typ: nf9.InBytes, value: []byte{0, 0, 5, 220}},
+		{typ: nf9.InPkts, value: []byte{0, 0, 0, 1}},
+		{typ: nf9.Protocol, value: []byte{6}},
+	})
+
+	nfs := newTestServer()
+	if n := nfs.processPacket(net.IP{192, 0, 2, 2}, pkt); n != 1 {
+		t.Fatalf("Expected 1 flow, got %d", n)
+	}
+	fl := <-nfs.Output
+	if !net.IP(fl.SrcAddr).Equal(net.IP{10, 0, 0, 1}) || !net.IP(fl.DstAddr).Equal(net.IP{10, 0, 0, 2}) {
+		t.Errorf("Unexpected addresses %v -> %v", net.IP(fl.SrcAddr), net.IP(fl.DstAddr))
+	}
+	if fl.Size != 1500 || fl.Packets != 1 || fl.Protocol != 6 {
+		t.Errorf("Expected 1 TCP packet of 1500 bytes, got %d packets of %d bytes, protocol %d", fl.Packets, fl.Size, fl.Protocol)
+	}
+	if fl.SrcPort != 0 || fl.DstPort != 0 || fl.MinTtl != 0 || fl.MaxTtl != 0 {
+		t.Errorf("Expected no ports and TTLs, got %d -> %d and TTL %d - %d", fl.SrcPort, fl.DstPort, fl.MinTtl, fl.MaxTtl)
+	}
+}
+
+func TestProcessTCPFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    []byte
+		expected uint32
+	}{
+		{name: "1 byte", value: []byte{0x12}, expected: 0x12},
+		{name: "2 bytes", value: []byte{0x00, 0x18}, expected: 0x18},
+		{name: "2 bytes with header length", value: []byte{0x50, 0x12}, expected: 0x12},
+		{name: "2 bytes with ECN flags", value: []byte{0x51, 0xc2}, expected: 0x1c2},
+	}
+
+	for i, test := range tests {
+		pkt := buildPacket(uint16(256+i), []field{
+			{typ: nf9.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+			{typ: nf9.IPv4DstAddr, value: []byte{10, 0, 0, 2}},
+			{typ: nf9.Protocol, value: []byte{6}},
+			{typ: nf9.TCPFlags, value: test.value},
+		})
+
+		nfs := newTestServer()
+		if n := nfs.processPacket(net.IP{192, 0, 2, 3}, pkt); n != 1 {
+			t.Errorf("%s: Expected 1 flow, got %d", test.name, n)
+			continue
+		}
+		if fl := <-nfs.Output; fl.TcpFlags != test.expected {
+			t.Errorf("%s: Expected TCP flags %#x, got %#x", test.name, test.expected, fl.TcpFlags)
+		}
+	}
+}
+
+func TestImportInvalidTemplates(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields string
+		id     int
+	}{
+		{name: "Record exceeding a packet", fields: `{"type": 8, "length": 40000}, {"type": 12, "length": 40000}`, id: 301},
+		{name: "Reserved template ID", fields: `{"type": 8, "length": 4}`, id: 255},
+	}
+
+	// Invalid templates are skipped without stopping the import
+	var templates []string
+	for _, test := range tests {
+		templates = append(templates, fmt.Sprintf(`{"exporter": "192.0.2.1", "template_id": %d, "fields": [%s]}`, test.id, test.fields))
+	}
+	templates = append(templates, `{"exporter": "192.0.2.1", "template_id": 300, "fields": [{"type": 8, "length": 4}, {"type": 12, "length": 0}]}`)
+
+	nfs := newTestServer()
+	invalid := atomic.LoadUint64(&stats.GlobalStats.TemplatesInvalid)
+	if n, err := nfs.ImportTemplates(strings.NewReader("[" + strings.Join(templates, ",") + "]")); err != nil || n != 1 {
+		t.Errorf("Expected only the valid template imported, got %d (%v)", n, err)
+	}
+	if got := atomic.LoadUint64(&stats.GlobalStats.TemplatesInvalid) - invalid; got != uint64(len(tests)) {
+		t.Errorf("Expected %d invalid templates, got %d", len(tests), got)
+	}
+	for _, test := range tests {
+		if nfs.tmplCache.get(net.IP{192, 0, 2, 1}, 0, uint16(test.id)) != nil {
+			t.Errorf("%s: Expected invalid template not to be cached", test.name)
+		}
+	}
+
+	// Fields of length 0 are accepted, as they are when received from exporters
+	if nfs.tmplCache.get(net.IP{192, 0, 2, 1}, 0, 300) == nil {
+		t.Errorf("Expected template with a field of length 0 to be cached")
+	}
+
+	// The same checks apply to templates received from exporters
+	invalid = atomic.LoadUint64(&stats.GlobalStats.TemplatesInvalid)
+	nfs.processPacket(net.IP{192, 0, 2, 4}, buildPacket(255, []field{
+		{typ: nf9.IPv4SrcAddr, value: []byte{10, 0, 0, 1}},
+	}))
+	if got := atomic.LoadUint64(&stats.GlobalStats.TemplatesInvalid) - invalid; got != 1 {
+		t.Errorf("Expected received template counted as invalid, got %d", got)
+	}
+	if nfs.tmplCache.get(net.IP{192, 0, 2, 4}, 0, 255) != nil {
+		t.Errorf("Expected invalid received template not to be cached")
+	}
+}
@@ -12,45 +12,280 @@
 package nfserver
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/golang/glog"
 	"github.com/google/tflow2/nf9"
+	"github.com/google/tflow2/stats"
 )
 
+// CachedTemplate is a template of an exporter as exchanged between collectors
+type CachedTemplate struct {
+	Exporter   string          `json:"exporter"`
+	SourceID   uint32          `json:"source_id"`
+	TemplateID uint16          `json:"template_id"`
+	Fields     []TemplateField `json:"fields"`
+}
+
+// TemplateField is a field of a `CachedTemplate`
+type TemplateField struct {
+	Type   uint16 `json:"type"`
+	Length uint16 `json:"length"`
+}
+
+// templateCache keeps the templates of all exporters, keyed by exporter, source
+// and template ID. It is shared by all workers and safe for concurrent use.
 type templateCache struct {
-	cache map[uint32]map[uint32]map[uint16]nf9.TemplateRecords
-	lock  sync.RWMutex
+	cache map[string]map[uint32]map[uint16]nf9.TemplateRecords
+
+	// seen holds the time each template was last received (or imported) at
+	seen map[cacheKey]time.Time
+
+	// ttl is the age templates are considered absent at, until they are received
+	// again or removed by `expire`. 0 keeps templates forever.
+	ttl time.Duration
+
+	lock sync.RWMutex
 }
 
-// newTemplateCache creates and initializes a new `templateCache` instance
-func newTemplateCache() *templateCache {
-	return &templateCache{cache: make(map[uint32]map[uint32]map[uint16]nf9.TemplateRecords)}
+// cacheKey identifies a template in `templateCache`
+type cacheKey struct {
+	exporter   string
+	sourceID   uint32
+	templateID uint16
 }
 
-func (c *templateCache) set(rtr uint32, sourceID uint32, templateID uint16, records nf9.TemplateRecords) {
+// exporterKey returns the key of exporter `rtr` in the cache. IPv4 exporters are
+// keyed by their 4 byte address whatever the representation of `rtr`, IPv6
+// exporters by their 16 byte address.
+func exporterKey(rtr net.IP) string {
+	if ip := rtr.To4(); ip != nil {
+		return string(ip)
+	}
+	return string(rtr.To16())
+}
+
+// newTemplateCache creates and initializes a new `templateCache` instance keeping
+// templates for `ttl`
+func newTemplateCache(ttl time.Duration) *templateCache {
+	return &templateCache{
+		cache: make(map[string]map[uint32]map[uint16]nf9.TemplateRecords),
+		seen:  make(map[cacheKey]time.Time),
+		ttl:   ttl,
+	}
+}
+
+// set stores `records` as template `templateID` of source `sourceID` of exporter `rtr`
+func (c *templateCache) set(rtr net.IP, sourceID uint32, templateID uint16, records nf9.TemplateRecords) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	if _, ok := c.cache[rtr]; !ok {
-		c.cache[rtr] = make(map[uint32]map[uint16]nf9.TemplateRecords)
+	key := exporterKey(rtr)
+	if _, ok := c.cache[key]; !ok {
+		c.cache[key] = make(map[uint32]map[uint16]nf9.TemplateRecords)
 	}
-	if _, ok := c.cache[rtr][sourceID]; !ok {
-		c.cache[rtr][sourceID] = make(map[uint16]nf9.TemplateRecords)
+	if _, ok := c.cache[key][sourceID]; !ok {
+		c.cache[key][sourceID] = make(map[uint16]nf9.TemplateRecords)
 	}
-	c.cache[rtr][sourceID][templateID] = records
+	c.cache[key][sourceID][templateID] = records
+	c.touch(cacheKey{key, sourceID, templateID})
 }
 
-func (c *templateCache) get(rtr uint32, sourceID uint32, templateID uint16) *nf9.TemplateRecords {
+// get returns a copy of template `templateID` of source `sourceID` of exporter `rtr`, nil if unknown
+// or not received within the TTL
+func (c *templateCache) get(rtr net.IP, sourceID uint32, templateID uint16) *nf9.TemplateRecords {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
-	if _, ok := c.cache[rtr]; !ok {
+	key := exporterKey(rtr)
+	if _, ok := c.cache[key]; !ok {
+		return nil
+	}
+	if _, ok := c.cache[key][sourceID]; !ok {
 		return nil
 	}
-	if _, ok := c.cache[rtr][sourceID]; !ok {
+	if _, ok := c.cache[key][sourceID][templateID]; !ok {
 		return nil
 	}
-	if _, ok := c.cache[rtr][sourceID][templateID]; !ok {
+	if c.ttl > 0 && time.Since(c.seen[cacheKey{key, sourceID, templateID}]) > c.ttl {
 		return nil
 	}
-	ret := c.cache[rtr][sourceID][templateID]
+	ret := c.cache[key][sourceID][templateID]
 	return &ret
 }
+
+// add stores `records` unless a template with the same key is cached already. It
+// returns true if the template was stored.
+func (c *templateCache) add(rtr net.IP, sourceID uint32, templateID uint16, records nf9.TemplateRecords) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := exporterKey(rtr)
+	if _, ok := c.cache[key][sourceID][templateID]; ok {
+		return false
+	}
+	if _, ok := c.cache[key]; !ok {
+		c.cache[key] = make(map[uint32]map[uint16]nf9.TemplateRecords)
+	}
+	if _, ok := c.cache[key][sourceID]; !ok {
+		c.cache[key][sourceID] = make(map[uint16]nf9.TemplateRecords)
+	}
+	c.cache[key][sourceID][templateID] = records
+	c.touch(cacheKey{key, sourceID, templateID})
+	return true
+}
+
+// touch records the receipt of template `k`, counting it for its exporter if it
+// is new. `c.lock` must be held.
+func (c *templateCache) touch(k cacheKey) {
+	if _, ok := c.seen[k]; !ok {
+		atomic.AddInt64(&stats.Router(net.IP(k.exporter).String()).Templates, 1)
+	}
+	c.seen[k] = time.Now()
+}
+
+// expire removes templates last received before `before`, so flowsets of their
+// IDs aren't decoded until the exporter sent the template again. It returns the
+// number of templates removed.
+func (c *templateCache) expire(before time.Time) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n := 0
+	for k, t := range c.seen {
+		if !t.Before(before) {
+			continue
+		}
+		delete(c.seen, k)
+		atomic.AddInt64(&stats.Router(net.IP(k.exporter).String()).Templates, -1)
+		delete(c.cache[k.exporter][k.sourceID], k.templateID)
+		if len(c.cache[k.exporter][k.sourceID]) == 0 {
+			delete(c.cache[k.exporter], k.sourceID)
+		}
+		if len(c.cache[k.exporter]) == 0 {
+			delete(c.cache, k.exporter)
+		}
+		n++
+	}
+	return n
+}
+
+// templates returns all cached templates
+func (c *templateCache) templates() []CachedTemplate {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	templates := make([]CachedTemplate, 0)
+	for rtr, sources := range c.cache {
+		exporter := net.IP(rtr)
+		for sourceID, tmpls := range sources {
+			for templateID, tmpl := range tmpls {
+				t := CachedTemplate{
+					Exporter:   exporter.String(),
+					SourceID:   sourceID,
+					TemplateID: templateID,
+				}
+				for _, r := range tmpl.Records {
+					t.Fields = append(t.Fields, TemplateField{Type: r.Type, Length: r.Length})
+				}
+				templates = append(templates, t)
+			}
+		}
+	}
+	return templates
+}
+
+// expireTemplates removes templates not received within `ttl` from the cache,
+// checking every minute (or every `ttl` if shorter)
+func (nfs *NetflowServer) expireTemplates(ttl time.Duration) {
+	interval := time.Minute
+	if ttl < interval {
+		interval = ttl
+	}
+	for range time.Tick(interval) {
+		if n := nfs.tmplCache.expire(time.Now().Add(-ttl)); n > 0 {
+			atomic.AddUint64(&stats.GlobalStats.TemplatesExpired, uint64(n))
+			glog.Infof("Expired %d templates not received within %v", n, ttl)
+		}
+	}
+}
+
+// ExportTemplates writes all cached templates to `w` as JSON, to be imported by
+// another collector using `ImportTemplates`
+func (nfs *NetflowServer) ExportTemplates(w io.Writer) error {
+	return json.NewEncoder(w).Encode(nfs.tmplCache.templates())
+}
+
+// ImportTemplates reads templates written by `ExportTemplates` from `r` into the
+// cache, so flows can be decoded before exporters resend their templates.
+// Templates received from exporters in the meantime are kept. Templates failing
+// the checks applied to received ones are skipped and counted as invalid. It
+// returns the number of templates imported.
+func (nfs *NetflowServer) ImportTemplates(r io.Reader) (int, error) {
+	var templates []CachedTemplate
+	if err := json.NewDecoder(r).Decode(&templates); err != nil {
+		return 0, fmt.Errorf("unable to decode templates: %v", err)
+	}
+
+	n := 0
+	for _, t := range templates {
+		ip := net.ParseIP(t.Exporter)
+		if ip == nil {
+			atomic.AddUint64(&stats.GlobalStats.TemplatesInvalid, 1)
+			glog.Warningf("Skipping template %d: invalid exporter address %q", t.TemplateID, t.Exporter)
+			continue
+		}
+		if len(t.Fields) > math.MaxUint16 {
+			atomic.AddUint64(&stats.GlobalStats.TemplatesInvalid, 1)
+			glog.Warningf("Skipping template %d of %s: %d fields exceed the field count", t.TemplateID, t.Exporter, len(t.Fields))
+			continue
+		}
+
+		tmpl := nf9.TemplateRecords{
+			Header: &nf9.TemplateRecordHeader{FieldCount: uint16(len(t.Fields)), TemplateID: t.TemplateID},
+		}
+		for _, f := range t.Fields {
+			tmpl.Records = append(tmpl.Records, &nf9.TemplateRecord{Type: f.Type, Length: f.Length})
+		}
+		if err := checkTemplate(&tmpl); err != nil {
+			atomic.AddUint64(&stats.GlobalStats.TemplatesInvalid, 1)
+			glog.Warningf("Skipping template %d of %s: %v", t.TemplateID, t.Exporter, err)
+			continue
+		}
+		if nfs.tmplCache.add(ip, t.SourceID, t.TemplateID, tmpl) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// checkTemplate returns an error if records of `tmpl` can't be decoded, as they
+// exceed a packet. It applies to templates received from exporters and imported
+// ones alike.
+func checkTemplate(tmpl *nf9.TemplateRecords) error {
+	if tmpl.Header.TemplateID <= nf9.FlowSetIDTemplateMax {
+		return fmt.Errorf("reserved template ID")
+	}
+
+	size := 0
+	for _, f := range tmpl.Records {
+		size += int(f.Length)
+	}
+	if size > nf9.MaxPacketSize {
+		return fmt.Errorf("records of %d bytes exceed a packet", size)
+	}
+	return nil
+}
+
+// ServeTemplates sends all cached templates to a peer collector warming up its cache
+func (nfs *NetflowServer) ServeTemplates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := nfs.ExportTemplates(w); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to export templates: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nfserver
+
+import (
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/nf5"
+	"github.com/google/tflow2/stats"
+)
+
+// processV5Packet decodes a raw NetFlow v5 packet and passes its flows on.
+// It returns the number of flows passed on.
+func (nfs *NetflowServer) processV5Packet(remote net.IP, buffer []byte) int {
+	packet, err := nf5.Decode(buffer)
+	if err != nil {
+		stats.CountDecodeError("netflow", "nf5")
+		atomic.AddUint64(&stats.Router(remote.String()).DecodeErrors, 1)
+		glog.Errorf("nf5.Decode: %v", err)
+		return 0
+	}
+
+	addr := remote.String()
+	rs := stats.Router(addr)
+	if rs.ObserveUptime(packet.Header.SysUpTime) {
+		glog.Warningf("Router %s rebooted: uptime went back to %d ms", remote, packet.Header.SysUpTime)
+	}
+
+	// NetFlow v5 sequence numbers count flows. Each flow switching engine has its own.
+	engine := uint32(packet.Header.EngineType)<<8 | uint32(packet.Header.EngineID)
+	stats.ObserveSequence(addr, engine, packet.Header.FlowSequence, len(packet.Records))
+
+	ts := int64(packet.Header.UnixSecs) + nfs.timeOffsets[addr]
+	rate := packet.Header.SamplingRate()
+	received := time.Now().UnixNano()
+
+	// First and Last are uptimes in milliseconds, the header tells when the router booted
+	boot := ts*1000 - int64(packet.Header.SysUpTime)
+
+	flows := 0
+	for i := range packet.Records {
+		r := &packet.Records[i]
+		atomic.AddUint64(&stats.GlobalStats.Flows4, 1)
+
+		var fl netflow.Flow
+		fl.Router = remote
+		fl.Received = received
+		fl.Timestamp = ts
+		fl.CollectorId = nfs.collectorID
+		fl.Family = 4
+		fl.SrcAddr = append([]byte{}, r.SrcAddr[:]...)
+		fl.DstAddr = append([]byte{}, r.DstAddr[:]...)
+		fl.NextHop = append([]byte{}, r.NextHop[:]...)
+		fl.IntIn = uint32(r.Input)
+		fl.IntOut = uint32(r.Output)
+		fl.Packets = r.DPkts
+		fl.Size = uint64(r.DOctets)
+		fl.Protocol = uint32(r.Prot)
+		if fl.HasPorts() {
+			fl.SrcPort = uint32(r.SrcPort)
+			fl.DstPort = uint32(r.DstPort)
+		}
+		fl.TcpFlags = uint32(r.TCPFlags)
+
+		// DSCP are the upper 6 bits of the type of service byte
+		fl.Tos = uint32(r.Tos)
+		fl.HasTos = true
+		fl.Dscp = fl.Tos >> 2
+		fl.HasDscp = true
+
+		fl.Start = boot + int64(r.First)
+		fl.End = boot + int64(r.Last)
+
+		if !nfs.bgpAugment {
+			fl.SrcAs = uint32(r.SrcAs)
+			fl.DstAs = uint32(r.DstAs)
+		}
+
+		if rate > 0 {
+			fl.Packets = scalePackets(fl.Packets, rate)
+			fl.Size *= uint64(rate)
+			fl.Scaled = true
+			fl.SamplingRate = rate
+		}
+
+		if nfs.pass(&fl, rs) {
+			flows++
+		}
+	}
+	rs.CountDomainPacket(engine, flows)
+	return flows
+}
+
+// scalePackets returns `packets` scaled by sampling rate `rate`. Counts exceeding
+// the 32 bits of flows are capped rather than wrapped, like those of packetsAt.
+func scalePackets(packets uint32, rate uint32) uint32 {
+	scaled := uint64(packets) * uint64(rate)
+	if scaled > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(scaled)
+}
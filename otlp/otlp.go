@@ -0,0 +1,393 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package otlp exports flows as OpenTelemetry log records using OTLP/HTTP
+// with JSON encoding
+package otlp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+const (
+	// logsPath is the path OTLP/HTTP receivers accept log records on
+	logsPath = "/v1/logs"
+
+	// maxAttempts is the number of times sending a batch is tried before it is dropped
+	maxAttempts = 5
+
+	// retryBackoff is the time waited before the first retry. It doubles with every attempt.
+	retryBackoff = 500 * time.Millisecond
+
+	// numQueuedBatches is the number of batches waiting to be sent. If the
+	// queue is full new batches are dropped rather than blocking the pipeline.
+	numQueuedBatches = 8
+)
+
+// Exporter represents an OTLP log exporter
+type Exporter struct {
+	url           string
+	batchSize     int
+	flushInterval time.Duration
+	client        *http.Client
+	batches       chan []*netflow.Flow
+	latency       *stats.Histogram
+
+	// Input is the channel used to receive flows from the annotator layer
+	Input chan *netflow.Flow
+}
+
+// New creates a new `Exporter` sending batches of up to `batchSize` flows to the
+// OTLP/HTTP receiver at `endpoint`, e.g. http://localhost:4318
+func New(endpoint string, batchSize int, flushInterval time.Duration) *Exporter {
+	e := &Exporter{
+		url:           endpoint + logsPath,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		batches:       make(chan []*netflow.Flow, numQueuedBatches),
+		latency:       stats.Latency("otlp"),
+		Input:         make(chan *netflow.Flow, batchSize),
+	}
+	go e.batcher()
+	go e.sender()
+	return e
+}
+
+// NewSink creates a new `Exporter` for acknowledged delivery to the OTLP/HTTP
+// receiver at `endpoint`. It doesn't batch flows itself and has no `Input`;
+// batches are passed to `Write`, e.g. by a `sink.Reliable`.
+func NewSink(endpoint string) *Exporter {
+	return &Exporter{
+		url:    endpoint + logsPath,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Write sends `batch` to the receiver in a single request. A nil error means the
+// receiver accepted the batch. Failed requests are not retried.
+func (e *Exporter) Write(batch []*netflow.Flow) error {
+	body, err := json.Marshal(logsRequest(batch))
+	if err != nil {
+		return fmt.Errorf("unable to marshal OTLP request: %v", err)
+	}
+	if _, err := e.post(body); err != nil {
+		return err
+	}
+	atomic.AddUint64(&stats.GlobalStats.OTLPFlows, uint64(len(batch)))
+	return nil
+}
+
+// batcher collects flows from `Input` into batches. Once `Input` is closed the
+// remaining flows are queued and the sender stops after sending all batches.
+func (e *Exporter) batcher() {
+	batch := make([]*netflow.Flow, 0, e.batchSize)
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case fl, ok := <-e.Input:
+			if !ok {
+				if len(batch) > 0 {
+					e.batches <- batch
+				}
+				close(e.batches)
+				return
+			}
+			batch = append(batch, fl)
+			if len(batch) < e.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		select {
+		case e.batches <- batch:
+		default:
+			atomic.AddUint64(&stats.GlobalStats.OTLPDropped, uint64(len(batch)))
+			if debug.Level() > 0 {
+				glog.Warningf("OTLP send queue full, dropped %d flows", len(batch))
+			}
+		}
+		batch = make([]*netflow.Flow, 0, e.batchSize)
+	}
+}
+
+// sender sends queued batches to the receiver
+func (e *Exporter) sender() {
+	for batch := range e.batches {
+		body, err := json.Marshal(logsRequest(batch))
+		if err != nil {
+			glog.Errorf("unable to marshal OTLP request: %v", err)
+			continue
+		}
+
+		if err := e.send(body); err != nil {
+			glog.Errorf("unable to export %d flows via OTLP: %v", len(batch), err)
+			atomic.AddUint64(&stats.GlobalStats.OTLPDropped, uint64(len(batch)))
+			continue
+		}
+		atomic.AddUint64(&stats.GlobalStats.OTLPFlows, uint64(len(batch)))
+		for _, fl := range batch {
+			e.latency.Observe(fl.Received)
+		}
+	}
+}
+
+// send posts `body` to the receiver retrying with exponential backoff on transient errors
+func (e *Exporter) send(body []byte) error {
+	backoff := retryBackoff
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		if i > 0 {
+			atomic.AddUint64(&stats.GlobalStats.OTLPRetries, 1)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var retry bool
+		retry, err = e.post(body)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// post sends a single request. It returns whether a failed request is worth retrying.
+func (e *Exporter) post(body []byte) (bool, error) {
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return false, fmt.Errorf("unexpected status: %s", resp.Status)
+}
+
+// The following types represent the parts of the OTLP JSON encoding used by tflow2
+
+type anyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type logRecord struct {
+	TimeUnixNano         string     `json:"timeUnixNano"`
+	ObservedTimeUnixNano string     `json:"observedTimeUnixNano"`
+	SeverityText         string     `json:"severityText"`
+	Body                 anyValue   `json:"body"`
+	Attributes           []keyValue `json:"attributes"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type scopeLogs struct {
+	Scope      scope       `json:"scope"`
+	LogRecords []logRecord `json:"logRecords"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type resourceLogs struct {
+	Resource  resource    `json:"resource"`
+	ScopeLogs []scopeLogs `json:"scopeLogs"`
+}
+
+type exportLogsServiceRequest struct {
+	ResourceLogs []resourceLogs `json:"resourceLogs"`
+}
+
+// logsRequest converts a batch of flows into an OTLP export request
+func logsRequest(batch []*netflow.Flow) *exportLogsServiceRequest {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	records := make([]logRecord, 0, len(batch))
+	for _, fl := range batch {
+		records = append(records, logRecord{
+			TimeUnixNano:         strconv.FormatInt(fl.Timestamp*int64(time.Second), 10),
+			ObservedTimeUnixNano: now,
+			SeverityText:         "INFO",
+			Body:                 stringValue("flow"),
+			Attributes:           attributes(fl),
+		})
+	}
+
+	return &exportLogsServiceRequest{
+		ResourceLogs: []resourceLogs{
+			{
+				Resource: resource{
+					Attributes: []keyValue{
+						{Key: "service.name", Value: stringValue("tflow2")},
+					},
+				},
+				ScopeLogs: []scopeLogs{
+					{
+						Scope:      scope{Name: "github.com/google/tflow2"},
+						LogRecords: records,
+					},
+				},
+			},
+		},
+	}
+}
+
+// attributes builds the list of OTLP attributes describing `fl`
+func attributes(fl *netflow.Flow) []keyValue {
+	attrs := []keyValue{
+		{Key: "flow.router", Value: stringValue(net.IP(fl.Router).String())},
+		{Key: "source.address", Value: stringValue(net.IP(fl.SrcAddr).String())},
+		{Key: "source.port", Value: intValue(uint64(fl.SrcPort))},
+		{Key: "destination.address", Value: stringValue(net.IP(fl.DstAddr).String())},
+		{Key: "destination.port", Value: intValue(uint64(fl.DstPort))},
+		{Key: "flow.protocol", Value: intValue(uint64(fl.Protocol))},
+		{Key: "flow.family", Value: intValue(uint64(fl.Family))},
+		{Key: "flow.packets", Value: intValue(uint64(fl.Packets))},
+		{Key: "flow.bytes", Value: intValue(fl.Size)},
+		{Key: "flow.interface.in", Value: intValue(uint64(fl.IntIn))},
+		{Key: "flow.interface.out", Value: intValue(uint64(fl.IntOut))},
+		{Key: "flow.next_hop", Value: stringValue(net.IP(fl.NextHop).String())},
+		{Key: "flow.src_as", Value: intValue(uint64(fl.SrcAs))},
+		{Key: "flow.dst_as", Value: intValue(uint64(fl.DstAs))},
+		{Key: "flow.next_hop_as", Value: intValue(uint64(fl.NextHopAs))},
+		{Key: "flow.src_peer_as", Value: intValue(uint64(fl.SrcPeerAs))},
+		{Key: "flow.l2_segment.type", Value: intValue(uint64(fl.L2SegmentType))},
+		{Key: "flow.l2_segment.id", Value: intValue(fl.L2SegmentId)},
+		{Key: "flow.enrichments", Value: intValue(uint64(fl.Enrichments))},
+		{Key: "flow.ttl.min", Value: intValue(uint64(fl.MinTtl))},
+		{Key: "flow.ttl.max", Value: intValue(uint64(fl.MaxTtl))},
+		{Key: "flow.ttl.anomaly", Value: boolValue(fl.TtlAnomaly)},
+	}
+
+	if fl.CollectorId != "" {
+		attrs = append(attrs, keyValue{Key: "flow.collector_id", Value: stringValue(fl.CollectorId)})
+	}
+	if fl.IntInName != "" {
+		attrs = append(attrs, keyValue{Key: "flow.interface.in.name", Value: stringValue(fl.IntInName)})
+	}
+	if fl.IntOutName != "" {
+		attrs = append(attrs, keyValue{Key: "flow.interface.out.name", Value: stringValue(fl.IntOutName)})
+	}
+
+	if fl.IngressVrf != 0 {
+		attrs = append(attrs, keyValue{Key: "flow.vrf.in", Value: intValue(uint64(fl.IngressVrf))})
+	}
+	if fl.EgressVrf != 0 {
+		attrs = append(attrs, keyValue{Key: "flow.vrf.out", Value: intValue(uint64(fl.EgressVrf))})
+	}
+	if fl.Vlan != 0 {
+		attrs = append(attrs, keyValue{Key: "flow.vlan", Value: intValue(uint64(fl.Vlan))})
+	}
+
+	if fl.SrcCountry != "" {
+		attrs = append(attrs, keyValue{Key: "source.geo.country_iso_code", Value: stringValue(fl.SrcCountry)})
+	}
+	if fl.DstCountry != "" {
+		attrs = append(attrs, keyValue{Key: "destination.geo.country_iso_code", Value: stringValue(fl.DstCountry)})
+	}
+	if fl.SrcHost != "" {
+		attrs = append(attrs, keyValue{Key: "source.domain", Value: stringValue(fl.SrcHost)})
+	}
+	if fl.DstHost != "" {
+		attrs = append(attrs, keyValue{Key: "destination.domain", Value: stringValue(fl.DstHost)})
+	}
+
+	if fl.SamplingRate != 0 {
+		attrs = append(attrs, keyValue{Key: "flow.sampling_rate", Value: intValue(uint64(fl.SamplingRate))})
+	}
+
+	if fl.AsPathLength != 0 {
+		attrs = append(attrs, keyValue{Key: "flow.as_path_length", Value: intValue(uint64(fl.AsPathLength))})
+	}
+
+	if len(fl.BgpNextHop) > 0 {
+		attrs = append(attrs, keyValue{Key: "flow.bgp_next_hop", Value: stringValue(net.IP(fl.BgpNextHop).String())})
+	}
+
+	if fl.DroppedBytes != 0 || fl.DroppedPackets != 0 {
+		attrs = append(attrs,
+			keyValue{Key: "flow.dropped.bytes", Value: intValue(fl.DroppedBytes)},
+			keyValue{Key: "flow.dropped.packets", Value: intValue(fl.DroppedPackets)},
+		)
+	}
+	if fl.ForwardingStatus != 0 {
+		attrs = append(attrs, keyValue{Key: "flow.forwarding_status", Value: intValue(uint64(fl.ForwardingStatus))})
+	}
+
+	if fl.ApplicationName != "" {
+		attrs = append(attrs, keyValue{Key: "flow.application.name", Value: stringValue(fl.ApplicationName)})
+	}
+
+	if fl.HasDscp {
+		attrs = append(attrs, keyValue{Key: "flow.dscp", Value: intValue(uint64(fl.Dscp))})
+	}
+	if fl.HasPostDscp {
+		attrs = append(attrs, keyValue{Key: "flow.dscp.post", Value: intValue(uint64(fl.PostDscp))})
+	}
+
+	if len(fl.MplsLabels) > 0 {
+		labels := make([]string, 0, len(fl.MplsLabels))
+		for _, l := range fl.MplsLabels {
+			labels = append(labels, strconv.FormatUint(uint64(l), 10))
+		}
+		attrs = append(attrs, keyValue{Key: "flow.mpls.labels", Value: stringValue(strings.Join(labels, ","))})
+	}
+
+	for k, v := range fl.Labels {
+		attrs = append(attrs, keyValue{Key: "flow.label." + k, Value: stringValue(v)})
+	}
+	return attrs
+}
+
+func stringValue(s string) anyValue {
+	return anyValue{StringValue: &s}
+}
+
+func boolValue(b bool) anyValue {
+	return anyValue{BoolValue: &b}
+}
+
+// intValue encodes `i` as string as the OTLP JSON encoding requires for 64 bit integers
+func intValue(i uint64) anyValue {
+	s := strconv.FormatUint(i, 10)
+	return anyValue{IntValue: &s}
+}
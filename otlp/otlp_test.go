@@ -0,0 +1,84 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otlp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/tflow2/netflow"
+)
+
+func TestExport(t *testing.T) {
+	requests := make(chan *exportLogsServiceRequest, 2)
+	failed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != logsPath {
+			t.Errorf("Unexpected path %q", r.URL.Path)
+		}
+
+		// Fail the first request to exercise the retry logic
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		req := &exportLogsServiceRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Errorf("Unable to decode request: %v", err)
+		}
+		requests <- req
+	}))
+	defer srv.Close()
+
+	e := New(srv.URL, 2, time.Hour)
+	for i := 0; i < 2; i++ {
+		e.Input <- &netflow.Flow{
+			Router:    []byte{10, 0, 0, 1},
+			SrcAddr:   []byte{192, 0, 2, 1},
+			DstAddr:   []byte{192, 0, 2, 2},
+			Packets:   2,
+			Size:      1500,
+			Timestamp: 1500000000,
+		}
+	}
+
+	var req *exportLogsServiceRequest
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for export request")
+	}
+
+	records := req.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 log records, got %d", len(records))
+	}
+	if records[0].TimeUnixNano != "1500000000000000000" {
+		t.Errorf("Unexpected timestamp %s", records[0].TimeUnixNano)
+	}
+
+	attrs := make(map[string]anyValue)
+	for _, kv := range records[0].Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if v := attrs["source.address"]; v.StringValue == nil || *v.StringValue != "192.0.2.1" {
+		t.Errorf("Unexpected source.address %v", v)
+	}
+	if v := attrs["flow.bytes"]; v.IntValue == nil || *v.IntValue != "1500" {
+		t.Errorf("Unexpected flow.bytes %v", v)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package packet provides light weight parsing of sampled packet headers
+// as exported in PSAMP header sections (e.g. ipHeaderPacketSection and
+// dataLinkFrameSection). Sections are usually truncated, so parsing stops
+// gracefully at the end of the available data.
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+
+	protoTCP  = 6
+	protoUDP  = 17
+	protoSCTP = 132
+
+	tcpFlagSYN = 0x02
+
+	tcpOptEnd         = 0
+	tcpOptNOP         = 1
+	tcpOptMSS         = 2
+	tcpOptWindowScale = 3
+)
+
+// TCPInfo represents information taken from a sampled TCP header
+type TCPInfo struct {
+	// Window is the unscaled window size
+	Window uint16
+
+	// SYN is set if the segment is a SYN
+	SYN bool
+
+	// MSS is the maximum segment size option of a SYN, 0 if absent
+	MSS uint16
+
+	// WindowScale is the window scale option of a SYN, 0 if absent
+	WindowScale uint8
+}
+
+// Headers represents the headers decoded from a sampled packet
+type Headers struct {
+	// Family is the IP version, 4 or 6
+	Family int
+
+	SrcAddr net.IP
+	DstAddr net.IP
+
+	// Protocol is the IP protocol, or the IPv6 next header
+	Protocol uint8
+
+	// TTL is the time to live, or the IPv6 hop limit
+	TTL uint8
+
+	// Length is the length of the IP packet as given in its header
+	Length int
+
+	// SrcPort and DstPort are set for TCP, UDP and SCTP if the sampled
+	// header is long enough to carry them
+	SrcPort uint16
+	DstPort uint16
+
+	// TCP is nil unless the packet carries TCP and is not truncated before the TCP window
+	TCP *TCPInfo
+}
+
+// DecodeEthernet decodes the headers of an ethernet frame carrying an IP packet.
+// It returns nil if the frame does not carry IP or is truncated before the end
+// of the IP header.
+func DecodeEthernet(frame []byte) *Headers {
+	if len(frame) < 14 {
+		return nil
+	}
+
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	frame = frame[14:]
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+		if len(frame) < 4 {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(frame[2:4])
+		frame = frame[4:]
+	}
+
+	if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+		return nil
+	}
+	return DecodeIP(frame)
+}
+
+// DecodeIP decodes the headers of an IPv4 or IPv6 packet. It returns nil if the
+// packet is truncated before the end of the IP header. IPv6 extension headers
+// are not supported.
+func DecodeIP(pkt []byte) *Headers {
+	if len(pkt) < 1 {
+		return nil
+	}
+
+	h := &Headers{}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return nil
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return nil
+		}
+		h.Family = 4
+		h.Length = int(binary.BigEndian.Uint16(pkt[2:4]))
+		h.Protocol = pkt[9]
+		h.TTL = pkt[8]
+		h.SrcAddr = net.IP(append([]byte{}, pkt[12:16]...))
+		h.DstAddr = net.IP(append([]byte{}, pkt[16:20]...))
+		pkt = pkt[ihl:]
+	case 6:
+		if len(pkt) < 40 {
+			return nil
+		}
+		h.Family = 6
+		h.Length = int(binary.BigEndian.Uint16(pkt[4:6])) + 40
+		h.Protocol = pkt[6]
+		h.TTL = pkt[7]
+		h.SrcAddr = net.IP(append([]byte{}, pkt[8:24]...))
+		h.DstAddr = net.IP(append([]byte{}, pkt[24:40]...))
+		pkt = pkt[40:]
+	default:
+		return nil
+	}
+
+	switch h.Protocol {
+	case protoTCP, protoUDP, protoSCTP:
+		if len(pkt) >= 4 {
+			h.SrcPort = binary.BigEndian.Uint16(pkt[0:2])
+			h.DstPort = binary.BigEndian.Uint16(pkt[2:4])
+		}
+	}
+	if h.Protocol == protoTCP {
+		h.TCP = parseTCP(pkt)
+	}
+	return h
+}
+
+// parseTCP parses a TCP header and its options
+func parseTCP(seg []byte) *TCPInfo {
+	if len(seg) < 16 {
+		return nil
+	}
+
+	info := &TCPInfo{
+		Window: binary.BigEndian.Uint16(seg[14:16]),
+		SYN:    seg[13]&tcpFlagSYN != 0,
+	}
+
+	// Options are only of interest in SYNs
+	dataOffset := int(seg[12]>>4) * 4
+	if !info.SYN || dataOffset <= 20 || len(seg) <= 20 {
+		return info
+	}
+	if dataOffset < len(seg) {
+		seg = seg[:dataOffset]
+	}
+
+	opts := seg[20:]
+	for len(opts) > 0 {
+		kind := opts[0]
+		if kind == tcpOptEnd {
+			break
+		}
+		if kind == tcpOptNOP {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || len(opts) < int(opts[1]) {
+			break
+		}
+
+		switch {
+		case kind == tcpOptMSS && opts[1] == 4:
+			info.MSS = binary.BigEndian.Uint16(opts[2:4])
+		case kind == tcpOptWindowScale && opts[1] == 3:
+			info.WindowScale = opts[2]
+		}
+		opts = opts[opts[1]:]
+	}
+
+	return info
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package packet
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// synIPv4 is an IPv4 TCP SYN with MSS 1460, SACK permitted, timestamps, NOP and window scale 7
+var synIPv4 = []byte{
+	// IPv4 header
+	0x45, 0x00, 0x00, 0x3c, 0x1c, 0x46, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+	192, 0, 2, 1,
+	192, 0, 2, 2,
+	// TCP header
+	0xc3, 0x50, 0x00, 0x50, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+	0xa0, 0x02, 0xfa, 0xf0, 0x00, 0x00, 0x00, 0x00,
+	// Options
+	0x02, 0x04, 0x05, 0xb4,
+	0x04, 0x02,
+	0x08, 0x0a, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+	0x01,
+	0x03, 0x03, 0x07,
+}
+
+func TestDecodeTCP(t *testing.T) {
+	tests := []struct {
+		name     string
+		pkt      []byte
+		expected *TCPInfo
+	}{
+		{
+			name:     "SYN with options",
+			pkt:      synIPv4,
+			expected: &TCPInfo{Window: 64240, SYN: true, MSS: 1460, WindowScale: 7},
+		},
+		{
+			name:     "SYN truncated within options",
+			pkt:      synIPv4[:44],
+			expected: &TCPInfo{Window: 64240, SYN: true, MSS: 1460},
+		},
+		{
+			name:     "Truncated before TCP window",
+			pkt:      synIPv4[:30],
+			expected: nil,
+		},
+		{
+			name:     "UDP",
+			pkt:      append([]byte{0x45, 0, 0, 0, 0, 0, 0, 0, 0x40, 17}, make([]byte, 30)...),
+			expected: nil,
+		},
+	}
+
+	for _, test := range tests {
+		h := DecodeIP(test.pkt)
+		if h == nil {
+			t.Errorf("Test %q: Expected headers, got nil", test.name)
+			continue
+		}
+		if !reflect.DeepEqual(h.TCP, test.expected) {
+			t.Errorf("Test %q: Expected %+v, got %+v", test.name, test.expected, h.TCP)
+		}
+	}
+}
+
+func TestDecodeEthernet(t *testing.T) {
+	frame := []byte{
+		0, 1, 2, 3, 4, 5, 0, 1, 2, 3, 4, 6,
+		0x81, 0x00, 0x00, 0x64,
+		0x08, 0x00,
+	}
+	frame = append(frame, synIPv4...)
+
+	h := DecodeEthernet(frame)
+	if h == nil || h.TCP == nil || h.TCP.MSS != 1460 {
+		t.Errorf("Expected MSS 1460 from VLAN tagged frame, got %+v", h)
+	}
+}
+
+func TestDecodeIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		pkt      []byte
+		expected *Headers
+	}{
+		{
+			name: "TCP",
+			pkt:  synIPv4,
+			expected: &Headers{
+				Family:   4,
+				SrcAddr:  net.IP{192, 0, 2, 1},
+				DstAddr:  net.IP{192, 0, 2, 2},
+				Protocol: 6,
+				TTL:      64,
+				Length:   60,
+				SrcPort:  50000,
+				DstPort:  80,
+				TCP:      &TCPInfo{Window: 64240, SYN: true, MSS: 1460, WindowScale: 7},
+			},
+		},
+		{
+			name: "Truncated after ports",
+			pkt:  synIPv4[:24],
+			expected: &Headers{
+				Family:   4,
+				SrcAddr:  net.IP{192, 0, 2, 1},
+				DstAddr:  net.IP{192, 0, 2, 2},
+				Protocol: 6,
+				TTL:      64,
+				Length:   60,
+				SrcPort:  50000,
+				DstPort:  80,
+			},
+		},
+		{
+			name: "Truncated before ports",
+			pkt:  synIPv4[:22],
+			expected: &Headers{
+				Family:   4,
+				SrcAddr:  net.IP{192, 0, 2, 1},
+				DstAddr:  net.IP{192, 0, 2, 2},
+				Protocol: 6,
+				TTL:      64,
+				Length:   60,
+			},
+		},
+		{
+			name:     "Truncated IP header",
+			pkt:      synIPv4[:19],
+			expected: nil,
+		},
+	}
+
+	for _, test := range tests {
+		h := DecodeIP(test.pkt)
+		if !reflect.DeepEqual(h, test.expected) {
+			t.Errorf("Test %q: Expected %+v, got %+v", test.name, test.expected, h)
+		}
+	}
+}
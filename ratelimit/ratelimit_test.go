@@ -0,0 +1,44 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBurst(t *testing.T) {
+	b := New(1, 10)
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if b.Allow() {
+			allowed++
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("Expected 10 events to be allowed, got %d", allowed)
+	}
+}
+
+func TestRefill(t *testing.T) {
+	b := New(1000, 1)
+	b.Allow()
+	if b.Allow() {
+		t.Errorf("Expected bucket to be empty")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if !b.Allow() {
+		t.Errorf("Expected bucket to be refilled")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package recorder keeps the last raw datagrams received from each exporter, so
+// they can be downloaded to analyze compatibility problems offline
+package recorder
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ports used as UDP destination port of recorded datagrams in pcap files
+var ports = map[string]uint16{
+	"netflow": 2055,
+	"ipfix":   4739,
+}
+
+// Packet is a datagram received from an exporter
+type Packet struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"`
+	Data     []byte    `json:"data"`
+}
+
+// ring keeps the last packets of a single exporter
+type ring struct {
+	packets []Packet
+	next    int
+}
+
+// Recorder keeps the last packets received from each exporter. It is safe for concurrent use.
+type Recorder struct {
+	size      int
+	exporters map[string]*ring
+	lock      sync.Mutex
+}
+
+// New creates a new `Recorder` keeping the last `size` packets of each exporter
+func New(size int) *Recorder {
+	return &Recorder{
+		size:      size,
+		exporters: make(map[string]*ring),
+	}
+}
+
+// Record keeps a copy of `data` received from `exporter` via `protocol` ("netflow" or "ipfix")
+func (r *Recorder) Record(protocol string, exporter net.IP, data []byte) {
+	p := Packet{
+		Time:     time.Now(),
+		Protocol: protocol,
+		Data:     make([]byte, len(data)),
+	}
+	copy(p.Data, data)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	addr := exporter.String()
+	rg, ok := r.exporters[addr]
+	if !ok {
+		rg = &ring{packets: make([]Packet, 0, r.size)}
+		r.exporters[addr] = rg
+	}
+	if len(rg.packets) < r.size {
+		rg.packets = append(rg.packets, p)
+		return
+	}
+	rg.packets[rg.next] = p
+	rg.next = (rg.next + 1) % r.size
+}
+
+// Packets returns up to the last `n` packets of `exporter`, oldest first. All kept packets are returned if `n` is 0.
+func (r *Recorder) Packets(exporter string, n int) []Packet {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	rg, ok := r.exporters[exporter]
+	if !ok {
+		return nil
+	}
+	packets := make([]Packet, 0, len(rg.packets))
+	packets = append(packets, rg.packets[rg.next:]...)
+	packets = append(packets, rg.packets[:rg.next]...)
+	if n > 0 && n < len(packets) {
+		packets = packets[len(packets)-n:]
+	}
+	return packets
+}
+
+// ServeHTTP sends the packets of the exporter given by parameter `exporter`.
+// Parameter `n` limits the number of packets. Packets are sent as JSON unless
+// `format` is "pcap".
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ip := net.ParseIP(req.FormValue("exporter"))
+	if ip == nil {
+		http.Error(w, "Parameter exporter must be an IP address", http.StatusBadRequest)
+		return
+	}
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+
+	var n int
+	if v := req.FormValue("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("Invalid number of packets %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	packets := r.Packets(ip.String(), n)
+	if req.FormValue("format") == "pcap" {
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ip.String()+".pcap"))
+		writePcap(w, ip, packets)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(packets); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to marshal packets: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// linkTypeRaw is the pcap link type of packets starting with an IPv4 or IPv6 header
+const linkTypeRaw = 101
+
+// writePcap writes `packets` received from `exporter` as pcap file. Each packet
+// is wrapped into the UDP and IP headers it was received with.
+func writePcap(w io.Writer, exporter net.IP, packets []Packet) error {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	for _, p := range packets {
+		frame := encapsulate(exporter, ports[p.Protocol], p.Data)
+		rec := make([]byte, 16)
+		binary.LittleEndian.PutUint32(rec[0:], uint32(p.Time.Unix()))
+		binary.LittleEndian.PutUint32(rec[4:], uint32(p.Time.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(len(frame)))
+		if _, err := w.Write(rec); err != nil {
+			return err
+		}
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encapsulate prepends IP and UDP headers from `src` to port `port` to `data`.
+// The destination address is unspecified and the UDP checksum is left out.
+func encapsulate(src net.IP, port uint16, data []byte) []byte {
+	udp := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint16(udp[2:], port)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(data)))
+	udp = append(udp, data...)
+
+	if v4 := src.To4(); v4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:], v4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17
+	ip[7] = 64
+	copy(ip[8:], src.To16())
+	return append(ip, udp...)
+}
+
+// checksum computes the internet checksum of `b`
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
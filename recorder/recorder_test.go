@@ -0,0 +1,83 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	r := New(3)
+	exporter := net.IP{192, 0, 2, 1}
+	for i := byte(0); i < 5; i++ {
+		r.Record("ipfix", exporter, []byte{i})
+	}
+	r.Record("netflow", net.IP{192, 0, 2, 2}, []byte{42})
+
+	packets := r.Packets("192.0.2.1", 0)
+	if len(packets) != 3 {
+		t.Fatalf("Expected 3 packets, got %d", len(packets))
+	}
+	for i, p := range packets {
+		if p.Data[0] != byte(i+2) {
+			t.Errorf("Expected packet %d to be %d, got %d", i, i+2, p.Data[0])
+		}
+	}
+
+	if packets := r.Packets("192.0.2.1", 1); len(packets) != 1 || packets[0].Data[0] != 4 {
+		t.Errorf("Expected last packet only, got %v", packets)
+	}
+	if packets := r.Packets("192.0.2.3", 0); len(packets) != 0 {
+		t.Errorf("Expected no packets of unknown exporter, got %d", len(packets))
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := New(10)
+	data := []byte{0, 10, 0, 16, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	r.Record("ipfix", net.IP{192, 0, 2, 1}, data)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/packets?exporter=192.0.2.1", nil))
+	var packets []Packet
+	if err := json.Unmarshal(w.Body.Bytes(), &packets); err != nil {
+		t.Fatalf("Unable to unmarshal response: %v", err)
+	}
+	if len(packets) != 1 || !bytes.Equal(packets[0].Data, data) || packets[0].Protocol != "ipfix" {
+		t.Errorf("Unexpected packets %v", packets)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/packets?exporter=192.0.2.1&format=pcap", nil))
+	pcap := w.Body.Bytes()
+	if len(pcap) != 24+16+20+8+len(data) {
+		t.Fatalf("Unexpected pcap length %d", len(pcap))
+	}
+	frame := pcap[40:]
+	if !bytes.Equal(frame[12:16], []byte{192, 0, 2, 1}) || binary.BigEndian.Uint16(frame[22:]) != 4739 || !bytes.Equal(frame[28:], data) {
+		t.Errorf("Unexpected frame %v", frame)
+	}
+	if checksum(frame[:20]) != 0 {
+		t.Errorf("Invalid IPv4 header checksum")
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/packets?exporter=foo", nil))
+	if w.Code != 400 {
+		t.Errorf("Expected status 400 for invalid exporter, got %d", w.Code)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sink provides acknowledged, at-least-once delivery of flow batches
+// to sinks that can fail, e.g. message queues or databases
+package sink
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+var (
+	// retryBackoff is the time waited before the first retry of a batch. It doubles with every attempt.
+	retryBackoff = 500 * time.Millisecond
+
+	// maxRetryBackoff is the longest time waited between two attempts
+	maxRetryBackoff = 30 * time.Second
+)
+
+// Sink is implemented by destinations acknowledging the batches they receive
+type Sink interface {
+	// Write delivers `batch`. A nil error acknowledges that the batch was
+	// durably accepted, any other error makes the batch be retried.
+	Write(batch []*netflow.Flow) error
+}
+
+// Reliable batches flows and delivers them to a `Sink`. Batches are only
+// considered delivered once acknowledged by the sink. Failed batches are kept in
+// a bounded buffer and retried until they are acknowledged or have been tried
+// too often, in which case they are dead-lettered. If the buffer is full, flows
+// are not accepted until there is room again, so the collector is slowed down
+// rather than flows being lost.
+type Reliable struct {
+	name          string
+	sink          Sink
+	batchSize     int
+	flushInterval time.Duration
+	maxAttempts   int
+	deadLetter    string
+	batches       chan []*netflow.Flow
+	stats         *stats.SinkStats
+	latency       *stats.Histogram
+
+	// Input is the channel used to receive flows from the annotator layer
+	Input chan *netflow.Flow
+
+	// done is closed once all batches were delivered or dead-lettered after `Input` was closed
+	done chan struct{}
+}
+
+// NewReliable creates a new `Reliable` delivering batches of up to `batchSize`
+// flows to `s`, at least every `flushInterval`. Up to `bufferSize` batches are
+// kept for delivery. Batches not acknowledged after `maxAttempts` attempts are
+// written to directory `deadLetter`, or dropped if it is empty. `name` identifies
+// the sink in logs, statistics and dead-letter files.
+func NewReliable(name string, s Sink, batchSize int, flushInterval time.Duration, bufferSize int, maxAttempts int, deadLetter string) *Reliable {
+	r := &Reliable{
+		name:          name,
+		sink:          s,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		maxAttempts:   maxAttempts,
+		deadLetter:    deadLetter,
+		batches:       make(chan []*netflow.Flow, bufferSize),
+		stats:         stats.Sink(name),
+		latency:       stats.Latency(name),
+		Input:         make(chan *netflow.Flow, batchSize),
+		done:          make(chan struct{}),
+	}
+	go r.batcher()
+	go r.deliverer()
+	return r
+}
+
+// batcher collects flows from `Input` into batches and queues them for delivery.
+// Once `Input` is closed the remaining flows are queued and the queue is closed.
+func (r *Reliable) batcher() {
+	batch := make([]*netflow.Flow, 0, r.batchSize)
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case fl, ok := <-r.Input:
+			if !ok {
+				if len(batch) > 0 {
+					r.queue(batch)
+				}
+				close(r.batches)
+				return
+			}
+			batch = append(batch, fl)
+			if len(batch) < r.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		r.queue(batch)
+		batch = make([]*netflow.Flow, 0, r.batchSize)
+	}
+}
+
+// queue adds `batch` to the buffer, waiting for room if it is full
+func (r *Reliable) queue(batch []*netflow.Flow) {
+	atomic.AddInt64(&r.stats.Buffered, 1)
+	r.batches <- batch
+}
+
+// deliverer delivers queued batches in order. A batch is retried with
+// exponential backoff until it is acknowledged or dead-lettered, so later
+// batches wait for it.
+func (r *Reliable) deliverer() {
+	defer close(r.done)
+	for batch := range r.batches {
+		r.deliver(batch)
+		atomic.AddInt64(&r.stats.Buffered, -1)
+	}
+}
+
+// deliver writes `batch` to the sink until it is acknowledged or `maxAttempts` attempts failed
+func (r *Reliable) deliver(batch []*netflow.Flow) {
+	backoff := retryBackoff
+	var err error
+	for i := 0; i < r.maxAttempts; i++ {
+		if i > 0 {
+			atomic.AddUint64(&r.stats.Retries, 1)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+
+		if err = r.sink.Write(batch); err == nil {
+			atomic.AddUint64(&r.stats.Acked, uint64(len(batch)))
+			for _, fl := range batch {
+				r.latency.Observe(fl.Received)
+			}
+			return
+		}
+		if debug.Level() > 0 {
+			glog.Warningf("%s: attempt %d to deliver %d flows failed: %v", r.name, i+1, len(batch), err)
+		}
+	}
+
+	glog.Errorf("%s: giving up delivering %d flows after %d attempts: %v", r.name, len(batch), r.maxAttempts, err)
+	atomic.AddUint64(&r.stats.DeadLettered, uint64(len(batch)))
+	if r.deadLetter == "" {
+		return
+	}
+	if err := r.writeDeadLetter(batch); err != nil {
+		glog.Errorf("%s: unable to dead-letter %d flows: %v", r.name, len(batch), err)
+	}
+}
+
+// writeDeadLetter writes `batch` to a file in the dead-letter directory. Files
+// use the format of the files written by the flow database, so they can be
+// inspected and replayed with the same tools.
+func (r *Reliable) writeDeadLetter(batch []*netflow.Flow) error {
+	buffer, err := proto.Marshal(&netflow.Flows{Flows: batch})
+	if err != nil {
+		return fmt.Errorf("unable to marshal flows into pb: %v", err)
+	}
+
+	fh, err := os.Create(fmt.Sprintf("%s/%s-%d.tflow2.pb.gzip", r.deadLetter, r.name, time.Now().UnixNano()))
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	gz := gzip.NewWriter(fh)
+	if _, err := gz.Write(buffer); err != nil {
+		return err
+	}
+	return gz.Close()
+}
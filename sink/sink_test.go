@@ -0,0 +1,140 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/tflow2/netflow"
+)
+
+// flakySink fails the first `failures` writes and records acknowledged batches
+type flakySink struct {
+	failures int
+	writes   int
+	acked    [][]*netflow.Flow
+	lock     sync.Mutex
+}
+
+func (s *flakySink) Write(batch []*netflow.Flow) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.writes++
+	if s.writes <= s.failures {
+		return fmt.Errorf("write %d failed", s.writes)
+	}
+	s.acked = append(s.acked, batch)
+	return nil
+}
+
+func init() {
+	retryBackoff = time.Millisecond
+}
+
+func TestReliable(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		acked        int
+		deadLettered int
+	}{
+		{
+			name:  "No failures",
+			acked: 2,
+		},
+		{
+			name:     "Retried",
+			failures: 2,
+			acked:    2,
+		},
+		{
+			name:         "Dead-lettered",
+			failures:     3,
+			acked:        1,
+			deadLettered: 1,
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "tflow2-sink")
+		if err != nil {
+			t.Fatalf("Unable to create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		s := &flakySink{failures: test.failures}
+		r := NewReliable("test", s, 2, time.Hour, 4, 3, dir)
+		for i := 0; i < 4; i++ {
+			r.Input <- &netflow.Flow{Packets: uint32(i)}
+		}
+		close(r.Input)
+
+		select {
+		case <-r.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: Timeout waiting for delivery", test.name)
+		}
+
+		if len(s.acked) != test.acked {
+			t.Errorf("%s: Expected %d acknowledged batches, got %d", test.name, test.acked, len(s.acked))
+		}
+
+		files, err := filepath.Glob(filepath.Join(dir, "test-*.tflow2.pb.gzip"))
+		if err != nil {
+			t.Fatalf("%s: Unable to list dead-letter files: %v", test.name, err)
+		}
+		if len(files) != test.deadLettered {
+			t.Fatalf("%s: Expected %d dead-letter files, got %d", test.name, test.deadLettered, len(files))
+		}
+		if len(files) == 0 {
+			continue
+		}
+
+		flows := readFlows(t, files[0])
+		if len(flows.Flows) != 2 || flows.Flows[0].Packets != 0 || flows.Flows[1].Packets != 1 {
+			t.Errorf("%s: Unexpected dead-lettered flows %v", test.name, flows.Flows)
+		}
+	}
+}
+
+// readFlows reads the flows in dead-letter file `path`
+func readFlows(t *testing.T, path string) *netflow.Flows {
+	fh, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unable to open %s: %v", path, err)
+	}
+	defer fh.Close()
+
+	gz, err := gzip.NewReader(fh)
+	if err != nil {
+		t.Fatalf("Unable to read %s: %v", path, err)
+	}
+	buffer, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Unable to read %s: %v", path, err)
+	}
+
+	flows := &netflow.Flows{}
+	if err := proto.Unmarshal(buffer, flows); err != nil {
+		t.Fatalf("Unable to unmarshal %s: %v", path, err)
+	}
+	return flows
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histogram buckets.
+// They reach up to several minutes as flows may be held back for coalescing.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600}
+
+// Histogram counts flow latencies in `latencyBuckets`. It is safe for concurrent use.
+type Histogram struct {
+	// counts holds the number of observations per bucket, the last one being +Inf
+	counts   []uint64
+	count    uint64
+	sumNanos uint64
+}
+
+// newHistogram creates an empty `Histogram`
+func newHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+// Observe records the latency of a flow received at `received` (unix nanoseconds)
+// and delivered now. Flows without receive time are ignored.
+func (h *Histogram) Observe(received int64) {
+	if received == 0 {
+		return
+	}
+	h.observe(time.Duration(time.Now().UnixNano() - received))
+}
+
+// observe records latency `d`
+func (h *Histogram) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sumNanos, uint64(d))
+}
+
+// latencies keeps a `Histogram` for each sink, keyed by name
+var latencies = struct {
+	sinks map[string]*Histogram
+	lock  sync.Mutex
+}{sinks: make(map[string]*Histogram)}
+
+// Latency returns the latency `Histogram` of sink `name`. It is created if it
+// doesn't exist yet. Callers on the hot path should keep the result.
+func Latency(name string) *Histogram {
+	latencies.lock.Lock()
+	defer latencies.lock.Unlock()
+
+	h, ok := latencies.sinks[name]
+	if !ok {
+		h = newHistogram()
+		latencies.sinks[name] = h
+	}
+	return h
+}
+
+// sortedLatencyNames returns the names of the sinks latencies are kept for in
+// alphabetical order. `latencies.lock` must be held.
+func sortedLatencyNames() []string {
+	names := make([]string, 0, len(latencies.sinks))
+	for name := range latencies.sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// varzLatencies sends the latency histograms to a client in the format of Prometheus histograms
+func varzLatencies(w http.ResponseWriter) {
+	latencies.lock.Lock()
+	defer latencies.lock.Unlock()
+
+	for _, name := range sortedLatencyNames() {
+		h := latencies.sinks[name]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			fmt.Fprintf(w, "netflow_collector_flow_latency_seconds_bucket{sink=\"%s\",le=\"%g\"} %d\n", name, le, cumulative)
+		}
+		cumulative += atomic.LoadUint64(&h.counts[len(latencyBuckets)])
+		fmt.Fprintf(w, "netflow_collector_flow_latency_seconds_bucket{sink=\"%s\",le=\"+Inf\"} %d\n", name, cumulative)
+		fmt.Fprintf(w, "netflow_collector_flow_latency_seconds_sum{sink=\"%s\"} %.6f\n", name, float64(atomic.LoadUint64(&h.sumNanos))/float64(time.Second))
+		fmt.Fprintf(w, "netflow_collector_flow_latency_seconds_count{sink=\"%s\"} %d\n", name, atomic.LoadUint64(&h.count))
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatency(t *testing.T) {
+	h := Latency("test")
+	h.observe(500 * time.Microsecond)
+	h.observe(time.Millisecond)
+	h.observe(2 * time.Second)
+	h.observe(time.Hour)
+	h.Observe(0)
+
+	rec := httptest.NewRecorder()
+	varzLatencies(rec)
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		`netflow_collector_flow_latency_seconds_bucket{sink="test",le="0.001"} 2`,
+		`netflow_collector_flow_latency_seconds_bucket{sink="test",le="1"} 2`,
+		`netflow_collector_flow_latency_seconds_bucket{sink="test",le="5"} 3`,
+		`netflow_collector_flow_latency_seconds_bucket{sink="test",le="600"} 3`,
+		`netflow_collector_flow_latency_seconds_bucket{sink="test",le="+Inf"} 4`,
+		`netflow_collector_flow_latency_seconds_sum{sink="test"} 3602.001500`,
+		`netflow_collector_flow_latency_seconds_count{sink="test"} 4`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// promCounter is a counter of `GlobalStats` exported to Prometheus
+type promCounter struct {
+	name  string
+	help  string
+	value *uint64
+}
+
+// promCounters are the counters of `GlobalStats` exported to Prometheus, in order
+var promCounters = []promCounter{
+	{"tflow2_queries_total", "Queries served by the web interface.", &GlobalStats.Queries},
+	{"tflow2_bird_cache_hits_total", "BIRD lookups answered from the cache.", &GlobalStats.BirdCacheHits},
+	{"tflow2_bird_cache_misses_total", "BIRD lookups not answered from the cache.", &GlobalStats.BirdCacheMiss},
+	{"tflow2_cymru_cache_hits_total", "Team Cymru ASN lookups answered from the cache.", &GlobalStats.CymruCacheHits},
+	{"tflow2_cymru_cache_misses_total", "Team Cymru ASN lookups not answered from the cache.", &GlobalStats.CymruCacheMiss},
+	{"tflow2_cymru_errors_total", "Team Cymru ASN lookups failed.", &GlobalStats.CymruErrors},
+	{"tflow2_geoip_errors_total", "GeoIP database lookups failed.", &GlobalStats.GeoIPErrors},
+	{"tflow2_snmp_queries_total", "SNMP interface name queries sent.", &GlobalStats.SNMPQueries},
+	{"tflow2_snmp_errors_total", "SNMP interface name queries failed.", &GlobalStats.SNMPErrors},
+	{"tflow2_rdns_cache_hits_total", "Reverse DNS lookups answered from the cache.", &GlobalStats.RDNSCacheHits},
+	{"tflow2_rdns_cache_misses_total", "Reverse DNS lookups not answered from the cache.", &GlobalStats.RDNSCacheMiss},
+	{"tflow2_rdns_errors_total", "Reverse DNS lookups failed.", &GlobalStats.RDNSErrors},
+	{"tflow2_coalesced_flows_total", "Flows merged into another flow by coalescing.", &GlobalStats.CoalescedFlows},
+	{"tflow2_coalesce_evictions_total", "Coalesced flows stored early as the coalescing table was full.", &GlobalStats.CoalesceEvictions},
+	{"tflow2_coalesce_ended_total", "Coalesced flows stored early as the flow ended.", &GlobalStats.CoalesceEnded},
+	{"tflow2_flow_packets_total", "Packets carried by the flows decoded.", &GlobalStats.FlowPackets},
+	{"tflow2_flow_bytes_total", "Bytes carried by the flows decoded.", &GlobalStats.FlowBytes},
+	{"tflow2_netflow9_packets_total", "NetFlow v9 packets received.", &GlobalStats.Netflow9packets},
+	{"tflow2_netflow9_bytes_total", "Bytes of NetFlow v9 packets received.", &GlobalStats.Netflow9bytes},
+	{"tflow2_ipfix_packets_total", "IPFIX messages received.", &GlobalStats.IPFIXpackets},
+	{"tflow2_ipfix_bytes_total", "Bytes of IPFIX messages received.", &GlobalStats.IPFIXbytes},
+	{"tflow2_ipfix_http_requests_total", "HTTP requests POSTing IPFIX messages received.", &GlobalStats.IPFIXHTTPRequests},
+	{"tflow2_ipfix_http_messages_total", "IPFIX messages received via HTTP.", &GlobalStats.IPFIXHTTPMessages},
+	{"tflow2_ipfix_export_flows_total", "Flows re-exported via IPFIX.", &GlobalStats.IPFIXExportFlows},
+	{"tflow2_ipfix_export_messages_total", "IPFIX messages re-exported.", &GlobalStats.IPFIXExportMessages},
+	{"tflow2_ipfix_export_errors_total", "IPFIX messages failed to re-export.", &GlobalStats.IPFIXExportErrors},
+	{"tflow2_enrich_cache_hits_total", "Enrichment lookups answered from the cache.", &GlobalStats.EnrichCacheHits},
+	{"tflow2_enrich_cache_misses_total", "Enrichment lookups not answered from the cache.", &GlobalStats.EnrichCacheMiss},
+	{"tflow2_enrich_dropped_total", "Enrichment lookups dropped as the queue was full.", &GlobalStats.EnrichDropped},
+	{"tflow2_enrich_errors_total", "Enrichment requests failed.", &GlobalStats.EnrichErrors},
+	{"tflow2_annotated_flows_total", "Flows passed through the annotator.", &GlobalStats.AnnotatedFlows},
+	{"tflow2_annotated_prefixes_total", "Flows annotated with source and destination prefix.", &GlobalStats.AnnotatedPrefixes},
+	{"tflow2_annotated_asns_total", "Flows annotated with source and destination ASN.", &GlobalStats.AnnotatedASNs},
+	{"tflow2_annotated_attributes_total", "Flows annotated by the enrichment service.", &GlobalStats.AnnotatedAttributes},
+	{"tflow2_annotated_complete_total", "Flows all built in annotations succeeded for.", &GlobalStats.AnnotatedComplete},
+	{"tflow2_ttl_anomalies_total", "Flows flagged for a TTL unusual for their source.", &GlobalStats.TTLAnomalies},
+	{"tflow2_otlp_flows_total", "Flows exported via OTLP.", &GlobalStats.OTLPFlows},
+	{"tflow2_otlp_retries_total", "OTLP export requests retried.", &GlobalStats.OTLPRetries},
+	{"tflow2_otlp_dropped_total", "Flows dropped by the OTLP exporter.", &GlobalStats.OTLPDropped},
+	{"tflow2_rate_limited_total", "Flows dropped exceeding the flow rate limit.", &GlobalStats.RateLimited},
+	{"tflow2_output_dropped_total", "Flows dropped as the annotator didn't take them in time.", &GlobalStats.OutputDropped},
+	{"tflow2_reboots_total", "Reboots detected of all routers.", &GlobalStats.Reboots},
+	{"tflow2_flow_rate_regressions_total", "Flow rate regressions detected of all routers.", &GlobalStats.FlowRateRegressions},
+	{"tflow2_sequence_lost_total", "Records or packets missing by sequence numbers of all routers.", &GlobalStats.SequenceLost},
+	{"tflow2_invalid_dropped_total", "Flows dropped violating validation rules.", &GlobalStats.InvalidDropped},
+	{"tflow2_empty_dropped_total", "Flows dropped without packets and bytes.", &GlobalStats.EmptyDropped},
+	{"tflow2_elephant_flows_total", "Elephant flows detected.", &GlobalStats.ElephantFlows},
+	{"tflow2_subscribe_flows_total", "Flows sent to gRPC subscribers.", &GlobalStats.SubscribeFlows},
+	{"tflow2_subscribe_dropped_total", "Flows dropped for gRPC subscribers falling behind.", &GlobalStats.SubscribeDropped},
+	{"tflow2_db_evicted_flows_total", "Flows evicted from memory to stay within the flow limit.", &GlobalStats.DBEvictedFlows},
+	{"tflow2_templates_expired_total", "Templates expired as their exporter didn't resend them.", &GlobalStats.TemplatesExpired},
+	{"tflow2_templates_invalid_total", "Templates received or imported that were skipped as their records can't be decoded.", &GlobalStats.TemplatesInvalid},
+	{"tflow2_template_misses_total", "Flowsets skipped as their template was unknown.", &GlobalStats.TemplateMisses},
+	{"tflow2_unknown_family_dropped_total", "Flows dropped of an unknown address family.", &GlobalStats.DroppedUnknownFamily},
+	{"tflow2_packet_panics_total", "Packets whose processing panicked.", &GlobalStats.PacketPanics},
+}
+
+// routerMetric is a per router metric exported to Prometheus
+type routerMetric struct {
+	name  string
+	typ   string
+	help  string
+	value func(rs *RouterStats, now int64) float64
+}
+
+// routerMetrics are the per router metrics exported to Prometheus, in order.
+// Flow end reasons are exported separately as they carry a further label.
+var routerMetrics = []routerMetric{
+	{"tflow2_router_packets_total", "counter", "Export packets (IPFIX messages) received from the router.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.Packets))
+	}},
+	{"tflow2_router_bytes_total", "counter", "Bytes of export packets received from the router.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.Bytes))
+	}},
+	{"tflow2_router_decode_errors_total", "counter", "Packets of the router failed to decode.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.DecodeErrors))
+	}},
+	{"tflow2_router_flows_total", "counter", "Flows decoded from the routers packets.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.Flows))
+	}},
+	{"tflow2_router_templates", "gauge", "Templates of the router cached.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadInt64(&rs.Templates))
+	}},
+	{"tflow2_router_template_misses_total", "counter", "Flowsets of the router skipped as their template was unknown.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.MissingTemplates))
+	}},
+	{"tflow2_router_last_packet_timestamp_seconds", "gauge", "Unix time the last packet of the router was received at.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadInt64(&rs.lastPacket))
+	}},
+	{"tflow2_router_queue_depth", "gauge", "Packets of the router waiting to be decoded.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.QueueDepth))
+	}},
+	{"tflow2_router_queue_drops_total", "counter", "Packets of the router dropped as its decode queue was full.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.QueueDrops))
+	}},
+	{"tflow2_router_selector_mismatches_total", "counter", "Records of the router with differing selector algorithms.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.SelectorMismatches))
+	}},
+	{"tflow2_router_reboots_total", "counter", "Reboots of the router detected.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.Reboots))
+	}},
+	{"tflow2_router_interface_remaps_total", "counter", "Interfaces of the router announced under a different index or name.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.InterfaceRemaps))
+	}},
+	{"tflow2_router_sequence_lost_total", "counter", "Records or packets of the router missing by sequence numbers.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.SequenceLost))
+	}},
+	{"tflow2_router_packet_rate", "gauge", "Current rate of export packets of the router per second.", func(rs *RouterStats, now int64) float64 {
+		pps, _, _ := rs.rates.rates(now)
+		return pps
+	}},
+	{"tflow2_router_flow_rate", "gauge", "Current rate of flows of the router per second.", func(rs *RouterStats, now int64) float64 {
+		_, fps, _ := rs.rates.rates(now)
+		return fps
+	}},
+	{"tflow2_router_bit_rate", "gauge", "Current rate of bits carried by flows of the router per second.", func(rs *RouterStats, now int64) float64 {
+		_, _, bps := rs.rates.rates(now)
+		return bps
+	}},
+	{"tflow2_router_flow_rate_baseline", "gauge", "Usual flow rate of the router per second.", func(rs *RouterStats, now int64) float64 {
+		baseline, _ := rs.baseline.state()
+		return baseline
+	}},
+	{"tflow2_router_flow_rate_regressed", "gauge", "1 while the flow rate of the router deviates from its baseline.", func(rs *RouterStats, now int64) float64 {
+		if _, regressed := rs.baseline.state(); regressed {
+			return 1
+		}
+		return 0
+	}},
+	{"tflow2_router_flow_rate_regressions_total", "counter", "Times the flow rate of the router started deviating from its baseline.", func(rs *RouterStats, now int64) float64 {
+		return float64(atomic.LoadUint64(&rs.FlowRateRegressions))
+	}},
+}
+
+// PrometheusHandler returns a handler serving the statistics to Prometheus
+// scrapers, in the text exposition format with types and help texts. Counters
+// are read on each request. The format is written directly rather than via the
+// client_golang registry, which isn't among the dependencies of tflow2.
+func PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w)
+	})
+}
+
+// labelEscaper escapes label values as the text exposition format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promWriter writes metrics in the Prometheus text exposition format
+type promWriter struct {
+	w io.Writer
+}
+
+// family starts metric family `name` of type `typ`
+func (p promWriter) family(name string, typ string, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes value `v` of `name`, labeled by `labels` given as name, value pairs
+func (p promWriter) sample(name string, v float64, labels ...string) {
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+		}
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(p.w, "%s %s\n", name, strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+// metric writes family `name` consisting of a single unlabeled sample `v`
+func (p promWriter) metric(name string, typ string, help string, v float64) {
+	p.family(name, typ, help)
+	p.sample(name, v)
+}
+
+// writePrometheus writes all statistics to `w` in the Prometheus text exposition format
+func writePrometheus(w io.Writer) {
+	p := promWriter{w: w}
+	now := time.Now().Unix()
+
+	p.metric("tflow2_uptime_seconds", "gauge", "Time since the collector started.", float64(now-GlobalStats.StartTime))
+	p.family("tflow2_flows_total", "counter", "Flows decoded, by address family.")
+	p.sample("tflow2_flows_total", float64(atomic.LoadUint64(&GlobalStats.Flows4)), "family", "4")
+	p.sample("tflow2_flows_total", float64(atomic.LoadUint64(&GlobalStats.Flows6)), "family", "6")
+	for _, c := range promCounters {
+		p.metric(c.name, "counter", c.help, float64(atomic.LoadUint64(c.value)))
+	}
+
+	p.metric("tflow2_subscribers", "gauge", "gRPC subscribers connected.", float64(atomic.LoadInt64(&GlobalStats.Subscribers)))
+	p.metric("tflow2_db_flows", "gauge", "Flows kept in memory.", float64(atomic.LoadInt64(&GlobalStats.DBFlows)))
+	var retention int64
+	if oldest := atomic.LoadInt64(&GlobalStats.DBOldest); oldest != 0 {
+		retention = now - oldest
+	}
+	p.metric("tflow2_db_retention_seconds", "gauge", "Age of the oldest flow kept in memory.", float64(retention))
+	p.metric("tflow2_sequence_streams", "gauge", "Sequence number streams tracked.", float64(sequences.next.Len()))
+
+	p.promDecodeErrors()
+	p.promAnnotatorInputs()
+	p.promWorkers()
+	p.promSinks()
+	p.promLatencies()
+	p.promRouters(now)
+	p.promSockets()
+}
+
+// promDecodeErrors writes the decode error and invalid flow counters
+func (p promWriter) promDecodeErrors() {
+	decodeErrors.lock.Lock()
+	p.family("tflow2_decode_errors_total", "counter", "Packets failed to decode, by protocol and reason.")
+	for _, k := range sortedErrorKeys(decodeErrors.counts) {
+		p.sample("tflow2_decode_errors_total", float64(decodeErrors.counts[k]), "protocol", k.protocol, "reason", k.category)
+	}
+	decodeErrors.lock.Unlock()
+
+	invalidFlows.lock.Lock()
+	p.family("tflow2_invalid_flows_total", "counter", "Flows violating validation rules, by protocol and rule.")
+	for _, k := range sortedErrorKeys(invalidFlows.counts) {
+		p.sample("tflow2_invalid_flows_total", float64(invalidFlows.counts[k]), "protocol", k.protocol, "rule", k.category)
+	}
+	invalidFlows.lock.Unlock()
+}
+
+// promAnnotatorInputs writes the per input statistics of the annotator
+func (p promWriter) promAnnotatorInputs() {
+	annotatorInputs.lock.Lock()
+	defer annotatorInputs.lock.Unlock()
+
+	p.family("tflow2_annotator_input_flows_total", "counter", "Flows received by the annotator, by input.")
+	for i, in := range annotatorInputs.inputs {
+		p.sample("tflow2_annotator_input_flows_total", float64(atomic.LoadUint64(&in.Flows)), "input", strconv.Itoa(i))
+	}
+	p.family("tflow2_annotator_input_queue_depth", "gauge", "Flows waiting for the annotator, by input.")
+	for i, in := range annotatorInputs.inputs {
+		p.sample("tflow2_annotator_input_queue_depth", float64(atomic.LoadUint64(&in.QueueDepth)), "input", strconv.Itoa(i))
+	}
+	p.family("tflow2_annotator_input_blocked_seconds_total", "counter", "Time flows waited for a free annotator worker, by input.")
+	for i, in := range annotatorInputs.inputs {
+		p.sample("tflow2_annotator_input_blocked_seconds_total", float64(atomic.LoadUint64(&in.BlockedNanos))/float64(time.Second), "input", strconv.Itoa(i))
+	}
+}
+
+// promWorkers writes the per worker statistics of the decoders
+func (p promWriter) promWorkers() {
+	workers.lock.Lock()
+	defer workers.lock.Unlock()
+
+	keys := sortedWorkerKeys()
+	p.family("tflow2_worker_packets_total", "counter", "Packets decoded, by protocol and worker.")
+	for _, k := range keys {
+		p.sample("tflow2_worker_packets_total", float64(atomic.LoadUint64(&workers.workers[k].Packets)), "protocol", k.protocol, "worker", strconv.Itoa(k.worker))
+	}
+	p.family("tflow2_worker_flows_total", "counter", "Flows decoded, by protocol and worker.")
+	for _, k := range keys {
+		p.sample("tflow2_worker_flows_total", float64(atomic.LoadUint64(&workers.workers[k].Flows)), "protocol", k.protocol, "worker", strconv.Itoa(k.worker))
+	}
+}
+
+// promSinks writes the statistics of sinks with acknowledged delivery
+func (p promWriter) promSinks() {
+	sinks.lock.Lock()
+	defer sinks.lock.Unlock()
+
+	names := sortedSinkNames()
+	p.family("tflow2_sink_acked_total", "counter", "Flows acknowledged, by sink.")
+	for _, name := range names {
+		p.sample("tflow2_sink_acked_total", float64(atomic.LoadUint64(&sinks.sinks[name].Acked)), "sink", name)
+	}
+	p.family("tflow2_sink_retries_total", "counter", "Batches delivered again after failing, by sink.")
+	for _, name := range names {
+		p.sample("tflow2_sink_retries_total", float64(atomic.LoadUint64(&sinks.sinks[name].Retries)), "sink", name)
+	}
+	p.family("tflow2_sink_dead_lettered_total", "counter", "Flows given up on after too many failed attempts, by sink.")
+	for _, name := range names {
+		p.sample("tflow2_sink_dead_lettered_total", float64(atomic.LoadUint64(&sinks.sinks[name].DeadLettered)), "sink", name)
+	}
+	p.family("tflow2_sink_buffered_batches", "gauge", "Batches waiting for delivery, by sink.")
+	for _, name := range names {
+		p.sample("tflow2_sink_buffered_batches", float64(atomic.LoadInt64(&sinks.sinks[name].Buffered)), "sink", name)
+	}
+}
+
+// promLatencies writes the latency histograms of the sinks
+func (p promWriter) promLatencies() {
+	latencies.lock.Lock()
+	defer latencies.lock.Unlock()
+
+	p.family("tflow2_flow_latency_seconds", "histogram", "Time from decoding flows to their delivery, by sink.")
+	for _, name := range sortedLatencyNames() {
+		h := latencies.sinks[name]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			p.sample("tflow2_flow_latency_seconds_bucket", float64(cumulative), "sink", name, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		cumulative += atomic.LoadUint64(&h.counts[len(latencyBuckets)])
+		p.sample("tflow2_flow_latency_seconds_bucket", float64(cumulative), "sink", name, "le", "+Inf")
+		p.sample("tflow2_flow_latency_seconds_sum", float64(atomic.LoadUint64(&h.sumNanos))/float64(time.Second), "sink", name)
+		p.sample("tflow2_flow_latency_seconds_count", float64(atomic.LoadUint64(&h.count)), "sink", name)
+	}
+}
+
+// promRouters writes the per router statistics
+func (p promWriter) promRouters(now int64) {
+	routerStats.lock.RLock()
+	defer routerStats.lock.RUnlock()
+
+	rtrs := make([]string, 0, len(routerStats.routers))
+	var templates int64
+	for rtr, rs := range routerStats.routers {
+		rtrs = append(rtrs, rtr)
+		templates += atomic.LoadInt64(&rs.Templates)
+	}
+	sort.Strings(rtrs)
+	p.metric("tflow2_templates", "gauge", "Templates cached of all routers.", float64(templates))
+
+	for _, m := range routerMetrics {
+		p.family(m.name, m.typ, m.help)
+		for _, rtr := range rtrs {
+			p.sample(m.name, m.value(routerStats.routers[rtr], now), "router", rtr)
+		}
+	}
+
+	p.family("tflow2_router_flow_end_reasons_total", "counter", "Flows of the router by flowEndReason.")
+	for _, rtr := range rtrs {
+		rs := routerStats.routers[rtr]
+		for reason, name := range endReasonNames {
+			p.sample("tflow2_router_flow_end_reasons_total", float64(atomic.LoadUint64(&rs.FlowEndReasons[reason])), "router", rtr, "reason", name)
+		}
+	}
+}
+
+// promSockets writes the datagrams dropped by the kernel for each registered socket
+func (p promWriter) promSockets() {
+	sockets.lock.Lock()
+	defer sockets.lock.Unlock()
+
+	p.family("tflow2_socket_drops_total", "counter", "Datagrams dropped by the kernel as the receive buffer was full, by socket.")
+	for _, name := range sortedSocketNames() {
+		if drops, ok := udpDrops(sockets.ports[name]); ok {
+			p.sample("tflow2_socket_drops_total", float64(drops), "socket", name)
+		}
+	}
+}
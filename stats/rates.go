@@ -0,0 +1,81 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"sync"
+)
+
+// rateSlots is the number of one second slots current rates are computed over
+const rateSlots = 60
+
+// rateSlot holds the counts of a single second
+type rateSlot struct {
+	second  int64
+	packets uint64
+	flows   uint64
+	bytes   uint64
+}
+
+// rateWindow is a ring of per second counts used to compute rates over a
+// sliding window. Its size is fixed, so memory is bound by the number of routers.
+type rateWindow struct {
+	slots     [rateSlots]rateSlot
+	firstSeen int64
+	lock      sync.Mutex
+}
+
+// add adds counts to the slot of second `now`
+func (w *rateWindow) add(now int64, packets uint64, flows uint64, bytes uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.firstSeen == 0 {
+		w.firstSeen = now
+	}
+	s := &w.slots[now%rateSlots]
+	if s.second != now {
+		*s = rateSlot{second: now}
+	}
+	s.packets += packets
+	s.flows += flows
+	s.bytes += bytes
+}
+
+// rates returns packets, flows and bits per second over the completed seconds
+// of the window before `now`
+func (w *rateWindow) rates(now int64) (pps float64, fps float64, bps float64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.firstSeen == 0 || now <= w.firstSeen {
+		return 0, 0, 0
+	}
+
+	var packets, flows, bytes uint64
+	for _, s := range w.slots {
+		if s.second < now-rateSlots || s.second >= now {
+			continue
+		}
+		packets += s.packets
+		flows += s.flows
+		bytes += s.bytes
+	}
+
+	// Routers seen for less than a full window are averaged over the time they were seen
+	seconds := now - w.firstSeen
+	if seconds > rateSlots {
+		seconds = rateSlots
+	}
+	d := float64(seconds)
+	return float64(packets) / d, float64(flows) / d, float64(bytes) * 8 / d
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import "testing"
+
+func TestRateWindow(t *testing.T) {
+	var w rateWindow
+	start := int64(1500000000)
+
+	// 10 packets carrying 20 flows of 100 bytes per second for two windows
+	for now := start; now < start+2*rateSlots; now++ {
+		w.add(now, 10, 20, 2000)
+	}
+
+	pps, fps, bps := w.rates(start + 2*rateSlots)
+	if pps != 10 || fps != 20 || bps != 16000 {
+		t.Errorf("Expected 10 pps, 20 fps and 16000 bps, got %v, %v and %v", pps, fps, bps)
+	}
+
+	// Rates decay once the router stops sending
+	pps, _, _ = w.rates(start + 2*rateSlots + rateSlots/2)
+	if pps != 5 {
+		t.Errorf("Expected 5 pps half a window after the last packet, got %v", pps)
+	}
+	pps, _, _ = w.rates(start + 4*rateSlots)
+	if pps != 0 {
+		t.Errorf("Expected 0 pps after a full window without packets, got %v", pps)
+	}
+}
+
+func TestRateWindowNew(t *testing.T) {
+	var w rateWindow
+	start := int64(1500000000)
+	for now := start; now < start+10; now++ {
+		w.add(now, 4, 0, 0)
+	}
+
+	// Routers seen for less than a window are not averaged over the full window
+	if pps, _, _ := w.rates(start + 10); pps != 4 {
+		t.Errorf("Expected 4 pps, got %v", pps)
+	}
+}
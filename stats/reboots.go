@@ -0,0 +1,90 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// rebootTolerance is the time in milliseconds uptimes may go backward (reordered
+// packets) and init times may move (clock adjustments) without being taken as reboot
+const rebootTolerance = 60 * 1000
+
+// uptimeWrapWindow is the time in milliseconds before the 32 bit uptime wraps in
+// which a backward jump is taken as wrap rather than reboot
+const uptimeWrapWindow = 60 * 60 * 1000
+
+// bootState keeps what was last seen of a routers uptime
+type bootState struct {
+	// uptime is the last NetFlow v9 sysUpTime in milliseconds
+	uptime     uint32
+	uptimeSeen bool
+
+	// initTime is the last IPFIX systemInitTimeMilliseconds
+	initTime uint64
+
+	lock sync.Mutex
+}
+
+// ObserveUptime records the uptime of the router in milliseconds, as carried in
+// NetFlow v9 headers. It returns true and counts a reboot if the uptime went backward.
+func (rs *RouterStats) ObserveUptime(uptime uint32) bool {
+	b := &rs.boot
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	last, seen := b.uptime, b.uptimeSeen
+	b.uptime, b.uptimeSeen = uptime, true
+	if !seen || uint64(uptime)+rebootTolerance >= uint64(last) {
+		return false
+	}
+
+	// The 32 bit uptime wraps after about 49.7 days
+	if last > math.MaxUint32-uptimeWrapWindow {
+		return false
+	}
+	return rs.countReboot()
+}
+
+// ObserveInitTime records the time the router was initialized at in milliseconds
+// since the epoch, as carried in IPFIX systemInitTimeMilliseconds. It returns true
+// and counts a reboot if the init time moved forward.
+func (rs *RouterStats) ObserveInitTime(initTime uint64) bool {
+	b := &rs.boot
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	last := b.initTime
+	b.initTime = initTime
+	if last == 0 || initTime <= last+rebootTolerance {
+		return false
+	}
+	return rs.countReboot()
+}
+
+// InitTime returns the init time of the router in milliseconds since the epoch
+// as last recorded by ObserveInitTime, 0 if unknown
+func (rs *RouterStats) InitTime() uint64 {
+	b := &rs.boot
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.initTime
+}
+
+// countReboot counts a reboot of the router
+func (rs *RouterStats) countReboot() bool {
+	atomic.AddUint64(&rs.Reboots, 1)
+	atomic.AddUint64(&GlobalStats.Reboots, 1)
+	return true
+}
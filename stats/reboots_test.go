@@ -0,0 +1,52 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"math"
+	"testing"
+)
+
+func TestObserveUptime(t *testing.T) {
+	tests := []struct {
+		name     string
+		uptimes  []uint32
+		expected uint64
+	}{
+		{name: "Increasing", uptimes: []uint32{1000, 2000, 3000}},
+		{name: "Reordered packets", uptimes: []uint32{100000, 99000, 101000}},
+		{name: "Reboot", uptimes: []uint32{5000000, 1000}, expected: 1},
+		{name: "Wrap", uptimes: []uint32{math.MaxUint32 - 1000, 5000}},
+	}
+
+	for _, test := range tests {
+		rs := &RouterStats{}
+		for _, u := range test.uptimes {
+			rs.ObserveUptime(u)
+		}
+		if rs.Reboots != test.expected {
+			t.Errorf("%s: Expected %d reboots, got %d", test.name, test.expected, rs.Reboots)
+		}
+	}
+}
+
+func TestObserveInitTime(t *testing.T) {
+	rs := &RouterStats{}
+	for _, it := range []uint64{1500000000000, 1500000000003, 1499999999998} {
+		if rs.ObserveInitTime(it) {
+			t.Errorf("Unexpected reboot at init time %d", it)
+		}
+	}
+	if !rs.ObserveInitTime(1500000600000) {
+		t.Errorf("Expected reboot")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// baselineAlpha is the weight of a new flow rate in the baseline
+	baselineAlpha = 0.1
+
+	// baselineSamples is the number of flow rates needed before regressions are reported
+	baselineSamples = 10
+
+	// baselineRelearn is the number of consecutive deviating flow rates after which
+	// the current rate is taken as the new baseline
+	baselineRelearn = 60
+)
+
+// rateBaseline keeps the moving average of a routers flow rate
+type rateBaseline struct {
+	baseline  float64
+	samples   int
+	deviating int
+	regressed bool
+	lock      sync.Mutex
+}
+
+// observe checks flow rate `fps` against the baseline and updates the baseline
+// with it. Rates deviating from the baseline by more than `factor` in either
+// direction mark the router as regressed and are kept out of the baseline, so a
+// regression can't hide itself. If the rate stays off for `baselineRelearn`
+// observations it is accepted as the new normal. It returns true if the
+// regression state changed.
+func (b *rateBaseline) observe(fps float64, factor float64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.samples == 0 {
+		b.baseline = fps
+		b.samples = 1
+		return false
+	}
+
+	deviates := b.samples >= baselineSamples && b.baseline > 0 && (fps*factor < b.baseline || fps > b.baseline*factor)
+	if deviates {
+		b.deviating++
+	} else {
+		b.deviating = 0
+	}
+	if b.deviating >= baselineRelearn {
+		b.baseline = fps
+		b.deviating = 0
+		deviates = false
+	}
+
+	if !deviates {
+		b.baseline += baselineAlpha * (fps - b.baseline)
+		if b.samples < baselineSamples {
+			b.samples++
+		}
+	}
+
+	changed := deviates != b.regressed
+	b.regressed = deviates
+	return changed
+}
+
+// state returns the baseline and whether the router is currently regressed
+func (b *rateBaseline) state() (float64, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.baseline, b.regressed
+}
+
+// WatchFlowRates compares the flow rate of each router to its baseline every
+// `interval` and reports routers whose rate deviates by more than `factor`,
+// e.g. because a sampling misconfiguration halved their volume. It doesn't return.
+func WatchFlowRates(interval time.Duration, factor float64) {
+	for range time.Tick(interval) {
+		checkFlowRates(time.Now().Unix(), factor)
+	}
+}
+
+// checkFlowRates updates the baselines of all routers with their flow rate at `now`
+func checkFlowRates(now int64, factor float64) {
+	routerStats.lock.RLock()
+	defer routerStats.lock.RUnlock()
+
+	for rtr, rs := range routerStats.routers {
+		_, fps, _ := rs.rates.rates(now)
+		if !rs.baseline.observe(fps, factor) {
+			continue
+		}
+
+		baseline, regressed := rs.baseline.state()
+		if !regressed {
+			glog.Infof("Flow rate of router %s is back to normal: %.2f/s, baseline %.2f/s", rtr, fps, baseline)
+			continue
+		}
+		atomic.AddUint64(&rs.FlowRateRegressions, 1)
+		atomic.AddUint64(&GlobalStats.FlowRateRegressions, 1)
+		glog.Warningf("Flow rate of router %s deviates from its baseline: %.2f/s, baseline %.2f/s", rtr, fps, baseline)
+	}
+}
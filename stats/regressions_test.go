@@ -0,0 +1,47 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"testing"
+)
+
+func TestRateBaseline(t *testing.T) {
+	var b rateBaseline
+	for i := 0; i < baselineSamples; i++ {
+		if b.observe(100, 1.5) {
+			t.Fatalf("Unexpected regression while learning the baseline")
+		}
+	}
+
+	if b.observe(80, 1.5) {
+		t.Errorf("Unexpected regression within factor")
+	}
+	if !b.observe(50, 1.5) {
+		t.Errorf("Expected regression for halved rate")
+	}
+	if baseline, regressed := b.state(); !regressed || baseline < 90 {
+		t.Errorf("Expected regressed router with baseline kept around 100, got %v/%.2f", regressed, baseline)
+	}
+	if !b.observe(100, 1.5) {
+		t.Errorf("Expected recovery")
+	}
+
+	// A lasting change becomes the new baseline
+	b.observe(300, 1.5)
+	for i := 1; i < baselineRelearn; i++ {
+		b.observe(300, 1.5)
+	}
+	if baseline, regressed := b.state(); regressed || baseline != 300 {
+		t.Errorf("Expected relearned baseline 300, got %v/%.2f", regressed, baseline)
+	}
+}
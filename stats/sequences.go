@@ -0,0 +1,96 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/tflow2/lru"
+)
+
+const (
+	// sequenceStreams is the number of (router, domain) pairs sequence numbers are tracked for
+	sequenceStreams = 10000
+
+	// sequenceIdle is the time after which the sequence number of an idle stream is forgotten
+	sequenceIdle = 10 * time.Minute
+
+	// maxSequenceGap is the largest jump of sequence numbers taken as loss. Larger
+	// jumps (in either direction) are taken as restart of the exporting process.
+	maxSequenceGap = 1 << 20
+)
+
+// sequenceState is what is known about the sequence numbers of a stream
+type sequenceState struct {
+	// next is the sequence number expected next, if known
+	next  uint32
+	known bool
+}
+
+// sequenceTracker keeps the next expected sequence number of each stream. Its
+// size is bound, so domain ID churn can't exhaust memory. Evicted streams are
+// learned anew when seen again rather than compared to a stale expectation.
+type sequenceTracker struct {
+	next *lru.Cache
+	lock sync.Mutex
+}
+
+// newSequenceTracker creates a tracker for up to `size` streams idle for at most `idle`
+func newSequenceTracker(size int, idle time.Duration) *sequenceTracker {
+	return &sequenceTracker{next: lru.New(size, idle)}
+}
+
+// observe records sequence number `seq` of stream `key`, followed by `count`
+// records (IPFIX) or packets (NetFlow v9), -1 if unknown. It returns the number
+// of records or packets lost since the last observation. Late (reordered)
+// messages, restarts and streams not seen before are not counted as loss.
+func (t *sequenceTracker) observe(key string, seq uint32, count int) uint32 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	next := sequenceState{next: seq + uint32(count), known: count >= 0}
+	v, ok := t.next.Get(key)
+	if !ok || !v.(sequenceState).known {
+		t.next.Set(key, next)
+		return 0
+	}
+
+	diff := int32(seq - v.(sequenceState).next)
+	if diff < 0 && diff > -maxSequenceGap {
+		// Late message, the expectation stays
+		return 0
+	}
+
+	t.next.Set(key, next)
+	if diff > 0 && diff < maxSequenceGap {
+		return uint32(diff)
+	}
+	return 0
+}
+
+// sequences tracks the sequence numbers of all exporters
+var sequences = newSequenceTracker(sequenceStreams, sequenceIdle)
+
+// ObserveSequence records sequence number `seq` of observation domain (IPFIX) or
+// source ID (NetFlow v9) `domain` of router `rtr`, followed by `count` records or
+// packets (-1 if unknown). Lost records or packets are counted and their number is returned.
+func ObserveSequence(rtr string, domain uint32, seq uint32, count int) uint32 {
+	lost := sequences.observe(fmt.Sprintf("%s/%d", rtr, domain), seq, count)
+	if lost > 0 {
+		atomic.AddUint64(&Router(rtr).SequenceLost, uint64(lost))
+		atomic.AddUint64(&GlobalStats.SequenceLost, uint64(lost))
+	}
+	return lost
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSequenceTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		seqs     []uint32
+		count    int
+		expected uint32
+	}{
+		{name: "In order", seqs: []uint32{0, 10, 20, 30}, count: 10},
+		{name: "Gap", seqs: []uint32{0, 10, 30}, count: 10, expected: 10},
+		{name: "Reordered", seqs: []uint32{0, 20, 10, 30}, count: 10, expected: 10},
+		{name: "Wrap", seqs: []uint32{4294967286, 0, 10}, count: 10},
+		{name: "Restart", seqs: []uint32{50000000, 0, 10}, count: 10},
+		{name: "Unknown count", seqs: []uint32{0, 1000, 1010}, count: -1},
+	}
+
+	for _, test := range tests {
+		tr := newSequenceTracker(10, 0)
+		var lost uint32
+		for _, seq := range test.seqs {
+			lost += tr.observe("192.0.2.1/0", seq, test.count)
+		}
+		if lost != test.expected {
+			t.Errorf("%s: Expected %d lost, got %d", test.name, test.expected, lost)
+		}
+	}
+}
+
+func TestSequenceTrackerEviction(t *testing.T) {
+	tr := newSequenceTracker(2, time.Hour)
+	tr.observe("192.0.2.1/0", 0, 10)
+
+	// Churning domain IDs evict the stream, which is learned anew when it returns
+	for i := uint32(1); i <= 100; i++ {
+		tr.observe(fmt.Sprintf("192.0.2.2/%d", i), i, 1)
+	}
+	if n := tr.next.Len(); n != 2 {
+		t.Errorf("Expected 2 tracked streams, got %d", n)
+	}
+	if lost := tr.observe("192.0.2.1/0", 5000, 10); lost != 0 {
+		t.Errorf("Expected no loss after eviction, got %d", lost)
+	}
+	if lost := tr.observe("192.0.2.1/0", 5020, 10); lost != 10 {
+		t.Errorf("Expected 10 lost after relearning, got %d", lost)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// udpTables are the files Linux lists its UDP sockets in
+var udpTables = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+// sockets holds the local ports of the UDP sockets flows are received on, keyed by server
+var sockets = struct {
+	ports map[string]int
+	lock  sync.Mutex
+}{ports: make(map[string]int)}
+
+// RegisterSocket registers the UDP socket server `name` receives on at local port
+// `port`, to export the number of datagrams the kernel dropped for it as its
+// receive buffer was full
+func RegisterSocket(name string, port int) {
+	sockets.lock.Lock()
+	defer sockets.lock.Unlock()
+	sockets.ports[name] = port
+}
+
+// sortedSocketNames returns the names of all registered sockets sorted.
+// `sockets.lock` must be held.
+func sortedSocketNames() []string {
+	names := make([]string, 0, len(sockets.ports))
+	for name := range sockets.ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// udpDrops returns the number of datagrams dropped by the kernel for the UDP
+// sockets bound to `port`. It returns false if the platform doesn't expose them.
+func udpDrops(port int) (uint64, bool) {
+	var drops uint64
+	found := false
+	for _, table := range udpTables {
+		f, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		n, err := parseUDPDrops(f, port)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		drops += n
+		found = true
+	}
+	return drops, found
+}
+
+// parseUDPDrops sums the drops of the sockets bound to `port` in the UDP socket
+// table `r`, formatted as /proc/net/udp. The local address is the second and
+// the drops the last column.
+func parseUDPDrops(r io.Reader, port int) (uint64, error) {
+	var drops uint64
+	s := bufio.NewScanner(r)
+	for header := true; s.Scan(); header = false {
+		fields := strings.Fields(s.Text())
+		if header || len(fields) < 3 {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			return 0, fmt.Errorf("invalid local address %q", fields[1])
+		}
+		p, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid local address %q: %v", fields[1], err)
+		}
+		if int(p) != port {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid drops %q: %v", fields[len(fields)-1], err)
+		}
+		drops += n
+	}
+	return drops, s.Err()
+}
+
+// varzSockets sends the datagrams dropped by the kernel for each registered socket to a client
+func varzSockets(w http.ResponseWriter) {
+	sockets.lock.Lock()
+	defer sockets.lock.Unlock()
+
+	for _, name := range sortedSocketNames() {
+		if drops, ok := udpDrops(sockets.ports[name]); ok {
+			fmt.Fprintf(w, "netflow_collector_socket_drops{socket=\"%s\"} %d\n", name, drops)
+		}
+	}
+}
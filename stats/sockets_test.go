@@ -0,0 +1,45 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"strings"
+	"testing"
+)
+
+// udpTable is a /proc/net/udp of two sockets on port 4739 (0x1283) and one on 2055 (0x0807)
+const udpTable = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  100: 00000000:1283 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 12345 2 0000000000000000 17
+  101: 00000000:0807 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 12346 2 0000000000000000 5
+  102: 0100007F:1283 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 12347 2 0000000000000000 3
+`
+
+func TestParseUDPDrops(t *testing.T) {
+	tests := []struct {
+		port  int
+		drops uint64
+	}{
+		{port: 4739, drops: 20},
+		{port: 2055, drops: 5},
+		{port: 6343, drops: 0},
+	}
+	for _, test := range tests {
+		drops, err := parseUDPDrops(strings.NewReader(udpTable), test.port)
+		if err != nil || drops != test.drops {
+			t.Errorf("Port %d: Expected %d drops, got %d (%v)", test.port, test.drops, drops, err)
+		}
+	}
+
+	if _, err := parseUDPDrops(strings.NewReader(udpTable+"  103: 00000000 x\n"), 4739); err == nil {
+		t.Errorf("Expected error parsing invalid local address")
+	}
+}
@@ -15,47 +15,659 @@ package stats
 import (
 	"fmt"
 	"net/http"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // Stats represents statistics of this program that are to be exported via /varz
 type Stats struct {
-	StartTime       int64
-	Flows4          uint64
-	Flows6          uint64
-	Queries         uint64
-	BirdCacheHits   uint64
-	BirdCacheMiss   uint64
-	FlowPackets     uint64
-	FlowBytes       uint64
-	Netflow9packets uint64
-	Netflow9bytes   uint64
-	IPFIXpackets    uint64
-	IPFIXbytes      uint64
+	StartTime            int64
+	Flows4               uint64
+	Flows6               uint64
+	Queries              uint64
+	BirdCacheHits        uint64
+	BirdCacheMiss        uint64
+	CymruCacheHits       uint64
+	CymruCacheMiss       uint64
+	CymruErrors          uint64
+	GeoIPErrors          uint64
+	SNMPQueries          uint64
+	SNMPErrors           uint64
+	RDNSCacheHits        uint64
+	RDNSCacheMiss        uint64
+	RDNSErrors           uint64
+	CoalescedFlows       uint64
+	CoalesceEvictions    uint64
+	CoalesceEnded        uint64
+	FlowPackets          uint64
+	FlowBytes            uint64
+	Netflow9packets      uint64
+	Netflow9bytes        uint64
+	IPFIXpackets         uint64
+	IPFIXbytes           uint64
+	IPFIXHTTPRequests    uint64
+	IPFIXHTTPMessages    uint64
+	IPFIXExportFlows     uint64
+	IPFIXExportMessages  uint64
+	IPFIXExportErrors    uint64
+	EnrichCacheHits      uint64
+	EnrichCacheMiss      uint64
+	EnrichDropped        uint64
+	EnrichErrors         uint64
+	AnnotatedFlows       uint64
+	AnnotatedPrefixes    uint64
+	AnnotatedASNs        uint64
+	AnnotatedAttributes  uint64
+	AnnotatedComplete    uint64
+	TTLAnomalies         uint64
+	OTLPFlows            uint64
+	OTLPRetries          uint64
+	OTLPDropped          uint64
+	RateLimited          uint64
+	OutputDropped        uint64
+	Reboots              uint64
+	FlowRateRegressions  uint64
+	SequenceLost         uint64
+	InvalidDropped       uint64
+	EmptyDropped         uint64
+	SubscribeFlows       uint64
+	SubscribeDropped     uint64
+	ElephantFlows        uint64
+	DBEvictedFlows       uint64
+	TemplatesExpired     uint64
+	TemplatesInvalid     uint64
+	TemplateMisses       uint64
+	DroppedUnknownFamily uint64
+	PacketPanics         uint64
+
+	// DecodeErrors counts packets that failed to decode, broken down by protocol
+	// and reason in /varz
+	DecodeErrors uint64
+
+	// Subscribers is the number of gRPC subscribers currently connected
+	Subscribers int64
+
+	// DBFlows is the number of flows in memory, DBOldest the timestamp of the oldest of them
+	DBFlows  int64
+	DBOldest int64
 }
 
 // GlobalStats is instance of `Stats` to keep stats of this program
 var GlobalStats Stats
 
+// endReasonNames maps IPFIX flowEndReason values to the label used in /varz
+var endReasonNames = []string{
+	"unknown",
+	"idle_timeout",
+	"active_timeout",
+	"end_of_flow",
+	"forced_end",
+	"lack_of_resources",
+}
+
+// RouterStats represents statistics of a single exporting router
+type RouterStats struct {
+	// FlowEndReasons counts flows by their flowEndReason. Index is the IPFIX
+	// flowEndReason value, index 0 is used for unknown reasons.
+	FlowEndReasons [6]uint64
+
+	// QueueDepth is the number of packets waiting in the routers decode queue
+	QueueDepth uint64
+
+	// QueueDrops counts packets dropped because the routers decode queue was full
+	QueueDrops uint64
+
+	// SelectorMismatches counts records carrying differing selectorAlgorithm and flowSelectorAlgorithm
+	SelectorMismatches uint64
+
+	// Reboots counts detected reboots of the router
+	Reboots uint64
+
+	// InterfaceRemaps counts interfaces announced under a different index or name than before
+	InterfaceRemaps uint64
+
+	// SequenceLost counts records (IPFIX) or packets (NetFlow v9) missing according to sequence numbers
+	SequenceLost uint64
+
+	// FlowRateRegressions counts times the routers flow rate started deviating from its baseline
+	FlowRateRegressions uint64
+
+	// Packets and Bytes count the export packets (IPFIX messages) received from the router
+	Packets uint64
+	Bytes   uint64
+
+	// DecodeErrors counts packets of the router that failed to decode
+	DecodeErrors uint64
+
+	// Flows counts flows decoded from the routers packets
+	Flows uint64
+
+	// Templates is the number of templates of the router currently cached
+	Templates int64
+
+	// MissingTemplates counts flowsets of the router skipped as their template was unknown
+	MissingTemplates uint64
+
+	// lastPacket is the unix time the last packet was received at
+	lastPacket int64
+
+	// domains holds the counters of up to maxDomains observation domains, by domain ID
+	domains     map[uint32]*DomainCounters
+	domainsLock sync.Mutex
+
+	// boot keeps the last seen uptime to detect reboots
+	boot bootState
+
+	// rates keeps recent counts to compute current packet, flow and bit rates
+	rates rateWindow
+
+	// baseline keeps the routers usual flow rate to detect regressions
+	baseline rateBaseline
+}
+
+// CountEndReason increments the counter for flowEndReason `reason`
+func (rs *RouterStats) CountEndReason(reason uint32) {
+	if reason >= uint32(len(rs.FlowEndReasons)) {
+		reason = 0
+	}
+	atomic.AddUint64(&rs.FlowEndReasons[reason], 1)
+}
+
+// CountPacket counts an export packet of `size` bytes received from the router,
+// also for its current packet rate
+func (rs *RouterStats) CountPacket(size int) {
+	now := time.Now().Unix()
+	atomic.AddUint64(&rs.Packets, 1)
+	atomic.AddUint64(&rs.Bytes, uint64(size))
+	atomic.StoreInt64(&rs.lastPacket, now)
+	rs.rates.add(now, 1, 0, 0)
+}
+
+// CountFlow counts a flow of `bytes` received from the router, also for its
+// current flow and bit rate
+func (rs *RouterStats) CountFlow(bytes uint64) {
+	atomic.AddUint64(&rs.Flows, 1)
+	rs.rates.add(time.Now().Unix(), 0, 1, bytes)
+}
+
+// maxDomains is the number of observation domains (IPFIX) or source IDs (NetFlow v9)
+// counted per router. Packets of further domains are only counted for the router.
+const maxDomains = 256
+
+// DomainCounters is a snapshot of the counters of an observation domain of a router
+type DomainCounters struct {
+	Packets uint64 `json:"packets"`
+	Flows   uint64 `json:"flows"`
+
+	// LastPacket is the unix time the last packet was received at
+	LastPacket int64 `json:"last_packet"`
+}
+
+// CountDomainPacket counts a packet of observation domain (IPFIX) or source ID
+// (NetFlow v9) `domainID` that carried `flows` flows
+func (rs *RouterStats) CountDomainPacket(domainID uint32, flows int) {
+	rs.domainsLock.Lock()
+	defer rs.domainsLock.Unlock()
+
+	d, ok := rs.domains[domainID]
+	if !ok {
+		if len(rs.domains) >= maxDomains {
+			return
+		}
+		if rs.domains == nil {
+			rs.domains = make(map[uint32]*DomainCounters)
+		}
+		d = &DomainCounters{}
+		rs.domains[domainID] = d
+	}
+	d.Packets++
+	d.Flows += uint64(flows)
+	d.LastPacket = time.Now().Unix()
+}
+
+// RouterCounters is a snapshot of the counters of a router
+type RouterCounters struct {
+	Packets          uint64 `json:"packets"`
+	Bytes            uint64 `json:"bytes"`
+	DecodeErrors     uint64 `json:"decode_errors"`
+	Flows            uint64 `json:"flows"`
+	Templates        int64  `json:"templates"`
+	MissingTemplates uint64 `json:"missing_templates"`
+
+	// LastPacket is the unix time the last packet was received at, 0 if none was
+	LastPacket int64 `json:"last_packet"`
+
+	// Domains holds the counters of the routers observation domains, by domain ID
+	Domains map[uint32]DomainCounters `json:"domains,omitempty"`
+}
+
+// Snapshot returns a copy of the counters of all routers, keyed by the routers
+// address. It doesn't share memory with the counters, so it is safe to serialize.
+func Snapshot() map[string]RouterCounters {
+	routerStats.lock.RLock()
+	defer routerStats.lock.RUnlock()
+
+	counters := make(map[string]RouterCounters, len(routerStats.routers))
+	for rtr, rs := range routerStats.routers {
+		c := RouterCounters{
+			Packets:          atomic.LoadUint64(&rs.Packets),
+			Bytes:            atomic.LoadUint64(&rs.Bytes),
+			DecodeErrors:     atomic.LoadUint64(&rs.DecodeErrors),
+			Flows:            atomic.LoadUint64(&rs.Flows),
+			Templates:        atomic.LoadInt64(&rs.Templates),
+			MissingTemplates: atomic.LoadUint64(&rs.MissingTemplates),
+			LastPacket:       atomic.LoadInt64(&rs.lastPacket),
+		}
+
+		rs.domainsLock.Lock()
+		if len(rs.domains) > 0 {
+			c.Domains = make(map[uint32]DomainCounters, len(rs.domains))
+			for id, d := range rs.domains {
+				c.Domains[id] = *d
+			}
+		}
+		rs.domainsLock.Unlock()
+
+		counters[rtr] = c
+	}
+	return counters
+}
+
+// InputStats represents statistics of a single input of the annotator
+type InputStats struct {
+	// Flows counts flows received on the input
+	Flows uint64
+
+	// QueueDepth is the number of flows waiting in the input
+	QueueDepth uint64
+
+	// BlockedNanos is the time in nanoseconds flows of the input waited for a free worker
+	BlockedNanos uint64
+}
+
+// annotatorInputs keeps an `InputStats` instance for each input of the annotator, by index
+var annotatorInputs = struct {
+	inputs []*InputStats
+	lock   sync.Mutex
+}{}
+
+// AnnotatorInput returns the `InputStats` of annotator input `i`. It is created if it doesn't exist yet.
+func AnnotatorInput(i int) *InputStats {
+	annotatorInputs.lock.Lock()
+	defer annotatorInputs.lock.Unlock()
+
+	for len(annotatorInputs.inputs) <= i {
+		annotatorInputs.inputs = append(annotatorInputs.inputs, &InputStats{})
+	}
+	return annotatorInputs.inputs[i]
+}
+
+// WorkerStats represents statistics of a single packet decoding worker
+type WorkerStats struct {
+	// Packets counts packets decoded by the worker
+	Packets uint64
+
+	// Flows counts flows decoded by the worker and passed on to the annotator layer
+	Flows uint64
+}
+
+// CountPacket counts a decoded packet that carried `flows` flows
+func (ws *WorkerStats) CountPacket(flows int) {
+	atomic.AddUint64(&ws.Packets, 1)
+	atomic.AddUint64(&ws.Flows, uint64(flows))
+}
+
+// workerKey identifies a decoding worker
+type workerKey struct {
+	protocol string
+	worker   int
+}
+
+// workers keeps a `WorkerStats` instance for each decoding worker
+var workers = struct {
+	workers map[workerKey]*WorkerStats
+	lock    sync.Mutex
+}{workers: make(map[workerKey]*WorkerStats)}
+
+// Worker returns the `WorkerStats` of decoding worker `worker` of `protocol`
+// ("netflow" or "ipfix"). It is created if it doesn't exist yet.
+func Worker(protocol string, worker int) *WorkerStats {
+	workers.lock.Lock()
+	defer workers.lock.Unlock()
+
+	k := workerKey{protocol: protocol, worker: worker}
+	ws, ok := workers.workers[k]
+	if !ok {
+		ws = &WorkerStats{}
+		workers.workers[k] = ws
+	}
+	return ws
+}
+
+// sortedWorkerKeys returns the keys of all workers sorted by protocol and
+// worker. `workers.lock` must be held.
+func sortedWorkerKeys() []workerKey {
+	keys := make([]workerKey, 0, len(workers.workers))
+	for k := range workers.workers {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].protocol != keys[j].protocol {
+			return keys[i].protocol < keys[j].protocol
+		}
+		return keys[i].worker < keys[j].worker
+	})
+	return keys
+}
+
+// SinkStats represents statistics of a sink with acknowledged delivery
+type SinkStats struct {
+	// Acked counts flows acknowledged by the sink
+	Acked uint64
+
+	// Retries counts attempts to deliver a batch again after it failed
+	Retries uint64
+
+	// DeadLettered counts flows given up on after too many failed attempts
+	DeadLettered uint64
+
+	// Buffered is the number of batches waiting for delivery
+	Buffered int64
+}
+
+// sinks keeps a `SinkStats` instance for each sink, keyed by name
+var sinks = struct {
+	sinks map[string]*SinkStats
+	lock  sync.Mutex
+}{sinks: make(map[string]*SinkStats)}
+
+// Sink returns the `SinkStats` of sink `name`. It is created if it doesn't exist yet.
+func Sink(name string) *SinkStats {
+	sinks.lock.Lock()
+	defer sinks.lock.Unlock()
+
+	s, ok := sinks.sinks[name]
+	if !ok {
+		s = &SinkStats{}
+		sinks.sinks[name] = s
+	}
+	return s
+}
+
+// sortedSinkNames returns the names of all sinks sorted. `sinks.lock` must be held.
+func sortedSinkNames() []string {
+	names := make([]string, 0, len(sinks.sinks))
+	for name := range sinks.sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// routerStats keeps a `RouterStats` instance for each router, keyed by the routers address
+var routerStats = struct {
+	routers map[string]*RouterStats
+	lock    sync.RWMutex
+}{routers: make(map[string]*RouterStats)}
+
+// Router returns the `RouterStats` of router `rtr`. It is created if it doesn't exist yet.
+func Router(rtr string) *RouterStats {
+	routerStats.lock.RLock()
+	rs, ok := routerStats.routers[rtr]
+	routerStats.lock.RUnlock()
+	if ok {
+		return rs
+	}
+
+	routerStats.lock.Lock()
+	defer routerStats.lock.Unlock()
+	if rs, ok := routerStats.routers[rtr]; ok {
+		return rs
+	}
+	rs = &RouterStats{}
+	routerStats.routers[rtr] = rs
+	return rs
+}
+
+// decodeErrors counts packets that failed to decode, keyed by protocol and error category
+var decodeErrors = struct {
+	counts map[decodeErrorKey]uint64
+	lock   sync.Mutex
+}{counts: make(map[decodeErrorKey]uint64)}
+
+type decodeErrorKey struct {
+	protocol string
+	category string
+}
+
+// CountDecodeError increments the counter of decode errors of `category` for `protocol`
+func CountDecodeError(protocol string, category string) {
+	atomic.AddUint64(&GlobalStats.DecodeErrors, 1)
+	decodeErrors.lock.Lock()
+	defer decodeErrors.lock.Unlock()
+	decodeErrors.counts[decodeErrorKey{protocol: protocol, category: category}]++
+}
+
+// invalidFlows counts flows violating validation rules, keyed by protocol and rule
+var invalidFlows = struct {
+	counts map[decodeErrorKey]uint64
+	lock   sync.Mutex
+}{counts: make(map[decodeErrorKey]uint64)}
+
+// sortedErrorKeys returns the keys of `counts` sorted by protocol and category
+func sortedErrorKeys(counts map[decodeErrorKey]uint64) []decodeErrorKey {
+	keys := make([]decodeErrorKey, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].protocol != keys[j].protocol {
+			return keys[i].protocol < keys[j].protocol
+		}
+		return keys[i].category < keys[j].category
+	})
+	return keys
+}
+
+// CountInvalidFlow increments the counter of flows of `protocol` violating validation rule `rule`
+func CountInvalidFlow(protocol string, rule string) {
+	invalidFlows.lock.Lock()
+	defer invalidFlows.lock.Unlock()
+	invalidFlows.counts[decodeErrorKey{protocol: protocol, category: rule}]++
+}
+
 // Init initilizes this module
 func Init() {
 	GlobalStats.StartTime = time.Now().Unix()
 }
 
-// Varz is used to serve HTTP requests /varz and send the statistics to a client in borgmon/prometheus compatible format
+// Varz is used to serve HTTP requests /varz and send the statistics to a client in borgmon compatible format
 func Varz(w http.ResponseWriter) {
 	now := time.Now().Unix()
 	fmt.Fprintf(w, "netflow_collector_uptime %d\n", now-GlobalStats.StartTime)
 	fmt.Fprintf(w, "netflow_collector_flows4 %d\n", atomic.LoadUint64(&GlobalStats.Flows4))
 	fmt.Fprintf(w, "netflow_collector_flows6 %d\n", atomic.LoadUint64(&GlobalStats.Flows6))
+	fmt.Fprintf(w, "netflow_collector_flows{family=\"4\"} %d\n", atomic.LoadUint64(&GlobalStats.Flows4))
+	fmt.Fprintf(w, "netflow_collector_flows{family=\"6\"} %d\n", atomic.LoadUint64(&GlobalStats.Flows6))
 	fmt.Fprintf(w, "netflow_collector_queries %d\n", atomic.LoadUint64(&GlobalStats.Queries))
 	fmt.Fprintf(w, "netflow_collector_bird_cache_hits %d\n", atomic.LoadUint64(&GlobalStats.BirdCacheHits))
 	fmt.Fprintf(w, "netflow_collector_bird_cache_miss %d\n", atomic.LoadUint64(&GlobalStats.BirdCacheMiss))
+	fmt.Fprintf(w, "netflow_collector_cymru_cache_hits %d\n", atomic.LoadUint64(&GlobalStats.CymruCacheHits))
+	fmt.Fprintf(w, "netflow_collector_cymru_cache_miss %d\n", atomic.LoadUint64(&GlobalStats.CymruCacheMiss))
+	fmt.Fprintf(w, "netflow_collector_cymru_errors %d\n", atomic.LoadUint64(&GlobalStats.CymruErrors))
+	fmt.Fprintf(w, "netflow_collector_geoip_errors %d\n", atomic.LoadUint64(&GlobalStats.GeoIPErrors))
+	fmt.Fprintf(w, "netflow_collector_snmp_queries %d\n", atomic.LoadUint64(&GlobalStats.SNMPQueries))
+	fmt.Fprintf(w, "netflow_collector_snmp_errors %d\n", atomic.LoadUint64(&GlobalStats.SNMPErrors))
+	fmt.Fprintf(w, "netflow_collector_rdns_cache_hits %d\n", atomic.LoadUint64(&GlobalStats.RDNSCacheHits))
+	fmt.Fprintf(w, "netflow_collector_rdns_cache_miss %d\n", atomic.LoadUint64(&GlobalStats.RDNSCacheMiss))
+	fmt.Fprintf(w, "netflow_collector_rdns_errors %d\n", atomic.LoadUint64(&GlobalStats.RDNSErrors))
+	fmt.Fprintf(w, "netflow_collector_coalesced_flows %d\n", atomic.LoadUint64(&GlobalStats.CoalescedFlows))
+	fmt.Fprintf(w, "netflow_collector_coalesce_evictions %d\n", atomic.LoadUint64(&GlobalStats.CoalesceEvictions))
+	fmt.Fprintf(w, "netflow_collector_coalesce_ended %d\n", atomic.LoadUint64(&GlobalStats.CoalesceEnded))
 	fmt.Fprintf(w, "netflow_collector_packets %d\n", atomic.LoadUint64(&GlobalStats.FlowPackets))
 	fmt.Fprintf(w, "netflow_collector_bytes %d\n", atomic.LoadUint64(&GlobalStats.FlowBytes))
 	fmt.Fprintf(w, "netflow_collector_netflow9_packets %d\n", atomic.LoadUint64(&GlobalStats.Netflow9packets))
 	fmt.Fprintf(w, "netflow_collector_netflow9_bytes %d\n", atomic.LoadUint64(&GlobalStats.Netflow9bytes))
 	fmt.Fprintf(w, "netflow_collector_ipfix_packets %d\n", atomic.LoadUint64(&GlobalStats.IPFIXpackets))
 	fmt.Fprintf(w, "netflow_collector_ipfix_bytes %d\n", atomic.LoadUint64(&GlobalStats.IPFIXbytes))
+	fmt.Fprintf(w, "netflow_collector_ipfix_http_requests %d\n", atomic.LoadUint64(&GlobalStats.IPFIXHTTPRequests))
+	fmt.Fprintf(w, "netflow_collector_ipfix_http_messages %d\n", atomic.LoadUint64(&GlobalStats.IPFIXHTTPMessages))
+	fmt.Fprintf(w, "netflow_collector_ipfix_export_flows %d\n", atomic.LoadUint64(&GlobalStats.IPFIXExportFlows))
+	fmt.Fprintf(w, "netflow_collector_ipfix_export_messages %d\n", atomic.LoadUint64(&GlobalStats.IPFIXExportMessages))
+	fmt.Fprintf(w, "netflow_collector_ipfix_export_errors %d\n", atomic.LoadUint64(&GlobalStats.IPFIXExportErrors))
+	fmt.Fprintf(w, "netflow_collector_enrich_cache_hits %d\n", atomic.LoadUint64(&GlobalStats.EnrichCacheHits))
+	fmt.Fprintf(w, "netflow_collector_enrich_cache_miss %d\n", atomic.LoadUint64(&GlobalStats.EnrichCacheMiss))
+	fmt.Fprintf(w, "netflow_collector_enrich_dropped %d\n", atomic.LoadUint64(&GlobalStats.EnrichDropped))
+	fmt.Fprintf(w, "netflow_collector_enrich_errors %d\n", atomic.LoadUint64(&GlobalStats.EnrichErrors))
+	fmt.Fprintf(w, "netflow_collector_annotated_flows %d\n", atomic.LoadUint64(&GlobalStats.AnnotatedFlows))
+	fmt.Fprintf(w, "netflow_collector_annotated_prefixes %d\n", atomic.LoadUint64(&GlobalStats.AnnotatedPrefixes))
+	fmt.Fprintf(w, "netflow_collector_annotated_asns %d\n", atomic.LoadUint64(&GlobalStats.AnnotatedASNs))
+	fmt.Fprintf(w, "netflow_collector_annotated_attributes %d\n", atomic.LoadUint64(&GlobalStats.AnnotatedAttributes))
+	fmt.Fprintf(w, "netflow_collector_annotated_complete %d\n", atomic.LoadUint64(&GlobalStats.AnnotatedComplete))
+	fmt.Fprintf(w, "netflow_collector_ttl_anomalies %d\n", atomic.LoadUint64(&GlobalStats.TTLAnomalies))
+	fmt.Fprintf(w, "netflow_collector_otlp_flows %d\n", atomic.LoadUint64(&GlobalStats.OTLPFlows))
+	fmt.Fprintf(w, "netflow_collector_otlp_retries %d\n", atomic.LoadUint64(&GlobalStats.OTLPRetries))
+	fmt.Fprintf(w, "netflow_collector_otlp_dropped %d\n", atomic.LoadUint64(&GlobalStats.OTLPDropped))
+	fmt.Fprintf(w, "netflow_collector_rate_limited %d\n", atomic.LoadUint64(&GlobalStats.RateLimited))
+	fmt.Fprintf(w, "netflow_collector_output_dropped %d\n", atomic.LoadUint64(&GlobalStats.OutputDropped))
+	fmt.Fprintf(w, "netflow_collector_sequence_streams %d\n", sequences.next.Len())
+	fmt.Fprintf(w, "netflow_collector_invalid_dropped %d\n", atomic.LoadUint64(&GlobalStats.InvalidDropped))
+	fmt.Fprintf(w, "netflow_collector_empty_dropped %d\n", atomic.LoadUint64(&GlobalStats.EmptyDropped))
+	fmt.Fprintf(w, "netflow_collector_elephant_flows %d\n", atomic.LoadUint64(&GlobalStats.ElephantFlows))
+	fmt.Fprintf(w, "netflow_collector_subscribers %d\n", atomic.LoadInt64(&GlobalStats.Subscribers))
+	fmt.Fprintf(w, "netflow_collector_subscribe_flows %d\n", atomic.LoadUint64(&GlobalStats.SubscribeFlows))
+	fmt.Fprintf(w, "netflow_collector_subscribe_dropped %d\n", atomic.LoadUint64(&GlobalStats.SubscribeDropped))
+	fmt.Fprintf(w, "netflow_collector_db_flows %d\n", atomic.LoadInt64(&GlobalStats.DBFlows))
+	fmt.Fprintf(w, "netflow_collector_db_evicted_flows %d\n", atomic.LoadUint64(&GlobalStats.DBEvictedFlows))
+	fmt.Fprintf(w, "netflow_collector_templates_expired %d\n", atomic.LoadUint64(&GlobalStats.TemplatesExpired))
+	fmt.Fprintf(w, "netflow_collector_templates_invalid %d\n", atomic.LoadUint64(&GlobalStats.TemplatesInvalid))
+	fmt.Fprintf(w, "netflow_collector_missing_templates %d\n", atomic.LoadUint64(&GlobalStats.TemplateMisses))
+	fmt.Fprintf(w, "netflow_collector_unknown_family_dropped %d\n", atomic.LoadUint64(&GlobalStats.DroppedUnknownFamily))
+	fmt.Fprintf(w, "netflow_collector_packet_panics %d\n", atomic.LoadUint64(&GlobalStats.PacketPanics))
+	var retention int64
+	if oldest := atomic.LoadInt64(&GlobalStats.DBOldest); oldest != 0 {
+		retention = now - oldest
+	}
+	fmt.Fprintf(w, "netflow_collector_db_retention_seconds %d\n", retention)
+	varzDecodeErrors(w)
+	varzInvalidFlows(w)
+	varzAnnotatorInputs(w)
+	varzWorkers(w)
+	varzSinks(w)
+	varzLatencies(w)
+	varzRouters(w)
+	varzSockets(w)
+}
+
+// varzAnnotatorInputs sends the per input statistics of the annotator to a client
+func varzAnnotatorInputs(w http.ResponseWriter) {
+	annotatorInputs.lock.Lock()
+	defer annotatorInputs.lock.Unlock()
+
+	for i, in := range annotatorInputs.inputs {
+		fmt.Fprintf(w, "netflow_collector_annotator_input_flows{input=\"%d\"} %d\n", i, atomic.LoadUint64(&in.Flows))
+		fmt.Fprintf(w, "netflow_collector_annotator_input_queue_depth{input=\"%d\"} %d\n", i, atomic.LoadUint64(&in.QueueDepth))
+		fmt.Fprintf(w, "netflow_collector_annotator_input_blocked_seconds{input=\"%d\"} %.3f\n", i, float64(atomic.LoadUint64(&in.BlockedNanos))/float64(time.Second))
+	}
+}
+
+// varzWorkers sends the per worker statistics of the decoders to a client
+func varzWorkers(w http.ResponseWriter) {
+	workers.lock.Lock()
+	defer workers.lock.Unlock()
+
+	for _, k := range sortedWorkerKeys() {
+		ws := workers.workers[k]
+		fmt.Fprintf(w, "netflow_collector_worker_packets{protocol=\"%s\",worker=\"%d\"} %d\n", k.protocol, k.worker, atomic.LoadUint64(&ws.Packets))
+		fmt.Fprintf(w, "netflow_collector_worker_flows{protocol=\"%s\",worker=\"%d\"} %d\n", k.protocol, k.worker, atomic.LoadUint64(&ws.Flows))
+	}
+}
+
+// varzSinks sends the statistics of sinks with acknowledged delivery to a client
+func varzSinks(w http.ResponseWriter) {
+	sinks.lock.Lock()
+	defer sinks.lock.Unlock()
+
+	for _, name := range sortedSinkNames() {
+		s := sinks.sinks[name]
+		fmt.Fprintf(w, "netflow_collector_sink_acked{sink=\"%s\"} %d\n", name, atomic.LoadUint64(&s.Acked))
+		fmt.Fprintf(w, "netflow_collector_sink_retries{sink=\"%s\"} %d\n", name, atomic.LoadUint64(&s.Retries))
+		fmt.Fprintf(w, "netflow_collector_sink_dead_lettered{sink=\"%s\"} %d\n", name, atomic.LoadUint64(&s.DeadLettered))
+		fmt.Fprintf(w, "netflow_collector_sink_buffered_batches{sink=\"%s\"} %d\n", name, atomic.LoadInt64(&s.Buffered))
+	}
+}
+
+// varzDecodeErrors sends the decode error counters to a client
+func varzDecodeErrors(w http.ResponseWriter) {
+	decodeErrors.lock.Lock()
+	defer decodeErrors.lock.Unlock()
+
+	for _, k := range sortedErrorKeys(decodeErrors.counts) {
+		fmt.Fprintf(w, "netflow_collector_decode_errors{protocol=\"%s\",reason=\"%s\"} %d\n", k.protocol, k.category, decodeErrors.counts[k])
+	}
+}
+
+// varzInvalidFlows sends the counters of flows violating validation rules to a client
+func varzInvalidFlows(w http.ResponseWriter) {
+	invalidFlows.lock.Lock()
+	defer invalidFlows.lock.Unlock()
+
+	for _, k := range sortedErrorKeys(invalidFlows.counts) {
+		fmt.Fprintf(w, "netflow_collector_invalid_flows{protocol=\"%s\",rule=\"%s\"} %d\n", k.protocol, k.category, invalidFlows.counts[k])
+	}
+}
+
+// varzRouters sends the per router statistics to a client
+func varzRouters(w http.ResponseWriter) {
+	routerStats.lock.RLock()
+	defer routerStats.lock.RUnlock()
+
+	rtrs := make([]string, 0, len(routerStats.routers))
+	for rtr := range routerStats.routers {
+		rtrs = append(rtrs, rtr)
+	}
+	sort.Strings(rtrs)
+
+	var templates int64
+	for _, rs := range routerStats.routers {
+		templates += atomic.LoadInt64(&rs.Templates)
+	}
+	fmt.Fprintf(w, "netflow_collector_templates %d\n", templates)
+
+	now := time.Now().Unix()
+	for _, rtr := range rtrs {
+		rs := routerStats.routers[rtr]
+		for reason, name := range endReasonNames {
+			fmt.Fprintf(w, "netflow_collector_flow_end_reason{router=\"%s\",reason=\"%s\"} %d\n", rtr, name, atomic.LoadUint64(&rs.FlowEndReasons[reason]))
+		}
+		fmt.Fprintf(w, "netflow_collector_queue_depth{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.QueueDepth))
+		fmt.Fprintf(w, "netflow_collector_queue_drops{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.QueueDrops))
+		fmt.Fprintf(w, "netflow_collector_selector_mismatches{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.SelectorMismatches))
+		fmt.Fprintf(w, "netflow_collector_reboots{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.Reboots))
+		fmt.Fprintf(w, "netflow_collector_interface_remaps{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.InterfaceRemaps))
+		fmt.Fprintf(w, "netflow_collector_sequence_lost{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.SequenceLost))
+		fmt.Fprintf(w, "netflow_collector_router_packets{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.Packets))
+		fmt.Fprintf(w, "netflow_collector_router_bytes{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.Bytes))
+		fmt.Fprintf(w, "netflow_collector_router_decode_errors{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.DecodeErrors))
+		fmt.Fprintf(w, "netflow_collector_router_flows{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.Flows))
+		fmt.Fprintf(w, "netflow_collector_router_templates{router=\"%s\"} %d\n", rtr, atomic.LoadInt64(&rs.Templates))
+		fmt.Fprintf(w, "netflow_collector_router_missing_templates{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.MissingTemplates))
+		fmt.Fprintf(w, "netflow_collector_router_last_packet{router=\"%s\"} %d\n", rtr, atomic.LoadInt64(&rs.lastPacket))
+
+		pps, fps, bps := rs.rates.rates(now)
+		fmt.Fprintf(w, "netflow_collector_packet_rate{router=\"%s\"} %.2f\n", rtr, pps)
+		fmt.Fprintf(w, "netflow_collector_flow_rate{router=\"%s\"} %.2f\n", rtr, fps)
+		fmt.Fprintf(w, "netflow_collector_bit_rate{router=\"%s\"} %.2f\n", rtr, bps)
+
+		baseline, regressed := rs.baseline.state()
+		var r int
+		if regressed {
+			r = 1
+		}
+		fmt.Fprintf(w, "netflow_collector_flow_rate_baseline{router=\"%s\"} %.2f\n", rtr, baseline)
+		fmt.Fprintf(w, "netflow_collector_flow_rate_regressed{router=\"%s\"} %d\n", rtr, r)
+		fmt.Fprintf(w, "netflow_collector_flow_rate_regressions{router=\"%s\"} %d\n", rtr, atomic.LoadUint64(&rs.FlowRateRegressions))
+	}
 }
@@ -0,0 +1,135 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrometheusHandler(t *testing.T) {
+	h := PrometheusHandler()
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("Expected text exposition format, got %q", ct)
+		}
+		return w.Body.String()
+	}
+
+	// Counters are read on every scrape
+	scrape()
+	n := atomic.AddUint64(&GlobalStats.Flows6, 1)
+	p := atomic.AddUint64(&GlobalStats.IPFIXpackets, 1)
+	atomic.AddUint64(&Router("192.0.2.1").Reboots, 1)
+	Latency("prometheus").observe(time.Millisecond)
+	body := scrape()
+	for _, want := range []string{
+		"# TYPE tflow2_flows_total counter\n",
+		fmt.Sprintf("tflow2_flows_total{family=\"6\"} %d\n", n),
+		fmt.Sprintf("# TYPE tflow2_ipfix_packets_total counter\ntflow2_ipfix_packets_total %d\n", p),
+		"# TYPE tflow2_uptime_seconds gauge\n",
+		"tflow2_router_reboots_total{router=\"192.0.2.1\"} 1\n",
+		"tflow2_flow_latency_seconds_bucket{sink=\"prometheus\",le=\"0.005\"} 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %q in scrape", want)
+		}
+	}
+
+	// Each family is declared once with help and type, before its samples
+	families := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+		case strings.HasPrefix(line, "# TYPE "):
+			if _, ok := families[fields[2]]; ok {
+				t.Errorf("Family %s declared twice", fields[2])
+			}
+			families[fields[2]] = fields[3]
+		default:
+			name := strings.SplitN(fields[0], "{", 2)[0]
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				if base := strings.TrimSuffix(name, suffix); families[base] == "histogram" {
+					name = base
+				}
+			}
+			if typ, ok := families[name]; !ok {
+				t.Errorf("Sample %q precedes the type of its family", line)
+			} else if typ == "counter" && !strings.HasSuffix(name, "_total") {
+				t.Errorf("Counter %s lacks the _total suffix", name)
+			}
+		}
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	buf := &strings.Builder{}
+	promWriter{w: buf}.sample("tflow2_test", 1.5, "sink", "a\"b\\c")
+	if want := "tflow2_test{sink=\"a\\\"b\\\\c\"} 1.5\n"; buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestVarzRouterTotals(t *testing.T) {
+	Router("192.0.2.2").countReboot()
+	w := httptest.NewRecorder()
+	Varz(w)
+
+	// Totals of all routers must not share the name of the per router series,
+	// or summing the series counts them twice
+	for _, name := range []string{"netflow_collector_reboots", "netflow_collector_sequence_lost", "netflow_collector_flow_rate_regressions"} {
+		if !strings.Contains(w.Body.String(), name+"{router=\"192.0.2.2\"}") {
+			t.Errorf("Expected %s of router 192.0.2.2", name)
+		}
+		if strings.Contains(w.Body.String(), "\n"+name+" ") {
+			t.Errorf("Expected no unlabeled %s", name)
+		}
+	}
+}
+
+func TestVarzSorted(t *testing.T) {
+	for _, name := range []string{"varz_b", "varz_a", "varz_c"} {
+		Sink(name)
+		Latency(name)
+	}
+	Worker("varz", 2)
+	Worker("varz", 10)
+	Worker("varz", 1)
+
+	// Each series must list its label values in the same order on every request
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		Varz(w)
+		body := w.Body.String()
+		for _, series := range []string{
+			`netflow_collector_sink_acked{sink="varz_a"}|netflow_collector_sink_acked{sink="varz_b"}|netflow_collector_sink_acked{sink="varz_c"}`,
+			`netflow_collector_flow_latency_seconds_count{sink="varz_a"}|netflow_collector_flow_latency_seconds_count{sink="varz_b"}|netflow_collector_flow_latency_seconds_count{sink="varz_c"}`,
+			`netflow_collector_worker_packets{protocol="varz",worker="1"}|netflow_collector_worker_packets{protocol="varz",worker="2"}|netflow_collector_worker_packets{protocol="varz",worker="10"}`,
+		} {
+			last := -1
+			for _, s := range strings.Split(series, "|") {
+				pos := strings.Index(body, s)
+				if pos <= last {
+					t.Fatalf("Expected %s after the preceding series, got position %d", s, pos)
+				}
+				last = pos
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// summary is a snapshot of the counters reported in summary log lines
+type summary struct {
+	packets      uint64
+	bytes        uint64
+	flows        uint64
+	dropped      uint64
+	lost         uint64
+	decodeErrors uint64
+}
+
+// takeSummary reads the current values of the counters
+func takeSummary() summary {
+	return summary{
+		packets: atomic.LoadUint64(&GlobalStats.Netflow9packets) + atomic.LoadUint64(&GlobalStats.IPFIXpackets),
+		bytes:   atomic.LoadUint64(&GlobalStats.Netflow9bytes) + atomic.LoadUint64(&GlobalStats.IPFIXbytes),
+		flows:   atomic.LoadUint64(&GlobalStats.Flows4) + atomic.LoadUint64(&GlobalStats.Flows6),
+		dropped: atomic.LoadUint64(&GlobalStats.RateLimited) + atomic.LoadUint64(&GlobalStats.OutputDropped) +
+			atomic.LoadUint64(&GlobalStats.InvalidDropped) + atomic.LoadUint64(&GlobalStats.EmptyDropped),
+		lost:         atomic.LoadUint64(&GlobalStats.SequenceLost),
+		decodeErrors: atomic.LoadUint64(&GlobalStats.DecodeErrors),
+	}
+}
+
+// since returns the increase of the counters from `last` to `s`
+func (s summary) since(last summary) summary {
+	return summary{
+		packets:      s.packets - last.packets,
+		bytes:        s.bytes - last.bytes,
+		flows:        s.flows - last.flows,
+		dropped:      s.dropped - last.dropped,
+		lost:         s.lost - last.lost,
+		decodeErrors: s.decodeErrors - last.decodeErrors,
+	}
+}
+
+// String formats the summary as log line
+func (s summary) String() string {
+	return fmt.Sprintf("%d packets, %d bytes, %d flows, %d flows dropped, %d records lost, %d decode errors",
+		s.packets, s.bytes, s.flows, s.dropped, s.lost, s.decodeErrors)
+}
+
+// LogSummaries logs the number of packets, bytes and flows received and of
+// flows dropped, records lost and decode errors every `interval`, each since
+// the previous summary. It doesn't return.
+func LogSummaries(interval time.Duration) {
+	last := takeSummary()
+	for range time.Tick(interval) {
+		cur := takeSummary()
+		glog.Infof("Summary of the last %v: %s", interval, cur.since(last))
+		last = cur
+	}
+}
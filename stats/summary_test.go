@@ -0,0 +1,32 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stats
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestSummary(t *testing.T) {
+	last := takeSummary()
+	atomic.AddUint64(&GlobalStats.IPFIXpackets, 2)
+	atomic.AddUint64(&GlobalStats.IPFIXbytes, 3000)
+	atomic.AddUint64(&GlobalStats.Flows4, 10)
+	atomic.AddUint64(&GlobalStats.RateLimited, 1)
+	atomic.AddUint64(&GlobalStats.InvalidDropped, 1)
+	CountDecodeError("ipfix", "summary_test")
+
+	want := "2 packets, 3000 bytes, 10 flows, 2 flows dropped, 0 records lost, 1 decode errors"
+	if got := takeSummary().since(last).String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package subscribe streams flows to gRPC subscribers. Each subscriber selects
+// flows using a filter applied on the server side.
+package subscribe
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+	"google.golang.org/grpc"
+)
+
+// subscriber is a single subscription
+type subscriber struct {
+	filter  *netflow.Filter
+	prefix  *net.IPNet
+	flows   chan *netflow.Flow
+	dropped uint64
+}
+
+// Server serves flows received on `Input` to subscribers
+type Server struct {
+	bufferSize  int
+	subscribers map[*subscriber]struct{}
+	lock        sync.RWMutex
+
+	// Input is the channel used to receive flows from the annotator layer
+	Input chan *netflow.Flow
+}
+
+// New creates a new `Server` accepting subscriptions on `listenAddr`. Up to
+// `bufferSize` flows are buffered per subscriber. Flows for subscribers not
+// keeping up are dropped and counted instead of slowing down the collector.
+func New(listenAddr string, bufferSize int) (*Server, error) {
+	lis, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %v", listenAddr, err)
+	}
+
+	s := newServer(bufferSize)
+	go s.serve(lis)
+	return s, nil
+}
+
+// newServer creates a new `Server` distributing flows to subscribers
+func newServer(bufferSize int) *Server {
+	s := &Server{
+		bufferSize:  bufferSize,
+		subscribers: make(map[*subscriber]struct{}),
+		Input:       make(chan *netflow.Flow, bufferSize),
+	}
+	go s.distribute()
+	return s
+}
+
+// serve serves gRPC requests received on `lis`
+func (s *Server) serve(lis net.Listener) {
+	srv := grpc.NewServer()
+	netflow.RegisterSubscriberServer(srv, s)
+	if err := srv.Serve(lis); err != nil {
+		glog.Errorf("gRPC subscription server: %v", err)
+	}
+}
+
+// distribute sends flows from `Input` to all subscribers they match
+func (s *Server) distribute() {
+	for fl := range s.Input {
+		s.lock.RLock()
+		for sub := range s.subscribers {
+			if !sub.matches(fl) {
+				continue
+			}
+			select {
+			case sub.flows <- fl:
+			default:
+				atomic.AddUint64(&sub.dropped, 1)
+				atomic.AddUint64(&stats.GlobalStats.SubscribeDropped, 1)
+			}
+		}
+		s.lock.RUnlock()
+	}
+}
+
+// Subscribe streams flows matching `filter` until the subscriber goes away
+func (s *Server) Subscribe(filter *netflow.Filter, stream netflow.Subscriber_SubscribeServer) error {
+	sub := &subscriber{
+		filter: filter,
+		flows:  make(chan *netflow.Flow, s.bufferSize),
+	}
+	if pfx := filter.GetPrefix(); pfx != nil {
+		sub.prefix = &net.IPNet{IP: pfx.IP, Mask: pfx.Mask}
+	}
+
+	s.lock.Lock()
+	s.subscribers[sub] = struct{}{}
+	s.lock.Unlock()
+	atomic.AddInt64(&stats.GlobalStats.Subscribers, 1)
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.subscribers, sub)
+		s.lock.Unlock()
+		atomic.AddInt64(&stats.GlobalStats.Subscribers, -1)
+		if debug.Level() > 0 {
+			glog.Infof("Subscriber %s went away, %d flows dropped", filter, atomic.LoadUint64(&sub.dropped))
+		}
+	}()
+
+	for {
+		select {
+		case fl := <-sub.flows:
+			if err := stream.Send(fl); err != nil {
+				return err
+			}
+			atomic.AddUint64(&stats.GlobalStats.SubscribeFlows, 1)
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// matches returns true if `fl` matches the filter of the subscriber
+func (sub *subscriber) matches(fl *netflow.Flow) bool {
+	if sub.filter.Protocol != 0 && fl.Protocol != sub.filter.Protocol {
+		return false
+	}
+	if sub.filter.As != 0 && fl.SrcAs != sub.filter.As && fl.DstAs != sub.filter.As {
+		return false
+	}
+	if sub.prefix != nil && !sub.prefix.Contains(fl.SrcAddr) && !sub.prefix.Contains(fl.DstAddr) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subscribe
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+	"google.golang.org/grpc"
+)
+
+func TestMatches(t *testing.T) {
+	fl := &netflow.Flow{
+		Protocol: 6,
+		SrcAs:    64500,
+		DstAs:    64501,
+		SrcAddr:  net.ParseIP("192.0.2.1").To4(),
+		DstAddr:  net.ParseIP("198.51.100.1").To4(),
+	}
+
+	tests := []struct {
+		name   string
+		filter *netflow.Filter
+		want   bool
+	}{
+		{name: "Empty filter", filter: &netflow.Filter{}, want: true},
+		{name: "Protocol", filter: &netflow.Filter{Protocol: 6}, want: true},
+		{name: "Other protocol", filter: &netflow.Filter{Protocol: 17}, want: false},
+		{name: "Destination AS", filter: &netflow.Filter{As: 64501}, want: true},
+		{name: "Other AS", filter: &netflow.Filter{As: 64502}, want: false},
+		{
+			name:   "Destination prefix",
+			filter: &netflow.Filter{Prefix: &netflow.Pfx{IP: net.ParseIP("198.51.100.0").To4(), Mask: net.CIDRMask(24, 32)}},
+			want:   true,
+		},
+		{
+			name:   "Other prefix",
+			filter: &netflow.Filter{Prefix: &netflow.Pfx{IP: net.ParseIP("203.0.113.0").To4(), Mask: net.CIDRMask(24, 32)}},
+			want:   false,
+		},
+		{
+			name:   "Protocol and AS",
+			filter: &netflow.Filter{Protocol: 17, As: 64500},
+			want:   false,
+		},
+	}
+
+	for _, test := range tests {
+		sub := &subscriber{filter: test.filter}
+		if pfx := test.filter.GetPrefix(); pfx != nil {
+			sub.prefix = &net.IPNet{IP: pfx.IP, Mask: pfx.Mask}
+		}
+		if got := sub.matches(fl); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	s := newServer(10)
+	go s.serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := netflow.NewSubscriberClient(conn).Subscribe(ctx, &netflow.Filter{Protocol: 17})
+	if err != nil {
+		t.Fatalf("Unable to subscribe: %v", err)
+	}
+
+	// Wait for the subscription to be registered before sending flows
+	for atomic.LoadInt64(&stats.GlobalStats.Subscribers) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.Input <- &netflow.Flow{Protocol: 6, Packets: 1}
+	s.Input <- &netflow.Flow{Protocol: 17, Packets: 2}
+
+	fl, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Unable to receive flow: %v", err)
+	}
+	if fl.Protocol != 17 || fl.Packets != 2 {
+		t.Errorf("Received unexpected flow %v", fl)
+	}
+}
@@ -14,59 +14,430 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/golang/glog"
 	"github.com/google/tflow2/annotator"
+	"github.com/google/tflow2/annotator/geoip"
+	"github.com/google/tflow2/annotator/rdns"
+	"github.com/google/tflow2/annotator/snmp"
+	"github.com/google/tflow2/coalesce"
 	"github.com/google/tflow2/database"
+	"github.com/google/tflow2/debug"
+	"github.com/google/tflow2/elephant"
 	"github.com/google/tflow2/frontend"
 	"github.com/google/tflow2/ifserver"
+	"github.com/google/tflow2/ipfixexport"
 	"github.com/google/tflow2/netflow"
 	"github.com/google/tflow2/nfserver"
+	"github.com/google/tflow2/otlp"
+	"github.com/google/tflow2/ratelimit"
+	"github.com/google/tflow2/recorder"
+	"github.com/google/tflow2/sink"
 	"github.com/google/tflow2/stats"
+	"github.com/google/tflow2/subscribe"
+	"github.com/google/tflow2/validate"
 )
 
 var (
 	nfAddr        = flag.String("netflow", ":2055", "Address to use to receive netflow packets")
 	ipfixAddr     = flag.String("ipfix", ":4739", "Address to use to receive ipfix packets")
+	ipfixTransp   = flag.String("ipfixtransport", "udp", "Transport to receive ipfix messages via, udp or tcp")
+	ipfixTimeout  = flag.Duration("ipfixtcptimeout", ifserver.DefaultTCPReadTimeout, "Time exporters connected via TCP have to send each message")
+	ipfixHTTP     = flag.String("ipfixhttp", "", "Address to receive IPFIX messages POSTed via HTTP on (disabled if empty)")
+	ipfixHTTPCert = flag.String("ipfixhttpcert", "", "TLS certificate file for the IPFIX HTTP ingest")
+	ipfixHTTPKey  = flag.String("ipfixhttpkey", "", "TLS key file for the IPFIX HTTP ingest")
+	ipfixProxies  = flag.String("ipfixhttpproxies", "", "Comma separated list of prefixes of proxies trusted to name the exporter of IPFIX HTTP ingest requests via X-Exporter-Address (header ignored if empty)")
+	fieldOverride = flag.String("fieldoverrides", "", "Comma separated list of per exporter IPFIX field overrides, as exporter/[enterprise/]type=field (or little_endian), e.g. 192.0.2.1/2=ignore")
+	peerAS        = flag.String("peeras", "", "Comma separated list of IPFIX exporters sending peer instead of origin ASNs in sourceAS/destinationAS")
+	templatePeer  = flag.String("templatepeer", "", "Web interface of a peer collector to import templates from at startup, e.g. http://peer:4444 (disabled if empty)")
+	sockBuffer    = flag.Int("sockbuffer", 0, "Receive buffer size of the netflow and ipfix UDP sockets in bytes (OS default if 0)")
+	packetSize    = flag.Int("packetsize", 8960, "Size of the largest netflow packet or ipfix UDP message read, larger ones are truncated")
+	templateTTL   = flag.Duration("templatettl", 30*time.Minute, "Time after which templates not resent by their exporter are expired (never if 0)")
+	validateRules = flag.String("validate", "zero_packets,size_below_packets,end_before_start", "Comma separated list of sanity rules to check decoded flows against (disabled if empty)")
+	dropInvalid   = flag.Bool("dropinvalid", false, "Drop flows violating a rule of -validate instead of only counting them")
+	dropEmpty     = flag.Bool("dropempty", false, "Drop flows without packets and bytes, e.g. keepalive records")
+	elephantBytes = flag.Uint64("elephantbytes", 0, "Number of bytes a single flow record must exceed to be reported as elephant flow (disabled if 0)")
+	elephantPkts  = flag.Uint("elephantpackets", 0, "Number of packets a single flow record must exceed to be reported as elephant flow (disabled if 0)")
+	elephantKeep  = flag.Int("elephantevents", 1000, "Number of elephant flow events kept for /elephants")
+	vrfMap        = flag.String("vrfmap", "", "Comma separated list of per exporter interface to VRF mappings for IPFIX exporters not sending VRF IDs, as exporter/ifindex=vrf, e.g. 192.0.2.1/12=3")
+	timeOffsets   = flag.String("timeoffsets", "", "Comma separated list of per exporter clock corrections in seconds, as exporter=seconds, e.g. 192.0.2.1=-7200")
+	stringLabels  = flag.String("stringlabels", "", "Comma separated list of IPFIX string fields to store as labels, as [enterprise/]type=label, e.g. 460=http.host")
+	ipfixRelay    = flag.Bool("ipfixrelay", false, "Expect ipfix packets to be prefixed with a relay header carrying the exporters address")
+	collectorID   = flag.String("collectorid", "", "ID of this collector instance flows are tagged with, e.g. in anycast deployments")
 	aggregation   = flag.Int64("aggregation", 60, "Time to groups flows together into one data point")
 	maxAge        = flag.Int64("maxage", 1800, "Maximum age of saved flows")
+	maxFlows      = flag.Int64("maxflows", 0, "Maximum number of flows kept in memory, oldest are evicted first (unlimited if 0)")
 	web           = flag.String("web", ":4444", "Address to use for web service")
 	birdSock      = flag.String("birdsock", "/var/run/bird/bird.ctl", "Unix domain socket to communicate with BIRD")
 	birdSock6     = flag.String("birdsock6", "/var/run/bird/bird6.ctl", "Unix domain socket to communicate with BIRD6")
+	birdCache     = flag.Int("birdcache", 100000, "Number of addresses to cache BIRD results for")
+	birdCacheTTL  = flag.Duration("birdcachettl", time.Hour, "Time BIRD results are cached for, so route changes are picked up (forever if 0)")
 	bgpAugment    = flag.Bool("bgp", true, "Use BIRD to augment BGP flow information")
+	cymru         = flag.Bool("cymru", false, "Look up ASNs BIRD has no route for via Team Cymru's DNS based IP to ASN service")
+	ttlAnomalies  = flag.Bool("ttlanomalies", false, "Flag flows whose TTL deviates from the TTL typically seen for their source")
+	geoipDB       = flag.String("geoip", "", "Comma separated list of MaxMind GeoIP2/GeoLite2 country, city or ASN databases (.mmdb) to look up source and destination countries and ASNs in (disabled if empty)")
+	snmpNames     = flag.Bool("snmp", false, "Look up interface names exporters don't announce via SNMP from the exporting router")
+	snmpCommunity = flag.String("snmpcommunity", "public", "SNMPv2c community to query routers with")
+	snmpRefresh   = flag.Duration("snmprefresh", time.Hour, "Time interface names looked up via SNMP are cached for (forever if 0)")
+	rdnsNames     = flag.Bool("rdns", false, "Look up host names of source and destination addresses via reverse DNS")
+	rdnsCache     = flag.Int("rdnscache", 100000, "Number of addresses to cache reverse DNS names for")
+	rdnsCacheTTL  = flag.Duration("rdnscachettl", time.Hour, "Time reverse DNS names (and missing ones) are cached for (forever if 0)")
 	protoNums     = flag.String("protonums", "protocol_numbers.csv", "CSV file to read protocol definitions from")
 	sockReaders   = flag.Int("sockreaders", 24, "Num of go routines reading and parsing netflow packets")
+	exporterQueue = flag.Int("exporterqueue", 0, "Number of packets to queue per exporter for fair decoding (disabled if 0)")
+	maxFlowRate   = flag.Float64("maxflowrate", 0, "Maximum number of flows per second passed on to the annotator layer (unlimited if 0)")
+	maxFlowBurst  = flag.Int("maxflowburst", 10000, "Number of flows allowed to exceed maxflowrate in bursts")
+	outputTimeout = flag.Duration("outputtimeout", 0, "Time decoded flows may wait for the annotator layer before being dropped (wait forever if 0)")
+	outputPanic   = flag.Bool("outputpanic", false, "Panic instead of dropping flows if they waited longer than outputtimeout")
+	rateFactor    = flag.Float64("rateregression", 0, "Factor by which an exporters flow rate may deviate from its baseline before it is reported (disabled if 0)")
+	summaryEvery  = flag.Duration("summaryinterval", 0, "Interval to log a summary of packets, flows and errors at, for setups without metrics collection (disabled if 0)")
+	recordPackets = flag.Int("recordpackets", 0, "Number of raw packets to keep per exporter for download via /packets (disabled if 0)")
 	channelBuffer = flag.Int("channelbuffer", 1024, "Size of buffer for channels")
 	dbAddWorkers  = flag.Int("dbaddworkers", 24, "Number of workers adding flows into database")
 	nAggr         = flag.Int("numaggr", 12, "Number of flow aggregator workers")
 	samplerate    = flag.Int("samplerate", 1, "Samplerate of routers")
 	debugLevel    = flag.Int("debug", 0, "Debug level, 0: none, 1: +shows if we are receiving flows we are lacking templates for, 2: -, 3: +dump all packets on screen")
+	coalesceSize  = flag.Int("coalesce", 0, "Number of flows to coalesce per tuple and aggregation bucket before storing them (disabled if 0)")
 	compLevel     = flag.Int("comp", 6, "gzip compression level for data storage on disk")
 	dataDir       = flag.String("data", "./data", "Path to store long term flow logs")
 	anonymize     = flag.Bool("anonymize", false, "Replace IP addresses with NULL before dumping flows to disk")
+	enrichURL     = flag.String("enrichurl", "", "URL of HTTP service to enrich flows with (disabled if empty)")
+	enrichCache   = flag.Int("enrichcache", 100000, "Number of addresses to cache enrichment results for")
+	enrichTimeout = flag.Duration("enrichtimeout", 2*time.Second, "Timeout for requests to the enrichment service")
+	ipfixExport   = flag.String("ipfixexport", "", "Comma separated list of collectors (host:port) to re-export flows to via IPFIX (disabled if empty)")
+	ipfixDomain   = flag.Uint("ipfixexportdomain", 0, "Observation domain ID used for IPFIX re-export")
+	otlpEndpoint  = flag.String("otlp", "", "OTLP/HTTP endpoint to export flows to, e.g. http://localhost:4318 (disabled if empty)")
+	otlpBatch     = flag.Int("otlpbatch", 1000, "Maximum number of flows sent to the OTLP endpoint in one request")
+	otlpFlush     = flag.Duration("otlpflush", 5*time.Second, "Maximum time flows are held back before being exported via OTLP")
+	otlpAcked     = flag.Bool("otlpacked", false, "Only consider flows exported via OTLP once acknowledged by the endpoint, retrying and dead-lettering failed batches")
+	sinkBuffer    = flag.Int("sinkbuffer", 64, "Number of batches kept for delivery by sinks with acknowledged delivery")
+	sinkAttempts  = flag.Int("sinkattempts", 10, "Number of attempts to deliver a batch to a sink with acknowledged delivery before it is dead-lettered")
+	grpcAddr      = flag.String("grpc", "", "Address to serve gRPC flow subscriptions on (disabled if empty)")
+	grpcBuffer    = flag.Int("grpcbuffer", 1000, "Number of flows buffered per gRPC subscriber before flows are dropped for it")
+	deadLetter    = flag.String("deadletter", "", "Directory to write batches to that sinks with acknowledged delivery gave up on (dropped if empty)")
 )
 
 func main() {
 	flag.Parse()
+	debug.SetLevel(*debugLevel)
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	stats.Init()
+	if *rateFactor > 0 {
+		go stats.WatchFlowRates(time.Minute, *rateFactor)
+	}
+	if *summaryEvery > 0 {
+		go stats.LogSummaries(*summaryEvery)
+	}
 
-	nfs := nfserver.New(*nfAddr, *sockReaders, *bgpAugment, *debugLevel)
+	// The limiter is shared to cap the total rate of flows of both servers
+	var limiter *ratelimit.Bucket
+	if *maxFlowRate > 0 {
+		limiter = ratelimit.New(*maxFlowRate, *maxFlowBurst)
+	}
 
-	ifs := ifserver.New(*ipfixAddr, *sockReaders, *bgpAugment, *debugLevel)
+	var rec *recorder.Recorder
+	if *recordPackets > 0 {
+		rec = recorder.New(*recordPackets)
+	}
+
+	offsets, err := parseTimeOffsets(*timeOffsets)
+	if err != nil {
+		glog.Exitf("Invalid -timeoffsets: %v", err)
+	}
+
+	var validator *validate.Validator
+	if *validateRules != "" {
+		validator, err = validate.New(strings.Split(*validateRules, ","), *dropInvalid)
+		if err != nil {
+			glog.Exitf("Invalid -validate: %v", err)
+		}
+	}
+
+	var elephants *elephant.Detector
+	if *elephantBytes > 0 || *elephantPkts > 0 {
+		elephants = elephant.New(*elephantBytes, uint32(*elephantPkts), *elephantKeep)
+		http.Handle("/elephants", elephants)
+	}
+
+	nfs := nfserver.New(nfserver.Config{
+		ListenAddr:    *nfAddr,
+		NumReaders:    *sockReaders,
+		BGPAugment:    *bgpAugment,
+		QueueSize:     *exporterQueue,
+		Limiter:       limiter,
+		TimeOffsets:   offsets,
+		Validator:     validator,
+		Elephants:     elephants,
+		DropEmpty:     *dropEmpty,
+		CollectorID:   *collectorID,
+		OutputTimeout: *outputTimeout,
+		OutputPanic:   *outputPanic,
+		Recorder:      rec,
+		TemplateTTL:   *templateTTL,
+		ReadBuffer:    *sockBuffer,
+		PacketSize:    *packetSize,
+	})
+
+	labels, err := ifserver.ParseStringLabels(*stringLabels)
+	if err != nil {
+		glog.Exitf("Invalid -stringlabels: %v", err)
+	}
+
+	peerASExporters := make(map[string]bool)
+	for _, addr := range strings.Split(*peerAS, ",") {
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			glog.Exitf("Invalid -peeras: %q is not an IP address", addr)
+		}
+		peerASExporters[ip.String()] = true
+	}
+
+	overrides, err := ifserver.ParseFieldOverrides(*fieldOverride)
+	if err != nil {
+		glog.Exitf("Invalid -fieldoverrides: %v", err)
+	}
+
+	vrfMaps, err := ifserver.ParseVRFMaps(*vrfMap)
+	if err != nil {
+		glog.Exitf("Invalid -vrfmap: %v", err)
+	}
+
+	ifs, err := ifserver.New(ifserver.Config{
+		ListenAddr:      *ipfixAddr,
+		Transport:       *ipfixTransp,
+		NumReaders:      *sockReaders,
+		BGPAugment:      *bgpAugment,
+		QueueSize:       *exporterQueue,
+		Relay:           *ipfixRelay,
+		NetflowV9:       nfs.ProcessPacket,
+		Limiter:         limiter,
+		StringLabels:    labels,
+		PeerASExporters: peerASExporters,
+		FieldOverrides:  overrides,
+		TimeOffsets:     offsets,
+		VRFMaps:         vrfMaps,
+		Validator:       validator,
+		Elephants:       elephants,
+		DropEmpty:       *dropEmpty,
+		CollectorID:     *collectorID,
+		OutputTimeout:   *outputTimeout,
+		OutputPanic:     *outputPanic,
+		Recorder:        rec,
+		TemplateTTL:     *templateTTL,
+		ReadBuffer:      *sockBuffer,
+		PacketSize:      *packetSize,
+		TCPReadTimeout:  *ipfixTimeout,
+	})
+	if err != nil {
+		glog.Exitf("Unable to start IPFIX server: %v", err)
+	}
+
+	if *templatePeer != "" {
+		warmupTemplates(*templatePeer, nfs, ifs)
+	}
+
+	if *ipfixHTTP != "" {
+		proxies, err := ifserver.ParseTrustedProxies(*ipfixProxies)
+		if err != nil {
+			glog.Exitf("Invalid -ipfixhttpproxies: %v", err)
+		}
+		if err := ifs.ListenHTTP(*ipfixHTTP, *ipfixHTTPCert, *ipfixHTTPKey, proxies); err != nil {
+			glog.Exitf("Unable to start IPFIX HTTP ingest: %v", err)
+		}
+	}
 
 	chans := make([]chan *netflow.Flow, 0)
 	chans = append(chans, nfs.Output)
 	chans = append(chans, ifs.Output)
 
-	flowDB := database.New(*aggregation, *maxAge, *dbAddWorkers, *samplerate, *debugLevel, *compLevel, *dataDir, *anonymize)
+	flowDB := database.New(*aggregation, *maxAge, *maxFlows, *dbAddWorkers, *samplerate, *compLevel, *dataDir, *anonymize)
+
+	outputs := []chan *netflow.Flow{flowDB.Input}
+	if *ipfixExport != "" {
+		ipe, err := ipfixexport.New(strings.Split(*ipfixExport, ","), uint32(*ipfixDomain), time.Second)
+		if err != nil {
+			glog.Exitf("Unable to start IPFIX export: %v", err)
+		}
+		outputs = append(outputs, ipe.Input)
+	}
+	if *otlpEndpoint != "" && *otlpAcked {
+		outputs = append(outputs, sink.NewReliable("otlp", otlp.NewSink(*otlpEndpoint), *otlpBatch, *otlpFlush, *sinkBuffer, *sinkAttempts, *deadLetter).Input)
+	} else if *otlpEndpoint != "" {
+		outputs = append(outputs, otlp.New(*otlpEndpoint, *otlpBatch, *otlpFlush).Input)
+	}
+
+	if *grpcAddr != "" {
+		sub, err := subscribe.New(*grpcAddr, *grpcBuffer)
+		if err != nil {
+			glog.Exitf("Unable to start gRPC subscription server: %v", err)
+		}
+		outputs = append(outputs, sub.Input)
+	}
+
+	if *coalesceSize > 0 {
+		outputs = []chan *netflow.Flow{coalesce.New(*coalesceSize, *aggregation, outputs).Input}
+	}
 
-	annotator.New(chans, flowDB.Input, *nAggr, *aggregation, *bgpAugment, *birdSock, *birdSock6, *debugLevel)
+	var plugins []annotator.Plugin
+	if *geoipDB != "" {
+		for _, path := range strings.Split(*geoipDB, ",") {
+			g, err := geoip.NewAnnotator(path)
+			if err != nil {
+				glog.Exitf("Unable to load GeoIP database %s: %v", path, err)
+			}
+			plugins = append(plugins, g)
+		}
+	}
+	if *snmpNames {
+		plugins = append(plugins, snmp.NewAnnotator(*snmpCommunity, *snmpRefresh))
+	}
+	if *rdnsNames {
+		plugins = append(plugins, rdns.NewAnnotator(*rdnsCache, *rdnsCacheTTL))
+	}
 
-	frontend.New(*web, *protoNums, flowDB)
+	ann := annotator.New(annotator.Config{
+		Inputs:          chans,
+		Outputs:         outputs,
+		NumWorkers:      *nAggr,
+		Aggregation:     *aggregation,
+		BGPAugment:      *bgpAugment,
+		BirdSock:        *birdSock,
+		BirdSock6:       *birdSock6,
+		BirdCacheSize:   *birdCache,
+		BirdCacheTTL:    *birdCacheTTL,
+		CymruFallback:   *cymru,
+		EnrichURL:       *enrichURL,
+		EnrichCacheSize: *enrichCache,
+		EnrichTimeout:   *enrichTimeout,
+		TTLAnomalies:    *ttlAnomalies,
+		Plugins:         plugins,
+	})
+
+	frontend.New(*web, *protoNums, flowDB, rec)
+	http.HandleFunc("/templates/netflow", nfs.ServeTemplates)
+	http.HandleFunc("/templates/ipfix", ifs.ServeTemplates)
+	http.HandleFunc("/options/ipfix", ifs.ServeOptions)
+	http.HandleFunc("/debuglevel", debugLevelHandler(map[string]debugSetter{
+		"ipfix":     ifs,
+		"annotator": ann,
+	}))
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	wg.Wait()
 }
+
+// debugSetter is implemented by components whose own debug level can be raised
+type debugSetter interface {
+	SetDebug(l int)
+}
+
+// debugLevelHandler returns a handler setting the debug level to parameter
+// `level`, so it can be raised during troubleshooting without a restart. The
+// level applies to all components, unless parameter `component` names one of
+// `components` to raise only. Levels above debug.MaxLevel are capped. Only POST
+// requests are accepted.
+func debugLevelHandler(components map[string]debugSetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		level, err := strconv.Atoi(r.FormValue("level"))
+		if err != nil || level < 0 {
+			http.Error(w, fmt.Sprintf("Invalid debug level %q", r.FormValue("level")), http.StatusBadRequest)
+			return
+		}
+		if level > debug.MaxLevel {
+			level = debug.MaxLevel
+		}
+
+		name := r.FormValue("component")
+		if name == "" {
+			debug.SetLevel(level)
+			glog.Infof("Debug level set to %d", level)
+			fmt.Fprintf(w, "Debug level set to %d\n", level)
+			return
+		}
+
+		c, ok := components[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown component %q", name), http.StatusBadRequest)
+			return
+		}
+		c.SetDebug(level)
+		glog.Infof("Debug level of %s set to %d", name, level)
+		fmt.Fprintf(w, "Debug level of %s set to %d\n", name, level)
+	}
+}
+
+// parseTimeOffsets parses a comma separated list of per exporter time offsets of
+// the form exporter=seconds, e.g. "192.0.2.1=-7200". The result is keyed by exporter address.
+func parseTimeOffsets(spec string) (map[string]int64, error) {
+	offsets := make(map[string]int64)
+	if spec == "" {
+		return offsets, nil
+	}
+
+	for _, elem := range strings.Split(spec, ",") {
+		parts := strings.SplitN(elem, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid element %q, expected exporter=seconds", elem)
+		}
+		ip := net.ParseIP(parts[0])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid exporter address in %q", elem)
+		}
+		offset, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset in %q: %v", elem, err)
+		}
+		offsets[ip.String()] = offset
+	}
+	return offsets, nil
+}
+
+// warmupTemplates imports the NetFlow and IPFIX templates of the peer collector
+// whose web interface is at `peer`, so flows can be decoded right after a restart.
+// Failures are logged only, exporters resend their templates eventually.
+func warmupTemplates(peer string, nfs *nfserver.NetflowServer, ifs *ifserver.IPFIXServer) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	importers := map[string]func(io.Reader) (int, error){
+		"netflow": nfs.ImportTemplates,
+		"ipfix":   ifs.ImportTemplates,
+	}
+	for protocol, importTemplates := range importers {
+		resp, err := client.Get(peer + "/templates/" + protocol)
+		if err != nil {
+			glog.Errorf("Unable to get %s templates from %s: %v", protocol, peer, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			glog.Errorf("Unable to get %s templates from %s: %s", protocol, peer, resp.Status)
+			continue
+		}
+
+		n, err := importTemplates(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			glog.Errorf("Unable to import %s templates from %s: %v", protocol, peer, err)
+			continue
+		}
+		glog.Infof("Imported %d %s templates from %s", n, protocol, peer)
+	}
+}
@@ -34,6 +34,7 @@ const FieldSrcPfx = 11;
 const FieldDstPfx = 12;
 const FieldSrcPort = 13;
 const FieldDstPort = 14;
+const FieldBgpNextHop = 18;
 const fields = {
         "Router": 1,
         "SrcAddr": 2,
@@ -49,6 +50,7 @@ const fields = {
         "DstPfx": 12,
         "SrcPort": 13,
         "DstPort": 14,
+        "BgpNextHop": 18,
 };
 const fieldById = {
     "1": "Router",
@@ -64,11 +66,12 @@ const fieldById = {
     "11": "SrcPfx",
     "12": "DstPfx",
     "13": "SrcPort",
-    "14": "DstPort"
+    "14": "DstPort",
+    "18": "BgpNextHop"
 };
 
 var bdfields = [
-        "SrcAddr", "DstAddr", "Protocol", "IntIn", "IntOut", "NextHop", "SrcAsn", "DstAsn",
+        "SrcAddr", "DstAddr", "Protocol", "IntIn", "IntOut", "NextHop", "BgpNextHop", "SrcAsn", "DstAsn",
         "NextHopAsn", "SrcPfx", "DstPfx", "SrcPort", "DstPort" ];
 
 function drawChart() {
@@ -0,0 +1,100 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package validate checks decoded flows for semantically impossible values.
+// These usually hint at decoding or alignment bugs rather than real traffic.
+package validate
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/tflow2/netflow"
+	"github.com/google/tflow2/stats"
+)
+
+// rule is a sanity check of flows
+type rule struct {
+	name string
+
+	// valid returns false if the flow violates the rule
+	valid func(fl *netflow.Flow) bool
+}
+
+// rules are the built-in rules, in the order they are checked
+var rules = []rule{
+	{
+		// Bytes can't be transferred without packets
+		name:  "zero_packets",
+		valid: func(fl *netflow.Flow) bool { return fl.Packets != 0 || fl.Size == 0 },
+	},
+	{
+		// Each packet carries at least one byte
+		name:  "size_below_packets",
+		valid: func(fl *netflow.Flow) bool { return fl.Size >= uint64(fl.Packets) },
+	},
+	{
+		// Flows can't end before they started
+		name:  "end_before_start",
+		valid: func(fl *netflow.Flow) bool { return fl.Start == 0 || fl.End == 0 || fl.End >= fl.Start },
+	},
+}
+
+// Rules returns the names of all built-in rules
+func Rules() []string {
+	names := make([]string, 0, len(rules))
+	for _, r := range rules {
+		names = append(names, r.name)
+	}
+	return names
+}
+
+// Validator checks flows against a set of rules
+type Validator struct {
+	rules []rule
+	drop  bool
+}
+
+// New creates a new `Validator` checking the rules named in `names`. Flows
+// violating a rule are dropped if `drop` is set, otherwise they are only counted.
+func New(names []string, drop bool) (*Validator, error) {
+	v := &Validator{drop: drop}
+	for _, name := range names {
+		found := false
+		for _, r := range rules {
+			if r.name == name {
+				v.rules = append(v.rules, r)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown rule %q, known rules are %s", name, strings.Join(Rules(), ", "))
+		}
+	}
+	return v, nil
+}
+
+// Keep checks `fl` received via `protocol` against the rules and counts the
+// first rule it violates. It returns false if `fl` is invalid and is to be dropped.
+func (v *Validator) Keep(protocol string, fl *netflow.Flow) bool {
+	for _, r := range v.rules {
+		if !r.valid(fl) {
+			stats.CountInvalidFlow(protocol, r.name)
+			if v.drop {
+				atomic.AddUint64(&stats.GlobalStats.InvalidDropped, 1)
+			}
+			return !v.drop
+		}
+	}
+	return true
+}
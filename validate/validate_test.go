@@ -0,0 +1,90 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validate
+
+import (
+	"testing"
+
+	"github.com/google/tflow2/netflow"
+)
+
+func TestKeep(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		drop  bool
+		flow  *netflow.Flow
+		keep  bool
+	}{
+		{
+			name:  "Valid",
+			rules: Rules(),
+			drop:  true,
+			flow:  &netflow.Flow{Packets: 2, Size: 3000, Start: 1000, End: 2000},
+			keep:  true,
+		},
+		{
+			name:  "No counters",
+			rules: Rules(),
+			drop:  true,
+			flow:  &netflow.Flow{},
+			keep:  true,
+		},
+		{
+			name:  "Bytes without packets",
+			rules: Rules(),
+			drop:  true,
+			flow:  &netflow.Flow{Size: 1500},
+		},
+		{
+			name:  "Size below packets",
+			rules: Rules(),
+			drop:  true,
+			flow:  &netflow.Flow{Packets: 10, Size: 5},
+		},
+		{
+			name:  "End before start",
+			rules: Rules(),
+			drop:  true,
+			flow:  &netflow.Flow{Packets: 1, Size: 40, Start: 2000, End: 1000},
+		},
+		{
+			name:  "Counted only",
+			rules: Rules(),
+			flow:  &netflow.Flow{Size: 1500},
+			keep:  true,
+		},
+		{
+			name:  "Rule disabled",
+			rules: []string{"end_before_start"},
+			drop:  true,
+			flow:  &netflow.Flow{Size: 1500},
+			keep:  true,
+		},
+	}
+
+	for _, test := range tests {
+		v, err := New(test.rules, test.drop)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %v", test.name, err)
+		}
+		if keep := v.Keep("ipfix", test.flow); keep != test.keep {
+			t.Errorf("%s: Expected Keep to return %v, got %v", test.name, test.keep, keep)
+		}
+	}
+}
+
+func TestUnknownRule(t *testing.T) {
+	if _, err := New([]string{"zero_packets", "bogus"}, false); err == nil {
+		t.Errorf("Expected error for unknown rule")
+	}
+}